@@ -1,9 +1,14 @@
 package api
 
 import (
+	"errors"
 	"reflect"
+	"time"
 )
 
+var ErrQuorumTimeOut = errors.New("not enough replicas acknowledged before the time-out")
+var ErrFenced = errors.New("stream fenced, a replica was promoted to origin")
+
 type Stream interface {
 
 	// Lifecycle
@@ -12,6 +17,8 @@ type Stream interface {
 	IsClosed() bool
 	TimeOut(waitTimeOut WaitTimeOut) Stream
 	WaitDuty(duty WaitDuty) Stream
+	KeepPolling(keepPolling bool) Stream
+	Notifier() Notifier
 
 	// Positioning operations
 	Reset() uint64
@@ -26,6 +33,7 @@ type Stream interface {
 	PeekLimit() uint64
 	Peek(absPos uint64) interface{}
 	Pull() Optional
+	PullEx() (elem interface{}, result PullResult)
 
 	// Transformations
 
@@ -77,6 +85,8 @@ type PersistentStream interface {
 
 	// Lifecycle
 	Feed(elem interface{})
+	// Feeds and waits until at least quorum replicas acknowledged it, ErrQuorumTimeOut if not before the time-out
+	FeedAndWait(elem interface{}, quorum int, timeout time.Duration) error
 	Close()
 	IsClosed() bool
 	CloseFile() error
@@ -89,8 +99,25 @@ type PersistentStream interface {
 	//Statistics() map[string]interface{}
 
 	Publish(uri string)
+	// signalled on every Feed and on Close, across processes
+	Notifier() Notifier
 	// Subscribing, wait time-out is UntilNoMoreData
 	Consume(subscriberName string) Stream
+	// Subscribing in explicit acknowledgement mode, the subscriber position is only persisted on Ack/Commit or, with
+	// autoCommit (zero disables it), by the first pull once the interval elapsed since the last commit: pulling implies
+	// the previous elements were processed. After a restart it resumes from the last committed position.
+	ConsumeAcked(subscriberName string, autoCommit time.Duration) AckStream
+}
+
+// Stream which consumed position is only persisted when acknowledged (at-least-once delivery).
+type AckStream interface {
+	Stream
+	// absolute position of the last pulled element, to be used with Ack
+	PulledAbsPos() uint64
+	// acknowledges the element at absPos and all the previous ones
+	Ack(absPos uint64)
+	// acknowledges all the elements pulled so far
+	Commit()
 }
 
 type WaitTimeOut int64
@@ -103,6 +130,16 @@ const (
 	WaitingUpto1s     WaitTimeOut = 1_000_000_000
 )
 
+// Outcome of pulling from a Stream, it differentiates a quiet Stream (the wait time-out expired but it is still open)
+// from a finished one (closed and fully consumed).
+type PullResult int8
+
+const (
+	PullOk       PullResult = iota // an element was read
+	PullTimedOut                   // no element arrived within the wait time-out, the Stream is still open
+	PullClosed                     // the Stream is closed and there are no more elements to read
+)
+
 // Strategy specifying how to wait and process for new data. Different strategies are a trade-off between latency and
 // CPU usage. i.e. busy wait will have the lowest latency, at the expense of putting one CPU at 100% usage.
 // Always-wait, will impose a few ms latency due to clock-checking, wait and context-switching.
@@ -117,6 +154,16 @@ type WaitDuty interface {
 	Reset()
 }
 
+// Doorbell rung by producers when new data is available (or the Stream is closed), so waiters can sleep instead of
+// polling. The sequence has to be read before checking for data, waiting on it will return straight away if anything
+// was notified in between, so no notification is lost.
+type Notifier interface {
+	Seq() uint32
+	// blocks until the sequence moves beyond seq or timeoutNs elapses, spurious wake-ups are possible
+	Wait(seq uint32, timeoutNs int64)
+	Notify()
+}
+
 // allocation free reducer
 type Reducer interface {
 	First(interface{})
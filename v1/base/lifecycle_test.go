@@ -3,6 +3,7 @@ package base
 import (
 	"github.com/kuking/go-frank/v1/api"
 	"testing"
+	"time"
 )
 
 // missing tests
@@ -39,3 +40,45 @@ func TestCloseFeedWorksInChain(t *testing.T) {
 	}
 
 }
+
+func TestPullExAndKeepPolling(t *testing.T) {
+	s := EmptyStream(1024)
+	s.TimeOut(api.WaitingUpto1000ns)
+	if _, result := s.PullEx(); result != api.PullTimedOut {
+		t.Fatal()
+	}
+
+	// without keep polling, the count finishes at the first time-out
+	mapped := s.Map(func(i int) int { return i * 2 })
+	if mapped.Count() != 0 {
+		t.Fatal()
+	}
+
+	// keep polling ignores the time-outs until the stream is closed
+	go func() {
+		for i := 0; i < 10; i++ {
+			time.Sleep(time.Millisecond)
+			s.Feed(i)
+		}
+		s.Close()
+	}()
+	if mapped.KeepPolling(true).Sum().First().Get() != 90 {
+		t.Fatal()
+	}
+	if _, result := mapped.PullEx(); result != api.PullClosed {
+		t.Fatal()
+	}
+}
+
+func TestKeepPollingSwitchedOffFromAnotherGoroutine(t *testing.T) {
+	s := EmptyStream(1024)
+	s.TimeOut(api.WaitingUpto1000ns)
+	s.KeepPolling(true)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.KeepPolling(false)
+	}()
+	if s.Count() != 0 {
+		t.Fatal()
+	}
+}
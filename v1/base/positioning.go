@@ -7,11 +7,11 @@ import (
 // skips N elements in the stream, it can block
 func (s *StreamImpl) Skip(n int) api.Stream {
 	pending := n
-	return s.chain(func() (read interface{}, closed bool) {
+	return s.chain(func() (read interface{}, result api.PullResult) {
 		for pending > 0 {
-			read, closed = s.pull()
-			if closed {
-				return nil, closed
+			read, result = s.pull()
+			if result != api.PullOk {
+				return nil, result
 			}
 			pending--
 		}
@@ -8,11 +8,12 @@ type StreamProvider interface {
 	Feed(elem interface{})
 	Close()
 	IsClosed() bool
-	Pull() (elem interface{}, closed bool)
+	Pull() (elem interface{}, result api.PullResult)
 	Reset() uint64
 	CurrAbsPos() uint64
 	PeekLimit() uint64
 	Peek(absPos uint64) interface{}
 	WaitTimeOut(waitTimeOut api.WaitTimeOut)
 	WaitDuty(waitDuty api.WaitDuty)
+	Notifier() api.Notifier
 }
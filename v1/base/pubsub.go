@@ -33,9 +33,16 @@ import (
 // binary package in little endian. If another encoding is required, the element should be converted to []byte before
 // publishing.
 //
-// tcp://bind_host:bind_port
-// Networked stream subscription with capacity to replay, re-subscribe and hold client states. Parameters like file+mm,
-// offset, subscriberId are supported.
+// tcp://host:port/name
+// Networked subscription to a persistent stream exposed by a remote.Server (import the remote package, the v1 package
+// does). Elements are []byte. Parameters:
+// - sn=string: subscriber name, the server keeps its position so it continues from it when re-subscribing
+// - offset=absPos: replays from an absolute position instead
+// - since=time: replays the elements fed since the RFC3339 time instead
+// - window=n: elements the server sends ahead of the ones consumed, flow control
+// Publishing into it feeds the remote stream instead, in batches acknowledged by the server. Parameters:
+// - batch=n: elements sent together, 256 by default
+// - linger=duration: a batch is sent after it, even if not full; 5ms by default
 //
 
 var LocalRegistry = registry.NewInMemoryRegistry()
@@ -47,7 +54,7 @@ func Subscribe(uri string) (api.Stream, error) {
 // Consumes the contents of this Stream and publishes it into the provided URI Steam. Consumption will follow the
 // Stream' Wait Time-Out; the output Stream will be left open.
 func (s *StreamImpl) Publish(uri string) error {
-	out, err := LocalRegistry.Obtain(uri)
+	out, err := LocalRegistry.ObtainSink(uri)
 	if err != nil {
 		return err
 	}
@@ -58,7 +65,7 @@ func (s *StreamImpl) Publish(uri string) error {
 // Consumes the contents of this Stream and publishes it into the provided URI Steam. Consumption will follow the
 // Stream' Wait Time-Out; the output Stream will be Closed when no more elements are available in the Stream.
 func (s *StreamImpl) PublishClose(uri string) error {
-	out, err := LocalRegistry.Obtain(uri)
+	out, err := LocalRegistry.ObtainSink(uri)
 	if err != nil {
 		return err
 	}
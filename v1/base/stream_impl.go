@@ -2,24 +2,39 @@ package base
 
 import (
 	api2 "github.com/kuking/go-frank/v1/api"
+	"sync/atomic"
 )
 
 type StreamImpl struct {
-	provider StreamProvider
-	pull     func() (read interface{}, closed bool)
+	provider    StreamProvider
+	pull        func() (read interface{}, result api2.PullResult)
+	keepPolling *int32 // shared by all the chained Streams, as the provider is; set from any goroutine, atomically
 }
 
-func NewStreamImpl(provider StreamProvider, pullFn func() (read interface{}, closed bool)) *StreamImpl {
+func NewStreamImpl(provider StreamProvider, pullFn func() (read interface{}, result api2.PullResult)) *StreamImpl {
 	return &StreamImpl{
-		provider: provider,
-		pull:     pullFn,
+		provider:    provider,
+		pull:        pullFn,
+		keepPolling: new(int32),
 	}
 }
 
-func (s *StreamImpl) chain(pullFn func() (read interface{}, closed bool)) *StreamImpl {
+func (s *StreamImpl) chain(pullFn func() (read interface{}, result api2.PullResult)) *StreamImpl {
 	return &StreamImpl{
-		provider: s.provider,
-		pull:     pullFn,
+		provider:    s.provider,
+		pull:        pullFn,
+		keepPolling: s.keepPolling,
+	}
+}
+
+// pulls the next element for operations consuming the whole Stream, if the Stream is set to keep polling, wait
+// time-outs are ignored and it will return only when an element is read or the Stream is closed.
+func (s *StreamImpl) pullNext() (read interface{}, result api2.PullResult) {
+	for {
+		read, result = s.pull()
+		if result != api2.PullTimedOut || atomic.LoadInt32(s.keepPolling) == 0 {
+			return
+		}
 	}
 }
 
@@ -38,14 +53,19 @@ func (s *StreamImpl) IsClosed() bool {
 // This is not mean to be used as standard API but on specific cases (i.e. to implement Binary Search). Blocks until
 // an element is in the Stream, or the Stream is Closed()
 func (s *StreamImpl) Pull() api2.Optional {
-	elem, closed := s.pull()
-	if closed {
+	elem, result := s.pull()
+	if result != api2.PullOk {
 		return api2.EmptyOptional()
 	} else {
 		return api2.OptionalOf(elem)
 	}
 }
 
+// As Pull, but it tells apart a wait time-out (api.PullTimedOut) from a closed Stream (api.PullClosed).
+func (s *StreamImpl) PullEx() (elem interface{}, result api2.PullResult) {
+	return s.pull()
+}
+
 func (s *StreamImpl) Reset() uint64 {
 	return s.provider.Reset()
 }
@@ -71,3 +91,19 @@ func (s *StreamImpl) WaitDuty(waitDuty api2.WaitDuty) api2.Stream {
 	s.provider.WaitDuty(waitDuty)
 	return s
 }
+
+// When set, terminal operations, reducers and publishers will ignore wait time-outs and continue polling until the
+// Stream is closed; the Stream wait time-out then only sets how often the polling loop wakes up.
+func (s *StreamImpl) KeepPolling(keepPolling bool) api2.Stream {
+	var value int32
+	if keepPolling {
+		value = 1
+	}
+	atomic.StoreInt32(s.keepPolling, value)
+	return s
+}
+
+// Notifier signalled by the Stream producers, to be used with NewNotifyWait for sleeping until new data arrives.
+func (s *StreamImpl) Notifier() api2.Notifier {
+	return s.provider.Notifier()
+}
@@ -13,18 +13,22 @@ import (
 // --------------------------------------------------------------------------------------------------------------------
 
 func (s *StreamImpl) First() api.Optional {
-	return s.Pull()
+	read, result := s.pullNext()
+	if result != api.PullOk {
+		return api.EmptyOptional()
+	}
+	return api.OptionalOf(read)
 }
 
 func (s *StreamImpl) Last() api.Optional {
-	read, closed := s.pull()
-	if closed {
+	read, result := s.pullNext()
+	if result != api.PullOk {
 		return api.EmptyOptional()
 	}
 	for {
 		lastRead := read
-		read, closed = s.pull()
-		if closed {
+		read, result = s.pullNext()
+		if result != api.PullOk {
 			return api.OptionalOf(lastRead)
 		}
 	}
@@ -44,36 +48,32 @@ func (s *StreamImpl) Count() int {
 
 func (s *StreamImpl) CountUint64() (c uint64) {
 	c = 0
-	closed := false
-	for !closed {
-		_, closed = s.pull()
-		if !closed {
-			c++
+	for {
+		if _, result := s.pullNext(); result != api.PullOk {
+			return
 		}
+		c++
 	}
-	return
 }
 
 func (s *StreamImpl) AsArray() (result []interface{}) {
 	result = make([]interface{}, 0)
-	var read interface{}
-	closed := false
-	for !closed {
-		read, closed = s.pull()
-		if !closed {
-			result = append(result, read)
+	for {
+		read, pullResult := s.pullNext()
+		if pullResult != api.PullOk {
+			return result
 		}
+		result = append(result, read)
 	}
-	return result
 }
 
 func (s *StreamImpl) AllMatch(op interface{}) bool {
-	val, closed := s.pull()
-	for !closed {
+	val, result := s.pullNext()
+	for result == api.PullOk {
 		if !reflect.ValueOf(op).Call([]reflect.Value{reflect.ValueOf(val)})[0].Bool() {
 			return false
 		}
-		val, closed = s.pull()
+		val, result = s.pullNext()
 	}
 	return true
 }
@@ -83,23 +83,20 @@ func (s *StreamImpl) NoneMatch(op interface{}) bool {
 }
 
 func (s *StreamImpl) AtLeastOne(op interface{}) bool {
-	val, closed := s.pull()
-	for !closed {
+	val, result := s.pullNext()
+	for result == api.PullOk {
 		if reflect.ValueOf(op).Call([]reflect.Value{reflect.ValueOf(val)})[0].Bool() {
 			return true
 		}
-		val, closed = s.pull()
+		val, result = s.pullNext()
 	}
 	return false
 }
 
 func (s *StreamImpl) ForEach(op interface{}) {
-	val, closed := s.pull()
-	if closed {
-		return
-	}
-	for !closed {
+	val, result := s.pullNext()
+	for result == api.PullOk {
 		reflect.ValueOf(op).Call([]reflect.Value{reflect.ValueOf(val)})
-		val, closed = s.pull()
+		val, result = s.pullNext()
 	}
 }
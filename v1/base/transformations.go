@@ -13,15 +13,15 @@ import (
 // --------------------------------------------------------------------------------------------------------------------
 
 func (s *StreamImpl) Reduce(op interface{}) api.Stream {
-	return s.chain(func() (read interface{}, closed bool) {
-		left, closed := s.pull()
-		if closed {
-			return nil, true
+	return s.chain(func() (read interface{}, result api.PullResult) {
+		left, result := s.pullNext()
+		if result != api.PullOk {
+			return nil, result
 		}
 		for {
-			right, closed := s.pull()
-			if closed {
-				return left, false
+			right, result := s.pullNext()
+			if result != api.PullOk {
+				return left, api.PullOk
 			}
 			fnop := reflect.ValueOf(op)
 			left = fnop.Call([]reflect.Value{misc.Reflected(left), misc.Reflected(right)})[0].Interface()
@@ -30,16 +30,16 @@ func (s *StreamImpl) Reduce(op interface{}) api.Stream {
 }
 
 func (s *StreamImpl) ReduceNA(reducer api.Reducer) api.Stream {
-	return s.chain(func() (read interface{}, closed bool) {
-		left, closed := s.pull()
-		if closed {
-			return nil, true
+	return s.chain(func() (read interface{}, result api.PullResult) {
+		left, result := s.pullNext()
+		if result != api.PullOk {
+			return nil, result
 		}
 		reducer.First(left)
 		for {
-			right, closed := s.pull()
-			if closed {
-				return reducer.Result(), false
+			right, result := s.pullNext()
+			if result != api.PullOk {
+				return reducer.Result(), api.PullOk
 			}
 			reducer.Next(right)
 		}
@@ -56,55 +56,52 @@ func (s *StreamImpl) SumInt64() api.Stream {
 
 func (s *StreamImpl) Map(op interface{}) api.Stream {
 	fnop := reflect.ValueOf(op)
-	return s.chain(func() (read interface{}, closed bool) {
-		value, closed := s.pull()
-		if closed {
-			return nil, true
+	return s.chain(func() (read interface{}, result api.PullResult) {
+		value, result := s.pull()
+		if result != api.PullOk {
+			return nil, result
 		}
-		return fnop.Call([]reflect.Value{misc.Reflected(value)})[0].Interface(), false
+		return fnop.Call([]reflect.Value{misc.Reflected(value)})[0].Interface(), api.PullOk
 	})
 }
 
 // MapInt64 requires one allocation per element (2 for the generic Map)
 func (s *StreamImpl) MapInt64(op func(int64) int64) api.Stream {
-	return s.chain(func() (read interface{}, closed bool) {
-		value, closed := s.pull()
-		if closed {
-			return nil, true
+	return s.chain(func() (read interface{}, result api.PullResult) {
+		value, result := s.pull()
+		if result != api.PullOk {
+			return nil, result
 		}
-		return op(value.(int64)), false
+		return op(value.(int64)), api.PullOk
 	})
 }
 
 func (s *StreamImpl) Filter(op interface{}) api.Stream {
 	fnop := reflect.ValueOf(op)
-	return s.chain(func() (read interface{}, closed bool) {
-		var elem interface{}
-		closed = false
-		for !closed {
-			elem, closed = s.pull()
-			if !closed {
-				if !fnop.Call([]reflect.Value{misc.Reflected(elem)})[0].Bool() {
-					return elem, false
-				}
+	return s.chain(func() (read interface{}, result api.PullResult) {
+		for {
+			read, result = s.pull()
+			if result != api.PullOk {
+				return nil, result
+			}
+			if !fnop.Call([]reflect.Value{misc.Reflected(read)})[0].Bool() {
+				return read, api.PullOk
 			}
 		}
-		return nil, true
 	})
 }
 
 func (s *StreamImpl) FilterNA(op func(interface{}) bool) api.Stream {
-	return s.chain(func() (read interface{}, closed bool) {
-		closed = false
-		for !closed {
-			read, closed = s.pull()
-			if !closed {
-				if !op(read) {
-					return
-				}
+	return s.chain(func() (read interface{}, result api.PullResult) {
+		for {
+			read, result = s.pull()
+			if result != api.PullOk {
+				return nil, result
+			}
+			if !op(read) {
+				return
 			}
 		}
-		return
 	})
 }
 
@@ -113,18 +110,17 @@ func (s *StreamImpl) FilterNA(op func(interface{}) bool) api.Stream {
 // conversion is disabled, or the coercion is not possible, it can be either drop (setting the parameter dropIfNotPossible)
 // or panic when dropping is disable.
 func (s *StreamImpl) EnsureTypeEx(kind reflect.Kind, coerce bool, dropIfNotPossible bool) api.Stream {
-	return s.chain(func() (read interface{}, closed bool) {
-		closed = false
-		for !closed {
-			read, closed = s.pull()
-			if !closed {
-				if reflect.TypeOf(read).Kind() == kind {
-					return
-				}
-				//TODO: coerce
+	return s.chain(func() (read interface{}, result api.PullResult) {
+		for {
+			read, result = s.pull()
+			if result != api.PullOk {
+				return nil, result
 			}
+			if reflect.TypeOf(read).Kind() == kind {
+				return
+			}
+			//TODO: coerce
 		}
-		return
 	})
 }
 
@@ -136,9 +132,9 @@ func (s *StreamImpl) EnsureType(kind reflect.Kind) api.Stream {
 // Modifies the Stream element in-place, avoids non-allocating operation. Given the root pointer can not be changed,
 // this can only be used with struct or containers i.e. maps, etc.
 func (s *StreamImpl) ModifyNA(fn func(interface{})) api.Stream {
-	return s.chain(func() (read interface{}, closed bool) {
-		read, closed = s.pull()
-		if !closed {
+	return s.chain(func() (read interface{}, result api.PullResult) {
+		read, result = s.pull()
+		if result == api.PullOk {
 			fn(read)
 		}
 		return
@@ -1,6 +1,7 @@
 package base
 
 import (
+	"github.com/kuking/go-frank/v1/api"
 	"time"
 )
 
@@ -56,3 +57,44 @@ func (w *FastSpinThenWait) Reset() {
 	w.currentSpin = 0
 	w.currentWait = w.minWaitNs
 }
+
+// Spins for a while and then sleeps on the notifier until the producers signal new data, the lowest CPU usage without
+// adding latency. maxWaitNs bounds every sleep, as a safety net.
+type NotifyWait struct {
+	notifier         api.Notifier
+	spinsBeforeSleep int
+	maxWaitNs        int64
+	currentSpin      int
+	seq              uint32
+}
+
+func NewNotifyWait(notifier api.Notifier, spinsBeforeSleep int, maxWaitNs int64) *NotifyWait {
+	return &NotifyWait{
+		notifier:         notifier,
+		spinsBeforeSleep: spinsBeforeSleep,
+		maxWaitNs:        maxWaitNs,
+	}
+}
+
+func NewDefaultNotifyWait(notifier api.Notifier) *NotifyWait {
+	return NewNotifyWait(notifier, 1_000, 50_000_000)
+}
+
+func (w *NotifyWait) Loop() (waitedNs int64) {
+	w.currentSpin++
+	if w.currentSpin > w.spinsBeforeSleep {
+		t0 := time.Now()
+		w.notifier.Wait(w.seq, w.maxWaitNs)
+		waitedNs = time.Since(t0).Nanoseconds()
+	} else {
+		waitedNs = 1 // estimated nil-wait, avoid using timers for speed, no need to be precise
+	}
+	// sequence read before the caller checks for data again
+	w.seq = w.notifier.Seq()
+	return
+}
+
+func (w *NotifyWait) Reset() {
+	w.currentSpin = 0
+	w.seq = w.notifier.Seq()
+}
@@ -1,6 +1,7 @@
 package base
 
 import (
+	"github.com/kuking/go-frank/v1/api"
 	"testing"
 	"time"
 )
@@ -72,3 +73,37 @@ func TestNewFastSpinThenWait(t *testing.T) {
 	}
 
 }
+
+func TestNotifyWait(t *testing.T) {
+	s := EmptyStream(16)
+	s.WaitDuty(NewNotifyWait(s.Notifier(), 10, 10_000_000_000)).TimeOut(api.UntilClosed)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.Feed(1)
+		time.Sleep(50 * time.Millisecond)
+		s.Close()
+	}()
+
+	t0 := time.Now()
+	if elem, result := s.PullEx(); result != api.PullOk || elem != 1 {
+		t.Fatal()
+	}
+	if _, result := s.PullEx(); result != api.PullClosed {
+		t.Fatal()
+	}
+	if td := time.Since(t0); td < 100*time.Millisecond || td > 5*time.Second {
+		t.Fatal("it should have slept until notified, not until the max wait", td)
+	}
+}
+
+func TestNotifyWait_TimeOut(t *testing.T) {
+	s := EmptyStream(16)
+	s.WaitDuty(NewNotifyWait(s.Notifier(), 10, 1_000_000)).TimeOut(api.WaitingUpto10ms)
+	t0 := time.Now()
+	if _, result := s.PullEx(); result != api.PullTimedOut {
+		t.Fatal()
+	}
+	if td := time.Since(t0); td < 10*time.Millisecond {
+		t.Fatal("it should have waited", td)
+	}
+}
@@ -0,0 +1,42 @@
+package benchmarks
+
+import (
+	"fmt"
+	"github.com/kuking/go-frank/v1/api"
+	"github.com/kuking/go-frank/v1/base"
+	"github.com/kuking/go-frank/v1/persistent"
+	"github.com/kuking/go-frank/v1/serialisation"
+	"math/rand"
+	"testing"
+)
+
+// ping-pong through two IPC channels, each end spinning on its own instance (as another process would); the one-way
+// latency is half the round trip. It needs two spare cores.
+func BenchmarkIpcRoundTrip(b *testing.B) {
+	ser := serialisation.ByteArraySerialiser{}
+	pingName, pongName := fmt.Sprintf("bench-ping-%x", rand.Uint64()), fmt.Sprintf("bench-pong-%x", rand.Uint64())
+	ping, _ := persistent.IpcCreate(pingName, 64*1024*1024, ser)
+	defer ping.Delete()
+	pong, _ := persistent.IpcCreate(pongName, 64*1024*1024, ser)
+	defer pong.Delete()
+
+	go func() {
+		pingIn, _ := persistent.IpcOpen(pingName, ser)
+		defer pingIn.CloseFile()
+		pongOut, _ := persistent.IpcOpen(pongName, ser)
+		defer pongOut.CloseFile()
+		subId := pingIn.SubscriberIdForName("echo")
+		for i := 0; i < b.N; i++ {
+			elem, _, _ := pingIn.PullBySubId(subId, api.UntilClosed, base.NewBusyWait())
+			pongOut.Feed(elem)
+		}
+	}()
+
+	subId := pong.SubscriberIdForName("bench")
+	elem := make([]byte, 32)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ping.Feed(elem)
+		pong.PullBySubId(subId, api.UntilClosed, base.NewBusyWait())
+	}
+}
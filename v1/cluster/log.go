@@ -0,0 +1,161 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/kuking/go-frank/v1/persistent"
+	"github.com/kuking/go-frank/v1/serialisation"
+	"io/ioutil"
+	"os"
+)
+
+const entryHeaderSize = 8 + 1 // term, kind
+
+// Raft log on a persistent stream, one element per entry: term (uint64, little endian), kind and data. Indexes start
+// at 1; the position, term and kind of every entry are kept in memory, rebuilt when it is opened.
+type raftLog struct {
+	stream *persistent.MmapStream
+	subId  int
+	pos    []uint64 // absPos of the entry index i+1
+	terms  []uint64
+	kinds  []EntryKind
+}
+
+func openRaftLog(baseName string, partSize uint64) (l *raftLog, err error) {
+	l = &raftLog{}
+	if l.stream, err = persistent.MmapStreamOpen(baseName, serialisation.ByteArraySerialiser{}); err != nil {
+		if l.stream, err = persistent.MmapStreamCreate(baseName, partSize, serialisation.ByteArraySerialiser{}); err != nil {
+			return nil, err
+		}
+	}
+	if l.stream.GetFirstPart() != 0 {
+		_ = l.stream.CloseFile()
+		return nil, errors.New("the raft log has been pruned, it can not be rebuilt")
+	}
+	l.subId = l.stream.SubscriberIdForName("raft-log")
+	for absPos := uint64(0); absPos < l.stream.WritePos(); {
+		elem, nextAbsPos, ok := l.stream.PeekBySubId(l.subId, absPos)
+		if !ok || len(elem.([]byte)) < entryHeaderSize {
+			_ = l.stream.CloseFile()
+			return nil, errors.New(fmt.Sprintf("invalid raft log entry at: %v", absPos))
+		}
+		data := elem.([]byte)
+		l.pos = append(l.pos, absPos)
+		l.terms = append(l.terms, binary.LittleEndian.Uint64(data[0:8]))
+		l.kinds = append(l.kinds, EntryKind(data[8]))
+		absPos = nextAbsPos
+	}
+	return l, nil
+}
+
+func (l *raftLog) lastIndex() uint64 {
+	return uint64(len(l.pos))
+}
+
+// term of the entry at index, zero for index zero (before the first entry)
+func (l *raftLog) term(index uint64) uint64 {
+	if index == 0 || index > l.lastIndex() {
+		return 0
+	}
+	return l.terms[index-1]
+}
+
+func (l *raftLog) entry(index uint64) Entry {
+	elem, _, ok := l.stream.PeekBySubId(l.subId, l.pos[index-1])
+	if !ok {
+		panic(fmt.Sprintf("raft log entry %v is not readable", index))
+	}
+	data := elem.([]byte)
+	return Entry{
+		Term: binary.LittleEndian.Uint64(data[0:8]),
+		Kind: EntryKind(data[8]),
+		Data: append([]byte(nil), data[entryHeaderSize:]...), // it is the mmap, it could be truncated
+	}
+}
+
+// entries [from, to]
+func (l *raftLog) entries(from, to uint64) []Entry {
+	entries := make([]Entry, 0, to-from+1)
+	for index := from; index <= to; index++ {
+		entries = append(entries, l.entry(index))
+	}
+	return entries
+}
+
+func (l *raftLog) append(entries ...Entry) {
+	for _, entry := range entries {
+		elem := make([]byte, entryHeaderSize+len(entry.Data))
+		binary.LittleEndian.PutUint64(elem[0:8], entry.Term)
+		elem[8] = byte(entry.Kind)
+		copy(elem[entryHeaderSize:], entry.Data)
+		l.pos = append(l.pos, l.stream.WritePos()) // single writer
+		l.terms = append(l.terms, entry.Term)
+		l.kinds = append(l.kinds, entry.Kind)
+		l.stream.Feed(elem)
+	}
+}
+
+// discards the entries from index on, they conflict with the leader' ones
+func (l *raftLog) truncateFrom(index uint64) {
+	if err := l.stream.Truncate(l.pos[index-1]); err != nil {
+		panic(fmt.Sprintf("failed to truncate the raft log, err: %v", err))
+	}
+	l.pos, l.terms, l.kinds = l.pos[:index-1], l.terms[:index-1], l.kinds[:index-1]
+}
+
+// index of the last membership entry up to index (included), zero if there is none
+func (l *raftLog) lastConfig(index uint64) uint64 {
+	for ; index > 0; index-- {
+		if l.kinds[index-1] == EntryConfig {
+			return index
+		}
+	}
+	return 0
+}
+
+// is a log ending with (lastTerm, lastIndex) at least as up-to-date as this one
+func (l *raftLog) upToDate(lastTerm, lastIndex uint64) bool {
+	ourTerm := l.term(l.lastIndex())
+	return lastTerm > ourTerm || lastTerm == ourTerm && lastIndex >= l.lastIndex()
+}
+
+func (l *raftLog) close() error {
+	return l.stream.CloseFile()
+}
+
+// Term and vote, they have to be on disk before answering: a node must not vote twice in a term, even if restarted.
+// File: term (uint64, little endian) followed by the voted node id.
+func loadHardState(filename string) (term uint64, votedFor string, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	if len(data) < 8 {
+		return 0, "", errors.New(fmt.Sprintf("invalid raft state file: %v", filename))
+	}
+	return binary.LittleEndian.Uint64(data[0:8]), string(data[8:]), nil
+}
+
+func saveHardState(filename string, term uint64, votedFor string) error {
+	data := make([]byte, 8+len(votedFor))
+	binary.LittleEndian.PutUint64(data[0:8], term)
+	copy(data[8:], votedFor)
+	f, err := os.OpenFile(filename+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
@@ -0,0 +1,137 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type MessageType byte
+
+const (
+	MsgVote       MessageType = 1 // candidate asks for a vote, LogIndex/LogTerm: its last entry
+	MsgVoteResp   MessageType = 2
+	MsgAppend     MessageType = 3 // leader replicates entries (or just heartbeats), LogIndex/LogTerm: the entry before them
+	MsgAppendResp MessageType = 4 // Hint: the last matching index when accepted, the follower last index when rejected
+)
+
+type EntryKind byte
+
+const (
+	EntryCommand EntryKind = 1 // proposed by the application, given to Config.Apply once committed
+	EntryNoop    EntryKind = 2 // appended by a new leader, so entries of previous terms can be committed
+	EntryConfig  EntryKind = 3 // membership, Data: the member ids separated by new lines
+)
+
+type Entry struct {
+	Term uint64
+	Kind EntryKind
+	Data []byte
+}
+
+type Message struct {
+	Type     MessageType
+	From     string
+	To       string
+	Term     uint64
+	LogIndex uint64
+	LogTerm  uint64
+	Commit   uint64
+	Reject   bool
+	Hint     uint64
+	Entries  []Entry
+}
+
+// Wire format, for networks between processes: a fixed header, the node ids, then each entry header and its data.
+// All little endian.
+type wireMessageHeader struct {
+	Type     MessageType
+	Reject   uint8
+	FromLen  uint16
+	ToLen    uint16
+	Term     uint64
+	LogIndex uint64
+	LogTerm  uint64
+	Commit   uint64
+	Hint     uint64
+	Entries  uint32
+}
+
+type wireEntryHeader struct {
+	Term    uint64
+	Kind    EntryKind
+	DataLen uint32
+}
+
+const maxWireEntryData = 64 * 1024 // an entry is one stream element
+
+func (m *Message) Write(w io.Writer) error {
+	header := wireMessageHeader{
+		Type:     m.Type,
+		FromLen:  uint16(len(m.From)),
+		ToLen:    uint16(len(m.To)),
+		Term:     m.Term,
+		LogIndex: m.LogIndex,
+		LogTerm:  m.LogTerm,
+		Commit:   m.Commit,
+		Hint:     m.Hint,
+		Entries:  uint32(len(m.Entries)),
+	}
+	if m.Reject {
+		header.Reject = 1
+	}
+	if err := binary.Write(w, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, m.From+m.To); err != nil {
+		return err
+	}
+	for _, entry := range m.Entries {
+		entryHeader := wireEntryHeader{Term: entry.Term, Kind: entry.Kind, DataLen: uint32(len(entry.Data))}
+		if err := binary.Write(w, binary.LittleEndian, &entryHeader); err != nil {
+			return err
+		}
+		if _, err := w.Write(entry.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Message) Read(r io.Reader) error {
+	var header wireMessageHeader
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	ids := make([]byte, int(header.FromLen)+int(header.ToLen))
+	if _, err := io.ReadFull(r, ids); err != nil {
+		return err
+	}
+	*m = Message{
+		Type:     header.Type,
+		From:     string(ids[0:header.FromLen]),
+		To:       string(ids[header.FromLen:]),
+		Term:     header.Term,
+		LogIndex: header.LogIndex,
+		LogTerm:  header.LogTerm,
+		Commit:   header.Commit,
+		Reject:   header.Reject != 0,
+		Hint:     header.Hint,
+	}
+	for i := uint32(0); i < header.Entries; i++ {
+		var entryHeader wireEntryHeader
+		if err := binary.Read(r, binary.LittleEndian, &entryHeader); err != nil {
+			return err
+		}
+		if entryHeader.DataLen > maxWireEntryData {
+			return errors.New(fmt.Sprintf("invalid entry length: %v", entryHeader.DataLen))
+		}
+		entry := Entry{Term: entryHeader.Term, Kind: entryHeader.Kind, Data: make([]byte, entryHeader.DataLen)}
+		if _, err := io.ReadFull(r, entry.Data); err != nil {
+			return err
+		}
+		m.Entries = append(m.Entries, entry)
+	}
+	return nil
+}
@@ -0,0 +1,7 @@
+package cluster
+
+// Carries messages between nodes. It can lose, duplicate, delay or reorder them (Raft copes with it); Send should not
+// block nor call back into the sending node.
+type Network interface {
+	Send(msg Message)
+}
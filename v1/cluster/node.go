@@ -0,0 +1,517 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Role int32
+
+const (
+	FOLLOWER  Role = iota
+	CANDIDATE Role = iota
+	LEADER    Role = iota
+)
+
+const maxAppendEntries = 64 // per MsgAppend
+
+var ErrNotLeader = errors.New("not the leader, see Status().Leader")
+var ErrMembershipChanging = errors.New("a membership change is in progress, one at a time")
+
+type Config struct {
+	Id             string
+	Peers          []string // initial members (this one included); empty for a node joining an existing cluster
+	ElectionTicks  int      // a follower not hearing from a leader for [ElectionTicks, 2*ElectionTicks) campaigns, 10 if 0
+	HeartbeatTicks int      // the leader heartbeats every HeartbeatTicks, 1 if 0
+	PartSize       uint64   // of the log stream, 64MiB if 0
+	Seed           int64    // of the election time-outs, for deterministic tests
+	// Called in order with every committed command, from the first one after a (re)start. It should not call back into
+	// the node.
+	Apply func(index uint64, command []byte)
+}
+
+type Status struct {
+	Id        string
+	Role      Role
+	Term      uint64
+	Leader    string
+	Commit    uint64
+	LastIndex uint64
+	Members   []string
+}
+
+// Raft consensus (https://raft.github.io/raft.pdf) over a persistent stream, the replicated log. It is a state machine
+// driven by Tick (time) and Step (messages from the other nodes); it sends through the Network, i.e. a TCPNetwork over
+// a transport (the OS one, or a SimNetwork in tests) with Run ticking it. Membership changes are one node at a time,
+// effective as soon as they are appended (section 4.1 of the Raft dissertation).
+type Node struct {
+	lock      sync.Mutex
+	cfg       Config
+	network   Network
+	log       *raftLog
+	statePath string
+	rand      *rand.Rand
+	stop      chan struct{}
+
+	role        Role
+	term        uint64
+	votedFor    string
+	leader      string
+	members     []string
+	configIndex uint64 // of the membership entry in use, zero for Config.Peers
+
+	commit  uint64
+	applied uint64
+	elapsed int
+	timeout int
+	votes   map[string]bool
+	next    map[string]uint64
+	match   map[string]uint64
+}
+
+// Opens (or creates) the node log in baseName, with its term and vote in baseName.raft.
+func NewNode(cfg Config, baseName string, network Network) (n *Node, err error) {
+	if cfg.ElectionTicks == 0 {
+		cfg.ElectionTicks = 10
+	}
+	if cfg.HeartbeatTicks == 0 {
+		cfg.HeartbeatTicks = 1
+	}
+	if cfg.PartSize == 0 {
+		cfg.PartSize = 64 * 1024 * 1024
+	}
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(cfg.Id))
+	n = &Node{
+		cfg:       cfg,
+		network:   network,
+		statePath: baseName + ".raft",
+		rand:      rand.New(rand.NewSource(cfg.Seed ^ int64(hash.Sum64()))),
+		stop:      make(chan struct{}),
+		role:      FOLLOWER,
+		next:      map[string]uint64{},
+		match:     map[string]uint64{},
+	}
+	if n.term, n.votedFor, err = loadHardState(n.statePath); err != nil {
+		return nil, err
+	}
+	if n.log, err = openRaftLog(baseName, cfg.PartSize); err != nil {
+		return nil, err
+	}
+	n.refreshMembers()
+	n.resetElapsed()
+	return n, nil
+}
+
+// Ticks the node every tick until Close, for real time operation (i.e. over TCPNetwork).
+func (n *Node) Run(tick time.Duration) {
+	go func() {
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				n.Tick()
+			case <-n.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (n *Node) Close() error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	select {
+	case <-n.stop:
+		return nil
+	default:
+		close(n.stop)
+	}
+	return n.log.close()
+}
+
+// ticks and messages arriving late are ignored once closed, its log is gone
+func (n *Node) closed() bool {
+	select {
+	case <-n.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (n *Node) Status() Status {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return Status{
+		Id:        n.cfg.Id,
+		Role:      n.role,
+		Term:      n.term,
+		Leader:    n.leader,
+		Commit:    n.commit,
+		LastIndex: n.log.lastIndex(),
+		Members:   append([]string(nil), n.members...),
+	}
+}
+
+// Committed entry at index, ok=false if it is not committed (yet).
+func (n *Node) Committed(index uint64) (entry Entry, ok bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if index == 0 || index > n.commit {
+		return Entry{}, false
+	}
+	return n.log.entry(index), true
+}
+
+// Appends the command to the log, it will be applied once committed (see Config.Apply). Only on the leader.
+func (n *Node) Propose(command []byte) (index uint64, err error) {
+	if len(command) > math.MaxUint16-entryHeaderSize {
+		return 0, errors.New("command too large for a log entry")
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.appendAsLeader(Entry{Kind: EntryCommand, Data: command})
+}
+
+// Adds a member, one at a time: it fails while the previous membership change is not committed. Only on the leader;
+// the new node should be started with no Peers, it learns the membership from the leader.
+func (n *Node) AddMember(id string) error {
+	return n.changeMembers(id, true)
+}
+
+// Removes a member, the leader itself included (it steps down once the change is committed).
+func (n *Node) RemoveMember(id string) error {
+	return n.changeMembers(id, false)
+}
+
+func (n *Node) changeMembers(id string, add bool) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.configIndex > n.commit {
+		return ErrMembershipChanging
+	}
+	members := make([]string, 0, len(n.members)+1)
+	for _, member := range n.members {
+		if member != id {
+			members = append(members, member)
+		}
+	}
+	if add {
+		members = append(members, id)
+	}
+	_, err := n.appendAsLeader(Entry{Kind: EntryConfig, Data: []byte(strings.Join(members, "\n"))})
+	return err
+}
+
+func (n *Node) appendAsLeader(entry Entry) (index uint64, err error) {
+	if n.role != LEADER {
+		return 0, ErrNotLeader
+	}
+	entry.Term = n.term
+	n.appendEntries(entry)
+	index = n.log.lastIndex()
+	for _, member := range n.members {
+		if member != n.cfg.Id && n.next[member] == index {
+			n.sendAppend(member)
+		}
+	}
+	n.maybeCommit()
+	return index, nil
+}
+
+func (n *Node) Tick() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.closed() {
+		return
+	}
+	n.elapsed++
+	if n.role == LEADER {
+		if n.elapsed >= n.cfg.HeartbeatTicks {
+			n.elapsed = 0
+			n.broadcastAppend()
+		}
+		return
+	}
+	if n.elapsed >= n.timeout && n.isMember(n.cfg.Id) {
+		n.campaign()
+	}
+}
+
+// Handles a message from another node.
+func (n *Node) Step(msg Message) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.closed() {
+		return
+	}
+	if msg.Term > n.term {
+		leader := ""
+		if msg.Type == MsgAppend {
+			leader = msg.From
+		}
+		n.becomeFollower(msg.Term, leader)
+	}
+	if msg.Term < n.term {
+		// from a deposed leader or candidate, it learns about the newer term with the answer
+		if msg.Type == MsgVote {
+			n.send(Message{Type: MsgVoteResp, To: msg.From, Reject: true})
+		} else if msg.Type == MsgAppend {
+			n.send(Message{Type: MsgAppendResp, To: msg.From, Reject: true, Hint: n.log.lastIndex()})
+		}
+		return
+	}
+	switch msg.Type {
+	case MsgVote:
+		grant := (n.votedFor == "" || n.votedFor == msg.From) && n.log.upToDate(msg.LogTerm, msg.LogIndex)
+		if grant {
+			n.votedFor = msg.From
+			n.saveHardState()
+			n.resetElapsed()
+		}
+		n.send(Message{Type: MsgVoteResp, To: msg.From, Reject: !grant})
+	case MsgVoteResp:
+		if n.role == CANDIDATE {
+			n.votes[msg.From] = !msg.Reject
+			if n.granted() > len(n.members)/2 {
+				n.becomeLeader()
+			}
+		}
+	case MsgAppend:
+		if n.role != FOLLOWER {
+			n.becomeFollower(n.term, msg.From)
+		}
+		n.leader = msg.From
+		n.resetElapsed()
+		n.handleAppend(msg)
+	case MsgAppendResp:
+		if n.role == LEADER {
+			n.handleAppendResp(msg)
+		}
+	}
+}
+
+func (n *Node) handleAppend(msg Message) {
+	lastIndex := n.log.lastIndex()
+	if msg.LogIndex > lastIndex || n.log.term(msg.LogIndex) != msg.LogTerm {
+		hint := lastIndex
+		if msg.LogIndex <= lastIndex {
+			hint = msg.LogIndex - 1
+		}
+		n.send(Message{Type: MsgAppendResp, To: msg.From, Reject: true, Hint: hint})
+		return
+	}
+	for i, entry := range msg.Entries {
+		index := msg.LogIndex + 1 + uint64(i)
+		if index <= n.log.lastIndex() {
+			if n.log.term(index) == entry.Term {
+				continue // already there
+			}
+			n.log.truncateFrom(index)
+			if n.configIndex >= index {
+				n.refreshMembers()
+			}
+		}
+		n.appendEntries(msg.Entries[i:]...)
+		break
+	}
+	match := msg.LogIndex + uint64(len(msg.Entries))
+	// a delayed or duplicated append can know less than what was already committed, the commit never goes backwards
+	newCommit := msg.Commit
+	if newCommit > match {
+		newCommit = match
+	}
+	if newCommit > n.commit {
+		n.commit = newCommit
+		n.applyCommitted()
+	}
+	n.send(Message{Type: MsgAppendResp, To: msg.From, Hint: match})
+}
+
+func (n *Node) handleAppendResp(msg Message) {
+	if msg.Reject {
+		// goes back to where the follower log ends (or one before), until both logs match
+		next := n.next[msg.From] - 1
+		if msg.Hint+1 < next {
+			next = msg.Hint + 1
+		}
+		if next < 1 {
+			next = 1
+		}
+		n.next[msg.From] = next
+		n.sendAppend(msg.From)
+		return
+	}
+	if msg.Hint > n.match[msg.From] {
+		n.match[msg.From] = msg.Hint
+	}
+	n.next[msg.From] = msg.Hint + 1
+	n.maybeCommit()
+	if n.role == LEADER && n.next[msg.From] <= n.log.lastIndex() {
+		n.sendAppend(msg.From)
+	}
+}
+
+func (n *Node) campaign() {
+	n.role = CANDIDATE
+	n.term++
+	n.votedFor = n.cfg.Id
+	n.leader = ""
+	n.saveHardState()
+	n.resetElapsed()
+	n.votes = map[string]bool{n.cfg.Id: true}
+	if n.granted() > len(n.members)/2 {
+		n.becomeLeader()
+		return
+	}
+	lastIndex := n.log.lastIndex()
+	for _, member := range n.members {
+		if member != n.cfg.Id {
+			n.send(Message{Type: MsgVote, To: member, LogIndex: lastIndex, LogTerm: n.log.term(lastIndex)})
+		}
+	}
+}
+
+func (n *Node) becomeFollower(term uint64, leader string) {
+	if term != n.term {
+		n.term = term
+		n.votedFor = ""
+		n.saveHardState()
+	}
+	n.role = FOLLOWER
+	n.leader = leader
+	n.resetElapsed()
+}
+
+func (n *Node) becomeLeader() {
+	n.role = LEADER
+	n.leader = n.cfg.Id
+	n.elapsed = 0
+	n.next = map[string]uint64{}
+	n.match = map[string]uint64{}
+	for _, member := range n.members {
+		n.next[member] = n.log.lastIndex() + 1
+	}
+	// entries of previous terms are only committed once one of its own term is
+	n.appendEntries(Entry{Term: n.term, Kind: EntryNoop})
+	n.broadcastAppend()
+	n.maybeCommit()
+}
+
+func (n *Node) appendEntries(entries ...Entry) {
+	n.log.append(entries...)
+	n.match[n.cfg.Id] = n.log.lastIndex()
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Kind == EntryConfig {
+			n.refreshMembers()
+			break
+		}
+	}
+}
+
+func (n *Node) broadcastAppend() {
+	for _, member := range n.members {
+		if member != n.cfg.Id {
+			n.sendAppend(member)
+		}
+	}
+}
+
+func (n *Node) sendAppend(to string) {
+	next := n.next[to]
+	if next == 0 {
+		next = n.log.lastIndex() + 1 // a member just added
+		n.next[to] = next
+	}
+	msg := Message{Type: MsgAppend, To: to, LogIndex: next - 1, LogTerm: n.log.term(next - 1), Commit: n.commit}
+	if last := n.log.lastIndex(); next <= last {
+		if last >= next+maxAppendEntries {
+			last = next + maxAppendEntries - 1
+		}
+		msg.Entries = n.log.entries(next, last)
+	}
+	n.send(msg)
+}
+
+// commits the last entry of the current term a majority has
+func (n *Node) maybeCommit() {
+	for index := n.log.lastIndex(); index > n.commit && n.log.term(index) == n.term; index-- {
+		count := 0
+		for _, member := range n.members {
+			if n.match[member] >= index {
+				count++
+			}
+		}
+		if count > len(n.members)/2 {
+			n.commit = index
+			n.applyCommitted()
+			break
+		}
+	}
+	if n.role == LEADER && !n.isMember(n.cfg.Id) && n.commit >= n.configIndex {
+		// removed, the remaining members elect a new leader
+		n.becomeFollower(n.term, "")
+	}
+}
+
+func (n *Node) applyCommitted() {
+	for n.applied < n.commit {
+		n.applied++
+		if n.cfg.Apply != nil && n.log.kinds[n.applied-1] == EntryCommand {
+			n.cfg.Apply(n.applied, n.log.entry(n.applied).Data)
+		}
+	}
+}
+
+// the membership is the last one in the log, committed or not
+func (n *Node) refreshMembers() {
+	n.configIndex = n.log.lastConfig(n.log.lastIndex())
+	if n.configIndex == 0 {
+		n.members = append([]string(nil), n.cfg.Peers...)
+		return
+	}
+	n.members = strings.Split(string(n.log.entry(n.configIndex).Data), "\n")
+}
+
+func (n *Node) isMember(id string) bool {
+	for _, member := range n.members {
+		if member == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Node) granted() (count int) {
+	for _, member := range n.members {
+		if n.votes[member] {
+			count++
+		}
+	}
+	return
+}
+
+func (n *Node) resetElapsed() {
+	n.elapsed = 0
+	n.timeout = n.cfg.ElectionTicks + n.rand.Intn(n.cfg.ElectionTicks)
+}
+
+func (n *Node) saveHardState() {
+	if err := saveHardState(n.statePath, n.term, n.votedFor); err != nil {
+		panic(fmt.Sprintf("failed to persist the raft term and vote, err: %v", err)) // it could vote twice
+	}
+}
+
+func (n *Node) send(msg Message) {
+	msg.From = n.cfg.Id
+	msg.Term = n.term
+	n.network.Send(msg)
+}
@@ -0,0 +1,374 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/kuking/go-frank/v1/transport"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+// nodes over TCPNetworks on a SimNetwork, ticked by the test
+type testCluster struct {
+	prefix    string
+	sim       *transport.SimNetwork
+	addrs     map[string]string
+	networks  map[string]*TCPNetwork
+	listeners map[string]net.Listener
+	nodes     map[string]*Node
+	isolated  map[string]bool
+	lock      sync.Mutex // applied is appended from the network goroutines
+	applied   map[string][]string
+}
+
+func givenCluster(t *testing.T, ids ...string) *testCluster {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	c := &testCluster{
+		prefix:    prefix,
+		sim:       transport.NewSimNetwork(42),
+		addrs:     map[string]string{},
+		networks:  map[string]*TCPNetwork{},
+		listeners: map[string]net.Listener{},
+		nodes:     map[string]*Node{},
+		isolated:  map[string]bool{},
+		applied:   map[string][]string{},
+	}
+	for _, id := range ids {
+		c.start(t, id, ids)
+	}
+	return c
+}
+
+// opens the node, it does not hear from the others until connected
+func (c *testCluster) open(t *testing.T, id string, peers []string) *Node {
+	c.addrs[id] = id + ":7000"
+	for _, network := range c.networks {
+		network.SetAddr(id, c.addrs[id])
+	}
+	network := NewTCPNetwork(c.addrs)
+	network.Transport = c.sim.Host(id)
+	c.lock.Lock()
+	c.applied[id] = nil
+	c.lock.Unlock()
+	node, err := NewNode(Config{
+		Id:       id,
+		Peers:    peers,
+		PartSize: 64 * 1024,
+		Seed:     42,
+		Apply: func(index uint64, command []byte) {
+			c.lock.Lock()
+			defer c.lock.Unlock()
+			c.applied[id] = append(c.applied[id], string(command))
+		},
+	}, path.Join(c.prefix, id), network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.networks[id] = network
+	c.nodes[id] = node
+	return node
+}
+
+func (c *testCluster) connect(t *testing.T, id string) {
+	listener, err := c.sim.Host(id).Listen("tcp", c.addrs[id])
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.listeners[id] = listener
+	go c.networks[id].Serve(listener, c.nodes[id])
+}
+
+func (c *testCluster) start(t *testing.T, id string, peers []string) *Node {
+	node := c.open(t, id, peers)
+	c.connect(t, id)
+	return node
+}
+
+// as if it crashed
+func (c *testCluster) stop(id string) {
+	_ = c.listeners[id].Close()
+	c.networks[id].Close()
+	_ = c.nodes[id].Close()
+	c.sim.Reset(id)
+	delete(c.listeners, id)
+	delete(c.networks, id)
+	delete(c.nodes, id)
+}
+
+func (c *testCluster) close() {
+	for id := range c.nodes {
+		c.stop(id)
+	}
+	_ = os.RemoveAll(c.prefix)
+}
+
+func (c *testCluster) isolate(id string) {
+	for other := range c.addrs {
+		if other != id {
+			c.sim.Partition(id, other)
+		}
+	}
+	c.isolated[id] = true
+}
+
+func (c *testCluster) reconnect(id string) {
+	for other := range c.addrs {
+		if other != id && !c.isolated[other] {
+			c.sim.Heal(id, other)
+		}
+	}
+	delete(c.isolated, id)
+}
+
+// each tick gives the messages sent some time to be delivered, and answered
+func (c *testCluster) tick(ticks int) {
+	for i := 0; i < ticks; i++ {
+		for _, node := range c.nodes {
+			node.Tick()
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+}
+
+// ticks until expr holds
+func (c *testCluster) eventually(t *testing.T, explanation string, expr func() bool) {
+	for i := 0; !expr(); i++ {
+		if i == 500 {
+			t.Fatalf("failed waiting for: %v", explanation)
+		}
+		c.tick(1)
+	}
+}
+
+// the leader among the connected nodes, after ticking until there is only one
+func (c *testCluster) leader(t *testing.T) *Node {
+	var leader *Node
+	c.eventually(t, "one leader", func() bool {
+		terms := map[uint64]bool{}
+		leader = nil
+		for id, node := range c.nodes {
+			if status := node.Status(); status.Role == LEADER && !c.isolated[id] {
+				if terms[status.Term] {
+					t.Fatal("more than one leader in term", status.Term)
+				}
+				terms[status.Term] = true
+				leader = node
+			}
+		}
+		return len(terms) == 1 // a deposed one has not heard about the newer term yet otherwise
+	})
+	return leader
+}
+
+func (c *testCluster) propose(t *testing.T, commands ...string) {
+	for _, command := range commands {
+		if _, err := c.leader(t).Propose([]byte(command)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (c *testCluster) appliedBy(id string) []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string(nil), c.applied[id]...)
+}
+
+func (c *testCluster) lastAppliedBy(id string) string {
+	applied := c.appliedBy(id)
+	if len(applied) == 0 {
+		return ""
+	}
+	return applied[len(applied)-1]
+}
+
+func assertApplied(t *testing.T, c *testCluster, id string, expected ...string) {
+	c.eventually(t, fmt.Sprintf("%v to apply %v", id, expected), func() bool {
+		return fmt.Sprint(c.appliedBy(id)) == fmt.Sprint(expected)
+	})
+}
+
+func TestNode_ElectsOneLeaderAndReplicates(t *testing.T) {
+	c := givenCluster(t, "a", "b", "c")
+	defer c.close()
+
+	leader := c.leader(t)
+	if _, err := c.nodes[leader.Status().Leader].Propose([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	for id, node := range c.nodes {
+		if node != leader {
+			if _, err := node.Propose([]byte("x")); err != ErrNotLeader {
+				t.Fatal("only the leader takes proposals")
+			}
+			c.eventually(t, id+" to follow the leader", func() bool {
+				status := node.Status()
+				return status.Leader == leader.Status().Id && status.Term == leader.Status().Term
+			})
+		}
+	}
+	c.propose(t, "y", "z")
+	for id, node := range c.nodes {
+		assertApplied(t, c, id, "x", "y", "z")
+		c.eventually(t, id+" to commit everything", func() bool {
+			status := node.Status()
+			return status.Commit == 4 && status.LastIndex == 4 // noop, x, y, z
+		})
+		if entry, ok := node.Committed(2); !ok || string(entry.Data) != "x" || entry.Kind != EntryCommand {
+			t.Fatal(id, entry)
+		}
+	}
+}
+
+func TestNode_LeaderIsolatedAndItsUncommittedEntriesDiscarded(t *testing.T) {
+	c := givenCluster(t, "a", "b", "c", "d", "e")
+	defer c.close()
+	c.propose(t, "1")
+	for id := range c.nodes {
+		assertApplied(t, c, id, "1")
+	}
+
+	old := c.leader(t)
+	oldId, oldTerm := old.Status().Id, old.Status().Term
+	c.isolate(oldId)
+	if _, err := old.Propose([]byte("lost")); err != nil {
+		t.Fatal("it does not know yet it is isolated")
+	}
+	c.tick(3)
+	assertApplied(t, c, oldId, "1")
+
+	leader := c.leader(t)
+	if leader == old || leader.Status().Term <= oldTerm {
+		t.Fatal("a new leader should be elected, in a newer term")
+	}
+	c.propose(t, "2", "3")
+
+	c.reconnect(oldId)
+	c.eventually(t, "the old leader to follow the new one", func() bool {
+		status := old.Status()
+		return status.Role == FOLLOWER && status.Leader == leader.Status().Id
+	})
+	for id := range c.nodes {
+		assertApplied(t, c, id, "1", "2", "3")
+	}
+	c.eventually(t, "the uncommitted entry to be replaced", func() bool {
+		return old.Status().LastIndex == leader.Status().LastIndex
+	})
+}
+
+func TestNode_NoProgressWithoutQuorum(t *testing.T) {
+	c := givenCluster(t, "a", "b", "c")
+	defer c.close()
+	leader := c.leader(t)
+	for id := range c.nodes {
+		if id != leader.Status().Id {
+			c.isolate(id)
+		}
+	}
+	index, _ := leader.Propose([]byte("x"))
+	c.tick(50)
+	if _, ok := leader.Committed(index); ok {
+		t.Fatal("one out of three is not a majority")
+	}
+	term := leader.Status().Term
+	for id := range c.nodes {
+		c.reconnect(id)
+	}
+	c.eventually(t, "a leader in the newer term of the campaigning ones", func() bool {
+		return c.leader(t).Status().Term > term
+	})
+	c.propose(t, "y")
+	for id := range c.nodes {
+		c.eventually(t, id+" to apply y", func() bool {
+			return c.lastAppliedBy(id) == "y"
+		})
+	}
+}
+
+func TestNode_RestartKeepsTermVoteAndLog(t *testing.T) {
+	c := givenCluster(t, "a", "b", "c")
+	defer c.close()
+	c.propose(t, "x", "y")
+
+	follower := "a"
+	if c.leader(t).Status().Id == follower {
+		follower = "b"
+	}
+	assertApplied(t, c, follower, "x", "y")
+	before := c.nodes[follower].Status()
+	c.stop(follower)
+	c.propose(t, "z")
+	node := c.open(t, follower, []string{"a", "b", "c"})
+	if status := node.Status(); status.Term != before.Term || status.LastIndex != before.LastIndex {
+		t.Fatal("term and log should be kept", before, status)
+	}
+	c.connect(t, follower)
+	assertApplied(t, c, follower, "x", "y", "z")
+}
+
+func TestNode_MembershipChanges(t *testing.T) {
+	c := givenCluster(t, "a", "b", "c")
+	defer c.close()
+	c.propose(t, "x")
+
+	leader := c.leader(t)
+	c.start(t, "d", nil)
+	if err := leader.AddMember("d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.AddMember("e"); err != ErrMembershipChanging {
+		t.Fatal("one change at a time, err:", err)
+	}
+	c.propose(t, "y")
+	assertApplied(t, c, "d", "x", "y")
+	c.eventually(t, "d to know the membership", func() bool {
+		return len(c.nodes["d"].Status().Members) == 4
+	})
+
+	// the leader removes itself
+	oldId := leader.Status().Id
+	if err := leader.RemoveMember(oldId); err != nil {
+		t.Fatal(err)
+	}
+	c.eventually(t, "the removed leader to step down", func() bool {
+		return leader.Status().Role != LEADER
+	})
+	c.stop(oldId)
+	c.propose(t, "z")
+	newLeader := c.leader(t)
+	if newLeader.Status().Id == oldId || len(newLeader.Status().Members) != 3 {
+		t.Fatal(newLeader.Status())
+	}
+	for id := range c.nodes {
+		c.eventually(t, id+" to apply z", func() bool {
+			return c.lastAppliedBy(id) == "z"
+		})
+	}
+}
+
+type discardNetwork struct{}
+
+func (discardNetwork) Send(Message) {}
+
+func TestNode_StaleAppendDoesNotLowerTheCommit(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+	node, err := NewNode(Config{Id: "b", Peers: []string{"a", "b", "c"}, PartSize: 64 * 1024},
+		path.Join(prefix, "b"), discardNetwork{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+
+	entries := []Entry{{Term: 1, Kind: EntryNoop}, {Term: 1, Kind: EntryCommand}, {Term: 1, Kind: EntryCommand}}
+	node.Step(Message{Type: MsgAppend, From: "a", To: "b", Term: 1, Entries: entries, Commit: 2})
+	// a heartbeat about the first entry only, but committing more, overtaken by the append above
+	node.Step(Message{Type: MsgAppend, From: "a", To: "b", Term: 1, LogIndex: 1, LogTerm: 1, Commit: 3})
+	if status := node.Status(); status.Commit != 2 || status.LastIndex != 3 {
+		t.Fatal("the commit should not go backwards", status)
+	}
+}
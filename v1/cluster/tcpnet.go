@@ -0,0 +1,163 @@
+package cluster
+
+import (
+	"errors"
+	"github.com/kuking/go-frank/v1/transport"
+	"log"
+	"net"
+	"sync"
+)
+
+const tcpOutboxSize = 1_024 // messages queued per peer, more are dropped (Raft retries)
+
+// Network over TCP, one connection per peer dialed when there is something to send. Messages are written in the
+// background, they are dropped while a peer is unreachable.
+type TCPNetwork struct {
+	Transport transport.Transport // the peers are dialed through, the OS network when nil (a SimNetwork host in tests)
+	lock      sync.Mutex
+	addrs     map[string]string // node id -> address
+	outbox    map[string]chan Message
+	conns     []net.Conn
+	closed    bool
+	closing   chan struct{}
+}
+
+func NewTCPNetwork(addrs map[string]string) *TCPNetwork {
+	t := &TCPNetwork{
+		addrs:   map[string]string{},
+		outbox:  map[string]chan Message{},
+		closing: make(chan struct{}),
+	}
+	for id, addr := range addrs {
+		t.addrs[id] = addr
+	}
+	return t
+}
+
+// Sets (or changes) the address of a node, i.e. one being added to the cluster.
+func (t *TCPNetwork) SetAddr(id, addr string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.addrs[id] = addr
+}
+
+// Accepts connections from the other nodes, their messages are given to the node. It returns when the listener is
+// closed.
+func (t *TCPNetwork) Serve(listener net.Listener, node *Node) error {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			log.Printf("error accepting connection, err: %v\n", err)
+			continue
+		}
+		if !t.track(conn) {
+			_ = conn.Close()
+			return nil
+		}
+		go func() {
+			bc := transport.NewBufferedConnSize(conn, 64*1024)
+			var msg Message
+			for {
+				if err := msg.Read(bc); err != nil {
+					_ = conn.Close()
+					return
+				}
+				node.Step(msg)
+			}
+		}()
+	}
+}
+
+func (t *TCPNetwork) Send(msg Message) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return
+	}
+	outbox, ok := t.outbox[msg.To]
+	if !ok {
+		outbox = make(chan Message, tcpOutboxSize)
+		t.outbox[msg.To] = outbox
+		go t.goFuncSend(msg.To, outbox)
+	}
+	select {
+	case outbox <- msg:
+	default: // the peer is not keeping up
+	}
+}
+
+func (t *TCPNetwork) goFuncSend(to string, outbox chan Message) {
+	var conn net.Conn
+	var bc transport.BufferedConn
+	for {
+		var msg Message
+		select {
+		case msg = <-outbox:
+		case <-t.closing:
+			if conn != nil {
+				_ = conn.Close()
+			}
+			return
+		}
+		if conn == nil {
+			t.lock.Lock()
+			addr := t.addrs[to]
+			t.lock.Unlock()
+			var err error
+			if conn, err = t.dial(addr); err != nil {
+				conn = nil
+				continue // lost, it will be retried
+			}
+			if !t.track(conn) {
+				_ = conn.Close()
+				return
+			}
+			bc = transport.NewBufferedConnSize(conn, 64*1024)
+		}
+		err := msg.Write(bc)
+		for err == nil && len(outbox) > 0 {
+			msg = <-outbox
+			err = msg.Write(bc)
+		}
+		if err == nil {
+			err = bc.Flush()
+		}
+		if err != nil {
+			_ = conn.Close()
+			conn = nil
+		}
+	}
+}
+
+func (t *TCPNetwork) dial(addr string) (net.Conn, error) {
+	if t.Transport == nil {
+		return net.Dial("tcp", addr)
+	}
+	return t.Transport.Dial("tcp", addr)
+}
+
+func (t *TCPNetwork) track(conn net.Conn) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return false
+	}
+	t.conns = append(t.conns, conn)
+	return true
+}
+
+// Closes all the connections, messages are not sent anymore.
+func (t *TCPNetwork) Close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return
+	}
+	t.closed = true
+	close(t.closing)
+	for _, conn := range t.conns {
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,82 @@
+package cluster
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTCPNetwork_ClusterOnLoopback(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+
+	ids := []string{"a", "b", "c"}
+	listeners := map[string]net.Listener{}
+	addrs := map[string]string{}
+	for _, id := range ids {
+		listeners[id], _ = net.Listen("tcp", "127.0.0.1:0")
+		addrs[id] = listeners[id].Addr().String()
+	}
+	var lock sync.Mutex
+	applied := map[string]int{}
+	nodes := map[string]*Node{}
+	for _, id := range ids {
+		id := id
+		network := NewTCPNetwork(addrs)
+		defer network.Close()
+		node, err := NewNode(Config{
+			Id:       id,
+			Peers:    ids,
+			PartSize: 64 * 1024,
+			Apply: func(index uint64, command []byte) {
+				lock.Lock()
+				defer lock.Unlock()
+				applied[id]++
+			},
+		}, path.Join(prefix, id), network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer node.Close()
+		go network.Serve(listeners[id], node)
+		defer listeners[id].Close()
+		node.Run(5 * time.Millisecond)
+		nodes[id] = node
+	}
+
+	var leader *Node
+	assertEventually(t, "a leader", func() bool {
+		for _, node := range nodes {
+			if node.Status().Role == LEADER {
+				leader = node
+				return true
+			}
+		}
+		return false
+	})
+	for i := 0; i < 100; i++ {
+		if _, err := leader.Propose([]byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertEventually(t, "all nodes to apply the commands", func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return applied["a"] == 100 && applied["b"] == 100 && applied["c"] == 100
+	})
+}
+
+func assertEventually(t *testing.T, explanation string, expr func() bool) {
+	t0 := time.Now()
+	for !expr() {
+		if time.Since(t0) > 10*time.Second {
+			t.Fatalf("failed waiting for: %v", explanation)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	api "github.com/kuking/go-frank/v1/api"
 	"github.com/kuking/go-frank/v1/base"
 	"github.com/kuking/go-frank/v1/persistent"
+	_ "github.com/kuking/go-frank/v1/remote" // tcp:// subscriptions and publishers
 	"github.com/kuking/go-frank/v1/serialisation"
 	"os"
 )
@@ -0,0 +1,55 @@
+package misc
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// In-process api.Notifier, ringing it is just an atomic increment unless there are goroutines waiting on it. The zero
+// value is ready to use.
+type Doorbell struct {
+	seq     uint32
+	waiters int32
+	lock    sync.Mutex
+	ch      chan struct{} // closed and discarded on every ring with waiters
+}
+
+func (d *Doorbell) Seq() uint32 {
+	return atomic.LoadUint32(&d.seq)
+}
+
+func (d *Doorbell) Notify() {
+	atomic.AddUint32(&d.seq, 1)
+	if atomic.LoadInt32(&d.waiters) == 0 {
+		return
+	}
+	d.lock.Lock()
+	if d.ch != nil {
+		close(d.ch)
+		d.ch = nil
+	}
+	d.lock.Unlock()
+}
+
+func (d *Doorbell) Wait(seq uint32, timeoutNs int64) {
+	atomic.AddInt32(&d.waiters, 1)
+	defer atomic.AddInt32(&d.waiters, -1)
+	d.lock.Lock()
+	if atomic.LoadUint32(&d.seq) != seq {
+		d.lock.Unlock()
+		return
+	}
+	if d.ch == nil {
+		d.ch = make(chan struct{})
+	}
+	ch := d.ch
+	d.lock.Unlock()
+
+	timer := time.NewTimer(time.Duration(timeoutNs))
+	select {
+	case <-ch:
+	case <-timer.C:
+	}
+	timer.Stop()
+}
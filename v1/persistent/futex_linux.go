@@ -0,0 +1,25 @@
+//go:build linux
+
+package persistent
+
+import (
+	"math"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	futexWaitOp = 0 // FUTEX_WAIT, not private: the word lives in a shared mapping
+	futexWakeOp = 1 // FUTEX_WAKE
+)
+
+// sleeps while *addr == val, up to timeoutNs; interruptions and spurious wake-ups are left to the caller's loop
+func futexWait(addr *uint32, val uint32, timeoutNs int64) {
+	ts := syscall.NsecToTimespec(timeoutNs)
+	_, _, _ = syscall.Syscall6(syscall.SYS_FUTEX, uintptr(unsafe.Pointer(addr)), futexWaitOp, uintptr(val),
+		uintptr(unsafe.Pointer(&ts)), 0, 0)
+}
+
+func futexWakeAll(addr *uint32) {
+	_, _, _ = syscall.Syscall6(syscall.SYS_FUTEX, uintptr(unsafe.Pointer(addr)), futexWakeOp, math.MaxInt32, 0, 0, 0)
+}
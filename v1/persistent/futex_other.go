@@ -0,0 +1,20 @@
+//go:build !linux
+
+package persistent
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const futexPollNs = 100_000
+
+// no futexes, polls the word every 100us up to timeoutNs
+func futexWait(addr *uint32, val uint32, timeoutNs int64) {
+	for ; timeoutNs > 0 && atomic.LoadUint32(addr) == val; timeoutNs -= futexPollNs {
+		time.Sleep(futexPollNs)
+	}
+}
+
+func futexWakeAll(_ *uint32) {
+}
@@ -0,0 +1,64 @@
+package persistent
+
+import (
+	"sync/atomic"
+)
+
+// Switches the subscriber into explicit acknowledgement mode (at-least-once). Pulls advance a process-local cursor
+// while the persisted subscriber position (the committed one) only moves on AckBySubId or CommitBySubId; after a
+// restart the subscriber resumes from the last committed position, re-reading anything pulled but not acknowledged.
+func (s *MmapStream) AckModeBySubId(subId int) {
+	if atomic.CompareAndSwapUint32(&s.subAckMode[subId], 0, 1) {
+		atomic.StoreUint64(&s.subCursor[subId], atomic.LoadUint64(&s.descriptor.SubRPos[subId]))
+	}
+}
+
+// Switches the subscriber back to pulls persisting its position, it continues from the committed position (what was
+// pulled but not acknowledged is read again). Consume does it, as a slot given to another subscriber.
+func (s *MmapStream) NoAckModeBySubId(subId int) {
+	atomic.StoreUint32(&s.subAckMode[subId], 0)
+}
+
+func (s *MmapStream) IsAckModeBySubId(subId int) bool {
+	return atomic.LoadUint32(&s.subAckMode[subId]) != 0
+}
+
+// Acknowledges the element at absPos (and all the previous ones), the committed position moves right after it. It
+// never moves the committed position backwards nor beyond the pulled ones.
+func (s *MmapStream) AckBySubId(subId int, absPos uint64) {
+	_, nextAbsPos, ok := s.PeekBySubId(subId, absPos)
+	if !ok {
+		return
+	}
+	if cursor := atomic.LoadUint64(&s.subCursor[subId]); nextAbsPos > cursor {
+		nextAbsPos = cursor
+	}
+	s.commitUpTo(subId, nextAbsPos)
+}
+
+// Acknowledges all the elements pulled so far.
+func (s *MmapStream) CommitBySubId(subId int) {
+	s.commitUpTo(subId, atomic.LoadUint64(&s.subCursor[subId]))
+}
+
+// Position of the next element to be pulled by the subscriber, in ack mode it can be ahead of the committed one.
+func (s *MmapStream) CursorBySubId(subId int) uint64 {
+	return atomic.LoadUint64(s.subReadPosPtr(subId))
+}
+
+func (s *MmapStream) commitUpTo(subId int, absPos uint64) {
+	for {
+		committed := atomic.LoadUint64(&s.descriptor.SubRPos[subId])
+		if absPos <= committed || atomic.CompareAndSwapUint64(&s.descriptor.SubRPos[subId], committed, absPos) {
+			return
+		}
+	}
+}
+
+// the read position pulls advance: the process-local cursor in ack mode, the persisted one otherwise
+func (s *MmapStream) subReadPosPtr(subId int) *uint64 {
+	if atomic.LoadUint32(&s.subAckMode[subId]) != 0 {
+		return &s.subCursor[subId]
+	}
+	return &s.descriptor.SubRPos[subId]
+}
@@ -0,0 +1,66 @@
+package persistent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// Whole part access for replication bulk-sync (advanced: don't use). A part is sealed once the writer moved beyond it,
+// its contents won't change and it can be shipped as it is; offsets are relative to the part body (no header).
+
+// Parts before this one are sealed, this is the part the writer is at.
+func (s *MmapStream) SealedParts() uint64 {
+	return atomic.LoadUint64(&s.descriptor.Write) / s.descriptor.PartSize
+}
+
+// Reads the sealed part body from ofs, returns the bytes read (fewer at the end of the part).
+func (s *MmapStream) ReadPartAt(partNo, ofs uint64, p []byte) (n int, err error) {
+	if partNo < s.GetFirstPart() || partNo >= s.SealedParts() {
+		return 0, errors.New(fmt.Sprintf("part %v is not available or not sealed", partNo))
+	}
+	if ofs >= s.descriptor.PartSize {
+		return 0, nil
+	}
+	if left := s.descriptor.PartSize - ofs; uint64(len(p)) > left {
+		p = p[0:left]
+	}
+	f, err := os.Open(s.partFilename(partNo))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.ReadAt(p, int64(mmapPartHeaderSize)+int64(ofs))
+}
+
+// Writes a chunk of a part body as received from the origin, creating the part file if it does not exist.
+func (s *MmapStream) WritePartAt(partNo, ofs uint64, p []byte) error {
+	if ofs+uint64(len(p)) > s.descriptor.PartSize {
+		return errors.New("chunk goes beyond the part size")
+	}
+	s.partLClock.Lock()
+	if _, err := os.Stat(s.partFilename(partNo)); os.IsNotExist(err) {
+		if err = createMmapPart(s.baseFilename, s.descriptor.UniqId, partNo, s.descriptor.PartSize); err != nil {
+			s.partLClock.Unlock()
+			return err
+		}
+	}
+	if atomic.LoadUint64(&s.descriptor.PartsCount) <= partNo {
+		atomic.StoreUint64(&s.descriptor.PartsCount, partNo+1)
+	}
+	s.partLClock.Unlock()
+	f, err := os.OpenFile(s.partFilename(partNo), os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteAt(p, int64(mmapPartHeaderSize)+int64(ofs)); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *MmapStream) partFilename(partNo uint64) string {
+	return s.baseFilename + fmt.Sprintf(".%05x", partNo)
+}
@@ -0,0 +1,90 @@
+package persistent
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// Failover. The origin and its replicas are a lineage, identified by the origin UniqId (ReplicaOf). Each of them keeps
+// the epoch of the origin it follows: promoting a replica to origin bumps it, replicas adopt it from the promoted
+// origin and from then on refuse (fence) an origin with an older epoch. Elements a replica got from the old origin
+// after the promotion are not in the new origin history, they are truncated (see Truncate).
+
+func (s *MmapStream) GetEpoch() uint64 {
+	return atomic.LoadUint64(&s.descriptor.Epoch)
+}
+
+func (s *MmapStream) GetEpochStart() uint64 {
+	return atomic.LoadUint64(&s.descriptor.EpochStart)
+}
+
+// Sets the epoch, as adopted from a promoted origin (advanced: don't use, for replication purposes.)
+func (s *MmapStream) SetEpoch(epoch, epochStart uint64) {
+	atomic.StoreUint64(&s.descriptor.EpochStart, epochStart)
+	atomic.StoreUint64(&s.descriptor.Epoch, epoch)
+}
+
+// A replica not promoted, elements are only written by the replication link.
+func (s *MmapStream) IsReplica() bool {
+	return s.descriptor.ReplicaOf != s.descriptor.UniqId && atomic.LoadUint32(&s.descriptor.Promoted) == 0
+}
+
+// Turns the replica into the origin of its lineage, from its current write position on a new epoch starts. It can be
+// written and replicated; replicas of the old origin follow it once it connects to them, the old origin is fenced.
+// The replication link into this replica (if any) should be closed, it is fenced when the old origin sends anything.
+func (s *MmapStream) Promote() (epoch uint64, err error) {
+	if !s.IsReplica() {
+		return s.GetEpoch(), errors.New("only replicas can be promoted")
+	}
+	epoch = s.GetEpoch() + 1
+	s.SetEpoch(epoch, s.WritePos())
+	atomic.StoreUint32(&s.descriptor.Promoted, 1)
+	return epoch, nil
+}
+
+// Marks the origin as superseded by a promoted replica (advanced: don't use, for replication purposes.)
+func (s *MmapStream) Fence() {
+	atomic.StoreUint32(&s.descriptor.Fenced, 1)
+}
+
+func (s *MmapStream) IsFenced() bool {
+	return atomic.LoadUint32(&s.descriptor.Fenced) != 0
+}
+
+// Discards the elements from absPos on, as they were never written (advanced: don't use, for replication purposes.)
+// Their bytes are zeroed, readers wait for the elements written there next. Subscribers and replicas beyond absPos
+// are moved back to it.
+func (s *MmapStream) Truncate(absPos uint64) error {
+	writePos := s.WritePos()
+	partSize := s.descriptor.PartSize
+	if absPos > writePos || absPos < s.GetFirstPart()*partSize {
+		return errors.New(fmt.Sprintf("can not truncate at %v, the stream is in [%v, %v)", absPos, s.GetFirstPart()*partSize, writePos))
+	}
+	zeros := make([]byte, 64*1024)
+	for ofs := absPos; ofs < writePos; {
+		n := (ofs/partSize+1)*partSize - ofs
+		if n > writePos-ofs {
+			n = writePos - ofs
+		}
+		if n > uint64(len(zeros)) {
+			n = uint64(len(zeros))
+		}
+		if err := s.WritePartAt(ofs/partSize, ofs%partSize, zeros[0:n]); err != nil {
+			return err
+		}
+		ofs += n
+	}
+	s.SetWritePos(absPos)
+	for subId := 0; subId < mmapStreamMaxClients; subId++ {
+		if s.ReadSubRPos(subId) > absPos {
+			s.SetSubRPos(subId, absPos)
+		}
+	}
+	for repId := 0; repId < mmapStreamMaxReplicators; repId++ {
+		if s.GetRepHWM(repId) > absPos {
+			s.SetRepHWM(repId, absPos)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+package persistent
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/edsrzf/mmap-go"
+	"github.com/kuking/go-frank/v1/api"
+	"github.com/kuking/go-frank/v1/serialisation"
+	"math"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+const (
+	leaseMemberShift         = 48
+	leaseReserved            = uint64(1) << 47 // claim being filled, reclaimed (not redelivered) if it expires
+	leaseDeadlineMask        = leaseReserved - 1
+	defaultGroupVisibilityMs = 30_000
+	memberLockMs             = 1_000 // a process dying while a member joins holds the others off for up to this long
+)
+
+// Competing consumers over a persistent stream. Each element is claimed by only one member of the group and leased
+// for the visibility time-out; if the claim is not acknowledged by then, it is redelivered to another member. The
+// group state lives in its own memory mapped file so members can be in different processes. Delivery is at-least-once:
+// a member dying in the middle of a claim can produce a duplicate, never a loss.
+type ConsumerGroup struct {
+	stream     *MmapStream
+	filename   string
+	groupMmap  mmap.MMap
+	descriptor *mmapGroupDescriptor
+}
+
+type GroupMember struct {
+	group    *ConsumerGroup
+	name     string
+	memberId int
+	subId    int // used for reading the stream parts
+}
+
+type GroupMemberStats struct {
+	Name        string
+	Claimed     uint64
+	Redelivered uint64
+	Acked       uint64
+	LostLeases  uint64
+	InFlight    int
+	LastSeen    time.Time
+}
+
+// Opens (or creates) the named consumer group for this stream. The visibility time-out is stored in the group, the
+// last one opening the group sets it; zero keeps the current one (or a default of 30s for new groups).
+func (s *MmapStream) ConsumerGroup(groupName string, visibilityTimeout time.Duration) (g *ConsumerGroup, err error) {
+	c := sha512.Sum512_256([]byte(groupName))
+	g = &ConsumerGroup{
+		stream:   s,
+		filename: s.baseFilename + fmt.Sprintf(".g%016x", binary.LittleEndian.Uint64(c[0:8])),
+	}
+	g.groupMmap, err = mmapOpen(g.filename)
+	if err != nil {
+		if err = mmapInit(g.filename, int(unsafe.Sizeof(mmapGroupDescriptor{}))); err != nil {
+			return nil, err
+		}
+		if g.groupMmap, err = mmapOpen(g.filename); err != nil {
+			return nil, err
+		}
+		g.descriptor = (*mmapGroupDescriptor)(unsafe.Pointer(&g.groupMmap[0]))
+		g.descriptor.Version = mmapGroupFileVersion
+		g.descriptor.UniqId = s.descriptor.UniqId
+		g.descriptor.VisibilityMs = defaultGroupVisibilityMs
+		serialisation.ToNTString(g.descriptor.Name[:], groupName)
+	}
+	g.descriptor = (*mmapGroupDescriptor)(unsafe.Pointer(&g.groupMmap[0]))
+	if g.descriptor.UniqId != s.descriptor.UniqId {
+		_ = g.groupMmap.Unmap()
+		return nil, errors.New("consumer group file is from another stream, different ids!")
+	}
+	if g.descriptor.Version != mmapGroupFileVersion {
+		_ = g.groupMmap.Unmap()
+		return nil, errors.New(fmt.Sprintf("consumer group file version %v, expected %v", g.descriptor.Version,
+			mmapGroupFileVersion))
+	}
+	if visibilityTimeout > 0 {
+		atomic.StoreInt64(&g.descriptor.VisibilityMs, visibilityTimeout.Milliseconds())
+	}
+	return g, nil
+}
+
+func (g *ConsumerGroup) Close() error {
+	return g.groupMmap.Unmap()
+}
+
+func (g *ConsumerGroup) Name() string {
+	return serialisation.FromNTString(g.descriptor.Name[:])
+}
+
+// Joins the group as the named member, a member re-joining with the same name takes over its previous statistics. A new
+// member takes the slot of the member gone for longer, once its leases expired; it fails if all the members have
+// claims in flight. Members join one at a time, also across processes (see lockMembers). Each member slot in use takes
+// one of the stream free subscriber slots for reading the parts, they are shared with the named subscribers and the
+// replicators (see SubscriberIdForName): joining fails when there is none left, it never evicts a subscriber.
+func (g *ConsumerGroup) Member(memberName string) (*GroupMember, error) {
+	lock := g.lockMembers()
+	defer g.unlockMembers(lock)
+
+	memberId := -1
+	for i := 0; i < mmapGroupMaxMembers && memberId == -1; i++ {
+		if serialisation.FromNTString(g.descriptor.MemberName[i][:]) == memberName {
+			memberId = i
+		}
+	}
+	joining := memberId == -1
+	if joining {
+		// picks the older member slot, without live leases
+		live := g.liveMembers()
+		olderTime := int64(math.MaxInt64)
+		for i := 0; i < mmapGroupMaxMembers; i++ {
+			if !live[i] && olderTime > atomic.LoadInt64(&g.descriptor.MemberTime[i]) {
+				olderTime = atomic.LoadInt64(&g.descriptor.MemberTime[i])
+				memberId = i
+			}
+		}
+		if memberId == -1 {
+			return nil, errors.New(fmt.Sprintf("all the %v members of the group have claims in flight",
+				mmapGroupMaxMembers))
+		}
+	}
+	subId, ok := g.stream.subscriberIdForName(fmt.Sprintf("%v%v:%v", groupSubscriberPrefix, g.Name(), memberId), false)
+	if !ok {
+		return nil, errors.New("there is no free subscriber slot in the stream for the member")
+	}
+	if joining {
+		serialisation.ToNTString(g.descriptor.MemberName[memberId][:], memberName)
+		atomic.StoreUint64(&g.descriptor.MemberClaimed[memberId], 0)
+		atomic.StoreUint64(&g.descriptor.MemberRedelivered[memberId], 0)
+		atomic.StoreUint64(&g.descriptor.MemberAcked[memberId], 0)
+		atomic.StoreUint64(&g.descriptor.MemberLostLeases[memberId], 0)
+	}
+	atomic.StoreInt64(&g.descriptor.MemberTime[memberId], time.Now().UnixNano())
+	return &GroupMember{
+		group:    g,
+		name:     memberName,
+		memberId: memberId,
+		subId:    subId,
+	}, nil
+}
+
+// takes the group member lock, as the claim leases: a CAS of its deadline in the group file, so it is taken over once
+// it expired if its holder died (it returns the deadline, for unlockMembers)
+func (g *ConsumerGroup) lockMembers() int64 {
+	for {
+		nowMs := time.Now().UnixMilli()
+		lock := atomic.LoadInt64(&g.descriptor.MemberLock)
+		if lock < nowMs && atomic.CompareAndSwapInt64(&g.descriptor.MemberLock, lock, nowMs+memberLockMs) {
+			return nowMs + memberLockMs
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (g *ConsumerGroup) unlockMembers(lock int64) {
+	atomic.CompareAndSwapInt64(&g.descriptor.MemberLock, lock, 0)
+}
+
+// the members holding leases which did not expire yet
+func (g *ConsumerGroup) liveMembers() (live [mmapGroupMaxMembers]bool) {
+	nowMs := uint64(time.Now().UnixMilli())
+	for c := 0; c < mmapGroupMaxInFlight; c++ {
+		lease := atomic.LoadUint64(&g.descriptor.ClaimLease[c])
+		if lease != 0 && lease&leaseDeadlineMask >= nowMs {
+			live[leaseMember(lease)] = true
+		}
+	}
+	return
+}
+
+func (g *ConsumerGroup) Stats() (stats []GroupMemberStats) {
+	stats = make([]GroupMemberStats, 0)
+	for i := 0; i < mmapGroupMaxMembers; i++ {
+		if len(serialisation.FromNTString(g.descriptor.MemberName[i][:])) != 0 {
+			stats = append(stats, g.memberStats(i))
+		}
+	}
+	return
+}
+
+func (g *ConsumerGroup) memberStats(memberId int) GroupMemberStats {
+	inFlight := 0
+	for c := 0; c < mmapGroupMaxInFlight; c++ {
+		if leaseMember(atomic.LoadUint64(&g.descriptor.ClaimLease[c])) == memberId {
+			inFlight++
+		}
+	}
+	return GroupMemberStats{
+		Name:        serialisation.FromNTString(g.descriptor.MemberName[memberId][:]),
+		Claimed:     atomic.LoadUint64(&g.descriptor.MemberClaimed[memberId]),
+		Redelivered: atomic.LoadUint64(&g.descriptor.MemberRedelivered[memberId]),
+		Acked:       atomic.LoadUint64(&g.descriptor.MemberAcked[memberId]),
+		LostLeases:  atomic.LoadUint64(&g.descriptor.MemberLostLeases[memberId]),
+		InFlight:    inFlight,
+		LastSeen:    time.Unix(0, atomic.LoadInt64(&g.descriptor.MemberTime[memberId])),
+	}
+}
+
+// Claims the next element for this member, expired claims of other members are redelivered first. The claim has to be
+// acknowledged with Ack(absPos) before the group visibility time-out, otherwise it will be redelivered. It returns
+// api.PullClosed once the stream is closed, fully claimed and there are no pending claims to be redelivered.
+func (m *GroupMember) Claim(timeOut api.WaitTimeOut, waitDuty api.WaitDuty) (elem interface{}, absPos uint64, result api.PullResult) {
+	g := m.group
+	s := g.stream
+	var totalNsWait int64
+	waitDuty.Reset()
+	atomic.StoreInt64(&g.descriptor.MemberTime[m.memberId], time.Now().UnixNano())
+	for {
+		nowMs := uint64(time.Now().UnixMilli())
+		deadline := nowMs + uint64(atomic.LoadInt64(&g.descriptor.VisibilityMs))
+
+		// redeliveries
+		pending := false
+		for c := 0; c < mmapGroupMaxInFlight; c++ {
+			lease := atomic.LoadUint64(&g.descriptor.ClaimLease[c])
+			if lease == 0 {
+				continue
+			}
+			if lease&leaseReserved != 0 && lease&leaseDeadlineMask < nowMs {
+				// its member died while filling it, before claiming anything with it
+				atomic.CompareAndSwapUint64(&g.descriptor.ClaimLease[c], lease, 0)
+				continue
+			}
+			pending = true
+			if lease&leaseDeadlineMask < nowMs &&
+				atomic.CompareAndSwapUint64(&g.descriptor.ClaimLease[c], lease, m.lease(deadline)) {
+				absPos = atomic.LoadUint64(&g.descriptor.ClaimAbsPos[c])
+				atomic.AddUint64(&g.descriptor.ClaimDeliveries[c], 1)
+				atomic.AddUint64(&g.descriptor.MemberRedelivered[m.memberId], 1)
+				elem, _, _ = s.PeekBySubId(m.subId, absPos)
+				return elem, absPos, api.PullOk
+			}
+		}
+
+		// new claims
+		absPos = atomic.LoadUint64(&g.descriptor.Next)
+		if s.readable(m.subId, absPos, s.WritePos()) {
+			if c := m.reserveClaim(deadline); c >= 0 {
+				var nextAbsPos uint64
+				elem, nextAbsPos = s.readAt(m.subId, absPos)
+				atomic.StoreUint64(&g.descriptor.ClaimAbsPos[c], absPos)
+				atomic.StoreUint64(&g.descriptor.ClaimDeliveries[c], 1)
+				atomic.StoreUint64(&g.descriptor.ClaimLease[c], m.lease(deadline))
+				if atomic.CompareAndSwapUint64(&g.descriptor.Next, absPos, nextAbsPos) {
+					atomic.AddUint64(&g.descriptor.MemberClaimed[m.memberId], 1)
+					return elem, absPos, api.PullOk
+				}
+				// another member claimed it first, if the lease is gone it was (wrongly) redelivered; harmless.
+				atomic.CompareAndSwapUint64(&g.descriptor.ClaimLease[c], m.lease(deadline), 0)
+				continue
+			}
+		} else if s.IsClosed() && !pending {
+			return nil, absPos, api.PullClosed
+		}
+
+		totalNsWait += waitDuty.Loop()
+		if timeOut == api.UntilClosed {
+			// just continue
+		} else if totalNsWait > int64(timeOut) {
+			return nil, absPos, api.PullTimedOut
+		}
+	}
+}
+
+// Acknowledges the claim at absPos, so it won't be redelivered. Returns false if this member does not hold the claim,
+// i.e. its lease expired and it was redelivered to another member.
+func (m *GroupMember) Ack(absPos uint64) bool {
+	g := m.group
+	for c := 0; c < mmapGroupMaxInFlight; c++ {
+		lease := atomic.LoadUint64(&g.descriptor.ClaimLease[c])
+		if leaseMember(lease) == m.memberId && lease&leaseReserved == 0 &&
+			atomic.LoadUint64(&g.descriptor.ClaimAbsPos[c]) == absPos &&
+			atomic.CompareAndSwapUint64(&g.descriptor.ClaimLease[c], lease, 0) {
+			atomic.AddUint64(&g.descriptor.MemberAcked[m.memberId], 1)
+			return true
+		}
+	}
+	atomic.AddUint64(&g.descriptor.MemberLostLeases[m.memberId], 1)
+	return false
+}
+
+func (m *GroupMember) Stats() GroupMemberStats {
+	return m.group.memberStats(m.memberId)
+}
+
+// reserves a free claim slot while it is being filled, -1 if all the claim slots are in use
+func (m *GroupMember) reserveClaim(deadlineMs uint64) int {
+	for c := 0; c < mmapGroupMaxInFlight; c++ {
+		if atomic.CompareAndSwapUint64(&m.group.descriptor.ClaimLease[c], 0, m.lease(deadlineMs)|leaseReserved) {
+			return c
+		}
+	}
+	return -1
+}
+
+func (m *GroupMember) lease(deadlineMs uint64) uint64 {
+	return uint64(m.memberId+1)<<leaseMemberShift | deadlineMs&leaseDeadlineMask
+}
+
+func leaseMember(lease uint64) int {
+	return int(lease>>leaseMemberShift) - 1
+}
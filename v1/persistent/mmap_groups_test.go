@@ -0,0 +1,258 @@
+package persistent
+
+import (
+	"fmt"
+	"github.com/kuking/go-frank/v1/api"
+	"github.com/kuking/go-frank/v1/base"
+	"github.com/kuking/go-frank/v1/serialisation"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConsumerGroup_CompetingMembersAcrossStreams(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	baseName := prefix + "/a-stream"
+	defer cleanup(prefix)
+
+	s1, _ := MmapStreamCreate(baseName, 64*1024, serialisation.ByteArraySerialiser{})
+	s2, _ := MmapStreamOpen(baseName, serialisation.ByteArraySerialiser{}) // as if it were another process
+	for i := 0; i < 5_000; i++ {
+		s1.Feed([]byte(fmt.Sprint(i)))
+	}
+	s1.Close()
+
+	g1, err := s1.ConsumerGroup("workers", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g2, err := s2.ConsumerGroup("workers", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	seen := map[string]int{}
+	var wg sync.WaitGroup
+	members := []*GroupMember{givenMember(g1, "m1", t), givenMember(g2, "m2", t), givenMember(g2, "m3", t)}
+	for _, m := range members {
+		wg.Add(1)
+		go func(m *GroupMember) {
+			defer wg.Done()
+			waitDuty := base.NewDefaultFastSpinThenWait()
+			for {
+				elem, absPos, result := m.Claim(api.UntilClosed, waitDuty)
+				if result != api.PullOk {
+					return
+				}
+				lock.Lock()
+				seen[string(elem.([]byte))]++
+				lock.Unlock()
+				if !m.Ack(absPos) {
+					t.Error("it should be able to ack its own claim")
+				}
+			}
+		}(m)
+	}
+	wg.Wait()
+
+	if len(seen) != 5_000 {
+		t.Fatal("all elements should have been claimed, claimed:", len(seen))
+	}
+	for k, v := range seen {
+		if v != 1 {
+			t.Fatal("element", k, "was delivered", v, "times")
+		}
+	}
+	var claimed, acked uint64
+	for _, st := range g1.Stats() {
+		claimed += st.Claimed
+		acked += st.Acked
+		if st.InFlight != 0 || st.Redelivered != 0 {
+			t.Fatal(st)
+		}
+	}
+	if len(g1.Stats()) != 3 || claimed != 5_000 || acked != 5_000 {
+		t.Fatal(g1.Stats())
+	}
+	_ = g1.Close()
+	_ = g2.Close()
+}
+
+func TestConsumerGroup_RedeliversAfterVisibilityTimeOut(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	baseName := prefix + "/a-stream"
+	defer cleanup(prefix)
+
+	s, _ := MmapStreamCreate(baseName, 64*1024, serialisation.ByteArraySerialiser{})
+	s.Feed([]byte("one"))
+	g, _ := s.ConsumerGroup("workers", 50*time.Millisecond)
+	m1 := givenMember(g, "m1", t)
+	m2 := givenMember(g, "m2", t)
+	waitDuty := base.NewDefaultFastSpinThenWait()
+
+	elem, absPos, result := m1.Claim(api.UntilNoMoreData, waitDuty)
+	if result != api.PullOk || string(elem.([]byte)) != "one" {
+		t.Fatal()
+	}
+	if _, _, result = m2.Claim(api.UntilNoMoreData, waitDuty); result != api.PullTimedOut {
+		t.Fatal("nothing to claim while the lease is valid")
+	}
+	s.Close()
+	if _, _, result = m2.Claim(api.UntilNoMoreData, waitDuty); result != api.PullTimedOut {
+		t.Fatal("it should not be closed while there are pending claims")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	elem2, absPos2, result := m2.Claim(api.UntilNoMoreData, waitDuty)
+	if result != api.PullOk || string(elem2.([]byte)) != "one" || absPos2 != absPos {
+		t.Fatal("expired claim should have been redelivered")
+	}
+	if m1.Ack(absPos) {
+		t.Fatal("m1 lease was lost")
+	}
+	if !m2.Ack(absPos2) {
+		t.Fatal()
+	}
+	if _, _, result = m1.Claim(api.UntilNoMoreData, waitDuty); result != api.PullClosed {
+		t.Fatal("closed and fully acknowledged")
+	}
+
+	if st := m1.Stats(); st.Claimed != 1 || st.Acked != 0 || st.LostLeases != 1 {
+		t.Fatal(st)
+	}
+	if st := m2.Stats(); st.Claimed != 0 || st.Redelivered != 1 || st.Acked != 1 {
+		t.Fatal(st)
+	}
+	_ = g.Close()
+	if err := s.Delete(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsumerGroup_ReclaimsExpiredReservations(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer cleanup(prefix)
+	s, _ := MmapStreamCreate(prefix+"/a-stream", 64*1024, serialisation.ByteArraySerialiser{})
+	defer s.CloseFile()
+	s.Feed([]byte("one"))
+	g, _ := s.ConsumerGroup("workers", 50*time.Millisecond)
+	defer g.Close()
+	dead := givenMember(g, "dead", t)
+	m := givenMember(g, "m", t)
+
+	// as if dead died while filling every claim slot
+	for c := 0; c < mmapGroupMaxInFlight; c++ {
+		if dead.reserveClaim(uint64(time.Now().Add(50*time.Millisecond).UnixMilli())) != c {
+			t.Fatal("the slots should be free")
+		}
+	}
+	waitDuty := base.NewDefaultFastSpinThenWait()
+	if _, _, result := m.Claim(api.UntilNoMoreData, waitDuty); result != api.PullTimedOut {
+		t.Fatal("all the claim slots are reserved")
+	}
+	time.Sleep(60 * time.Millisecond)
+	elem, absPos, result := m.Claim(api.UntilNoMoreData, waitDuty)
+	if result != api.PullOk || string(elem.([]byte)) != "one" || !m.Ack(absPos) {
+		t.Fatal("the expired reservations should have been reclaimed", elem, result)
+	}
+	if st := m.Stats(); st.Claimed != 1 || st.Redelivered != 0 {
+		t.Fatal("nothing was claimed with the reservations, it is not a redelivery", st)
+	}
+}
+
+func TestConsumerGroup_DoesNotTakeOverLiveMembers(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer cleanup(prefix)
+	s, _ := MmapStreamCreate(prefix+"/a-stream", 64*1024, serialisation.ByteArraySerialiser{})
+	defer s.CloseFile()
+	for i := 0; i < mmapGroupMaxMembers; i++ {
+		s.Feed([]byte(fmt.Sprint(i)))
+	}
+	g, _ := s.ConsumerGroup("workers", 50*time.Millisecond)
+	defer g.Close()
+	waitDuty := base.NewDefaultFastSpinThenWait()
+	for i := 0; i < mmapGroupMaxMembers; i++ {
+		if _, _, result := givenMember(g, fmt.Sprint("m", i), t).Claim(api.UntilNoMoreData, waitDuty); result != api.PullOk {
+			t.Fatal(result)
+		}
+	}
+	if _, err := g.Member("late"); err == nil {
+		t.Fatal("every member has a claim in flight")
+	}
+	time.Sleep(60 * time.Millisecond)
+	late := givenMember(g, "late", t)
+	if st := late.Stats(); st.Name != "late" || st.Claimed != 0 {
+		t.Fatal("it should take the slot of a member whose leases expired", st)
+	}
+}
+
+func TestConsumerGroup_MembersJoinOneAtATimeAcrossStreams(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	baseName := prefix + "/a-stream"
+	defer cleanup(prefix)
+	s1, _ := MmapStreamCreate(baseName, 64*1024, serialisation.ByteArraySerialiser{})
+	defer s1.CloseFile()
+	s2, _ := MmapStreamOpen(baseName, serialisation.ByteArraySerialiser{}) // as if it were another process
+	defer s2.CloseFile()
+	g1, _ := s1.ConsumerGroup("workers", time.Minute)
+	defer g1.Close()
+	g2, _ := s2.ConsumerGroup("workers", 0)
+	defer g2.Close()
+
+	members := make([]*GroupMember, 32)
+	var wg sync.WaitGroup
+	for i := range members {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			g := g1
+			if i%2 == 1 {
+				g = g2
+			}
+			members[i], _ = g.Member(fmt.Sprint("m", i))
+		}(i)
+	}
+	wg.Wait()
+	taken := map[int]bool{}
+	for i, m := range members {
+		if m == nil || taken[m.memberId] || m.Stats().Name != fmt.Sprint("m", i) {
+			t.Fatal("every member should have its own slot, member", i)
+		}
+		taken[m.memberId] = true
+	}
+	if len(g1.Stats()) != len(members) {
+		t.Fatal(g1.Stats())
+	}
+}
+
+func TestConsumerGroup_MembersDoNotEvictSubscribers(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer cleanup(prefix)
+	s, _ := MmapStreamCreate(prefix+"/a-stream", 64*1024, serialisation.ByteArraySerialiser{})
+	defer s.CloseFile()
+	for i := 0; i < mmapStreamMaxClients-1; i++ {
+		s.SubscriberIdForName(fmt.Sprint("sub-", i))
+	}
+	g, _ := s.ConsumerGroup("workers", time.Minute)
+	defer g.Close()
+	givenMember(g, "m1", t)
+	if _, err := g.Member("m2"); err == nil {
+		t.Fatal("there is no free subscriber slot left for it")
+	}
+	givenMember(g, "m1", t) // re-joining keeps its slot
+	for i := 0; i < mmapStreamMaxClients-1; i++ {
+		if _, ok := s.subscriberIdForName(fmt.Sprint("sub-", i), false); !ok {
+			t.Fatal("the subscribers should still be there")
+		}
+	}
+}
+
+func givenMember(g *ConsumerGroup, name string, t *testing.T) *GroupMember {
+	m, err := g.Member(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
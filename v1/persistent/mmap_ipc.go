@@ -0,0 +1,55 @@
+package persistent
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kuking/go-frank/v1/serialisation"
+	"os"
+	"path"
+	"strings"
+)
+
+// IPC channels are streams living in shared memory (/dev/shm, where there is one) rather than in a file system, so a
+// producer in one process feeds consumers in others through memory alone. Consumers get the lowest latency spinning
+// (ConsumeWaiting with base.NewBusyWait()) at the cost of a CPU each, or they sleep on the stream futex until a
+// producer feeds it (base.NewDefaultNotifyWait). Their parts stay in memory until the channel is deleted.
+
+const ipcShmDir = "/dev/shm"
+
+// Base file name of the channel, as given to MmapStreamOpen.
+func IpcPath(name string) string {
+	dir := os.TempDir()
+	if info, err := os.Stat(ipcShmDir); err == nil && info.IsDir() {
+		dir = ipcShmDir
+	}
+	return path.Join(dir, "frank-ipc-"+name)
+}
+
+func IpcCreate(name string, partSize uint64, serialiser serialisation.StreamSerialiser) (*MmapStream, error) {
+	if err := validIpcName(name); err != nil {
+		return nil, err
+	}
+	return MmapStreamCreate(IpcPath(name), partSize, serialiser)
+}
+
+func IpcOpen(name string, serialiser serialisation.StreamSerialiser) (*MmapStream, error) {
+	if err := validIpcName(name); err != nil {
+		return nil, err
+	}
+	return MmapStreamOpen(IpcPath(name), serialiser)
+}
+
+// Opens the channel, creating it when it does not exist.
+func IpcOpenCreate(name string, partSize uint64, serialiser serialisation.StreamSerialiser) (*MmapStream, error) {
+	if s, err := IpcOpen(name, serialiser); err == nil {
+		return s, nil
+	}
+	return IpcCreate(name, partSize, serialiser)
+}
+
+func validIpcName(name string) error {
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return errors.New(fmt.Sprintf("invalid IPC channel name: %q", name))
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package persistent
+
+import (
+	"fmt"
+	"github.com/kuking/go-frank/v1/api"
+	"github.com/kuking/go-frank/v1/base"
+	"github.com/kuking/go-frank/v1/serialisation"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIpc_ProducerFeedsAnotherInstance(t *testing.T) {
+	name := fmt.Sprintf("test-%x", rand.Uint64())
+	producer, err := IpcCreate(name, 64*1024, &serialisation.ByteArraySerialiser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer producer.Delete()
+	if !strings.Contains(IpcPath(name), name) {
+		t.Fatal(IpcPath(name))
+	}
+
+	// as another process would
+	consumer, err := IpcOpenCreate(name, 64*1024, &serialisation.ByteArraySerialiser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.CloseFile()
+	if consumer.GetUniqId() != producer.GetUniqId() {
+		t.Fatal("it should have opened the existing channel")
+	}
+	received := make(chan string, 1)
+	go func() {
+		subId := consumer.SubscriberIdForName("consumer")
+		waitDuty := base.NewDefaultNotifyWait(consumer.Notifier())
+		for i := 0; i < 10_000; i++ {
+			elem, _, result := consumer.PullBySubId(subId, api.WaitingUpto1s, waitDuty)
+			if result != api.PullOk || string(elem.([]byte)) != fmt.Sprint(i) {
+				received <- fmt.Sprint("unexpected element ", i, " ", result)
+				return
+			}
+		}
+		received <- "all"
+	}()
+	for i := 0; i < 10_000; i++ {
+		producer.Feed([]byte(fmt.Sprint(i)))
+	}
+	select {
+	case res := <-received:
+		if res != "all" {
+			t.Fatal(res)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the consumer should have received everything")
+	}
+}
+
+func TestIpc_Names(t *testing.T) {
+	for _, invalid := range []string{"", "a/b", "../etc", `a\b`} {
+		if _, err := IpcCreate(invalid, 64*1024, &serialisation.ByteArraySerialiser{}); err == nil {
+			t.Fatal("it should be invalid:", invalid)
+		}
+	}
+	if _, err := IpcOpen(fmt.Sprintf("missing-%x", rand.Uint64()), &serialisation.ByteArraySerialiser{}); err == nil {
+		t.Fatal("there is no such channel")
+	}
+}
@@ -0,0 +1,56 @@
+package persistent
+
+import (
+	"github.com/kuking/go-frank/v1/api"
+	"sync/atomic"
+	"time"
+)
+
+// Notifier living in the stream descriptor, so producers in one process can wake up consumers sleeping in another one.
+// It is a futex word where available (linux), otherwise waiters poll the sequence with short sleeps.
+type mmapNotifier struct {
+	stream     *MmapStream
+	descriptor *mmapStreamDescriptor
+}
+
+func (s *MmapStream) Notifier() api.Notifier {
+	return &mmapNotifier{stream: s, descriptor: s.descriptor}
+}
+
+func (s *MmapStream) notify() {
+	wakeAll(&s.descriptor.NotifySeq, &s.descriptor.NotifyWaiters)
+}
+
+func wakeAll(seqAddr, waitersAddr *uint32) {
+	atomic.AddUint32(seqAddr, 1)
+	// a waiter process dying while waiting leaves the counter up, it will only cost a few unneeded wake calls
+	if atomic.LoadUint32(waitersAddr) != 0 {
+		futexWakeAll(seqAddr)
+	}
+}
+
+// waits until the sequence moves from seq, up to timeoutNs
+func waitSeq(seqAddr, waitersAddr *uint32, seq uint32, timeoutNs int64) {
+	atomic.AddUint32(waitersAddr, 1)
+	defer atomic.AddUint32(waitersAddr, ^uint32(0))
+	deadline := time.Now().Add(time.Duration(timeoutNs))
+	for atomic.LoadUint32(seqAddr) == seq {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return
+		}
+		futexWait(seqAddr, seq, left.Nanoseconds())
+	}
+}
+
+func (n *mmapNotifier) Seq() uint32 {
+	return atomic.LoadUint32(&n.descriptor.NotifySeq)
+}
+
+func (n *mmapNotifier) Wait(seq uint32, timeoutNs int64) {
+	waitSeq(&n.descriptor.NotifySeq, &n.descriptor.NotifyWaiters, seq, timeoutNs)
+}
+
+func (n *mmapNotifier) Notify() {
+	n.stream.notify()
+}
@@ -86,6 +86,12 @@ func (mp *mmapPart) WriteEoP(absOfs uint64) {
 	mp.mmap[localOfs] = entryIsEoP
 }
 
+// the part ends at absOfs: there is an end-of-part mark or no room for another element
+func (mp *mmapPart) IsEoP(absOfs uint64) bool {
+	localOfs := mmapPartHeaderSize + int(absOfs%mp.partSize)
+	return uint64(localOfs+entryHeaderSize) > mp.partSize+uint64(mmapPartHeaderSize) || mp.mmap[localOfs] == entryIsEoP
+}
+
 func (mp *mmapPart) ReadAt(absOfs uint64) (elem interface{}, elemLength uint16) {
 	var t0 *time.Time
 	localOfs := mmapPartHeaderSize + int(absOfs%mp.partSize)
@@ -0,0 +1,48 @@
+package persistent
+
+import (
+	"github.com/kuking/go-frank/v1/api"
+	"sync/atomic"
+	"time"
+)
+
+// Synchronous replication: the element is fed as usual, then it waits until at least quorum replicas acknowledged it
+// (their high-water-mark is beyond it). The replicators update the high-water-marks in the descriptor, so the producer
+// can be in another process. On time-out the element stays in the stream, it might still get replicated later.
+// A fenced origin does not take the element, api.ErrFenced.
+func (s *MmapStream) FeedAndWait(elem interface{}, quorum int, timeout time.Duration) error {
+	if s.IsFenced() {
+		return api.ErrFenced
+	}
+	endAbsPos, err := s.feed(elem)
+	if err != nil {
+		return err
+	}
+	return s.WaitForQuorum(endAbsPos, quorum, timeout)
+}
+
+// Waits until at least quorum replicas acknowledged everything before absPos, api.ErrQuorumTimeOut otherwise.
+func (s *MmapStream) WaitForQuorum(absPos uint64, quorum int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		seq := atomic.LoadUint32(&s.descriptor.RepNotifySeq)
+		if s.ReplicasAt(absPos) >= quorum {
+			return nil
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return api.ErrQuorumTimeOut
+		}
+		waitSeq(&s.descriptor.RepNotifySeq, &s.descriptor.RepNotifyWaiters, seq, left.Nanoseconds())
+	}
+}
+
+// How many replicas acknowledged everything before absPos.
+func (s *MmapStream) ReplicasAt(absPos uint64) (n int) {
+	for _, repId := range s.GetReplicatorIds() {
+		if s.GetRepHWM(repId) >= absPos {
+			n++
+		}
+	}
+	return
+}
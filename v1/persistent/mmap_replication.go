@@ -3,14 +3,22 @@ package persistent
 import (
 	"crypto/sha512"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/kuking/go-frank/v1/serialisation"
 	"math"
+	"strings"
 	"sync/atomic"
 	"time"
 )
 
 func (s *MmapStream) SubscriberIdForName(namedSubscriber string) int {
+	subId, _ := s.subscriberIdForName(namedSubscriber, true)
+	return subId
+}
+
+// as SubscriberIdForName, but without evict it only takes a free slot, never another subscriber's (false if none is)
+func (s *MmapStream) subscriberIdForName(namedSubscriber string, evict bool) (int, bool) {
 	s.subIdLock.Lock()
 	defer s.subIdLock.Unlock()
 
@@ -26,31 +34,84 @@ func (s *MmapStream) SubscriberIdForName(namedSubscriber string) int {
 		if subId == subIdForName {
 			s.descriptor.SubTime[i] = time.Now().UnixNano()
 			serialisation.ToNTString(s.descriptor.SubName[i][:], namedSubscriber)
-			return i
+			return i, true
 		}
 	}
 
 	// find a new sloth
-	var possibleSubId int
+	possibleSubId := -1
 	posibleSubTime := int64(math.MaxInt64)
 	for i := 0; i < len(s.descriptor.SubId); i++ {
+		if !evict && s.descriptor.SubName[i][0] != 0 {
+			continue
+		}
 		if posibleSubTime > s.descriptor.SubTime[i] {
 			posibleSubTime = s.descriptor.SubTime[i]
 			possibleSubId = i
 		}
 	}
+	if possibleSubId < 0 {
+		return possibleSubId, false
+	}
 	// picks the older subscriber slot
 	s.descriptor.SubTime[possibleSubId] = time.Now().UnixNano()
 	serialisation.ToNTString(s.descriptor.SubName[possibleSubId][:], namedSubscriber)
 	s.descriptor.SubId[possibleSubId] = subIdForName
-	s.descriptor.SubRPos[possibleSubId] = 0
-	return possibleSubId
+	s.descriptor.SubRPos[possibleSubId] = s.firstAbsPos()
+	atomic.StoreUint32(&s.subAckMode[possibleSubId], 0) // the previous subscriber mode, in this process
+	return possibleSubId, true
+}
+
+const (
+	replicatorSubscriberPrefix = "REPL:"  // see ReplicatorIdForNameHost
+	groupSubscriberPrefix      = "GROUP:" // see ConsumerGroup.Member
+)
+
+// As SubscriberIdForName, for the names peers give (i.e. remote subscribers, or the replicated positions): the names
+// replicators and consumer groups use are refused, as the ones that don't fit in a slot, and no other subscriber is
+// evicted for it; it fails when there is no free slot.
+func (s *MmapStream) PeerSubscriberIdForName(name string) (int, error) {
+	if name == "" || len(name) > len(s.descriptor.SubName[0]) {
+		return -1, errors.New(fmt.Sprintf("invalid subscriber name: %q", name))
+	}
+	if strings.HasPrefix(name, replicatorSubscriberPrefix) || strings.HasPrefix(name, groupSubscriberPrefix) {
+		return -1, errors.New(fmt.Sprintf("reserved subscriber name: %q", name))
+	}
+	subId, ok := s.subscriberIdForName(name, false)
+	if !ok {
+		return -1, errors.New(fmt.Sprintf("no free subscriber slot for %q", name))
+	}
+	return subId, nil
+}
+
+// Committed read positions of the named subscribers, but the replicators ones (which are about this stream replicas).
+func (s *MmapStream) SubscriberPositions() map[string]uint64 {
+	s.subIdLock.Lock()
+	defer s.subIdLock.Unlock()
+	positions := map[string]uint64{}
+	for subId := range s.descriptor.SubName {
+		name := serialisation.FromNTString(s.descriptor.SubName[subId][:])
+		if name != "" && !strings.HasPrefix(name, replicatorSubscriberPrefix) {
+			positions[name] = s.ReadSubRPos(subId)
+		}
+	}
+	return positions
+}
+
+// Sets the named subscriber read position, subscribing it if needed (advanced: don't use, for replication purposes.)
+// Names are taken as in PeerSubscriberIdForName, it returns false when the position was not set.
+func (s *MmapStream) SetSubscriberPosition(name string, absPos uint64) bool {
+	subId, err := s.PeerSubscriberIdForName(name)
+	if err == nil {
+		s.SetSubRPos(subId, absPos)
+	}
+	return err == nil
 }
 
 func (s *MmapStream) GetReplicatorIds() (reps []int) {
 	reps = make([]int, 0)
 	for repId := 0; repId < mmapStreamMaxReplicators; repId++ {
-		if len(serialisation.FromNTString(s.descriptor.SubName[repId][:])) != 0 {
+		if len(serialisation.FromNTString(s.descriptor.RepName[repId][:])) != 0 {
 			reps = append(reps, repId)
 		}
 	}
@@ -67,7 +128,7 @@ func (s *MmapStream) ReplicatorIdForNameHost(name, host string) (repId, subId in
 		}
 	}
 	for repId = 0; repId < mmapStreamMaxReplicators; repId++ {
-		if len(serialisation.FromNTString(s.descriptor.SubName[repId][:])) == 0 {
+		if len(serialisation.FromNTString(s.descriptor.RepName[repId][:])) == 0 {
 			break
 		}
 	}
@@ -93,9 +154,10 @@ func (s *MmapStream) GetRepHWM(repId int) uint64 {
 	return atomic.LoadUint64(&s.descriptor.RepHWMPos[repId])
 }
 
-// Sets Replica HighWaterMark
+// Sets Replica HighWaterMark, waking up the producers waiting for a quorum
 func (s *MmapStream) SetRepHWM(repId int, HWM uint64) {
 	atomic.StoreUint64(&s.descriptor.RepHWMPos[repId], HWM)
+	wakeAll(&s.descriptor.RepNotifySeq, &s.descriptor.RepNotifyWaiters)
 }
 
 // Gets Writer Position
@@ -131,3 +193,8 @@ func (s *MmapStream) GetPartsCount() uint64 {
 func (s *MmapStream) GetFirstPart() uint64 {
 	return atomic.LoadUint64(&s.descriptor.FirstPart)
 }
+
+// Sets the First Part (advanced: don't use, for replication purposes.)
+func (s *MmapStream) SetFirstPart(partNo uint64) {
+	atomic.StoreUint64(&s.descriptor.FirstPart, partNo)
+}
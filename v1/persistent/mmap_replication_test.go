@@ -1,10 +1,15 @@
 package persistent
 
 import (
+	"bytes"
 	"fmt"
+	"github.com/kuking/go-frank/v1/api"
+	"github.com/kuking/go-frank/v1/base"
 	"github.com/kuking/go-frank/v1/serialisation"
 	"io/ioutil"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestMmapStreamSubscriberForID(t *testing.T) {
@@ -73,4 +78,220 @@ func TestMmapStream_GetRepSubIds(t *testing.T) {
 		t.Fatal()
 	}
 
+	repId3, _, created3 := s.ReplicatorIdForNameHost("bye", "a-host")
+	if repId3 == repId || !created3 {
+		t.Fatal("another replicator should get another slot")
+	}
+	if reps := s.GetReplicatorIds(); len(reps) != 2 || reps[0] != repId || reps[1] != repId3 {
+		t.Fatal(reps)
+	}
+
+}
+
+func TestMmapStream_PartsCanBeCopiedWhole(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer cleanup(prefix)
+
+	origin, _ := MmapStreamCreate(prefix+"/origin", 64*1024, serialisation.ByteArraySerialiser{})
+	replica, _ := MmapStreamCreate(prefix+"/replica", 64*1024, serialisation.ByteArraySerialiser{})
+	for i := 0; origin.SealedParts() < 3; i++ {
+		origin.Feed(bytes.Repeat([]byte{byte(i)}, i%1_000))
+	}
+	if _, err := origin.ReadPartAt(3, 0, make([]byte, 10)); err == nil {
+		t.Fatal("the part being written is not sealed, it can not be read whole")
+	}
+
+	// parts 1 and 2, as if 0 had been pruned
+	chunk := make([]byte, 10_000)
+	for partNo := uint64(1); partNo < 3; partNo++ {
+		for ofs := uint64(0); ofs < origin.GetPartSize(); {
+			n, err := origin.ReadPartAt(partNo, ofs, chunk)
+			if err != nil || n == 0 {
+				t.Fatal(n, err)
+			}
+			if err = replica.WritePartAt(partNo, ofs, chunk[0:n]); err != nil {
+				t.Fatal(err)
+			}
+			ofs += uint64(n)
+		}
+	}
+	replica.SetFirstPart(1)
+	replica.SetWritePos(3 * replica.GetPartSize())
+	if replica.GetPartsCount() != 3 {
+		t.Fatal("parts count should follow the written parts, got:", replica.GetPartsCount())
+	}
+
+	subId := replica.SubscriberIdForName("verify")
+	if _, _, ok := replica.PeekBySubId(subId, 0); ok {
+		t.Fatal("nothing before the first part")
+	}
+	absPos := replica.GetPartSize()
+	for {
+		elem, nextAbsPos, ok := replica.PeekBySubId(subId, absPos)
+		if !ok {
+			break
+		}
+		originElem, _, _ := origin.PeekBySubId(subId, absPos)
+		if !bytes.Equal(elem.([]byte), originElem.([]byte)) {
+			t.Fatal("different element at", absPos)
+		}
+		absPos = nextAbsPos
+	}
+	if absPos < 3*replica.GetPartSize()-1_000 {
+		t.Fatal("it should have read up to the end of the copied parts, it stopped at:", absPos)
+	}
+
+	// and it continues where the copied parts end
+	replica.Feed([]byte("next"))
+	if elem, _, ok := replica.PeekBySubId(subId, 3*replica.GetPartSize()); !ok || string(elem.([]byte)) != "next" {
+		t.Fatal()
+	}
+}
+
+func TestMmapStream_FeedAndWaitForQuorum(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer cleanup(prefix)
+
+	s, _ := MmapStreamCreate(prefix+"/a-stream", 64*1024, serialisation.ByteArraySerialiser{})
+	s2, _ := MmapStreamOpen(prefix+"/a-stream", serialisation.ByteArraySerialiser{}) // as if it were another process
+	repA, _, _ := s.ReplicatorIdForNameHost("a", "host-a")
+	repB, _, _ := s.ReplicatorIdForNameHost("b", "host-b")
+
+	if err := s.FeedAndWait([]byte("hello"), 1, 10*time.Millisecond); err != api.ErrQuorumTimeOut {
+		t.Fatal("nobody acknowledged it, err:", err)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		s2.SetRepHWM(repA, s2.WritePos())
+		time.Sleep(20 * time.Millisecond)
+		s2.SetRepHWM(repB, s2.WritePos())
+	}()
+	t0 := time.Now()
+	if err := s.FeedAndWait([]byte("world"), 2, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(t0) < 40*time.Millisecond || s.ReplicasAt(s.WritePos()) != 2 {
+		t.Fatal("it should have waited for both replicas")
+	}
+	if err := s.FeedAndWait([]byte("!"), 0, 0); err != nil {
+		t.Fatal("no quorum, no wait")
+	}
+	if s.ReplicasAt(s.WritePos()) != 0 {
+		t.Fatal()
+	}
+}
+
+func TestMmapStream_PromoteAndTruncate(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer cleanup(prefix)
+
+	origin, _ := MmapStreamCreate(prefix+"/origin", 64*1024, serialisation.ByteArraySerialiser{})
+	replica, _ := MmapStreamCreate(prefix+"/replica", 64*1024, serialisation.ByteArraySerialiser{})
+	replica.SetReplicaOf(origin.GetUniqId())
+	if origin.IsReplica() || !replica.IsReplica() {
+		t.Fatal()
+	}
+	if _, err := origin.Promote(); err == nil {
+		t.Fatal("the origin is not a replica, it can not be promoted")
+	}
+
+	for i := 0; i < 100; i++ {
+		replica.Feed([]byte(fmt.Sprint(i)))
+	}
+	epochStart := replica.WritePos()
+	epoch, err := replica.Promote()
+	if err != nil || epoch != 1 || replica.GetEpoch() != 1 || replica.GetEpochStart() != epochStart || replica.IsReplica() {
+		t.Fatal("it should be an origin at epoch 1 from", epochStart, "err:", err)
+	}
+
+	// elements beyond the promotion point, spanning a few parts, are discarded
+	subId := replica.SubscriberIdForName("sub")
+	repId, _, _ := replica.ReplicatorIdForNameHost("repl", "host")
+	for i := 0; replica.GetPartsCount() < 4; i++ {
+		replica.Feed(bytes.Repeat([]byte{'x'}, 1_000))
+	}
+	replica.SetSubRPos(subId, replica.WritePos())
+	replica.SetRepHWM(repId, replica.WritePos())
+	if err = replica.Truncate(replica.WritePos() + 1); err == nil {
+		t.Fatal("it can not truncate beyond the write position")
+	}
+	if err = replica.Truncate(epochStart); err != nil {
+		t.Fatal(err)
+	}
+	if replica.WritePos() != epochStart || replica.ReadSubRPos(subId) != epochStart || replica.GetRepHWM(repId) != epochStart {
+		t.Fatal("write position, subscribers and replicas should be moved back to", epochStart)
+	}
+	for i := 100; i < 1_000; i++ {
+		replica.Feed([]byte(fmt.Sprint(i)))
+	}
+	verifyId := replica.SubscriberIdForName("verify")
+	for i := 0; i < 1_000; i++ {
+		elem, _, result := replica.PullBySubId(verifyId, api.WaitingUpto10ms, base.NewBusyWait())
+		if result != api.PullOk || string(elem.([]byte)) != fmt.Sprint(i) {
+			t.Fatal("unexpected element", i, result)
+		}
+	}
+
+	if origin.IsFenced() || origin.FeedAndWait([]byte("ok"), 0, 0) != nil {
+		t.Fatal()
+	}
+	origin.Fence()
+	if err = origin.FeedAndWait([]byte("fenced"), 0, 0); err != api.ErrFenced {
+		t.Fatal("a fenced origin should not take elements, err:", err)
+	}
+}
+
+func TestMmapStream_SubscriberPositions(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer cleanup(prefix)
+
+	s, err := MmapStreamCreate(prefix+"/a-stream", 1024*1024, &serialisation.ByteArraySerialiser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		s.Feed([]byte("hello"))
+	}
+	billing := s.SubscriberIdForName("billing")
+	for i := 0; i < 3; i++ {
+		s.PullBySubId(billing, api.WaitingUpto10ms, base.NewBusyWait())
+	}
+	s.ReplicatorIdForNameHost("dr", "10.0.0.2:1234")
+
+	positions := s.SubscriberPositions()
+	if len(positions) != 1 || positions["billing"] != s.ReadSubRPos(billing) || positions["billing"] == 0 {
+		t.Fatal("only the billing subscriber was expected, got:", positions)
+	}
+	s.SetSubscriberPosition("audit", 42)
+	s.SetSubscriberPosition("billing", 0)
+	if s.ReadSubRPos(s.SubscriberIdForName("audit")) != 42 || s.ReadSubRPos(billing) != 0 {
+		t.Fatal("the positions should have been set by name")
+	}
+}
+
+func TestMmapStream_SetSubscriberPositionNeverEvictsReplicators(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer cleanup(prefix)
+
+	s, err := MmapStreamCreate(prefix+"/a-stream", 1024*1024, &serialisation.ByteArraySerialiser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, repSubId, _ := s.ReplicatorIdForNameHost("dr", "10.0.0.2:1234")
+	for i := 0; i < mmapStreamMaxClients; i++ {
+		if i != repSubId && !s.SetSubscriberPosition(fmt.Sprint("sub-", i), 0) {
+			t.Fatal("there should have been a slot for", i)
+		}
+	}
+	if s.SetSubscriberPosition("REPL:dr", 0) || s.SetSubscriberPosition(strings.Repeat("x", 65), 0) {
+		t.Fatal("replicator names and names that don't fit should be skipped")
+	}
+	s.SetSubRPos(repSubId, 7)
+	for i := 0; i < 2*mmapStreamMaxClients; i++ {
+		s.SetSubscriberPosition(fmt.Sprint("more-", i), 0)
+	}
+	if name := serialisation.FromNTString(s.descriptor.SubName[repSubId][:]); name != "REPL:dr" ||
+		s.ReadSubRPos(repSubId) != 7 {
+		t.Fatal("the replicator slot should not have been evicted, got:", name)
+	}
 }
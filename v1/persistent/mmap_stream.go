@@ -27,6 +27,8 @@ type MmapStream struct {
 	writerPart     *mmapPart                       // writer mmpart
 	partLClock     sync.Mutex                      // lock only used when loading parts or creating to avoid races on create/load
 	subIdLock      sync.Mutex                      // lock used to allocate unique subId
+	subAckMode     [mmapStreamMaxClients]uint32    // subscribers in explicit acknowledgement mode (see mmap_acks.go)
+	subCursor      [mmapStreamMaxClients]uint64    // process-local read position for subscribers in ack mode
 }
 
 func MmapStreamCreate(baseFilename string, partSize uint64, serialiser serialisation.StreamSerialiser) (s *MmapStream, err error) {
@@ -99,6 +101,11 @@ func (s *MmapStream) Delete() error {
 	if err != nil {
 		return err
 	}
+	groupFiles, err := filepath.Glob(s.baseFilename + ".g????????????????")
+	if err != nil {
+		return err
+	}
+	files = append(files, groupFiles...)
 	for _, file := range files {
 		if err := os.Remove(file); err != nil {
 			return err
@@ -160,10 +167,15 @@ func (s *MmapStream) resolvePart(subId int, partNo uint64) *mmapPart {
 }
 
 func (s *MmapStream) Feed(elem interface{}) {
+	_, _ = s.feed(elem)
+}
+
+// appends elem, returns the position after it (what the write position is once it is written)
+func (s *MmapStream) feed(elem interface{}) (endAbsPos uint64, err error) {
 	encodedSize, err := s.serialiser.EncodedSize(elem)
 	if err != nil {
 		log.Println("error retrieving encoded size, won't recover from this probably, err:", err)
-		return
+		return 0, err
 	}
 	encodedSizePlusHeader := int(encodedSize) + entryHeaderSize
 	for i := 0; ; i++ {
@@ -186,7 +198,8 @@ func (s *MmapStream) Feed(elem interface{}) {
 			}
 			mp := s.resolvePart(-1, partNo)
 			mp.WriteAt(ofsWrite, elem, encodedSize)
-			return
+			s.notify()
+			return newOfsWrite, nil
 		}
 		runtime.Gosched()
 		time.Sleep(time.Duration(i) * time.Nanosecond) // notice nanos vs micros
@@ -194,44 +207,76 @@ func (s *MmapStream) Feed(elem interface{}) {
 }
 
 // TODO: this could return an []byte pointer to the mmap, so no copy;
-// TODO: needs to differentiate between timeout and closed stream, to different things
-func (s *MmapStream) PullBySubId(subId int, timeOut api.WaitTimeOut, waitDuty api.WaitDuty) (elem interface{}, readAbsPos uint64, closed bool) {
+func (s *MmapStream) PullBySubId(subId int, timeOut api.WaitTimeOut, waitDuty api.WaitDuty) (elem interface{}, readAbsPos uint64, result api.PullResult) {
 	var totalNsWait int64
 	waitDuty.Reset()
+	rPos := s.subReadPosPtr(subId)
 	for i := 0; ; i++ {
-		readAbsPos = atomic.LoadUint64(&s.descriptor.SubRPos[subId])
+		readAbsPos = atomic.LoadUint64(rPos)
+		if firstAbsPos := s.firstAbsPos(); readAbsPos < firstAbsPos {
+			atomic.CompareAndSwapUint64(rPos, readAbsPos, firstAbsPos) // pruned, or a replica bulk-synced past it
+			continue
+		}
 		ofsWrite := atomic.LoadUint64(&s.descriptor.Write)
-		if readAbsPos < ofsWrite {
-			var ofsNewRead uint64
-			partNo := readAbsPos / s.descriptor.PartSize
-			part := s.resolvePart(subId, partNo)
-			value, length := part.ReadAt(readAbsPos)
-			if length == math.MaxUint16 {
-				partNo++
-				endSlack := s.descriptor.PartSize - (readAbsPos % s.descriptor.PartSize)
-				part = s.resolvePart(subId, partNo)
-				value, length = part.ReadAt(readAbsPos + endSlack)
-				ofsNewRead = readAbsPos + endSlack + uint64(entryHeaderSize) + uint64(length)
-			} else {
-				ofsNewRead = readAbsPos + uint64(entryHeaderSize) + uint64(length)
-			}
-			if atomic.CompareAndSwapUint64(&s.descriptor.SubRPos[subId], readAbsPos, ofsNewRead) {
-				return value, readAbsPos, false
+		if s.readable(subId, readAbsPos, ofsWrite) {
+			value, ofsNewRead := s.readAt(subId, readAbsPos)
+			if atomic.CompareAndSwapUint64(rPos, readAbsPos, ofsNewRead) {
+				return value, readAbsPos, api.PullOk
 			}
 		} else if s.IsClosed() {
-			return nil, readAbsPos, true
+			return nil, readAbsPos, api.PullClosed
 		}
 		totalNsWait += waitDuty.Loop()
 		if timeOut == api.UntilClosed {
 			// just continue
 		} else if totalNsWait > int64(timeOut) {
-			return nil, readAbsPos, true
+			return nil, readAbsPos, api.PullTimedOut
 		}
 	}
 }
 
+// Random access read of the element at absPos, without moving the subscriber read position. The subscriber' part is
+// used for reading, so it should be called from the same goroutine consuming the subscriber. Returns ok=false if absPos
+// is not yet written or it is before the first available part.
+func (s *MmapStream) PeekBySubId(subId int, absPos uint64) (elem interface{}, nextAbsPos uint64, ok bool) {
+	if !s.readable(subId, absPos, atomic.LoadUint64(&s.descriptor.Write)) || absPos < s.firstAbsPos() {
+		return nil, absPos, false
+	}
+	elem, nextAbsPos = s.readAt(subId, absPos)
+	return elem, nextAbsPos, true
+}
+
+// there is an element at absPos: it is before the write position and, when the write position is just at the start of
+// a part (i.e. a replica after bulk-syncing parts), absPos is not the end of the previous one
+func (s *MmapStream) readable(subId int, absPos, ofsWrite uint64) bool {
+	if absPos >= ofsWrite {
+		return false
+	}
+	partSize := s.descriptor.PartSize
+	if ofsWrite%partSize != 0 || absPos/partSize != ofsWrite/partSize-1 {
+		return true
+	}
+	return !s.resolvePart(subId, absPos/partSize).IsEoP(absPos)
+}
+
+// reads the element at absPos (jumping over the end-of-part slack if required) and returns the position of the
+// following element, absPos should be lower than the write position
+func (s *MmapStream) readAt(subId int, absPos uint64) (elem interface{}, nextAbsPos uint64) {
+	partNo := absPos / s.descriptor.PartSize
+	part := s.resolvePart(subId, partNo)
+	value, length := part.ReadAt(absPos)
+	if length == math.MaxUint16 {
+		partNo++
+		absPos += s.descriptor.PartSize - (absPos % s.descriptor.PartSize)
+		part = s.resolvePart(subId, partNo)
+		value, length = part.ReadAt(absPos)
+	}
+	return value, absPos + uint64(entryHeaderSize) + uint64(length)
+}
+
 func (s *MmapStream) Close() {
 	atomic.StoreUint32(&s.descriptor.Closed, 1)
+	s.notify()
 }
 
 func (s *MmapStream) IsClosed() bool {
@@ -239,6 +284,31 @@ func (s *MmapStream) IsClosed() bool {
 }
 
 func (s *MmapStream) Reset(subId int) uint64 {
-	atomic.StoreUint64(&s.descriptor.SubRPos[subId], 0) //XXX: fix when prune is implemented
-	return 0
+	firstAbsPos := s.firstAbsPos()
+	atomic.StoreUint64(&s.descriptor.SubRPos[subId], firstAbsPos)
+	atomic.StoreUint64(&s.subCursor[subId], firstAbsPos)
+	return firstAbsPos
+}
+
+// the position of the first element available, the start of the first part
+func (s *MmapStream) firstAbsPos() uint64 {
+	return atomic.LoadUint64(&s.descriptor.FirstPart) * s.descriptor.PartSize
+}
+
+// Position to replay the elements fed since t from: the start of the part before the oldest one modified since then (or
+// before the one the writer is at). Parts are as precise as their files modification times, so it might replay up to a
+// part of elements fed before t.
+func (s *MmapStream) PositionSince(t time.Time) uint64 {
+	firstPart, sealedParts := s.GetFirstPart(), s.SealedParts()
+	partNo := sealedParts
+	for p := firstPart; p < sealedParts; p++ {
+		if info, err := os.Stat(s.partFilename(p)); err == nil && !info.ModTime().Before(t) {
+			partNo = p
+			break
+		}
+	}
+	if partNo > firstPart {
+		partNo--
+	}
+	return partNo * s.descriptor.PartSize
 }
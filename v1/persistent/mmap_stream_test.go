@@ -2,6 +2,7 @@ package persistent
 
 import (
 	"fmt"
+	"github.com/kuking/go-frank/v1/api"
 	"github.com/kuking/go-frank/v1/base"
 	"github.com/kuking/go-frank/v1/serialisation"
 	"io/ioutil"
@@ -94,3 +95,103 @@ func cleanup(prefix string) {
 		fmt.Println(err)
 	}
 }
+
+func TestMmapNotifierAcrossOpenStreams(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	baseName := prefix + "/a-stream"
+	defer cleanup(prefix)
+
+	producer, _ := MmapStreamCreate(baseName, 64*1024, serialisation.ByteArraySerialiser{})
+	consumer, _ := MmapStreamOpen(baseName, serialisation.ByteArraySerialiser{}) // as if it were another process
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		producer.Feed([]byte("hello"))
+	}()
+
+	notifier := consumer.Notifier()
+	t0 := time.Now()
+	elem, _, _ := consumer.PullBySubId(0, api.UntilClosed, base.NewNotifyWait(notifier, 10, 10_000_000_000))
+	if string(elem.([]byte)) != "hello" {
+		t.Fatal()
+	}
+	if td := time.Since(t0); td > 5*time.Second {
+		t.Fatal("it should have been woken up by the producer", td)
+	}
+
+	seq := notifier.Seq()
+	t0 = time.Now()
+	notifier.Wait(seq, 20_000_000)
+	if td := time.Since(t0); td < 20*time.Millisecond {
+		t.Fatal("nothing was notified, it should have waited", td)
+	}
+	producer.Close()
+	notifier.Wait(seq, 10_000_000_000)
+	if notifier.Seq() == seq {
+		t.Fatal("closing should notify")
+	}
+}
+
+func TestMmapStream_PositionSince(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer cleanup(prefix)
+	s, _ := MmapStreamCreate(prefix+"/a-stream", 64*1024, serialisation.ByteArraySerialiser{})
+	defer s.CloseFile()
+	for i := 0; i < 500; i++ {
+		s.Feed(make([]byte, 1_000))
+	}
+	if pos := s.PositionSince(time.Now().Add(-time.Hour)); pos != 0 {
+		t.Fatal("everything was fed since", pos)
+	}
+	time.Sleep(50 * time.Millisecond)
+	since := time.Now()
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 100; i++ {
+		s.Feed([]byte("after"))
+	}
+
+	pos := s.PositionSince(since)
+	if pos == 0 || pos%s.GetPartSize() != 0 {
+		t.Fatal("it should skip the parts before", pos)
+	}
+	after := 0
+	for elem, next, ok := s.PeekBySubId(0, pos); ok; elem, next, ok = s.PeekBySubId(0, next) {
+		if string(elem.([]byte)) == "after" {
+			after++
+		}
+	}
+	if after != 100 {
+		t.Fatal("it should replay everything fed since, replayed:", after)
+	}
+}
+
+func TestMmapStream_SubscribersStartAtTheFirstPart(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer cleanup(prefix)
+	s, _ := MmapStreamCreate(prefix+"/a-stream", 64*1024, serialisation.ByteArraySerialiser{})
+	defer s.CloseFile()
+	for i := 0; s.SealedParts() < 3; i++ {
+		s.Feed([]byte(fmt.Sprint(i)))
+	}
+	stale := s.SubscriberIdForName("stale") // subscribed before the parts were gone
+	// as a replica bulk-synced from the third part
+	s.SetFirstPart(2)
+	for partNo := uint64(0); partNo < 2; partNo++ {
+		_ = os.Remove(s.partFilename(partNo))
+	}
+	first, _, _ := s.PeekBySubId(0, 2*s.GetPartSize())
+
+	consumer := s.Consume("new")
+	if elem, _ := consumer.PullEx(); string(elem.([]byte)) != string(first.([]byte)) {
+		t.Fatal("it should start at the first part, got:", elem)
+	}
+	if pos := consumer.Reset(); pos != 2*s.GetPartSize() {
+		t.Fatal("it should reset to the first part, got:", pos)
+	}
+	if elem, _ := consumer.PullEx(); string(elem.([]byte)) != string(first.([]byte)) {
+		t.Fatal("it should start at the first part after a reset, got:", elem)
+	}
+	if elem, absPos, _ := s.PullBySubId(stale, api.UntilNoMoreData, base.NewBusyWait()); absPos != 2*s.GetPartSize() ||
+		string(elem.([]byte)) != string(first.([]byte)) {
+		t.Fatal("it should skip to the first part, got:", elem, absPos)
+	}
+}
@@ -18,6 +18,11 @@ const (
 	entryIsEoP      byte = 0x11
 	entryIsValid    byte = 0x22
 	entrySkip       byte = 0x33 // mark as 'this will never be complete' after certain timeout
+
+	// Consumer groups
+	mmapGroupFileVersion uint64 = 2
+	mmapGroupMaxMembers  int    = 64
+	mmapGroupMaxInFlight int    = 1024
 )
 
 // Descriptor file structure
@@ -42,6 +47,20 @@ type mmapStreamDescriptor struct {
 	RepHWMPos [mmapStreamMaxReplicators]uint64    // high-water-mark for replica
 	RepName   [mmapStreamMaxReplicators][64]byte  // replicator-name
 	RepHost   [mmapStreamMaxReplicators][128]byte // last known host
+
+	// cross-process new data notification, futex words (see mmap_notify.go)
+	NotifySeq     uint32
+	NotifyWaiters uint32
+
+	// cross-process replica high-water-mark updates notification, for FeedAndWait
+	RepNotifySeq     uint32
+	RepNotifyWaiters uint32
+
+	// failover (see mmap_failover.go)
+	Epoch      uint64 // bumped every time a replica of the lineage is promoted to origin
+	EpochStart uint64 // write position when the epoch started, the promoted replica had everything before it
+	Promoted   uint32 // a replica promoted to origin
+	Fenced     uint32 // an origin superseded by a promoted replica
 }
 
 // Part File header structure
@@ -53,3 +72,27 @@ type mmapPartFileDescriptor struct {
 	// IndexOfs[0] is the first element in the part file, IndexOfs[mmapPartIndexesSize-1] is the last one.
 	// the ones in between are spread equally.
 }
+
+// Consumer group file structure, one file per group.
+// A claim lease is: (member index + 1) << 48 | lease deadline in unix millis; zero meaning the claim slot is free.
+type mmapGroupDescriptor struct {
+	Version      uint64
+	UniqId       uint64 // same as the stream descriptor
+	Next         uint64 // next position to be claimed by the group
+	VisibilityMs int64  // how long a claim is leased before it is redelivered to another member
+	MemberLock   int64  // unix ms until which a member is joining, see ConsumerGroup.Member
+	Name         [64]byte
+
+	// 64 members
+	MemberName        [mmapGroupMaxMembers][64]byte
+	MemberTime        [mmapGroupMaxMembers]int64 // last time a member was active
+	MemberClaimed     [mmapGroupMaxMembers]uint64
+	MemberRedelivered [mmapGroupMaxMembers]uint64 // claims taken over after another member' lease expired
+	MemberAcked       [mmapGroupMaxMembers]uint64
+	MemberLostLeases  [mmapGroupMaxMembers]uint64 // acks arriving after the claim was redelivered
+
+	// in-flight claims
+	ClaimLease      [mmapGroupMaxInFlight]uint64
+	ClaimAbsPos     [mmapGroupMaxInFlight]uint64
+	ClaimDeliveries [mmapGroupMaxInFlight]uint64
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/kuking/go-frank/v1/api"
 	"github.com/kuking/go-frank/v1/base"
 	"github.com/kuking/go-frank/v1/serialisation"
+	"time"
 )
 
 func OpenCreatePersistentStream(basePath string, partSize uint64, serialiser serialisation.StreamSerialiser) (ps api.PersistentStream, err error) {
@@ -17,21 +18,63 @@ func OpenCreatePersistentStream(basePath string, partSize uint64, serialiser ser
 }
 
 func (s *MmapStream) Consume(subscriberName string) api.Stream {
-	waitDuty := base.NewDefaultFastSpinThenWait()
+	return s.ConsumeWaiting(subscriberName, base.NewDefaultFastSpinThenWait())
+}
+
+// As Consume, waiting for new elements with the given duty: i.e. base.NewBusyWait() for the lowest latency, or
+// base.NewDefaultNotifyWait(s.Notifier()) to sleep until a producer (in any process) feeds the stream.
+func (s *MmapStream) ConsumeWaiting(subscriberName string, waitDuty api.WaitDuty) api.Stream {
 	subId := s.SubscriberIdForName(subscriberName)
+	s.NoAckModeBySubId(subId) // i.e. it was consumed with ConsumeAcked before
 	provider := &mmapStreamProviderForSubscriber{
 		subId:       subId,
 		waitTimeOut: api.UntilNoMoreData,
 		waitDuty:    waitDuty,
 		mmapStream:  s,
 	}
-	pullFn := func() (read interface{}, closed bool) {
-		read, _, closed = s.PullBySubId(subId, provider.waitTimeOut, provider.waitDuty)
+	pullFn := func() (read interface{}, result api.PullResult) {
+		read, _, result = s.PullBySubId(subId, provider.waitTimeOut, provider.waitDuty)
 		return
 	}
 	return base.NewStreamImpl(provider, pullFn)
 }
 
+// See api.PersistentStream, auto-commit happens on Pull: a subscriber which stops pulling keeps its last elements
+// uncommitted until it pulls again, acknowledges or commits them.
+func (s *MmapStream) ConsumeAcked(subscriberName string, autoCommit time.Duration) api.AckStream {
+	subId := s.SubscriberIdForName(subscriberName)
+	s.AckModeBySubId(subId)
+	provider := &mmapStreamProviderForSubscriber{
+		subId:       subId,
+		waitTimeOut: api.UntilNoMoreData,
+		waitDuty:    base.NewDefaultFastSpinThenWait(),
+		mmapStream:  s,
+		autoCommit:  autoCommit,
+		lastCommit:  time.Now(),
+	}
+	return &mmapAckStream{
+		StreamImpl: base.NewStreamImpl(provider, provider.Pull),
+		provider:   provider,
+	}
+}
+
+type mmapAckStream struct {
+	*base.StreamImpl
+	provider *mmapStreamProviderForSubscriber
+}
+
+func (as *mmapAckStream) PulledAbsPos() uint64 {
+	return as.provider.pulledAbsPos
+}
+
+func (as *mmapAckStream) Ack(absPos uint64) {
+	as.provider.mmapStream.AckBySubId(as.provider.subId, absPos)
+}
+
+func (as *mmapAckStream) Commit() {
+	as.provider.mmapStream.CommitBySubId(as.provider.subId)
+}
+
 // FIXME
 func (s *MmapStream) Publish(uri string) {
 	base.LocalRegistry.Register(uri, s)
@@ -42,6 +85,10 @@ type mmapStreamProviderForSubscriber struct {
 	waitTimeOut api.WaitTimeOut
 	waitDuty    api.WaitDuty
 	mmapStream  *MmapStream
+	// ack mode only
+	autoCommit   time.Duration
+	lastCommit   time.Time
+	pulledAbsPos uint64
 }
 
 func (ms *mmapStreamProviderForSubscriber) Feed(elem interface{}) {
@@ -55,8 +102,17 @@ func (ms *mmapStreamProviderForSubscriber) IsClosed() bool {
 	return ms.mmapStream.IsClosed()
 }
 
-func (ms *mmapStreamProviderForSubscriber) Pull() (elem interface{}, closed bool) {
-	elem, _, closed = ms.mmapStream.PullBySubId(ms.subId, ms.waitTimeOut, ms.waitDuty)
+func (ms *mmapStreamProviderForSubscriber) Pull() (elem interface{}, result api.PullResult) {
+	if ms.autoCommit > 0 && time.Since(ms.lastCommit) >= ms.autoCommit {
+		// asking for the next element implies the previously pulled ones have been processed
+		ms.mmapStream.CommitBySubId(ms.subId)
+		ms.lastCommit = time.Now()
+	}
+	var absPos uint64
+	elem, absPos, result = ms.mmapStream.PullBySubId(ms.subId, ms.waitTimeOut, ms.waitDuty)
+	if result == api.PullOk {
+		ms.pulledAbsPos = absPos
+	}
 	return
 }
 
@@ -65,18 +121,16 @@ func (ms *mmapStreamProviderForSubscriber) Reset() uint64 {
 }
 
 func (ms *mmapStreamProviderForSubscriber) CurrAbsPos() uint64 {
-	//XXX: implement
-	return 0
+	return ms.mmapStream.CursorBySubId(ms.subId)
 }
 
 func (ms *mmapStreamProviderForSubscriber) PeekLimit() uint64 {
-	//XXX: implement
-	return 0
+	return ms.mmapStream.WritePos()
 }
 
 func (ms *mmapStreamProviderForSubscriber) Peek(absPos uint64) interface{} {
-	//XXX: implement
-	return nil
+	elem, _, _ := ms.mmapStream.PeekBySubId(ms.subId, absPos)
+	return elem
 }
 
 func (ms *mmapStreamProviderForSubscriber) WaitTimeOut(waitTimeOut api.WaitTimeOut) {
@@ -86,3 +140,7 @@ func (ms *mmapStreamProviderForSubscriber) WaitTimeOut(waitTimeOut api.WaitTimeO
 func (ms *mmapStreamProviderForSubscriber) WaitDuty(waitDuty api.WaitDuty) {
 	ms.waitDuty = waitDuty
 }
+
+func (ms *mmapStreamProviderForSubscriber) Notifier() api.Notifier {
+	return ms.mmapStream.Notifier()
+}
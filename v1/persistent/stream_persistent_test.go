@@ -116,3 +116,151 @@ func TestPersistentWithZeroLengthElementsWorks(t *testing.T) {
 		t.Fatal()
 	}
 }
+
+func TestPersistentPeekAndPositions(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	base := prefix + "/a-stream"
+	defer cleanup(prefix)
+	p, _ := OpenCreatePersistentStream(base, 64*1024, serialisation.ByteArraySerialiser{})
+
+	s := p.Consume("peeker")
+	if s.CurrAbsPos() != 0 || s.PeekLimit() != 0 || s.Peek(0) != nil {
+		t.Fatal("empty stream should not peek anything")
+	}
+
+	for i := 0; i < 10_000; i++ { // spans a few 64k parts
+		s.Feed(fmt.Sprintf("elem-%v", i))
+	}
+	if s.PeekLimit() != p.(*MmapStream).WritePos() {
+		t.Fatal()
+	}
+	if s.Peek(s.PeekLimit()) != nil {
+		t.Fatal("it should not peek beyond the peek limit")
+	}
+
+	positions := make([]uint64, 0)
+	for i := 0; i < 10_000; i++ {
+		absPos := s.CurrAbsPos()
+		peeked := s.Peek(absPos)
+		pulled := s.Pull().Get()
+		if serialisation.AsString(peeked) != fmt.Sprintf("elem-%v", i) || serialisation.AsString(pulled) != serialisation.AsString(peeked) {
+			t.Fatal(fmt.Sprintf("peeked: %v, pulled: %v, expected: elem-%v", peeked, pulled, i))
+		}
+		positions = append(positions, absPos)
+	}
+
+	// random access into history, already consumed
+	for _, i := range []int{9_999, 0, 5_000, 1} {
+		if serialisation.AsString(s.Peek(positions[i])) != fmt.Sprintf("elem-%v", i) {
+			t.Fatal()
+		}
+	}
+	if s.CurrAbsPos() != s.PeekLimit() {
+		t.Fatal("peeking should not move the subscriber position")
+	}
+}
+
+func TestPersistentPullExTimedOutVsClosed(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	base := prefix + "/a-stream"
+	defer cleanup(prefix)
+	p, _ := OpenCreatePersistentStream(base, 64*1024, serialisation.ByteArraySerialiser{})
+
+	s := p.Consume("lala").TimeOut(api.WaitingUpto1000ns)
+	if _, result := s.PullEx(); result != api.PullTimedOut {
+		t.Fatal("an open quiet stream should time out")
+	}
+	s.Feed("1")
+	if elem, result := s.PullEx(); result != api.PullOk || serialisation.AsString(elem) != "1" {
+		t.Fatal()
+	}
+	p.Close()
+	if _, result := s.PullEx(); result != api.PullClosed {
+		t.Fatal("a closed and consumed stream should be closed")
+	}
+}
+
+func TestPersistentConsumeAcked_ResumesFromLastAck(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	base := prefix + "/a-stream"
+	defer cleanup(prefix)
+	p, _ := OpenCreatePersistentStream(base, 64*1024, serialisation.ByteArraySerialiser{})
+	for i := 0; i < 10; i++ {
+		p.Feed([]byte(fmt.Sprint(i)))
+	}
+
+	s := p.ConsumeAcked("worker", 0)
+	var ackPos uint64
+	for i := 0; i < 5; i++ {
+		if _, result := s.PullEx(); result != api.PullOk {
+			t.Fatal()
+		}
+		if i == 2 {
+			ackPos = s.PulledAbsPos()
+		}
+	}
+	s.Ack(ackPos)
+	_ = p.CloseFile() // as if it crashed while processing the 4th and 5th elements
+
+	p, _ = OpenCreatePersistentStream(base, 64*1024, serialisation.ByteArraySerialiser{})
+	s = p.ConsumeAcked("worker", 0)
+	if elem, _ := s.PullEx(); serialisation.AsString(elem) != "3" {
+		t.Fatal("it should resume after the last acknowledged element, got:", serialisation.AsString(elem))
+	}
+	s.Commit()
+	_ = p.CloseFile()
+
+	p, _ = OpenCreatePersistentStream(base, 64*1024, serialisation.ByteArraySerialiser{})
+	if elem := p.Consume("worker").First().Get(); serialisation.AsString(elem) != "4" {
+		t.Fatal("it should resume after the committed element, got:", serialisation.AsString(elem))
+	}
+	_ = p.CloseFile()
+}
+
+func TestPersistentConsumeAcked_AutoCommit(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	base := prefix + "/a-stream"
+	defer cleanup(prefix)
+	p, _ := OpenCreatePersistentStream(base, 64*1024, serialisation.ByteArraySerialiser{})
+	for i := 0; i < 10; i++ {
+		p.Feed([]byte(fmt.Sprint(i)))
+	}
+
+	s := p.ConsumeAcked("worker", time.Nanosecond)
+	for i := 0; i < 3; i++ {
+		s.PullEx()
+	}
+	_ = p.CloseFile()
+
+	p, _ = OpenCreatePersistentStream(base, 64*1024, serialisation.ByteArraySerialiser{})
+	if elem := p.Consume("worker").First().Get(); serialisation.AsString(elem) != "2" {
+		t.Fatal("pulling commits the previously pulled elements, got:", serialisation.AsString(elem))
+	}
+	_ = p.CloseFile()
+}
+
+func TestPersistentConsumeAcked_ThenConsumeSavesItsPosition(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	base := prefix + "/a-stream"
+	defer cleanup(prefix)
+	p, _ := OpenCreatePersistentStream(base, 64*1024, serialisation.ByteArraySerialiser{})
+	for i := 0; i < 10; i++ {
+		p.Feed([]byte(fmt.Sprint(i)))
+	}
+
+	s := p.ConsumeAcked("worker", 0)
+	s.PullEx()
+	s.Ack(s.PulledAbsPos())
+	s.PullEx()
+	s.PullEx()
+	if elem := p.Consume("worker").First().Get(); serialisation.AsString(elem) != "1" {
+		t.Fatal("it should continue after the acknowledged element, got:", serialisation.AsString(elem))
+	}
+	_ = p.CloseFile()
+
+	p, _ = OpenCreatePersistentStream(base, 64*1024, serialisation.ByteArraySerialiser{})
+	if elem := p.Consume("worker").First().Get(); serialisation.AsString(elem) != "2" {
+		t.Fatal("consuming without acks should save the position, got:", serialisation.AsString(elem))
+	}
+	_ = p.CloseFile()
+}
@@ -13,9 +13,46 @@ type Registry interface {
 	Register(uri string, stream interface{}) error
 	Unregister(uri string)
 	Obtain(uri string) (api.Stream, error)
+	// A stream to publish into, as Obtain unless a sink scheme is registered for the URI scheme
+	ObtainSink(uri string) (api.Stream, error)
+	// The stream registered with the name, as it was registered (i.e. the persistent stream, not a subscription to it)
+	Lookup(name string) (stream interface{}, ok bool)
 	List() []string
 }
 
+var (
+	schemesLock sync.Mutex
+	schemes     = map[string]func(uri string) (api.Stream, error){}
+	sinkSchemes = map[string]func(uri string) (api.Stream, error){}
+)
+
+// Streams of URIs with the scheme are obtained with the function instead of looked up in the registry, i.e. "tcp" (see
+// the remote package, which registers it).
+func RegisterScheme(scheme string, obtain func(uri string) (api.Stream, error)) {
+	schemesLock.Lock()
+	defer schemesLock.Unlock()
+	schemes[scheme] = obtain
+}
+
+// Streams to publish into, of URIs with the scheme, are obtained with the function (see ObtainSink).
+func RegisterSinkScheme(scheme string, sink func(uri string) (api.Stream, error)) {
+	schemesLock.Lock()
+	defer schemesLock.Unlock()
+	sinkSchemes[scheme] = sink
+}
+
+func schemeFor(scheme string) func(uri string) (api.Stream, error) {
+	schemesLock.Lock()
+	defer schemesLock.Unlock()
+	return schemes[scheme]
+}
+
+func sinkSchemeFor(scheme string) func(uri string) (api.Stream, error) {
+	schemesLock.Lock()
+	defer schemesLock.Unlock()
+	return sinkSchemes[scheme]
+}
+
 type InMemoryRegistry struct {
 	lock     sync.Mutex
 	registry map[string]interface{}
@@ -50,8 +87,11 @@ func (i *InMemoryRegistry) Obtain(uri string) (api.Stream, error) {
 	if err != nil {
 		return nil, err
 	}
+	if obtain := schemeFor(URI.Scheme); obtain != nil {
+		return obtain(uri)
+	}
 	name := URI.Path
-	stream, ok := i.registry[name]
+	stream, ok := i.Lookup(name)
 	if !ok {
 		return nil, errors.New(fmt.Sprintf("registry does not have a stream with name: %v", name))
 	}
@@ -70,6 +110,24 @@ func (i *InMemoryRegistry) Obtain(uri string) (api.Stream, error) {
 	}
 }
 
+func (i *InMemoryRegistry) ObtainSink(uri string) (api.Stream, error) {
+	URI, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if sink := sinkSchemeFor(URI.Scheme); sink != nil {
+		return sink(uri)
+	}
+	return i.Obtain(uri)
+}
+
+func (i *InMemoryRegistry) Lookup(name string) (stream interface{}, ok bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	stream, ok = i.registry[name]
+	return
+}
+
 func (i *InMemoryRegistry) List() []string {
 	i.lock.Lock()
 	defer i.lock.Unlock()
@@ -1,6 +1,7 @@
 package registry
 
 import (
+	"github.com/kuking/go-frank/v1/api"
 	"testing"
 )
 
@@ -25,4 +26,40 @@ func TestInMemoryRegistry_Crud(t *testing.T) {
 	}
 }
 
+func TestRegisterScheme(t *testing.T) {
+	imr := NewInMemoryRegistry()
+	obtained := ""
+	RegisterScheme("test+scheme", func(uri string) (api.Stream, error) {
+		obtained = uri
+		return nil, nil
+	})
+	uri := "test+scheme://host:1234/name?sn=a"
+	if _, err := imr.Obtain(uri); err != nil || obtained != uri {
+		t.Fatal("it should be obtained by the scheme", err, obtained)
+	}
+	if _, err := imr.Obtain("other://host:1234/name"); err == nil {
+		t.Fatal("there is no such stream")
+	}
+	_ = imr.Register("name", "a stream")
+	if stream, ok := imr.Lookup("name"); !ok || stream != "a stream" {
+		t.Fatal()
+	}
+}
+
+func TestRegisterSinkScheme(t *testing.T) {
+	imr := NewInMemoryRegistry()
+	sunk := ""
+	RegisterSinkScheme("test+sink", func(uri string) (api.Stream, error) {
+		sunk = uri
+		return nil, nil
+	})
+	uri := "test+sink://host:1234/name"
+	if _, err := imr.ObtainSink(uri); err != nil || sunk != uri {
+		t.Fatal("it should be obtained by the sink scheme", err, sunk)
+	}
+	if _, err := imr.Obtain(uri); err == nil {
+		t.Fatal("it is only a sink scheme")
+	}
+}
+
 // more tests in extra_tests to avoid circular references
@@ -0,0 +1,316 @@
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/kuking/go-frank/v1/api"
+	"github.com/kuking/go-frank/v1/base"
+	"github.com/kuking/go-frank/v1/ringbuffer"
+	"github.com/kuking/go-frank/v1/serialisation"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultBatch     = 256
+	defaultLinger    = 5 * time.Millisecond
+	defaultReconnect = 30 * time.Second
+	maxBatchBytes    = 64 * 1024
+	maxBatchLength   = maxBatchBytes + 2 + math.MaxUint16 // sent once over maxBatchBytes, with up to a 64K element
+	maxInFlight      = 16                                 // batches sent and not acknowledged yet
+)
+
+// Publishes into a stream registered in a Server: tcp://host:port/name, elements are []byte (or string). What is fed
+// into the returned stream is sent in batches of up to batch=n elements (256), or of what was fed during
+// linger=duration (5ms); the server feeds each batch once, in order, and acknowledges it. Unacknowledged batches are
+// resent after redialing a dropped connection, for up to reconnect=duration (30s) before giving up and dropping what
+// is fed. The returned stream is to be fed and closed only, closing it waits until everything fed was acknowledged (or
+// the server refused it, or it gave up).
+func Publish(uri string) (api.Stream, error) {
+	pub, err := parsePublication(uri)
+	if err != nil {
+		return nil, err
+	}
+	buffer := ringbuffer.NewRingBufferProvider(pub.batch*maxInFlight+1, base.NewBusyWait())
+	buffer.WaitDuty(base.NewNotifyWait(buffer.Notifier(), 1_000, pub.linger.Nanoseconds()))
+	buffer.WaitTimeOut(api.WaitTimeOut(pub.linger))
+	pub.StreamProvider = buffer
+	if err = pub.connect(); err != nil {
+		return nil, err
+	}
+	go pub.goFuncSend()
+	return base.NewStreamImpl(pub, buffer.Pull), nil
+}
+
+func parsePublication(uri string) (*publisher, error) {
+	URI, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimPrefix(URI.Path, "/")
+	if URI.Scheme != "tcp" || URI.Host == "" || name == "" {
+		return nil, errors.New(fmt.Sprintf("expected tcp://host:port/name, got: %v", uri))
+	}
+	pub := &publisher{
+		address:    URI.Host,
+		request:    WirePublishMsg{Version: WireVersion, Message: WirePUBLISH, Publisher: rand.Uint64()},
+		batch:      defaultBatch,
+		linger:     defaultLinger,
+		reconnect:  defaultReconnect,
+		serialiser: serialisation.ByteArraySerialiser{},
+		ack:        make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	serialisation.ToNTString(pub.request.Name[:], name)
+	query := URI.Query()
+	if batch := query.Get("batch"); batch != "" {
+		if pub.batch, err = strconv.Atoi(batch); err != nil || pub.batch <= 0 || pub.batch > math.MaxUint16 {
+			return nil, errors.New(fmt.Sprintf("invalid batch: %v", batch))
+		}
+	}
+	if linger := query.Get("linger"); linger != "" {
+		if pub.linger, err = time.ParseDuration(linger); err != nil || pub.linger <= 0 {
+			return nil, errors.New(fmt.Sprintf("invalid linger: %v", linger))
+		}
+	}
+	if reconnect := query.Get("reconnect"); reconnect != "" {
+		if pub.reconnect, err = time.ParseDuration(reconnect); err != nil || pub.reconnect <= 0 {
+			return nil, errors.New(fmt.Sprintf("invalid reconnect: %v", reconnect))
+		}
+	}
+	return pub, nil
+}
+
+type publisher struct {
+	base.StreamProvider // buffering what was fed and not sent yet
+	address             string
+	request             WirePublishMsg
+	batch               int
+	linger              time.Duration
+	reconnect           time.Duration // redialing for, before giving up
+	serialiser          serialisation.StreamSerialiser
+	conn                net.Conn
+	broken              chan struct{} // closed when the connection drops
+	acked               uint64        // last batch acknowledged
+	ack                 chan struct{} // signalled on every WireBATCHACK
+	seq                 uint64        // last batch sent
+	pending             []pendingBatch
+	done                chan struct{} // closed once it stopped sending
+}
+
+// a batch sent and not acknowledged yet
+type pendingBatch struct {
+	seq  uint64
+	data []byte // the WireBatchMsg and the elements, as sent
+}
+
+// dials and announces the publisher, resending what was not acknowledged
+func (p *publisher) connect() error {
+	conn, err := net.Dial("tcp", p.address)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	var published WirePublishedMsg
+	if err = binary.Write(conn, binary.LittleEndian, &p.request); err == nil {
+		var first []byte
+		if first, err = r.Peek(2); err == nil && first[1] == WireERROR {
+			err = readError(r)
+		} else if err == nil {
+			err = binary.Read(r, binary.LittleEndian, &published)
+		}
+	}
+	if err == nil && (published.Version != WireVersion || published.Message != WirePUBLISHED) {
+		err = errors.New(fmt.Sprintf("expected a WirePUBLISHED, got message %v version %v",
+			published.Message, published.Version))
+	}
+	if err == nil && published.LastSeq > atomic.LoadUint64(&p.acked) {
+		atomic.StoreUint64(&p.acked, published.LastSeq)
+	}
+	p.dropAcked()
+	for i := 0; err == nil && i < len(p.pending); i++ {
+		_, err = conn.Write(p.pending[i].data)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	p.conn, p.broken = conn, make(chan struct{})
+	go p.goFuncRecvAcks(r, p.broken)
+	return nil
+}
+
+func (p *publisher) goFuncRecvAcks(r *bufio.Reader, broken chan struct{}) {
+	defer close(broken)
+	for {
+		var ack WireBatchAckMsg
+		if err := binary.Read(r, binary.LittleEndian, &ack); err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("error reading from %v, err: %v\n", p.address, err)
+			}
+			return
+		}
+		if ack.Version != WireVersion || ack.Message != WireBATCHACK {
+			log.Printf("expected a WireBATCHACK from %v, got message %v version %v\n", p.address, ack.Message, ack.Version)
+			return
+		}
+		atomic.StoreUint64(&p.acked, ack.Seq)
+		select {
+		case p.ack <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// batches what is fed, until the stream is closed and everything was acknowledged
+func (p *publisher) goFuncSend() {
+	defer close(p.done)
+	var elements bytes.Buffer
+	var started time.Time
+	count := 0
+	for {
+		elem, result := p.StreamProvider.Pull()
+		var err error
+		if result == api.PullOk {
+			if err := p.append(&elements, elem); err != nil {
+				log.Printf("dropping an element that can not be published to %v, err: %v\n", p.address, err)
+			} else {
+				if count == 0 {
+					started = time.Now()
+				}
+				count++
+			}
+		}
+		if count > 0 && (result != api.PullOk || count >= p.batch || elements.Len() >= maxBatchBytes ||
+			time.Since(started) >= p.linger) {
+			err = p.send(count, elements.Bytes())
+			elements.Reset()
+			count = 0
+		} else if result == api.PullTimedOut {
+			err = p.await(maxInFlight) // resends after a drop while idle
+		}
+		if err == nil && result == api.PullClosed {
+			if err = p.await(0); err == nil {
+				closed := WireClosedMsg{Version: WireVersion, Message: WireCLOSED}
+				_ = binary.Write(p.conn, binary.LittleEndian, &closed)
+				_ = p.conn.Close()
+				return
+			}
+		}
+		if err != nil {
+			log.Printf("publishing to %v failed, dropping what is fed, err: %v\n", p.address, err)
+			_ = p.conn.Close()
+			for result != api.PullClosed {
+				_, result = p.StreamProvider.Pull()
+			}
+			return
+		}
+	}
+}
+
+func (p *publisher) append(elements *bytes.Buffer, elem interface{}) error {
+	size, err := p.serialiser.EncodedSize(elem)
+	if err != nil {
+		return err
+	}
+	encoded := make([]byte, 2+int(size))
+	binary.LittleEndian.PutUint16(encoded, size)
+	if err = p.serialiser.Encode(elem, encoded[2:]); err != nil {
+		return err
+	}
+	elements.Write(encoded)
+	return nil
+}
+
+// sends the batch once there is room in flight for it
+func (p *publisher) send(count int, elements []byte) error {
+	if err := p.await(maxInFlight - 1); err != nil {
+		return err
+	}
+	p.seq++
+	var data bytes.Buffer
+	header := WireBatchMsg{
+		Version: WireVersion,
+		Message: WireBATCH,
+		Count:   uint16(count),
+		Seq:     p.seq,
+		Length:  uint32(len(elements)),
+	}
+	_ = binary.Write(&data, binary.LittleEndian, &header)
+	data.Write(elements)
+	p.pending = append(p.pending, pendingBatch{seq: p.seq, data: data.Bytes()})
+	if _, err := p.conn.Write(data.Bytes()); err != nil {
+		_ = p.conn.Close() // the receiver notices it, and it is resent after reconnecting
+	}
+	return nil
+}
+
+// waits until at most inFlight batches are not acknowledged, redialing when the connection drops
+func (p *publisher) await(inFlight int) error {
+	for {
+		p.dropAcked()
+		select {
+		case <-p.broken:
+			if err := p.redial(); err != nil {
+				return err
+			}
+			continue
+		default:
+		}
+		if len(p.pending) <= inFlight {
+			return nil
+		}
+		select {
+		case <-p.ack:
+		case <-p.broken:
+		}
+	}
+}
+
+// until it connects, the server refuses it or the reconnect time is over
+func (p *publisher) redial() error {
+	_ = p.conn.Close()
+	log.Printf("publishing to %v dropped, %v batches to resend\n", p.address, len(p.pending))
+	giveUp := time.Now().Add(p.reconnect)
+	for backoff := reconnectBackoffMin; ; backoff *= 2 {
+		if backoff > reconnectBackoffMax {
+			backoff = reconnectBackoffMax
+		}
+		if wait := time.Until(giveUp); backoff > wait {
+			backoff = wait
+		}
+		time.Sleep(backoff)
+		err := p.connect()
+		if err == nil || errors.Is(err, ErrRefused) {
+			return err
+		}
+		if !time.Now().Before(giveUp) {
+			return fmt.Errorf("gave up reconnecting after %v: %w", p.reconnect, err)
+		}
+		log.Printf("reconnecting to %v, err: %v\n", p.address, err)
+	}
+}
+
+func (p *publisher) dropAcked() {
+	acked := atomic.LoadUint64(&p.acked)
+	for len(p.pending) > 0 && p.pending[0].seq <= acked {
+		p.pending = p.pending[1:]
+	}
+}
+
+// Sends what was fed, and waits until the server acknowledged it.
+func (p *publisher) Close() {
+	p.StreamProvider.Close()
+	<-p.done
+}
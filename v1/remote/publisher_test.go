@@ -0,0 +1,172 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kuking/go-frank/v1/api"
+	"github.com/kuking/go-frank/v1/base"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParsePublication(t *testing.T) {
+	pub, err := parsePublication("tcp://localhost:1234/events?batch=10&linger=1ms&reconnect=1m")
+	if err != nil || pub.address != "localhost:1234" || pub.batch != 10 || pub.linger != time.Millisecond ||
+		pub.reconnect != time.Minute {
+		t.Fatal("unexpected", pub, err)
+	}
+	pub, err = parsePublication("tcp://localhost:1234/events")
+	if err != nil || pub.batch != defaultBatch || pub.linger != defaultLinger || pub.reconnect != defaultReconnect ||
+		pub.request.Publisher == 0 {
+		t.Fatal("unexpected", pub, err)
+	}
+	for _, uri := range []string{
+		"tcp://localhost:1234/",
+		"udp://localhost:1234/events",
+		"tcp://localhost:1234/events?batch=0",
+		"tcp://localhost:1234/events?batch=100000",
+		"tcp://localhost:1234/events?linger=soon",
+		"tcp://localhost:1234/events?reconnect=0s",
+	} {
+		if _, err = parsePublication(uri); err == nil {
+			t.Fatal("it should fail:", uri)
+		}
+	}
+}
+
+func TestPublish_FeedsTheRemoteStream(t *testing.T) {
+	prefix, stream, addr, server := givenServer(0, t)
+	defer os.RemoveAll(prefix)
+	defer stream.CloseFile()
+	defer server.Close()
+
+	pub, err := Publish(fmt.Sprintf("tcp://%v/events?batch=10", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1_000; i++ {
+		pub.Feed([]byte(fmt.Sprint(i)))
+	}
+	pub.Close()
+	assertPulls(stream.Consume("check"), 0, 1_000, t)
+	assertWait("the server to forget the publisher", func() bool {
+		server.lock.Lock()
+		defer server.lock.Unlock()
+		return len(server.published) == 0
+	}, t)
+}
+
+func TestPublish_StreamPublish(t *testing.T) {
+	prefix, stream, addr, server := givenServer(0, t)
+	defer os.RemoveAll(prefix)
+	defer stream.CloseFile()
+	defer server.Close()
+
+	source := base.ArrayStream([]string{"0", "1", "2"}).TimeOut(api.UntilNoMoreData)
+	if err := source.PublishClose(fmt.Sprintf("tcp://%v/events", addr)); err != nil {
+		t.Fatal(err)
+	}
+	assertPulls(stream.Consume("check"), 0, 3, t)
+}
+
+func TestPublish_ResendsAfterDrops(t *testing.T) {
+	prefix, stream, _, server := givenServer(0, t)
+	defer os.RemoveAll(prefix)
+	defer stream.CloseFile()
+	defer server.Close()
+	listener := givenDroppingListener(t)
+	go server.Serve(listener)
+
+	pub, err := Publish(fmt.Sprintf("tcp://%v/events?batch=10&linger=1ms", listener.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2_000; i++ {
+		pub.Feed([]byte(fmt.Sprint(i)))
+		if i%500 == 250 {
+			listener.drop()
+		}
+	}
+	pub.Close()
+	// once, in order
+	check := stream.Consume("check")
+	assertPulls(check, 0, 2_000, t)
+	if elem, result := check.TimeOut(api.WaitingUpto10ms).PullEx(); result != api.PullTimedOut {
+		t.Fatal("it should not feed more, got:", elem)
+	}
+}
+
+func TestPublish_GivesUpReconnecting(t *testing.T) {
+	prefix, stream, addr, server := givenServer(0, t)
+	defer os.RemoveAll(prefix)
+	defer stream.CloseFile()
+
+	pub, err := Publish(fmt.Sprintf("tcp://%v/events?linger=1ms&reconnect=300ms", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub.Feed([]byte("0"))
+	_ = server.Close() // and it does not come back
+	pub.Feed([]byte("1"))
+	closed := make(chan struct{})
+	go func() {
+		pub.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("closing should not wait for the server forever")
+	}
+}
+
+func TestPublish_Refusals(t *testing.T) {
+	prefix, stream, addr, server := givenServer(0, t)
+	defer os.RemoveAll(prefix)
+	defer stream.CloseFile()
+	defer server.Close()
+	_ = server.Registry.Register("not-a-stream", "not-a-stream")
+
+	for _, name := range []string{"missing", "not-a-stream"} {
+		if _, err := Publish(fmt.Sprintf("tcp://%v/%v", addr, name)); !errors.Is(err, ErrRefused) {
+			t.Fatal("it should be refused:", name, err)
+		}
+	}
+}
+
+// a listener dropping every accepted connection on demand
+type droppingListener struct {
+	net.Listener
+	lock  sync.Mutex
+	conns []net.Conn
+}
+
+func givenDroppingListener(t *testing.T) *droppingListener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &droppingListener{Listener: listener}
+}
+
+func (d *droppingListener) Accept() (net.Conn, error) {
+	conn, err := d.Listener.Accept()
+	if err == nil {
+		d.lock.Lock()
+		d.conns = append(d.conns, conn)
+		d.lock.Unlock()
+	}
+	return conn, err
+}
+
+func (d *droppingListener) drop() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, conn := range d.conns {
+		_ = conn.Close()
+	}
+	d.conns = nil
+}
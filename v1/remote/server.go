@@ -0,0 +1,567 @@
+package remote
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/kuking/go-frank/v1/base"
+	"github.com/kuking/go-frank/v1/persistent"
+	"github.com/kuking/go-frank/v1/registry"
+	"github.com/kuking/go-frank/v1/serialisation"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultWindow   = 1024
+	maxWindow       = 64 * 1024        // elements in flight, subscriptions asking for more are refused
+	publisherMemory = 10 * time.Minute // the last batch of a disconnected publisher is remembered for, see Publish
+)
+
+// A Server exposes the persistent streams registered in its registry to remote subscribers (see Subscribe), each
+// subscription is served by a pair of goroutines. Remote publishers (see Publish) feed the streams registered in it.
+type Server struct {
+	Registry registry.Registry
+	// Of the elements on the wire, subscribers get them as []byte. ByteArraySerialiser by default.
+	Serialiser serialisation.StreamSerialiser
+	lock       sync.Mutex
+	closed     bool
+	listeners  []net.Listener
+	conns      map[net.Conn]bool
+	active     map[string]bool         // stream and subscriber names of the subscriptions being served, or publishers
+	published  map[string]publishedSeq // last batch fed, by stream and publisher
+	serving    sync.WaitGroup
+}
+
+func NewServer(reg registry.Registry) *Server {
+	return &Server{
+		Registry:   reg,
+		Serialiser: serialisation.ByteArraySerialiser{},
+		conns:      map[net.Conn]bool{},
+		active:     map[string]bool{},
+		published:  map[string]publishedSeq{},
+	}
+}
+
+func (s *Server) ListenTCP(bind string) error {
+	listener, err := net.Listen("tcp", bind)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Accepts subscriptions on the listener, it returns when the listener (or the server) is closed.
+func (s *Server) Serve(listener net.Listener) error {
+	if !s.track(listener) {
+		_ = listener.Close()
+		return net.ErrClosed
+	}
+	for {
+		conn, err := listener.Accept()
+		if err == nil {
+			go s.serveConn(conn)
+		} else if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else {
+			log.Printf("error accepting connection, err: %v\n", err)
+		}
+	}
+}
+
+// Stops listening and drops every subscription, it returns once they ended (the streams can be closed after it).
+func (s *Server) Close() error {
+	s.lock.Lock()
+	s.closed = true
+	for _, listener := range s.listeners {
+		_ = listener.Close()
+	}
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.lock.Unlock()
+	s.serving.Wait()
+	return nil
+}
+
+func (s *Server) track(listener net.Listener) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.listeners = append(s.listeners, listener)
+	return !s.closed
+}
+
+func (s *Server) trackConn(conn net.Conn, track bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if track && !s.closed {
+		s.conns[conn] = true
+		s.serving.Add(1)
+		return true
+	} else if !track {
+		delete(s.conns, conn)
+		s.serving.Done()
+	}
+	return false
+}
+
+// only one subscription per subscriber name, they would move each other position
+func (s *Server) acquire(key string, acquire bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !acquire {
+		delete(s.active, key)
+		return true
+	}
+	if s.active[key] {
+		return false
+	}
+	s.active[key] = true
+	return true
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	if !s.trackConn(conn, true) {
+		return
+	}
+	defer s.trackConn(conn, false)
+	r := bufio.NewReader(conn)
+	first, err := r.Peek(2)
+	if err != nil {
+		log.Printf("error reading from %v, err: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+	if first[1] == WirePUBLISH {
+		s.servePublisher(conn, r)
+	} else {
+		s.serveSubscriber(conn, r)
+	}
+}
+
+func (s *Server) serveSubscriber(conn net.Conn, r *bufio.Reader) {
+	var msg WireSubscribeMsg
+	if err := binary.Read(r, binary.LittleEndian, &msg); err != nil {
+		log.Printf("error reading subscription from %v, err: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+	sub, err := s.subscribe(conn, &msg)
+	if err != nil {
+		log.Printf("subscription from %v refused, err: %v\n", conn.RemoteAddr(), err)
+		_ = sendError(conn, err)
+		return
+	}
+	defer s.acquire(sub.key, false)
+	if err = sub.run(r); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("subscription %v from %v failed, err: %v\n", sub.key, conn.RemoteAddr(), err)
+	}
+}
+
+func (s *Server) subscribe(conn net.Conn, msg *WireSubscribeMsg) (*subscription, error) {
+	if msg.Version != WireVersion || msg.Message != WireSUBSCRIBE {
+		return nil, errors.New(fmt.Sprintf("expected a subscription, got message %v version %v", msg.Message, msg.Version))
+	}
+	name, subscriber := serialisation.FromNTString(msg.Name[:]), serialisation.FromNTString(msg.Subscriber[:])
+	if subscriber == "" {
+		return nil, errors.New("a subscriber name is required")
+	}
+	registered, ok := s.Registry.Lookup(name)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("no such stream: %v", name))
+	}
+	stream, ok := registered.(*persistent.MmapStream)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("only persistent streams can be subscribed to remotely: %v", name))
+	}
+	window := msg.Window
+	if window == 0 {
+		window = defaultWindow
+	}
+	if window > maxWindow {
+		return nil, errors.New(fmt.Sprintf("window %v is over the maximum of %v", window, maxWindow))
+	}
+	sub := &subscription{
+		conn:       conn,
+		stream:     stream,
+		serialiser: s.Serialiser,
+		key:        name + "?sn=" + subscriber,
+		credit:     int64(window),
+		acked:      make(chan struct{}, 1),
+		sent:       make(chan uint64, window),
+	}
+	if !s.acquire(sub.key, true) {
+		return nil, fmt.Errorf("%w: %v is already subscribed", ErrBusy, sub.key)
+	}
+	var err error
+	if sub.subId, err = stream.PeerSubscriberIdForName(subscriber); err != nil {
+		s.acquire(sub.key, false)
+		return nil, err
+	}
+	switch msg.From {
+	case WireFromOffset:
+		sub.next = msg.Offset
+	case WireFromSince:
+		sub.next = stream.PositionSince(time.Unix(0, msg.Since))
+	default:
+		sub.next = stream.ReadSubRPos(sub.subId)
+	}
+	if firstAbsPos := stream.GetFirstPart() * stream.GetPartSize(); sub.next < firstAbsPos {
+		sub.next = firstAbsPos // pruned
+	}
+	if sub.next > stream.WritePos() {
+		s.acquire(sub.key, false)
+		return nil, errors.New(fmt.Sprintf("offset %v is beyond the end of the stream", sub.next))
+	}
+	if !elementAt(stream, sub.subId, sub.next) {
+		s.acquire(sub.key, false)
+		return nil, errors.New(fmt.Sprintf("offset %v is not the position of an element", sub.next))
+	}
+	return sub, nil
+}
+
+// there is an element at absPos (or it is the write position), walking the elements from the start of its part
+func elementAt(stream *persistent.MmapStream, subId int, absPos uint64) bool {
+	pos := absPos - absPos%stream.GetPartSize()
+	for pos < absPos {
+		_, next, ok := stream.PeekBySubId(subId, pos)
+		if !ok {
+			return false
+		}
+		pos = next
+	}
+	return pos == absPos
+}
+
+type subscription struct {
+	conn       net.Conn
+	stream     *persistent.MmapStream
+	serialiser serialisation.StreamSerialiser
+	subId      int
+	key        string
+	next       uint64        // position of the next element to send
+	credit     int64         // elements it can send before the subscriber acknowledges more
+	acked      chan struct{} // signalled on every WireACK
+	sent       chan uint64   // positions after the elements sent and not acknowledged, the only ones a WireACK sets
+}
+
+func (sub *subscription) run(r *bufio.Reader) error {
+	w := bufio.NewWriter(sub.conn)
+	subscribed := WireSubscribedMsg{Version: WireVersion, Message: WireSUBSCRIBED, AbsPos: sub.next}
+	if err := binary.Write(w, binary.LittleEndian, &subscribed); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go sub.goFuncRecvAcks(r, done)
+	waitDuty := base.NewDefaultNotifyWait(sub.stream.Notifier())
+	var buffer []byte
+	for {
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+		if atomic.LoadInt64(&sub.credit) <= 0 {
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			select {
+			case <-sub.acked:
+			case <-done:
+				return nil
+			}
+			continue
+		}
+		elem, nextAbsPos, ok := sub.stream.PeekBySubId(sub.subId, sub.next)
+		if !ok {
+			if firstAbsPos := sub.stream.GetFirstPart() * sub.stream.GetPartSize(); sub.next < firstAbsPos {
+				sub.next = firstAbsPos // pruned
+				continue
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			if sub.stream.IsClosed() && sub.next >= sub.stream.WritePos() {
+				// the subscriber closes the connection once it consumed everything, acknowledging it
+				closed := WireClosedMsg{Version: WireVersion, Message: WireCLOSED}
+				if err := binary.Write(sub.conn, binary.LittleEndian, &closed); err != nil {
+					return err
+				}
+				<-done
+				return nil
+			}
+			waitDuty.Loop()
+			continue
+		}
+		waitDuty.Reset()
+		size, err := sub.serialiser.EncodedSize(elem)
+		if err != nil {
+			return err
+		}
+		if int(size) > len(buffer) {
+			buffer = make([]byte, size)
+		}
+		if err = sub.serialiser.Encode(elem, buffer[:size]); err != nil {
+			return err
+		}
+		header := WireElementMsg{
+			Version:    WireVersion,
+			Message:    WireELEMENT,
+			AbsPos:     sub.next,
+			NextAbsPos: nextAbsPos,
+			Length:     size,
+		}
+		if err = binary.Write(w, binary.LittleEndian, &header); err != nil {
+			return err
+		}
+		if _, err = w.Write(buffer[:size]); err != nil {
+			return err
+		}
+		sub.sent <- nextAbsPos // never blocks, there are at most a window of them
+		atomic.AddInt64(&sub.credit, -1)
+		sub.next = nextAbsPos
+	}
+}
+
+// the subscriber acknowledges what it consumed, moving its named position and giving credit for more
+func (sub *subscription) goFuncRecvAcks(r *bufio.Reader, done chan struct{}) {
+	defer close(done)
+	for {
+		var ack WireAckMsg
+		if err := binary.Read(r, binary.LittleEndian, &ack); err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("error reading from subscriber %v, err: %v\n", sub.key, err)
+			}
+			return
+		}
+		if ack.Version != WireVersion || ack.Message != WireACK {
+			log.Printf("expected an ACK from subscriber %v, got message %v version %v\n", sub.key, ack.Message, ack.Version)
+			return
+		}
+		if absPos, ok := sub.acknowledge(ack.Count); !ok || absPos != ack.AbsPos {
+			log.Printf("subscriber %v acknowledged %v elements up to %v, they were not sent\n", sub.key, ack.Count, ack.AbsPos)
+			return
+		}
+		if ack.AbsPos > sub.stream.ReadSubRPos(sub.subId) { // a replay does not move the named position back
+			sub.stream.SetSubRPos(sub.subId, ack.AbsPos)
+		}
+		atomic.AddInt64(&sub.credit, int64(ack.Count))
+		select {
+		case sub.acked <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// the position after the last of count elements sent, if they were
+func (sub *subscription) acknowledge(count uint32) (absPos uint64, ok bool) {
+	for i := uint32(0); i < count; i++ {
+		select {
+		case absPos = <-sub.sent:
+		default:
+			return 0, false
+		}
+	}
+	return absPos, count > 0
+}
+
+func (s *Server) servePublisher(conn net.Conn, r *bufio.Reader) {
+	var msg WirePublishMsg
+	if err := binary.Read(r, binary.LittleEndian, &msg); err != nil {
+		log.Printf("error reading publisher from %v, err: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+	pub, err := s.publish(conn, &msg)
+	if err != nil {
+		log.Printf("publisher from %v refused, err: %v\n", conn.RemoteAddr(), err)
+		_ = sendError(conn, err)
+		return
+	}
+	defer s.acquire(pub.key, false)
+	if err = pub.run(r); err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) {
+		log.Printf("publisher %v from %v failed, err: %v\n", pub.key, conn.RemoteAddr(), err)
+	}
+}
+
+func (s *Server) publish(conn net.Conn, msg *WirePublishMsg) (*publication, error) {
+	if msg.Version != WireVersion || msg.Message != WirePUBLISH {
+		return nil, errors.New(fmt.Sprintf("expected a publisher, got message %v version %v", msg.Message, msg.Version))
+	}
+	name := serialisation.FromNTString(msg.Name[:])
+	registered, ok := s.Registry.Lookup(name)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("no such stream: %v", name))
+	}
+	stream, ok := registered.(feeder)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("can not publish into: %v", name))
+	}
+	pub := &publication{
+		server:     s,
+		conn:       conn,
+		stream:     stream,
+		serialiser: s.Serialiser,
+		key:        fmt.Sprintf("%v?publisher=%x", name, msg.Publisher),
+	}
+	if !s.acquire(pub.key, true) {
+		return nil, fmt.Errorf("%w: %v is already publishing", ErrBusy, pub.key)
+	}
+	s.forgetIdlePublishers()
+	return pub, nil
+}
+
+type publishedSeq struct {
+	seq uint64
+	at  time.Time
+}
+
+// the last batch fed from the publisher, 0 if none
+func (s *Server) lastSeq(key string) uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.published[key].seq
+}
+
+func (s *Server) setLastSeq(key string, seq uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if seq == 0 {
+		delete(s.published, key)
+	} else {
+		s.published[key] = publishedSeq{seq: seq, at: time.Now()}
+	}
+}
+
+// the publishers which did not close their stream (i.e. they crashed), gone for longer than they would redial
+func (s *Server) forgetIdlePublishers() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key, published := range s.published {
+		if !s.active[key] && time.Since(published.at) > publisherMemory {
+			delete(s.published, key)
+		}
+	}
+}
+
+type feeder interface {
+	Feed(elem interface{})
+}
+
+type publication struct {
+	server     *Server
+	conn       net.Conn
+	stream     feeder
+	serialiser serialisation.StreamSerialiser
+	key        string
+}
+
+func (pub *publication) run(r *bufio.Reader) error {
+	lastSeq := pub.server.lastSeq(pub.key)
+	published := WirePublishedMsg{Version: WireVersion, Message: WirePUBLISHED, LastSeq: lastSeq}
+	if err := binary.Write(pub.conn, binary.LittleEndian, &published); err != nil {
+		return err
+	}
+	var header WireBatchMsg
+	for {
+		first, err := r.Peek(2)
+		if err != nil {
+			return err
+		}
+		if first[0] != WireVersion {
+			return errors.New(fmt.Sprintf("received a message of unknown wire version: %v", first[0]))
+		}
+		switch first[1] {
+		case WireBATCH:
+			if err = binary.Read(r, binary.LittleEndian, &header); err != nil {
+				return err
+			}
+			if header.Length > maxBatchLength {
+				return errors.New(fmt.Sprintf("batch of %v bytes, max: %v", header.Length, maxBatchLength))
+			}
+			batch := make([]byte, header.Length) // not reused, decoded elements can point into it
+			if _, err = io.ReadFull(r, batch); err != nil {
+				return err
+			}
+			if lastSeq == 0 && header.Seq > 0 {
+				lastSeq = header.Seq - 1 // a new publisher, or one the server forgot about (i.e. it restarted)
+			}
+			if header.Seq > lastSeq+1 {
+				return errors.New(fmt.Sprintf("expected batch %v, got: %v", lastSeq+1, header.Seq))
+			} else if header.Seq == lastSeq+1 { // otherwise it was already fed, resent after a reconnection
+				if err = pub.feed(header.Count, batch); err != nil {
+					return err
+				}
+				lastSeq = header.Seq
+				pub.server.setLastSeq(pub.key, lastSeq)
+			}
+			ack := WireBatchAckMsg{Version: WireVersion, Message: WireBATCHACK, Seq: header.Seq}
+			if err = binary.Write(pub.conn, binary.LittleEndian, &ack); err != nil {
+				return err
+			}
+		case WireCLOSED:
+			pub.server.setLastSeq(pub.key, 0)
+			return nil
+		default:
+			return errors.New(fmt.Sprintf("received an unrecognised message type: %v", first[1]))
+		}
+	}
+}
+
+// decodes the whole batch before feeding any of it
+func (pub *publication) feed(count uint16, batch []byte) error {
+	elems := make([]interface{}, count)
+	for i := range elems {
+		if len(batch) < 2 {
+			return errors.New("truncated batch")
+		}
+		size := 2 + int(binary.LittleEndian.Uint16(batch))
+		if len(batch) < size {
+			return errors.New("truncated batch")
+		}
+		elem, err := pub.serialiser.Decode(batch[2:size])
+		if err != nil {
+			return err
+		}
+		elems[i], batch = elem, batch[size:]
+	}
+	for _, elem := range elems {
+		pub.stream.Feed(elem)
+	}
+	return nil
+}
+
+func sendError(w io.Writer, err error) error {
+	text := err.Error()
+	if len(text) > 1024 {
+		text = text[:1024]
+	}
+	msg := WireErrorMsg{Version: WireVersion, Message: WireERROR, Length: uint16(len(text))}
+	if errors.Is(err, ErrBusy) {
+		msg.Busy = 1
+	}
+	if err := binary.Write(w, binary.LittleEndian, &msg); err != nil {
+		return err
+	}
+	_, err = w.Write([]byte(text))
+	return err
+}
+
+func readError(r io.Reader) error {
+	var msg WireErrorMsg
+	if err := binary.Read(r, binary.LittleEndian, &msg); err != nil {
+		return err
+	}
+	text := make([]byte, msg.Length)
+	if _, err := io.ReadFull(r, text); err != nil {
+		return err
+	}
+	if msg.Busy != 0 {
+		return fmt.Errorf("%w: %v", ErrBusy, strings.TrimPrefix(string(text), ErrBusy.Error()+": "))
+	}
+	return fmt.Errorf("%w: %v", ErrRefused, string(text))
+}
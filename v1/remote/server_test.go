@@ -0,0 +1,315 @@
+package remote
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/kuking/go-frank/v1/api"
+	"github.com/kuking/go-frank/v1/base"
+	"github.com/kuking/go-frank/v1/persistent"
+	"github.com/kuking/go-frank/v1/registry"
+	"github.com/kuking/go-frank/v1/serialisation"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestServer_ContinuesFromNamedPosition(t *testing.T) {
+	prefix, stream, addr, server := givenServer(1_000, t)
+	defer os.RemoveAll(prefix)
+	defer stream.CloseFile()
+	defer server.Close()
+
+	sub, err := Subscribe(fmt.Sprintf("tcp://%v/events?sn=a&window=100", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPulls(sub, 0, 100, t)
+	sub.Close()
+	subId := stream.SubscriberIdForName("a")
+	assertWait("the server to get the ACKs", func() bool {
+		elem, _, ok := stream.PeekBySubId(subId, stream.ReadSubRPos(subId))
+		return ok && string(elem.([]byte)) == "100"
+	}, t)
+
+	assertWait("the server to drop the first subscription", func() bool {
+		sub, err = Subscribe(fmt.Sprintf("tcp://%v/events?sn=a", addr))
+		return err == nil
+	}, t)
+	defer sub.Close()
+	assertPulls(sub, 100, 900, t)
+}
+
+func TestServer_Replays(t *testing.T) {
+	prefix, stream, addr, server := givenServer(1_000, t)
+	defer os.RemoveAll(prefix)
+	defer stream.CloseFile()
+	defer server.Close()
+
+	var offset uint64
+	for i := 0; i < 10; i++ {
+		_, offset, _ = stream.PeekBySubId(0, offset)
+	}
+	sub, err := Subscribe(fmt.Sprintf("tcp://%v/events?sn=a&offset=%v", addr, offset))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPulls(sub, 10, 990, t)
+	sub.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	since := time.Now()
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 100; i++ {
+		stream.Feed([]byte("after"))
+	}
+	sub, err = Subscribe(fmt.Sprintf("tcp://%v/events?sn=b&since=%v", addr, since.Format(time.RFC3339Nano)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	after := 0
+	for after < 100 {
+		elem, result := sub.TimeOut(api.WaitingUpto1s).PullEx()
+		if result != api.PullOk {
+			t.Fatal("it should replay the elements fed since, got:", after)
+		}
+		if string(elem.([]byte)) == "after" {
+			after++
+		}
+	}
+}
+
+func TestServer_FlowControl(t *testing.T) {
+	prefix, stream, addr, server := givenServer(1_000, t)
+	defer os.RemoveAll(prefix)
+	defer stream.CloseFile()
+	defer server.Close()
+
+	sub, err := Subscribe(fmt.Sprintf("tcp://%v/events?sn=a&window=10", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	time.Sleep(100 * time.Millisecond)
+	if received := sub.PeekLimit(); received != 10 {
+		t.Fatal("it should receive a window and wait, received:", received)
+	}
+	assertPulls(sub, 0, 5, t)
+	assertWait("the server to send more", func() bool { return sub.PeekLimit() > 10 }, t)
+	assertPulls(sub, 5, 995, t)
+}
+
+func TestServer_ClosedStream(t *testing.T) {
+	prefix, stream, addr, server := givenServer(1_000, t)
+	defer os.RemoveAll(prefix)
+	defer stream.CloseFile()
+	defer server.Close()
+
+	stream.Close()
+	sub, err := Subscribe(fmt.Sprintf("tcp://%v/events?sn=a", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := sub.Count(); count != 1_000 {
+		t.Fatal("it should end once everything was consumed, got:", count)
+	}
+	subId := stream.SubscriberIdForName("a")
+	assertWait("the last ACK", func() bool { return stream.ReadSubRPos(subId) == stream.WritePos() }, t)
+}
+
+func TestServer_Refusals(t *testing.T) {
+	prefix, stream, addr, server := givenServer(10, t)
+	defer os.RemoveAll(prefix)
+	defer stream.CloseFile()
+	defer server.Close()
+	_ = server.Registry.Register("in-memory", base.EmptyStream(10))
+
+	for _, uri := range []string{"missing?sn=a", "in-memory?sn=a", fmt.Sprintf("events?sn=a&offset=%v", 1<<40)} {
+		if _, err := Subscribe(fmt.Sprintf("tcp://%v/%v", addr, uri)); !errors.Is(err, ErrRefused) {
+			t.Fatal("it should be refused:", uri, err)
+		}
+	}
+	sub, err := Subscribe(fmt.Sprintf("tcp://%v/events?sn=a", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	if _, err = Subscribe(fmt.Sprintf("tcp://%v/events?sn=a", addr)); !errors.Is(err, ErrBusy) {
+		t.Fatal("it is already subscribed", err)
+	}
+}
+
+func TestServer_RefusesReservedNamesAndLargeWindows(t *testing.T) {
+	prefix, stream, addr, server := givenServer(10, t)
+	defer os.RemoveAll(prefix)
+	defer stream.CloseFile()
+	defer server.Close()
+	_, repSubId, _ := stream.ReplicatorIdForNameHost("dr", "10.0.0.2:1234")
+	stream.SetSubRPos(repSubId, stream.WritePos())
+
+	for _, uri := range []string{"events?sn=REPL:dr", "events?sn=GROUP:g:m"} {
+		if _, err := Subscribe(fmt.Sprintf("tcp://%v/%v", addr, uri)); !errors.Is(err, ErrRefused) {
+			t.Fatal("it should be refused:", uri, err)
+		}
+	}
+	if _, err := Subscribe(fmt.Sprintf("tcp://%v/events?sn=a&window=%v", addr, maxWindow+1)); err == nil {
+		t.Fatal("the window is over the maximum")
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request, _, _ := parseSubscription("tcp://host/events?sn=a")
+	request.Window = math.MaxUint32
+	if err = binary.Write(conn, binary.LittleEndian, &request); err != nil {
+		t.Fatal(err)
+	}
+	if err = readError(bufio.NewReader(conn)); !errors.Is(err, ErrRefused) {
+		t.Fatal("the window is over the maximum, err:", err)
+	}
+
+	// once the free slots are taken new names are refused, rather than evicting the replicator (or anybody)
+	for i := 0; ; i++ {
+		sub, err := Subscribe(fmt.Sprintf("tcp://%v/events?sn=s%v", addr, i))
+		if errors.Is(err, ErrRefused) {
+			break
+		} else if err != nil || i > 64 {
+			t.Fatal("it should have run out of slots, err:", err)
+		}
+		sub.Close()
+	}
+	if stream.ReadSubRPos(repSubId) != stream.WritePos() {
+		t.Fatal("the replicator slot should not have been taken")
+	}
+}
+
+func TestServer_RefusesMisalignedOffsets(t *testing.T) {
+	prefix, stream, addr, server := givenServer(10, t)
+	defer os.RemoveAll(prefix)
+	defer stream.CloseFile()
+	defer server.Close()
+
+	if _, err := Subscribe(fmt.Sprintf("tcp://%v/events?sn=a&offset=3", addr)); !errors.Is(err, ErrRefused) {
+		t.Fatal("offset 3 is within the first element, it should be refused:", err)
+	}
+	sub, err := Subscribe(fmt.Sprintf("tcp://%v/events?sn=a", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	assertPulls(sub, 0, 10, t)
+}
+
+func TestServer_DropsAcksOfElementsNotSent(t *testing.T) {
+	prefix, stream, addr, server := givenServer(10, t)
+	defer os.RemoveAll(prefix)
+	defer stream.CloseFile()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request, _, _ := parseSubscription("tcp://host/events?sn=a")
+	ack := WireAckMsg{Version: WireVersion, Message: WireACK, Count: 1, AbsPos: 3}
+	if binary.Write(conn, binary.LittleEndian, &request) != nil || binary.Write(conn, binary.LittleEndian, &ack) != nil {
+		t.Fatal()
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = io.Copy(io.Discard, conn); err != nil {
+		t.Fatal("the server should close the connection, err:", err)
+	}
+	if pos := stream.ReadSubRPos(stream.SubscriberIdForName("a")); pos != 0 {
+		t.Fatal("the named position should not move, it is:", pos)
+	}
+}
+
+func TestServer_RefusesOversizedBatches(t *testing.T) {
+	prefix, stream, addr, server := givenServer(0, t)
+	defer os.RemoveAll(prefix)
+	defer stream.CloseFile()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := WirePublishMsg{Version: WireVersion, Message: WirePUBLISH, Publisher: 1}
+	serialisation.ToNTString(request.Name[:], "events")
+	var published WirePublishedMsg
+	batch := WireBatchMsg{Version: WireVersion, Message: WireBATCH, Count: 1, Seq: 1, Length: math.MaxUint32}
+	if binary.Write(conn, binary.LittleEndian, &request) != nil ||
+		binary.Read(conn, binary.LittleEndian, &published) != nil ||
+		binary.Write(conn, binary.LittleEndian, &batch) != nil {
+		t.Fatal()
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = io.Copy(io.Discard, conn); err != nil {
+		t.Fatal("the server should close the connection, err:", err)
+	}
+}
+
+func TestServer_ForgetsIdlePublishers(t *testing.T) {
+	prefix, stream, addr, server := givenServer(0, t)
+	defer os.RemoveAll(prefix)
+	defer stream.CloseFile()
+	defer server.Close()
+	server.published["events?publisher=1"] = publishedSeq{seq: 10, at: time.Now().Add(-publisherMemory - time.Second)}
+	server.published["events?publisher=2"] = publishedSeq{seq: 10, at: time.Now()}
+
+	pub, err := Publish(fmt.Sprintf("tcp://%v/events", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub.Close()
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if _, ok := server.published["events?publisher=1"]; ok || len(server.published) != 1 {
+		t.Fatal("only the idle publisher should be forgotten", server.published)
+	}
+}
+
+// a server exposing the stream "events", with elements "0", "1", ...
+func givenServer(elements int, t *testing.T) (prefix string, stream *persistent.MmapStream, addr string, server *Server) {
+	prefix, _ = ioutil.TempDir("", "MMAP-")
+	stream, err := persistent.MmapStreamCreate(path.Join(prefix, "events"), 64*1024, serialisation.ByteArraySerialiser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < elements; i++ {
+		stream.Feed([]byte(fmt.Sprint(i)))
+	}
+	server = NewServer(registry.NewInMemoryRegistry())
+	_ = server.Registry.Register("events", stream)
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Serve(listener)
+	return prefix, stream, listener.Addr().String(), server
+}
+
+func assertPulls(sub api.Stream, from, n int, t *testing.T) {
+	for i := from; i < from+n; i++ {
+		elem, result := sub.TimeOut(api.WaitingUpto1s).PullEx()
+		if result != api.PullOk || string(elem.([]byte)) != fmt.Sprint(i) {
+			t.Fatal("expected", i, "got", elem, result)
+		}
+	}
+}
+
+func assertWait(explanation string, expr func() bool, t *testing.T) {
+	for t0 := time.Now(); time.Since(t0) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if expr() {
+			return
+		}
+	}
+	t.Fatal("failed waiting for:", explanation)
+}
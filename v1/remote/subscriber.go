@@ -0,0 +1,253 @@
+package remote
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/kuking/go-frank/v1/api"
+	"github.com/kuking/go-frank/v1/base"
+	"github.com/kuking/go-frank/v1/registry"
+	"github.com/kuking/go-frank/v1/ringbuffer"
+	"github.com/kuking/go-frank/v1/serialisation"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	reconnectBackoffMin = 250 * time.Millisecond
+	reconnectBackoffMax = 5 * time.Second
+)
+
+var (
+	// The server refused the subscription, i.e. there is no such stream; it is not retried.
+	ErrRefused = errors.New("refused by the server")
+	// The server still serves the previous connection of the subscriber; it is retried when reconnecting.
+	ErrBusy = errors.New("busy")
+)
+
+func init() {
+	registry.RegisterScheme("tcp", Subscribe)
+	registry.RegisterSinkScheme("tcp", Publish)
+}
+
+// Subscribes to a stream exposed by a Server: tcp://host:port/name?sn=subscriber, elements are []byte. It continues
+// from the subscriber named position in the server, unless offset=absPos (replays from an absolute position) or
+// since=time (RFC3339, replays the elements fed since then) are given; window=n bounds the elements the server sends
+// ahead of the consumed ones (1024, up to 64K). A dropped connection is redialed, continuing after the last element
+// received. The wait time-out of the stream is UntilClosed, the server closes it once the stream is closed and
+// consumed.
+func Subscribe(uri string) (api.Stream, error) {
+	request, address, err := parseSubscription(uri)
+	if err != nil {
+		return nil, err
+	}
+	buffer := ringbuffer.NewRingBufferProvider(int(request.Window)+1, base.NewBusyWait()) // it holds capacity-1
+	buffer.WaitDuty(base.NewDefaultNotifyWait(buffer.Notifier()))
+	sub := &subscriber{StreamProvider: buffer, address: address, request: request}
+	conn, r, err := sub.subscribe()
+	if err != nil {
+		return nil, err
+	}
+	go sub.goFuncRecv(conn, r)
+	return base.NewStreamImpl(sub, sub.Pull), nil
+}
+
+func parseSubscription(uri string) (request WireSubscribeMsg, address string, err error) {
+	URI, err := url.Parse(uri)
+	if err != nil {
+		return
+	}
+	name := strings.TrimPrefix(URI.Path, "/")
+	if URI.Scheme != "tcp" || URI.Host == "" || name == "" {
+		err = errors.New(fmt.Sprintf("expected tcp://host:port/name, got: %v", uri))
+		return
+	}
+	query := URI.Query()
+	if query.Get("sn") == "" {
+		err = errors.New("remote subscriptions need a 'sn' (subscriber name) parameter")
+		return
+	}
+	request = WireSubscribeMsg{Version: WireVersion, Message: WireSUBSCRIBE, From: WireFromNamed, Window: defaultWindow}
+	serialisation.ToNTString(request.Name[:], name)
+	serialisation.ToNTString(request.Subscriber[:], query.Get("sn"))
+	if offset := query.Get("offset"); offset != "" {
+		request.From = WireFromOffset
+		if request.Offset, err = strconv.ParseUint(offset, 10, 64); err != nil {
+			return
+		}
+	}
+	if since := query.Get("since"); since != "" {
+		var t time.Time
+		if t, err = time.Parse(time.RFC3339Nano, since); err != nil {
+			return
+		}
+		request.From, request.Since = WireFromSince, t.UnixNano()
+	}
+	if window := query.Get("window"); window != "" {
+		var w uint64
+		if w, err = strconv.ParseUint(window, 10, 32); err != nil || w == 0 || w > maxWindow {
+			err = errors.New(fmt.Sprintf("invalid window: %v", window))
+			return
+		}
+		request.Window = uint32(w)
+	}
+	return request, URI.Host, nil
+}
+
+type subscriber struct {
+	base.StreamProvider // buffering what was received and not pulled yet, up to a window
+	address             string
+	request             WireSubscribeMsg
+	lock                sync.Mutex
+	conn                net.Conn
+	received            uint64 // position after the last element received, a new connection continues from it
+	pulled              uint32 // since the last WireACK
+	closing             int32
+}
+
+// an element, and the position after it
+type remoteElem struct {
+	elem interface{}
+	next uint64
+}
+
+func (s *subscriber) subscribe() (net.Conn, *bufio.Reader, error) {
+	conn, err := net.Dial("tcp", s.address)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := bufio.NewReader(conn)
+	var subscribed WireSubscribedMsg
+	if err = binary.Write(conn, binary.LittleEndian, &s.request); err == nil {
+		var first []byte
+		if first, err = r.Peek(2); err == nil && first[1] == WireERROR {
+			err = readError(r)
+		} else if err == nil {
+			err = binary.Read(r, binary.LittleEndian, &subscribed)
+		}
+	}
+	if err == nil && (subscribed.Version != WireVersion || subscribed.Message != WireSUBSCRIBED) {
+		err = errors.New(fmt.Sprintf("expected a WireSUBSCRIBED, got message %v version %v",
+			subscribed.Message, subscribed.Version))
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	atomic.StoreUint64(&s.received, subscribed.AbsPos)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if atomic.LoadInt32(&s.closing) != 0 {
+		_ = conn.Close()
+		return nil, nil, net.ErrClosed
+	}
+	s.conn, s.pulled = conn, 0
+	return conn, r, nil
+}
+
+// receives until the server closes the stream, redialing when the connection drops
+func (s *subscriber) goFuncRecv(conn net.Conn, r *bufio.Reader) {
+	for {
+		err := s.recv(r)
+		if err == nil || atomic.LoadInt32(&s.closing) != 0 {
+			go s.StreamProvider.Close() // once everything received is pulled
+			return
+		}
+		_ = conn.Close()
+		log.Printf("subscription to %v dropped, err: %v\n", s.address, err)
+		for backoff := reconnectBackoffMin; ; backoff *= 2 {
+			if backoff > reconnectBackoffMax {
+				backoff = reconnectBackoffMax
+			}
+			time.Sleep(backoff)
+			s.request.From, s.request.Offset = WireFromOffset, atomic.LoadUint64(&s.received)
+			if conn, r, err = s.subscribe(); err == nil {
+				break
+			}
+			if errors.Is(err, ErrRefused) || errors.Is(err, net.ErrClosed) {
+				log.Printf("subscription to %v ended, err: %v\n", s.address, err)
+				go s.StreamProvider.Close()
+				return
+			}
+			log.Printf("resubscribing to %v, err: %v\n", s.address, err)
+		}
+	}
+}
+
+// nil when the server closed the stream
+func (s *subscriber) recv(r *bufio.Reader) error {
+	var header WireElementMsg
+	for {
+		first, err := r.Peek(2)
+		if err != nil {
+			return err
+		}
+		if first[0] != WireVersion {
+			return errors.New(fmt.Sprintf("received a message of unknown wire version: %v", first[0]))
+		}
+		switch first[1] {
+		case WireELEMENT:
+			if err = binary.Read(r, binary.LittleEndian, &header); err != nil {
+				return err
+			}
+			elem := make([]byte, header.Length)
+			if _, err = io.ReadFull(r, elem); err != nil {
+				return err
+			}
+			s.StreamProvider.Feed(remoteElem{elem: elem, next: header.NextAbsPos})
+			atomic.StoreUint64(&s.received, header.NextAbsPos)
+		case WireCLOSED:
+			_, _ = r.Discard(2)
+			return nil
+		case WireERROR:
+			return readError(r)
+		default:
+			return errors.New(fmt.Sprintf("received an unrecognised message type: %v", first[1]))
+		}
+	}
+}
+
+// Acknowledges the pulled elements every quarter of the window, or once everything received was pulled.
+func (s *subscriber) Pull() (interface{}, api.PullResult) {
+	read, result := s.StreamProvider.Pull()
+	if result == api.PullClosed {
+		s.Close()
+	}
+	elem, ok := read.(remoteElem)
+	if result != api.PullOk || !ok {
+		return read, result
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pulled++
+	if s.pulled >= s.request.Window/4 || s.StreamProvider.CurrAbsPos() == s.StreamProvider.PeekLimit() {
+		ack := WireAckMsg{Version: WireVersion, Message: WireACK, Count: s.pulled, AbsPos: elem.next}
+		_ = binary.Write(s.conn, binary.LittleEndian, &ack) // when it fails, the receiver redials
+		s.pulled = 0
+	}
+	return elem.elem, api.PullOk
+}
+
+func (s *subscriber) Peek(absPos uint64) interface{} {
+	if elem, ok := s.StreamProvider.Peek(absPos).(remoteElem); ok {
+		return elem.elem
+	}
+	return nil
+}
+
+// Unsubscribes, what was received is still pulled.
+func (s *subscriber) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if atomic.CompareAndSwapInt32(&s.closing, 0, 1) && s.conn != nil {
+		_ = s.conn.Close()
+	}
+}
@@ -0,0 +1,82 @@
+package remote
+
+import (
+	"fmt"
+	"github.com/kuking/go-frank/v1/api"
+	"github.com/kuking/go-frank/v1/registry"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseSubscription(t *testing.T) {
+	request, address, err := parseSubscription("tcp://localhost:1234/events?sn=a&offset=42&window=10")
+	if err != nil || address != "localhost:1234" || request.From != WireFromOffset || request.Offset != 42 ||
+		request.Window != 10 {
+		t.Fatal("unexpected", request, address, err)
+	}
+	since := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	request, _, err = parseSubscription("tcp://localhost:1234/events?sn=a&since=" + since.Format(time.RFC3339Nano))
+	if err != nil || request.From != WireFromSince || request.Since != since.UnixNano() {
+		t.Fatal("unexpected", request, err)
+	}
+	request, _, err = parseSubscription("tcp://localhost:1234/events?sn=a")
+	if err != nil || request.From != WireFromNamed || request.Window != defaultWindow {
+		t.Fatal("unexpected", request, err)
+	}
+	for _, uri := range []string{
+		"tcp://localhost:1234/events",
+		"tcp://localhost:1234/?sn=a",
+		"udp://localhost:1234/events?sn=a",
+		"tcp://localhost:1234/events?sn=a&window=0",
+		"tcp://localhost:1234/events?sn=a&offset=x",
+		"tcp://localhost:1234/events?sn=a&since=yesterday",
+	} {
+		if _, _, err = parseSubscription(uri); err == nil {
+			t.Fatal("it should fail:", uri)
+		}
+	}
+}
+
+func TestSubscribe_ObtainedFromRegistry(t *testing.T) {
+	prefix, stream, addr, server := givenServer(100, t)
+	defer os.RemoveAll(prefix)
+	defer stream.CloseFile()
+	defer server.Close()
+
+	sub, err := registry.NewInMemoryRegistry().Obtain(fmt.Sprintf("tcp://%v/events?sn=a", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	assertPulls(sub, 0, 100, t)
+}
+
+func TestSubscribe_ResubscribesAfterADrop(t *testing.T) {
+	prefix, stream, addr, server := givenServer(1_000, t)
+	defer os.RemoveAll(prefix)
+	defer stream.CloseFile()
+
+	sub, err := Subscribe(fmt.Sprintf("tcp://%v/events?sn=a&window=100", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	assertPulls(sub, 0, 150, t)
+	_ = server.Close()
+
+	server = NewServer(server.Registry)
+	defer server.Close()
+	var listener net.Listener
+	assertWait("listening again", func() bool {
+		listener, err = net.Listen("tcp", addr)
+		return err == nil
+	}, t)
+	go server.Serve(listener)
+	// continues after the last one received, without repeating what was buffered before the drop
+	assertPulls(sub, 150, 850, t)
+	if elem, result := sub.TimeOut(api.WaitingUpto10ms).PullEx(); result != api.PullTimedOut {
+		t.Fatal("it should not receive more, got:", elem)
+	}
+}
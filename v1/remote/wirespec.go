@@ -0,0 +1,123 @@
+package remote
+
+const (
+	WireVersion    byte = 1
+	WireSUBSCRIBE  byte = 1
+	WireSUBSCRIBED byte = 2
+	WireELEMENT    byte = 3
+	WireACK        byte = 4
+	WireCLOSED     byte = 5
+	WireERROR      byte = 6
+	WirePUBLISH    byte = 7
+	WirePUBLISHED  byte = 8
+	WireBATCH      byte = 9
+	WireBATCHACK   byte = 10
+)
+
+// WireSubscribeMsg.From
+const (
+	WireFromNamed  byte = 0 // the subscriber named position, kept by the server
+	WireFromOffset byte = 1 // WireSubscribeMsg.Offset, an absolute position in the stream
+	WireFromSince  byte = 2 // the elements fed since WireSubscribeMsg.Since (see MmapStream.PositionSince)
+)
+
+// One TCP connection per subscription, all structs are sent in little endian.
+// The server sends at most WireSubscribeMsg.Window elements beyond the ones the subscriber acknowledged (flow control);
+// WireACKs move the subscriber named position in the server, so a new subscription with the same name continues from
+// the last acknowledged element. A subscriber reconnecting continues from the last element it received instead.
+
+// Subscription flow
+// SUBSCRIBER   ->     SERVER
+// send   WireSUBSCRIBE  recv     - Stream, subscriber name, from where to start and window
+// recv   WireSUBSCRIBED send     - Position the subscription starts at
+// recv    WireERROR     send     - Instead of WireSUBSCRIBED: i.e. no such stream, the connection is closed after it
+// recv   WireELEMENT    send     - One element, serialised with the server Serialiser
+// send     WireACK      recv     - Elements consumed since the last WireACK, and the position after them
+// recv    WireCLOSED    send     - The stream is closed and the subscriber has everything, the connection is closed
+
+// A publisher sends batches of elements numbered from 1, at most a few of them unacknowledged. The server feeds each
+// batch into the stream once, in order, remembering the last one fed for each publisher: after reconnecting, the
+// publisher resends the ones after WirePublishedMsg.LastSeq. A server not knowing the publisher (LastSeq 0, i.e. it
+// restarted, or the publisher was gone for too long) starts from the first batch it gets, resent batches can be fed
+// twice then. When the publisher is closed and everything was acknowledged, it sends a WireCLOSED and the server
+// forgets about it. WireBatchMsg.Length is at most maxBatchLength.
+
+// Publishing flow
+// PUBLISHER    ->     SERVER
+// send    WirePUBLISH   recv     - Stream and publisher id
+// recv   WirePUBLISHED  send     - Last batch fed from this publisher, 0 if none
+// recv    WireERROR     send     - Instead of WirePUBLISHED: i.e. no such stream, the connection is closed after it
+// send    WireBATCH     recv     - Elements, serialised with the server Serialiser
+// recv  WireBATCHACK    send     - The batch, and the ones before it, were fed
+// send    WireCLOSED    recv     - The publisher is done, the connection is closed
+
+type WireSubscribeMsg struct {
+	Version    byte // = WireVersion
+	Message    byte // = WireSUBSCRIBE
+	From       byte
+	Window     uint32
+	Offset     uint64
+	Since      int64 // unix nanos
+	Name       [128]byte
+	Subscriber [64]byte
+}
+
+type WireSubscribedMsg struct {
+	Version byte // = WireVersion
+	Message byte // = WireSUBSCRIBED
+	AbsPos  uint64
+}
+
+type WireElementMsg struct {
+	Version    byte // = WireVersion
+	Message    byte // = WireELEMENT
+	AbsPos     uint64
+	NextAbsPos uint64
+	Length     uint16 // followed by the element
+}
+
+type WireAckMsg struct {
+	Version byte // = WireVersion
+	Message byte // = WireACK
+	Count   uint32
+	AbsPos  uint64 // after the last one consumed
+}
+
+type WireClosedMsg struct {
+	Version byte // = WireVersion
+	Message byte // = WireCLOSED
+}
+
+type WireErrorMsg struct {
+	Version byte   // = WireVersion
+	Message byte   // = WireERROR
+	Busy    byte   // 1 when it can be retried, i.e. the previous connection of the subscriber or publisher is served
+	Length  uint16 // followed by the error text
+}
+
+type WirePublishMsg struct {
+	Version   byte // = WireVersion
+	Message   byte // = WirePUBLISH
+	Publisher uint64
+	Name      [128]byte
+}
+
+type WirePublishedMsg struct {
+	Version byte // = WireVersion
+	Message byte // = WirePUBLISHED
+	LastSeq uint64
+}
+
+type WireBatchMsg struct {
+	Version byte // = WireVersion
+	Message byte // = WireBATCH
+	Count   uint16
+	Seq     uint64
+	Length  uint32 // followed by Count elements, each one an uint16 length and the element
+}
+
+type WireBatchAckMsg struct {
+	Version byte // = WireVersion
+	Message byte // = WireBATCHACK
+	Seq     uint64
+}
@@ -2,6 +2,7 @@ package ringbuffer
 
 import (
 	"github.com/kuking/go-frank/v1/api"
+	"github.com/kuking/go-frank/v1/misc"
 	"runtime"
 	"sync/atomic"
 	"time"
@@ -15,6 +16,7 @@ type ringBufferProvider struct {
 	closedFlag  int32
 	waitTimeOut api.WaitTimeOut
 	waitDuty    api.WaitDuty
+	doorbell    misc.Doorbell
 }
 
 func NewRingBufferProvider(capacity int, waitDuty api.WaitDuty) *ringBufferProvider {
@@ -43,6 +45,7 @@ func (r *ringBufferProvider) Feed(elem interface{}) {
 				if !atomic.CompareAndSwapUint64(&r.ringWrite, ringWrite, ringWriteNextVal) {
 					panic("failed to commit allocated write in ring-buffer")
 				}
+				r.doorbell.Notify()
 				return
 			}
 		}
@@ -51,7 +54,7 @@ func (r *ringBufferProvider) Feed(elem interface{}) {
 	}
 }
 
-func (r *ringBufferProvider) Pull() (read interface{}, closed bool) {
+func (r *ringBufferProvider) Pull() (read interface{}, result api.PullResult) {
 	var totalNsWait int64
 	r.waitDuty.Reset()
 	rbs := uint64(len(r.ringBuffer))
@@ -63,18 +66,18 @@ func (r *ringBufferProvider) Pull() (read interface{}, closed bool) {
 			ringReadNextVal := ringRead + 1
 			val := r.ringBuffer[ringRead%rbs]
 			if atomic.CompareAndSwapUint64(&r.ringRead, ringRead, ringReadNextVal) {
-				return val, false
+				return val, api.PullOk
 			}
 		}
 		otherThreadWriting := ringWrite != ringWAlloc
 		if ringRead == ringWAlloc && !otherThreadWriting && r.IsClosed() {
-			return nil, true
+			return nil, api.PullClosed
 		}
 		totalNsWait += r.waitDuty.Loop()
 		if r.waitTimeOut == api.UntilClosed {
 			// just continue
 		} else if !otherThreadWriting && totalNsWait > int64(r.waitTimeOut) {
-			return nil, true
+			return nil, api.PullTimedOut
 		}
 	}
 }
@@ -86,6 +89,7 @@ func (r *ringBufferProvider) Close() {
 		ringWrite := atomic.LoadUint64(&r.ringWrite)
 		if ringRead == ringWrite {
 			atomic.StoreInt32(&r.closedFlag, 1)
+			r.doorbell.Notify()
 			return
 		}
 		runtime.Gosched()
@@ -136,3 +140,7 @@ func (r *ringBufferProvider) WaitTimeOut(waitTimeOut api.WaitTimeOut) {
 func (r *ringBufferProvider) WaitDuty(waitDuty api.WaitDuty) {
 	r.waitDuty = waitDuty
 }
+
+func (r *ringBufferProvider) Notifier() api.Notifier {
+	return &r.doorbell
+}
@@ -2,15 +2,30 @@ package transport
 
 import (
 	"bufio"
+	"io"
 	"net"
 )
 
 type BufferedConn struct {
-	r *bufio.Reader
-	w *bufio.Writer
+	r bufferedReader
+	w bufferedWriter
 	net.Conn
 }
 
+type bufferedReader interface {
+	io.Reader
+	Peek(n int) ([]byte, error)
+	Buffered() int
+}
+
+type bufferedWriter interface {
+	io.Writer
+	io.ByteWriter
+	io.StringWriter
+	WriteRune(r rune) (int, error)
+	Flush() error
+}
+
 func NewBufferedConn(c net.Conn) BufferedConn {
 	return BufferedConn{bufio.NewReader(c), bufio.NewWriter(c), c}
 }
@@ -19,10 +34,20 @@ func NewBufferedConnSize(c net.Conn, n int) BufferedConn {
 	return BufferedConn{bufio.NewReaderSize(c, n), bufio.NewWriterSize(c, n), c}
 }
 
+// Buffers messages into datagrams of up to mtu bytes, for packet connections (UDP).
+func NewDatagramConn(c net.Conn, mtu int) BufferedConn {
+	return BufferedConn{newDatagramReader(c), newDatagramWriter(c, mtu), c}
+}
+
 func (b BufferedConn) Peek(n int) ([]byte, error) {
 	return b.r.Peek(n)
 }
 
+// bytes that can be read without reading the connection
+func (b BufferedConn) Buffered() int {
+	return b.r.Buffered()
+}
+
 func (b BufferedConn) Read(p []byte) (int, error) {
 	return b.r.Read(p)
 }
@@ -0,0 +1,135 @@
+package transport
+
+import (
+	"github.com/kuking/go-frank/v1/persistent"
+	"hash/crc32"
+	"time"
+)
+
+const (
+	partChunkSize = 32 * 1024              // part bytes per WirePART message, over streams
+	partReqEvery  = 100 * time.Millisecond // a stalled part transfer is asked again, over datagrams
+	partWindow    = 64 * 1024              // part bytes asked at once over datagrams, the origin does not overrun the replica
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// Replica side of the bulk-sync. Sealed parts [first, end) are asked one at a time, chunks are written where they go
+// as they arrive (with a good checksum) and only the missing ranges are asked again, so a lost chunk does not make the
+// origin resend the rest of the part. Over datagrams the part is asked a window at a time, the next one once half of
+// the previous arrived. Once all are written the replica continues from the end of them, asking the
+// origin to stream entries from there with a WireNACKN.
+type bulkSync struct {
+	active   bool
+	resuming bool // over datagrams, the WireNACKN resuming the entries streaming is repeated until entries arrive
+	first    uint64
+	end      uint64
+	partNo   uint64
+	offset   uint64            // the part is complete up to here
+	received uint64            // end of the furthest chunk received
+	asked    uint64            // the part is asked up to here
+	window   uint64            // bytes asked at once, zero: the whole part
+	ahead    map[uint64]uint64 // chunks received after a missing one, offset -> length
+	lastReq  time.Time
+}
+
+// starts if a whole sealed part is missing or the origin' first part is beyond the replica write position (the entries
+// in between are gone, it can not be streamed); false if entry streaming is enough
+func (b *bulkSync) start(stream *persistent.MmapStream, status *WireStatusMsg, window uint64) bool {
+	partSize := stream.GetPartSize()
+	writePos := stream.WritePos()
+	first := writePos / partSize
+	if first < status.FirstPart {
+		first = status.FirstPart
+	}
+	end := status.WritePos / partSize
+	if writePos >= status.FirstPart*partSize && first >= end {
+		return false
+	}
+	*b = bulkSync{active: true, first: first, end: end, partNo: first, ahead: map[uint64]uint64{}, window: window}
+	return true
+}
+
+// writes the chunk, returns the range it skipped over if any (newly missing). Late, duplicated or corrupted chunks are
+// ignored, they will be asked again if still missing.
+func (b *bulkSync) write(stream *persistent.MmapStream, msg *WirePartMsg, data []byte) (gapOfs, gapLen uint64, err error) {
+	_, dup := b.ahead[msg.Offset]
+	if msg.PartNo != b.partNo || msg.Offset < b.offset || dup || len(data) == 0 ||
+		crc32.Checksum(data, crc32c) != msg.Crc {
+		return 0, 0, nil
+	}
+	if err = stream.WritePartAt(b.partNo, msg.Offset, data); err != nil {
+		return 0, 0, err
+	}
+	if msg.Offset > b.received {
+		gapOfs, gapLen = b.received, msg.Offset-b.received
+	}
+	if msg.Offset+uint64(len(data)) > b.received {
+		b.received = msg.Offset + uint64(len(data))
+	}
+	b.ahead[msg.Offset] = uint64(len(data))
+	for length, ok := b.ahead[b.offset]; ok; length, ok = b.ahead[b.offset] {
+		delete(b.ahead, b.offset)
+		b.offset += length
+	}
+	if b.offset == stream.GetPartSize() {
+		b.partNo++
+		b.offset = 0
+		b.received = 0
+		b.asked = 0
+	}
+	return
+}
+
+// the next range of the part to ask for, if it is time to
+func (b *bulkSync) next(partSize uint64) (ofs, length uint64, ok bool) {
+	if b.asked >= partSize || b.received+b.window/2 < b.asked {
+		return 0, 0, false
+	}
+	ofs, length = b.asked, b.window
+	if length == 0 || ofs+length > partSize {
+		length = partSize - ofs
+	}
+	b.asked += length
+	return ofs, length, true
+}
+
+// all the ranges still missing in the part (up to where it was asked), offset -> length
+func (b *bulkSync) missing() map[uint64]uint64 {
+	ranges := map[uint64]uint64{}
+	for ofs := b.offset; ofs < b.received; {
+		length, ok := b.ahead[ofs]
+		if ok {
+			ofs += length
+			continue
+		}
+		next := b.received
+		for aheadOfs := range b.ahead {
+			if aheadOfs > ofs && aheadOfs < next {
+				next = aheadOfs
+			}
+		}
+		ranges[ofs] = next - ofs
+		ofs = next
+	}
+	if b.received < b.asked {
+		ranges[b.received] = b.asked - b.received
+	}
+	return ranges
+}
+
+func (b *bulkSync) done() bool {
+	return b.partNo >= b.end
+}
+
+// the replica continues from the end of the received parts, with nothing before them if it was behind the first part
+func (b *bulkSync) finish(stream *persistent.MmapStream) {
+	partSize := stream.GetPartSize()
+	if stream.WritePos() < b.first*partSize {
+		stream.SetFirstPart(b.first)
+	}
+	if stream.WritePos() < b.end*partSize {
+		stream.SetWritePos(b.end * partSize)
+	}
+	b.active = false
+}
@@ -0,0 +1,95 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/kuking/go-frank/v1/persistent"
+	"github.com/kuking/go-frank/v1/serialisation"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestReplicator_BulkSyncsPartsPrunedAtTheOrigin(t *testing.T) {
+	for _, network := range []string{"tcp", "udp"} {
+		t.Run(network, func(t *testing.T) {
+			prefix, _ := ioutil.TempDir("", "MMAP-")
+			defer os.RemoveAll(prefix)
+
+			stream, _ := persistent.MmapStreamCreate(path.Join(prefix, "origin"), 64*1024, serialisation.ByteArraySerialiser{})
+			for i := 0; stream.SealedParts() < 5; i++ {
+				stream.Feed(bytes.Repeat([]byte{byte(i)}, i%2_000))
+			}
+			givenPartsArePruned(stream, path.Join(prefix, "origin"), 2)
+
+			var sl *SyncLink
+			if network == "tcp" {
+				listener, _ := net.Listen("tcp", "127.0.0.1:0")
+				defer listener.Close()
+				go NewReplicator().Serve(listener, prefix)
+				conn, _ := net.Dial("tcp", listener.Addr().String())
+				sl = NewReplicator().NewSyncLinkSend(conn, "replica", stream, "repl")
+			} else {
+				pconn, _ := net.ListenPacket("udp", "127.0.0.1:0")
+				defer pconn.Close()
+				go NewReplicator().ServeUDP(pconn, prefix)
+				conn, _ := net.Dial("udp", pconn.LocalAddr().String())
+				sl = NewReplicator().NewSyncLinkSend(&lossyConn{Conn: conn, dropEvery: 5, swapEvery: 7}, "replica", stream, "repl")
+				sl.datagram = true
+			}
+			go sl.goFuncSend()
+			defer sl.Close()
+			assertReplicaCatchesUp(prefix, stream, t)
+
+			// and then it streams entries as usual
+			for i := 0; i < 1_000; i++ {
+				stream.Feed([]byte(fmt.Sprint(i)))
+			}
+			assertReplicaCatchesUp(prefix, stream, t)
+
+			replicaStream, _ := persistent.MmapStreamOpen(path.Join(prefix, hexId(stream)), serialisation.ByteArraySerialiser{})
+			defer replicaStream.CloseFile()
+			if replicaStream.GetFirstPart() != 2 {
+				t.Fatal("the replica should start at the origin first part, it starts at:", replicaStream.GetFirstPart())
+			}
+			if err := sameStreamContentsSince(stream, replicaStream, 2*stream.GetPartSize()); err != nil {
+				t.Fatal(err)
+			}
+			first, _, _ := stream.PeekBySubId(stream.SubscriberIdForName("verify"), 2*stream.GetPartSize())
+			if elem, _ := replicaStream.Consume("reader").PullEx(); !bytes.Equal(elem.([]byte), first.([]byte)) {
+				t.Fatal("a new subscriber of the replica should start at its first part, got:", elem)
+			}
+		})
+	}
+}
+
+func givenPartsArePruned(stream *persistent.MmapStream, baseName string, firstPart uint64) {
+	stream.SetFirstPart(firstPart)
+	for partNo := uint64(0); partNo < firstPart; partNo++ {
+		_ = os.Remove(baseName + fmt.Sprintf(".%05x", partNo))
+	}
+}
+
+func sameStreamContentsSince(a, b *persistent.MmapStream, absPos uint64) error {
+	aSubId, bSubId := a.SubscriberIdForName("verify"), b.SubscriberIdForName("verify")
+	count := 0
+	for {
+		aElem, aNextAbsPos, aOk := a.PeekBySubId(aSubId, absPos)
+		bElem, bNextAbsPos, bOk := b.PeekBySubId(bSubId, absPos)
+		if !aOk && !bOk {
+			break
+		}
+		if aOk != bOk || aNextAbsPos != bNextAbsPos || !bytes.Equal(aElem.([]byte), bElem.([]byte)) {
+			return errors.New(fmt.Sprint("different element at: ", absPos, " after ", count, " elements"))
+		}
+		absPos = aNextAbsPos
+		count++
+	}
+	if absPos != a.WritePos() {
+		return errors.New(fmt.Sprint("stopped before the end at: ", absPos))
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package transport
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	compressBatchSize  = 32 * 1024                   // WireDATA frames are batched up to this size before compressing them
+	maxCompressedBatch = compressBatchSize + 64*1024 // the batch is sent once beyond compressBatchSize, an element is up to 64KiB
+)
+
+// SyncLink.compress, agreed in the WireHELLOs
+const (
+	compressOff     uint32 = iota
+	compressOffered        // the origin offered it, it holds on streaming until the replica answers
+	compressOn
+)
+
+// Origin side of the compression, WireDATA frames (header and payload, as they would be sent) are batched and sent
+// flate-compressed in one WireCDATA message. Only over streams, a lost datagram would lose the whole batch.
+type deflater struct {
+	raw        bytes.Buffer
+	compressed bytes.Buffer
+	w          *flate.Writer
+}
+
+func newDeflater(level int) (*deflater, error) {
+	d := &deflater{}
+	var err error
+	d.w, err = flate.NewWriter(&d.compressed, level)
+	return d, err
+}
+
+func (d *deflater) add(header *WireDataMsgNA, elem []byte) {
+	d.raw.Write(header[:])
+	d.raw.Write(elem)
+}
+
+func (d *deflater) full() bool {
+	return d.raw.Len() >= compressBatchSize
+}
+
+// compresses the batched frames and writes them as a WireCDATA message, if there are any
+func (d *deflater) flush(w io.Writer, stats *linkCounters) error {
+	if d.raw.Len() == 0 {
+		return nil
+	}
+	d.compressed.Reset()
+	d.w.Reset(&d.compressed)
+	if _, err := d.w.Write(d.raw.Bytes()); err != nil {
+		return err
+	}
+	if err := d.w.Close(); err != nil {
+		return err
+	}
+	msg := WireCDataMsg{
+		Version:   WireVersion,
+		Message:   WireCDATA,
+		RawLength: uint32(d.raw.Len()),
+		Length:    uint32(d.compressed.Len()),
+	}
+	if err := binary.Write(w, binary.LittleEndian, &msg); err != nil {
+		return err
+	}
+	if _, err := w.Write(d.compressed.Bytes()); err != nil {
+		return err
+	}
+	stats.batch(d.raw.Len(), binary.Size(&msg)+d.compressed.Len())
+	d.raw.Reset()
+	return nil
+}
+
+// Replica side, reads a WireCDATA message and returns the frames in it (valid until the next read).
+type inflater struct {
+	compressed []byte
+	raw        []byte
+	src        bytes.Reader
+	r          io.ReadCloser
+}
+
+func (i *inflater) read(r io.Reader, stats *linkCounters) (frames []byte, err error) {
+	var msg WireCDataMsg
+	if err = binary.Read(r, binary.LittleEndian, &msg); err != nil {
+		return nil, err
+	}
+	if msg.RawLength > maxCompressedBatch || msg.Length > maxCompressedBatch*2 {
+		return nil, errors.New(fmt.Sprintf("invalid WireCDATA lengths: %v (%v compressed)", msg.RawLength, msg.Length))
+	}
+	if cap(i.compressed) < int(msg.Length) {
+		i.compressed = make([]byte, msg.Length)
+	}
+	if _, err = io.ReadFull(r, i.compressed[0:msg.Length]); err != nil {
+		return nil, err
+	}
+	i.src.Reset(i.compressed[0:msg.Length])
+	if i.r == nil {
+		i.r = flate.NewReader(&i.src)
+	} else if err = i.r.(flate.Resetter).Reset(&i.src, nil); err != nil {
+		return nil, err
+	}
+	if cap(i.raw) < int(msg.RawLength) {
+		i.raw = make([]byte, msg.RawLength)
+	}
+	if _, err = io.ReadFull(i.r, i.raw[0:msg.RawLength]); err != nil {
+		return nil, err
+	}
+	stats.batch(int(msg.RawLength), binary.Size(&msg)+int(msg.Length))
+	return i.raw[0:msg.RawLength], nil
+}
+
+// splits the first WireDATA frame out of a batch
+func nextFrame(frames []byte) (absPos uint64, elem []byte, rest []byte, err error) {
+	var header WireDataMsgNA
+	if len(frames) < len(header) {
+		return 0, nil, nil, errors.New("truncated WireCDATA frame")
+	}
+	copy(header[:], frames)
+	end := len(header) + int(header.Length())
+	if header.Version() != WireVersion || header.Message() != WireDATA || end > len(frames) {
+		return 0, nil, nil, errors.New("invalid WireCDATA frame")
+	}
+	return header.AbsPos(), frames[len(header):end], frames[end:], nil
+}
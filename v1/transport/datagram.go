@@ -0,0 +1,204 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultDatagramMTU    = 1_400                  // conservative payload size, it avoids IP fragmentation on most networks
+	defaultDatagramWindow = 128 * 1024             // bytes sent and not yet acknowledged by the replica
+	datagramAckEvery      = 16 * 1024              // replica acknowledges at least every this many bytes
+	datagramAckTimeOut    = 250 * time.Millisecond // no ACK progress with data in flight, the tail is sent again
+	datagramIdleEvery     = 20 * time.Millisecond  // idle replica re-asks for missing elements or acknowledges
+	datagramHelloEvery    = 250 * time.Millisecond
+	datagramQueueSize     = 1_024       // datagrams queued per peer in a demultiplexed listener
+	datagramPeerIdle      = time.Minute // a demultiplexed peer sending nothing for this long is dropped, with its link
+	datagramSocketBuffer  = 4 * 1024 * 1024
+)
+
+var errShortDatagram = errors.New("message crosses the datagram boundary")
+
+// Reads whole datagrams and serves the messages within them, a message never spans two datagrams so a lost datagram
+// only loses whole messages. Every message is peeked first (Peek moves on to the next datagram), then read.
+type datagramReader struct {
+	conn net.Conn
+	buf  []byte
+	r, w int
+}
+
+func newDatagramReader(conn net.Conn) *datagramReader {
+	return &datagramReader{conn: conn, buf: make([]byte, 65536)}
+}
+
+func (d *datagramReader) next() error {
+	for d.r == d.w {
+		n, err := d.conn.Read(d.buf)
+		if err != nil {
+			return err
+		}
+		d.r, d.w = 0, n
+	}
+	return nil
+}
+
+func (d *datagramReader) Peek(n int) ([]byte, error) {
+	if err := d.next(); err != nil {
+		return nil, err
+	}
+	if n > d.w-d.r {
+		return d.buf[d.r:d.w], errShortDatagram
+	}
+	return d.buf[d.r : d.r+n], nil
+}
+
+func (d *datagramReader) Buffered() int {
+	return d.w - d.r
+}
+
+// reads within the current datagram only, a message ending short of what is read is an error (not the next datagram)
+func (d *datagramReader) Read(p []byte) (int, error) {
+	n := copy(p, d.buf[d.r:d.w])
+	d.r += n
+	if n < len(p) {
+		return n, errShortDatagram
+	}
+	return n, nil
+}
+
+// Packs messages into datagrams up to the MTU, every Write call has to be a whole message; a message bigger than the
+// MTU travels alone (and the IP layer will fragment it).
+type datagramWriter struct {
+	conn net.Conn
+	mtu  int
+	buf  []byte
+}
+
+func newDatagramWriter(conn net.Conn, mtu int) *datagramWriter {
+	return &datagramWriter{conn: conn, mtu: mtu, buf: make([]byte, 0, mtu)}
+}
+
+func (d *datagramWriter) Write(p []byte) (int, error) {
+	if len(d.buf) > 0 && len(d.buf)+len(p) > d.mtu {
+		if err := d.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	d.buf = append(d.buf, p...)
+	return len(p), nil
+}
+
+func (d *datagramWriter) WriteByte(c byte) error {
+	_, err := d.Write([]byte{c})
+	return err
+}
+
+func (d *datagramWriter) WriteRune(r rune) (int, error) {
+	return d.Write([]byte(string(r)))
+}
+
+func (d *datagramWriter) WriteString(s string) (int, error) {
+	return d.Write([]byte(s))
+}
+
+func (d *datagramWriter) Flush() error {
+	if len(d.buf) == 0 {
+		return nil
+	}
+	_, err := d.conn.Write(d.buf)
+	d.buf = d.buf[:0]
+	return err
+}
+
+// One peer of a demultiplexed datagram listener, as a net.Conn: reads come from the listener, writes go to the peer.
+type demuxConn struct {
+	pconn    net.PacketConn
+	addr     net.Addr
+	in       chan []byte
+	closed   chan struct{}
+	once     sync.Once
+	deadline atomic.Value // time.Time
+	lastSeen time.Time    // of its last datagram, kept by the listener
+}
+
+func newDemuxConn(pconn net.PacketConn, addr net.Addr) *demuxConn {
+	dc := &demuxConn{
+		pconn:  pconn,
+		addr:   addr,
+		in:     make(chan []byte, datagramQueueSize),
+		closed: make(chan struct{}),
+	}
+	dc.deadline.Store(time.Time{})
+	return dc
+}
+
+// queues a datagram for the reader, it is dropped if the peer is not keeping up (as the network would do)
+func (dc *demuxConn) deliver(datagram []byte) {
+	select {
+	case dc.in <- datagram:
+	default:
+	}
+}
+
+func (dc *demuxConn) isClosed() bool {
+	select {
+	case <-dc.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (dc *demuxConn) Read(p []byte) (int, error) {
+	var timeOut <-chan time.Time
+	if deadline := dc.deadline.Load().(time.Time); !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeOut = timer.C
+	}
+	select {
+	case datagram := <-dc.in:
+		return copy(p, datagram), nil
+	case <-dc.closed:
+		return 0, net.ErrClosed
+	case <-timeOut:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (dc *demuxConn) Write(p []byte) (int, error) {
+	if dc.isClosed() {
+		return 0, net.ErrClosed
+	}
+	return dc.pconn.WriteTo(p, dc.addr)
+}
+
+func (dc *demuxConn) Close() error {
+	dc.once.Do(func() { close(dc.closed) })
+	return nil
+}
+
+func (dc *demuxConn) LocalAddr() net.Addr {
+	return dc.pconn.LocalAddr()
+}
+
+func (dc *demuxConn) RemoteAddr() net.Addr {
+	return dc.addr
+}
+
+func (dc *demuxConn) SetDeadline(t time.Time) error {
+	return dc.SetReadDeadline(t)
+}
+
+func (dc *demuxConn) SetReadDeadline(t time.Time) error {
+	dc.deadline.Store(t)
+	return nil
+}
+
+func (dc *demuxConn) SetWriteDeadline(_ time.Time) error {
+	return nil
+}
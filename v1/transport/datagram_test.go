@@ -0,0 +1,190 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/kuking/go-frank/v1/persistent"
+	"github.com/kuking/go-frank/v1/serialisation"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDatagramWriter_NeverSplitsMessages(t *testing.T) {
+	conn := &recordingConn{}
+	w := newDatagramWriter(conn, 100)
+	for i := 0; i < 10; i++ {
+		_, _ = w.Write(bytes.Repeat([]byte{byte(i)}, 30))
+	}
+	_, _ = w.Write(bytes.Repeat([]byte{0xff}, 250)) // bigger than the MTU, alone
+	_ = w.Flush()
+
+	if len(conn.datagrams) != 5 {
+		t.Fatal("expected 3 messages per datagram and the big one alone, got:", len(conn.datagrams))
+	}
+	for i, datagram := range conn.datagrams[:4] {
+		if len(datagram)%30 != 0 || (i < 3 && len(datagram) != 90) {
+			t.Fatal("datagram", i, "has a partial message, len:", len(datagram))
+		}
+	}
+	if len(conn.datagrams[4]) != 250 {
+		t.Fatal()
+	}
+
+	r := newDatagramReader(&recordingConn{datagrams: conn.datagrams})
+	if b, err := r.Peek(2); err != nil || b[0] != 0 {
+		t.Fatal(err)
+	}
+	if _, err := r.Peek(91); err != errShortDatagram {
+		t.Fatal("it should not peek beyond the datagram")
+	}
+	if n, err := r.Read(make([]byte, 91)); err != errShortDatagram || n != 90 {
+		t.Fatal("it should not read beyond the datagram", n, err)
+	}
+	if n, err := r.Read(make([]byte, 1)); err != errShortDatagram || n != 0 {
+		t.Fatal("the next datagram is only read peeking the next message", n, err)
+	}
+	if b, err := r.Peek(2); err != nil || b[0] != 3 {
+		t.Fatal("it should peek the next datagram", err)
+	}
+}
+
+func TestReplicator_EvictsIdlePeers(t *testing.T) {
+	now := time.Now()
+	peers := map[string]*demuxConn{"closed": newDemuxConn(nil, nil), "idle": newDemuxConn(nil, nil),
+		"active": newDemuxConn(nil, nil)}
+	_ = peers["closed"].Close()
+	peers["closed"].lastSeen = now
+	peers["idle"].lastSeen = now.Add(-datagramPeerIdle - time.Second)
+	peers["active"].lastSeen = now.Add(-time.Second)
+	idle := peers["idle"]
+
+	evictIdlePeers(peers, now)
+	if len(peers) != 1 || peers["active"] == nil || !idle.isClosed() {
+		t.Fatal("only the active peer should be kept", peers)
+	}
+}
+
+func TestReplicator_UDP(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+	pconn, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	defer pconn.Close()
+	go NewReplicator().ServeUDP(pconn, prefix)
+
+	stream, _ := persistent.MmapStreamCreate(path.Join(prefix, "origin"), 1024*1024, serialisation.ByteArraySerialiser{})
+	for i := 0; i < 10_000; i++ {
+		stream.Feed(bytes.Repeat([]byte{byte(i)}, i%3_000))
+	}
+	if err := NewReplicator().ConnectUDP(stream, "repl", pconn.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	assertReplicaCatchesUp(prefix, stream, t)
+}
+
+func TestReplicator_UDPRecoversLostAndReorderedDatagrams(t *testing.T) {
+	for _, secret := range []string{"", "s3cr3t"} {
+		t.Run(fmt.Sprintf("secret=%v", secret), func(t *testing.T) {
+			prefix, _ := ioutil.TempDir("", "MMAP-")
+			defer os.RemoveAll(prefix)
+			replica := NewReplicator()
+			replica.SharedSecret = []byte(secret)
+			pconn, _ := net.ListenPacket("udp", "127.0.0.1:0")
+			defer pconn.Close()
+			go replica.ServeUDP(pconn, prefix)
+
+			stream, _ := persistent.MmapStreamCreate(path.Join(prefix, "origin"), 1024*1024, serialisation.ByteArraySerialiser{})
+			for i := 0; i < 5_000; i++ {
+				stream.Feed([]byte(fmt.Sprint(i)))
+			}
+			origin := NewReplicator()
+			origin.SharedSecret = []byte(secret)
+			conn, _ := net.Dial("udp", pconn.LocalAddr().String())
+			sl := origin.NewSyncLinkSend(&lossyConn{Conn: conn, dropEvery: 5, swapEvery: 7}, "replica", stream, "repl")
+			sl.datagram = true
+			go sl.goFuncSend()
+
+			assertReplicaCatchesUp(prefix, stream, t)
+			replicaStream, _ := persistent.MmapStreamOpen(path.Join(prefix, hexId(stream)), serialisation.ByteArraySerialiser{})
+			defer replicaStream.CloseFile()
+			if err := sameStreamContents(stream, replicaStream); err != nil {
+				t.Fatal(err)
+			}
+			sl.Close()
+		})
+	}
+}
+
+func assertReplicaCatchesUp(prefix string, stream *persistent.MmapStream, t *testing.T) {
+	assertWait("replica to catch up", func() bool {
+		replica, err := persistent.MmapStreamOpen(path.Join(prefix, hexId(stream)), serialisation.ByteArraySerialiser{})
+		if err != nil {
+			return false
+		}
+		defer replica.CloseFile()
+		return replica.WritePos() == stream.WritePos()
+	}, 10*time.Second, t)
+}
+
+func sameStreamContents(a, b *persistent.MmapStream) error {
+	as, bs := a.Consume("verify").AsArray(), b.Consume("verify").AsArray()
+	if len(as) != len(bs) {
+		return errors.New(fmt.Sprint("different lengths: ", len(as), " ", len(bs)))
+	}
+	for i := range as {
+		if !bytes.Equal(as[i].([]byte), bs[i].([]byte)) {
+			return errors.New(fmt.Sprint("different element at: ", i))
+		}
+	}
+	return nil
+}
+
+// drops one every dropEvery datagrams and swaps the order of one every swapEvery ones
+type lossyConn struct {
+	net.Conn
+	lock      sync.Mutex
+	dropEvery int
+	swapEvery int
+	count     int
+	held      []byte
+}
+
+func (l *lossyConn) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.count++
+	if l.count%l.dropEvery == 1 {
+		return len(p), nil
+	}
+	if l.held == nil && l.count%l.swapEvery == 0 {
+		l.held = append([]byte(nil), p...)
+		return len(p), nil
+	}
+	n, err := l.Conn.Write(p)
+	if l.held != nil {
+		_, _ = l.Conn.Write(l.held)
+		l.held = nil
+	}
+	return n, err
+}
+
+type recordingConn struct {
+	net.Conn
+	datagrams [][]byte
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.datagrams = append(c.datagrams, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	datagram := c.datagrams[0]
+	c.datagrams = c.datagrams[1:]
+	return copy(p, datagram), nil
+}
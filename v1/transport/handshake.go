@@ -0,0 +1,35 @@
+package transport
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	handshakeRoleOrigin  byte = 'O'
+	handshakeRoleReplica byte = 'R'
+)
+
+var (
+	ErrAuthenticationFailed   = errors.New("authentication failed, shared secret mismatch")
+	ErrAuthenticationRequired = errors.New("authentication required, a shared secret has to be configured on both ends")
+)
+
+// the role byte stops a peer from reflecting the other end's MAC back
+func handshakeMac(secret []byte, role byte, originNonce, replicaNonce [16]byte, uniqId uint64) (mac [32]byte) {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte{role})
+	h.Write(originNonce[:])
+	h.Write(replicaNonce[:])
+	_ = binary.Write(h, binary.LittleEndian, uniqId)
+	copy(mac[:], h.Sum(nil))
+	return
+}
+
+func newNonce() (nonce [16]byte, err error) {
+	_, err = rand.Read(nonce[:])
+	return
+}
@@ -0,0 +1,460 @@
+package transport
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	muxFrameSize  = 16 * 1024  // a channel holds the connection for one frame, then it is the next channel turn
+	muxQueueSize  = 16         // frames queued per channel, writing beyond it blocks
+	muxWindow     = 256 * 1024 // bytes a channel sends beyond what the link at the other end read
+	muxBufferSize = 64 * 1024
+)
+
+// Many links over a single connection, one channel each. Every link reads and writes its own channel (a virtual
+// connection) as it would do with a connection of its own, so each one keeps its handshake, HWM and ACKs. The sender
+// takes one frame from every channel with something to send in turn, so a busy stream does not starve the others.
+// A channel does not send more than its window beyond what the link at the other end read (the reader grants it back
+// with WireMUXCREDIT), so the frames of a slow link are queued for it without holding the others. Channels are opened
+// by the origin end and accepted by the replica one, and they are gone once both ends closed them; the origin end
+// half-closes the connection when all its channels are gone, and the replica end closes it then.
+type mux struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	lock     sync.Mutex
+	cond     *sync.Cond // signals frames queued, and frames sent
+	channels map[uint32]*muxConn
+	order    []*muxConn // round-robin of the sender
+	turn     int
+	lastId   uint32            // opened
+	grants   map[uint32]uint32 // credit to send back, by channel
+	accept   func(mc *muxConn) // nil on the origin end
+	done     chan struct{}
+	err      error
+	closing  bool // no more channels can be opened
+}
+
+func newMux(conn net.Conn, r *bufio.Reader, accept func(mc *muxConn)) *mux {
+	if r == nil {
+		r = bufio.NewReaderSize(conn, muxBufferSize)
+	}
+	m := &mux{
+		conn:     conn,
+		r:        r,
+		channels: map[uint32]*muxConn{},
+		grants:   map[uint32]uint32{},
+		accept:   accept,
+		done:     make(chan struct{}),
+	}
+	m.cond = sync.NewCond(&m.lock)
+	go m.goFuncWrite()
+	go m.goFuncRead()
+	return m
+}
+
+// a new channel, the replica end accepts it with its first frame
+func (m *mux) open() (*muxConn, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closing {
+		return nil, net.ErrClosed
+	}
+	m.lastId++
+	return m.add(m.lastId), nil
+}
+
+func (m *mux) isClosed() bool {
+	select {
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// with the lock held
+func (m *mux) add(id uint32) *muxConn {
+	mc := &muxConn{
+		mux:     m,
+		id:      id,
+		arrived: make(chan struct{}, 1),
+		credit:  muxWindow,
+		closed:  make(chan struct{}),
+	}
+	mc.deadline.Store(time.Time{})
+	mc.writeDeadline.Store(time.Time{})
+	m.channels[id] = mc
+	m.order = append(m.order, mc)
+	return mc
+}
+
+// it sent its last frame; with the lock held
+func (m *mux) remove(mc *muxConn) {
+	mc.sentClose = true
+	if mc.gotClose {
+		delete(m.channels, mc.id)
+	}
+	for i, other := range m.order {
+		if other == mc {
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			if i < m.turn {
+				m.turn--
+			}
+			break
+		}
+	}
+}
+
+// the next frame to send, round-robin between the channels with credit for it; with the lock held
+func (m *mux) nextFrame() (*muxConn, []byte) {
+	for i := 0; i < len(m.order); i++ {
+		mc := m.order[(m.turn+i)%len(m.order)]
+		if len(mc.out) > 0 && len(mc.out[0]) <= mc.credit {
+			frame := mc.out[0]
+			mc.out[0] = nil
+			mc.out = mc.out[1:]
+			mc.credit -= len(frame)
+			m.turn = (m.turn + i + 1) % len(m.order)
+			m.cond.Broadcast()
+			if len(frame) == 0 { // closed, this is its last one
+				m.remove(mc)
+			}
+			return mc, frame
+		}
+	}
+	return nil, nil
+}
+
+// the credit to send back; with the lock held
+func (m *mux) takeGrants() (grants []WireMuxCreditMsg) {
+	for id, credit := range m.grants {
+		grants = append(grants, WireMuxCreditMsg{Version: WireVersion, Message: WireMUXCREDIT, Channel: id, Credit: credit})
+		delete(m.grants, id)
+	}
+	return
+}
+
+func (m *mux) fail(err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.isClosed() {
+		return
+	}
+	m.err = err
+	m.closing = true
+	close(m.done)
+	m.cond.Broadcast()
+	_ = m.conn.Close()
+}
+
+func (m *mux) goFuncWrite() {
+	w := bufio.NewWriterSize(m.conn, muxBufferSize)
+	header := WireMuxMsg{Version: WireVersion, Message: WireMUX}
+	for {
+		m.lock.Lock()
+		grants := m.takeGrants()
+		mc, frame := m.nextFrame()
+		for len(grants) == 0 && mc == nil && !m.isClosed() {
+			if w.Buffered() > 0 { // nothing else to send, it goes out now
+				m.lock.Unlock()
+				if err := w.Flush(); err != nil {
+					m.fail(err)
+					return
+				}
+				m.lock.Lock()
+			} else if m.accept == nil && len(m.channels) == 0 && m.lastId > 0 {
+				m.closing = true
+				m.lock.Unlock()
+				m.closeWrite()
+				return
+			} else {
+				m.cond.Wait()
+			}
+			grants = m.takeGrants()
+			mc, frame = m.nextFrame()
+		}
+		m.lock.Unlock()
+		if len(grants) == 0 && mc == nil {
+			return
+		}
+		for i := range grants {
+			if err := binary.Write(w, binary.LittleEndian, &grants[i]); err != nil {
+				m.fail(err)
+				return
+			}
+		}
+		if mc == nil {
+			continue
+		}
+		header.Channel = mc.id
+		header.Length = uint16(len(frame))
+		if err := binary.Write(w, binary.LittleEndian, &header); err != nil {
+			m.fail(err)
+			return
+		}
+		if _, err := w.Write(frame); err != nil {
+			m.fail(err)
+			return
+		}
+	}
+}
+
+// the replica end closes the connection once it reads everything sent, then the reader finishes
+func (m *mux) closeWrite() {
+	if cw, ok := m.conn.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+		return
+	}
+	m.fail(net.ErrClosed)
+}
+
+func (m *mux) goFuncRead() {
+	var header WireMuxMsg
+	var credit WireMuxCreditMsg
+	for {
+		first, err := m.r.Peek(2)
+		if err == nil && first[0] == WireVersion && first[1] == WireMUXCREDIT {
+			if err = binary.Read(m.r, binary.LittleEndian, &credit); err != nil {
+				m.fail(err)
+				return
+			}
+			m.lock.Lock()
+			if mc := m.channels[credit.Channel]; mc != nil {
+				mc.credit += int(credit.Credit)
+				m.cond.Broadcast()
+			}
+			m.lock.Unlock()
+			continue
+		}
+		if err == nil {
+			err = binary.Read(m.r, binary.LittleEndian, &header)
+		}
+		if err != nil {
+			m.fail(err)
+			return
+		}
+		if header.Version != WireVersion || header.Message != WireMUX {
+			m.fail(errors.New(fmt.Sprintf("expected a multiplexed frame, got message %v version %v", header.Message, header.Version)))
+			return
+		}
+		frame := make([]byte, header.Length)
+		if _, err := io.ReadFull(m.r, frame); err != nil {
+			m.fail(err)
+			return
+		}
+		m.lock.Lock()
+		mc := m.channels[header.Channel]
+		accepted := false
+		if mc == nil && m.accept != nil && header.Length > 0 {
+			mc = m.add(header.Channel)
+			accepted = true
+		} else if mc != nil && header.Length == 0 {
+			mc.gotClose = true
+			if mc.sentClose {
+				delete(m.channels, mc.id)
+				m.cond.Broadcast() // it might have been the last one
+			}
+		}
+		if mc != nil {
+			mc.deliver(frame)
+		}
+		m.lock.Unlock()
+		if accepted {
+			m.accept(mc)
+		}
+	}
+}
+
+// One channel of a mux, a net.Conn for the link using it.
+type muxConn struct {
+	mux           *mux
+	id            uint32
+	in            [][]byte      // frames arrived and not read yet, guarded by the mux lock
+	arrived       chan struct{} // signalled when a frame arrives
+	pending       []byte        // what did not fit in the last read
+	eof           bool
+	read          int      // bytes read by the link and not granted back yet
+	out           [][]byte // guarded by the mux lock, as credit, sentClose and gotClose
+	credit        int      // bytes it can send
+	sentClose     bool
+	gotClose      bool
+	closed        chan struct{}
+	once          sync.Once
+	deadline      atomic.Value // time.Time
+	writeDeadline atomic.Value // time.Time
+}
+
+// queues the frame for the link, the other end sends no more than the window so it does not wait for the link to
+// read it; with the mux lock held
+func (mc *muxConn) deliver(frame []byte) {
+	if mc.isClosed() {
+		return
+	}
+	mc.in = append(mc.in, frame)
+	select {
+	case mc.arrived <- struct{}{}:
+	default:
+	}
+}
+
+func (mc *muxConn) nextIn() (frame []byte, ok bool) {
+	mc.mux.lock.Lock()
+	defer mc.mux.lock.Unlock()
+	if len(mc.in) == 0 {
+		return nil, false
+	}
+	frame = mc.in[0]
+	mc.in[0] = nil
+	mc.in = mc.in[1:]
+	return frame, true
+}
+
+func (mc *muxConn) Read(p []byte) (int, error) {
+	if len(mc.pending) == 0 && !mc.eof {
+		var timeOut <-chan time.Time
+		if deadline := mc.deadline.Load().(time.Time); !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			timeOut = timer.C
+		}
+		frame, ok := mc.nextIn()
+		for !ok {
+			select {
+			case <-mc.arrived:
+			case <-mc.closed:
+				return 0, net.ErrClosed
+			case <-mc.mux.done:
+				return 0, mc.mux.err
+			case <-timeOut:
+				return 0, os.ErrDeadlineExceeded
+			}
+			frame, ok = mc.nextIn()
+		}
+		mc.pending = frame
+		mc.eof = len(frame) == 0
+	}
+	if mc.eof {
+		return 0, io.EOF
+	}
+	n := copy(p, mc.pending)
+	mc.pending = mc.pending[n:]
+	mc.grant(n)
+	return n, nil
+}
+
+// the link read n more bytes, the other end gets the credit back in chunks (less than a window minus a frame, so it
+// never waits for credit which is not granted)
+func (mc *muxConn) grant(n int) {
+	mc.read += n
+	if mc.read >= muxWindow/4 {
+		m := mc.mux
+		m.lock.Lock()
+		m.grants[mc.id] += uint32(mc.read)
+		m.cond.Broadcast()
+		m.lock.Unlock()
+		mc.read = 0
+	}
+}
+
+func (mc *muxConn) Write(p []byte) (int, error) {
+	m := mc.mux
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	deadline := mc.writeDeadline.Load().(time.Time)
+	if !deadline.IsZero() {
+		// wakes the write up when the deadline is due
+		timer := time.AfterFunc(time.Until(deadline), func() {
+			m.lock.Lock()
+			defer m.lock.Unlock()
+			m.cond.Broadcast()
+		})
+		defer timer.Stop()
+	}
+	expired := func() bool { return !deadline.IsZero() && !time.Now().Before(deadline) }
+	for n := 0; n < len(p); {
+		for len(mc.out) >= muxQueueSize && !m.isClosed() && !mc.isClosed() && !expired() {
+			m.cond.Wait()
+		}
+		if m.isClosed() {
+			return n, m.err
+		}
+		if mc.isClosed() {
+			return n, net.ErrClosed
+		}
+		if expired() {
+			return n, os.ErrDeadlineExceeded
+		}
+		size := len(p) - n
+		if size > muxFrameSize {
+			size = muxFrameSize
+		}
+		mc.out = append(mc.out, append([]byte(nil), p[n:n+size]...))
+		n += size
+		m.cond.Broadcast()
+	}
+	return len(p), nil
+}
+
+func (mc *muxConn) isClosed() bool {
+	select {
+	case <-mc.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// what was written is still sent, followed by an empty frame closing the channel at the other end
+func (mc *muxConn) Close() error {
+	mc.once.Do(func() {
+		m := mc.mux
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		close(mc.closed)
+		mc.out = append(mc.out, []byte{})
+		m.cond.Broadcast()
+	})
+	return nil
+}
+
+func (mc *muxConn) LocalAddr() net.Addr {
+	return mc.mux.conn.LocalAddr()
+}
+
+func (mc *muxConn) RemoteAddr() net.Addr {
+	return mc.mux.conn.RemoteAddr()
+}
+
+func (mc *muxConn) SetDeadline(t time.Time) error {
+	_ = mc.SetWriteDeadline(t)
+	return mc.SetReadDeadline(t)
+}
+
+func (mc *muxConn) SetReadDeadline(t time.Time) error {
+	mc.deadline.Store(t)
+	return nil
+}
+
+// a write waiting for room in the channel queue (i.e. its link at the other end is not reading) gives up at t
+func (mc *muxConn) SetWriteDeadline(t time.Time) error {
+	mc.writeDeadline.Store(t)
+	return nil
+}
+
+// a connection already read into r, so nothing read is lost
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (pc *peekedConn) Read(p []byte) (int, error) {
+	return pc.r.Read(p)
+}
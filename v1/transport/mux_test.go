@@ -0,0 +1,204 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/kuking/go-frank/v1/persistent"
+	"github.com/kuking/go-frank/v1/serialisation"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return conn, err
+}
+
+func TestReplicator_MuxManyStreamsOneConnection(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+	replicaPath := path.Join(prefix, "replica")
+	_ = os.Mkdir(replicaPath, 0755)
+	tcpListener, _ := net.Listen("tcp", "127.0.0.1:0")
+	listener := &countingListener{Listener: tcpListener}
+	replica := NewReplicator()
+	go replica.Serve(listener, replicaPath)
+	defer replica.Shutdown(context.Background())
+
+	origin := NewReplicator()
+	streams := make([]*persistent.MmapStream, 10)
+	for i := range streams {
+		streams[i], _ = persistent.MmapStreamCreate(path.Join(prefix, fmt.Sprint("origin", i)), 64*1024, serialisation.ByteArraySerialiser{})
+		defer streams[i].CloseFile()
+		if err := origin.ConnectTCPMux(streams[i], "repl", listener.Addr().String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	feed := func(n int) {
+		for i := 0; i < n; i++ {
+			for s, stream := range streams {
+				stream.Feed([]byte(fmt.Sprint("stream ", s, " element ", i)))
+			}
+		}
+	}
+	feed(100)
+	for _, stream := range streams {
+		assertReplicaCatchesUp(replicaPath, stream, t)
+	}
+	for _, link := range origin.Links {
+		link := link
+		assertWait("every stream acknowledged", func() bool {
+			return link.Stream.GetRepHWM(link.repId) == link.Stream.WritePos()
+		}, 5*time.Second, t)
+	}
+	if atomic.LoadInt32(&listener.accepted) != 1 || replica.linkCount() != len(streams) {
+		t.Fatal("it should be a link per stream over a single connection")
+	}
+
+	// closing one link leaves the others going
+	closed := origin.Links[0]
+	closed.Close()
+	assertWait("its replica link to close", func() bool { return connectedLinks(replica) == len(streams)-1 }, 5*time.Second, t)
+	feed(100)
+	for _, stream := range streams[1:] {
+		assertReplicaCatchesUp(replicaPath, stream, t)
+	}
+	if atomic.LoadInt32(&listener.accepted) != 1 {
+		t.Fatal("it should still be the same connection")
+	}
+
+	if err := origin.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	assertWait("replica links to close", func() bool { return connectedLinks(replica) == 0 }, 5*time.Second, t)
+	for _, stream := range streams {
+		replicated, _ := persistent.MmapStreamOpen(path.Join(replicaPath, hexId(stream)), serialisation.ByteArraySerialiser{})
+		if stream != streams[0] {
+			if err := sameStreamContents(stream, replicated); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_ = replicated.CloseFile()
+	}
+}
+
+func TestReplicator_MuxDialDoesNotHoldTheReplicator(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+	silent, _ := net.Listen("tcp", "127.0.0.1:0") // never accepted, the TLS handshake hangs
+	defer silent.Close()
+	listener, replicaPath := givenReplicaServing(prefix, "replica")
+	defer listener.Close()
+	stream, _ := persistent.MmapStreamCreate(path.Join(prefix, "origin"), 64*1024, serialisation.ByteArraySerialiser{})
+	defer stream.CloseFile()
+	stream.Feed([]byte("hello"))
+
+	origin := NewReplicator()
+	go origin.ConnectTLSMux(stream, "silent", silent.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	time.Sleep(50 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		_ = origin.Stats()
+		_ = origin.ConnectTCPMux(stream, "repl", listener.Addr().String())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("dialing a silent replica should not hold the others")
+	}
+	assertReplicaCatchesUp(replicaPath, stream, t)
+
+	// a plain and a TLS connection to the same replica are not the same one
+	if err := origin.ConnectTLSMux(stream, "tls", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true}); err == nil {
+		t.Fatal("it should have dialed a TLS connection, not shared the plain one")
+	}
+	_ = origin.Shutdown(context.Background())
+}
+
+func TestMux_ChannelsTakeTurns(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	m := newMux(local, nil, nil)
+	busy, _ := m.open()
+	quiet, _ := m.open()
+	go busy.Write(make([]byte, 64*muxFrameSize))
+	time.Sleep(50 * time.Millisecond) // its queue is full
+	go quiet.Write([]byte("me too"))
+	time.Sleep(50 * time.Millisecond)
+
+	var header WireMuxMsg
+	for frames := 0; ; frames++ {
+		if err := binary.Read(remote, binary.LittleEndian, &header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.CopyN(io.Discard, remote, int64(header.Length)); err != nil {
+			t.Fatal(err)
+		}
+		if header.Channel == quiet.id {
+			if frames > muxQueueSize/2 {
+				t.Fatal("the quiet channel waited for", frames, "frames")
+			}
+			return
+		}
+		if frames > 64 {
+			t.Fatal("the quiet channel was never sent")
+		}
+	}
+}
+
+func TestMux_SlowChannelDoesNotHoldTheOthers(t *testing.T) {
+	local, remote := net.Pipe()
+	accepted := make(chan *muxConn, 2)
+	origin := newMux(local, nil, nil)
+	replica := newMux(remote, nil, func(mc *muxConn) { accepted <- mc })
+	defer origin.fail(net.ErrClosed)
+	defer replica.fail(net.ErrClosed)
+	slow, _ := origin.open()
+	fast, _ := origin.open()
+
+	// nobody reads the slow channel at the other end, it runs out of window then of queue
+	_ = slow.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := slow.Write(make([]byte, 3*muxWindow)); !errors.Is(err, os.ErrDeadlineExceeded) ||
+		n != muxWindow+muxQueueSize*muxFrameSize {
+		t.Fatal("it should have given up once the window and the queue were full, wrote:", n, err)
+	}
+	<-accepted
+	if _, err := fast.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	fastEnd := <-accepted
+	_ = fastEnd.SetReadDeadline(time.Now().Add(5 * time.Second))
+	hello := make([]byte, 5)
+	if _, err := io.ReadFull(fastEnd, hello); err != nil || string(hello) != "hello" {
+		t.Fatal("the other channels should go on, err:", err)
+	}
+}
+
+func connectedLinks(r *Replicator) (connected int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, link := range r.Links {
+		if link.State() != DISCONNECTED {
+			connected++
+		}
+	}
+	return
+}
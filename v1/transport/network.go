@@ -0,0 +1,64 @@
+package transport
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+const (
+	dialTimeout      = 10 * time.Second // an unreachable peer fails as a dropped connection, and it is redialed
+	handshakeTimeout = 10 * time.Second // for the TLS handshake
+)
+
+// How a replicator reaches its replicas and listens for origins: the OS network when Replicator.Transport is nil, a
+// SimNetwork in tests. Networks are named as in the net package ("tcp", "udp", "unix").
+type Transport interface {
+	Dial(network, address string) (net.Conn, error)
+	Listen(network, address string) (net.Listener, error)
+	ListenPacket(network, address string) (net.PacketConn, error)
+}
+
+type osTransport struct{}
+
+func (osTransport) Dial(network, address string) (net.Conn, error) {
+	return net.DialTimeout(network, address, dialTimeout)
+}
+
+func (osTransport) Listen(network, address string) (net.Listener, error) {
+	return net.Listen(network, address)
+}
+
+func (osTransport) ListenPacket(network, address string) (net.PacketConn, error) {
+	return net.ListenPacket(network, address)
+}
+
+func (r *Replicator) transport() Transport {
+	if r.Transport == nil {
+		return osTransport{}
+	}
+	return r.Transport
+}
+
+// as tls.Dial, but over the transport
+func dialTLS(transport Transport, address string, config *tls.Config) (net.Conn, error) {
+	conn, err := transport.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(address)
+	}
+	tlsConn := tls.Client(conn, config)
+	_ = tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err = tlsConn.Handshake(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
@@ -0,0 +1,32 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+)
+
+// Identity of the counter-party of a replication link, as presented to Replicator.Authorise.
+type PeerIdentity struct {
+	Addr        string
+	CommonName  string            // subject common name of the verified client certificate, empty on plain connections
+	Certificate *x509.Certificate // verified client certificate, nil on plain connections
+}
+
+func peerIdentityOf(conn net.Conn, host string) PeerIdentity {
+	peer := PeerIdentity{Addr: host}
+	switch c := conn.(type) {
+	case *peekedConn:
+		conn = c.Conn
+	case *muxConn:
+		conn = c.mux.conn
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		if len(state.VerifiedChains) > 0 && len(state.PeerCertificates) > 0 {
+			peer.Certificate = state.PeerCertificates[0]
+			peer.CommonName = peer.Certificate.Subject.CommonName
+		}
+	}
+	return peer
+}
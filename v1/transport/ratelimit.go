@@ -0,0 +1,82 @@
+package transport
+
+import (
+	"sync"
+	"time"
+)
+
+const rateLimitBurst = 100 * time.Millisecond // worth of bytes/entries that can be sent at once, after being idle
+
+// Sending rate limit of a link, or of all the links of a Replicator; zero meaning unlimited.
+type RateLimit struct {
+	BytesPerSec   uint64
+	EntriesPerSec uint64
+}
+
+// Token bucket, sending is allowed while it is not in debt. Elements are taken whole, so it can go into debt by one.
+type rateLimiter struct {
+	lock    sync.Mutex
+	limit   RateLimit
+	bytes   float64
+	entries float64
+	last    time.Time
+}
+
+func (l *rateLimiter) set(limit RateLimit) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.limit = limit
+	l.bytes, l.entries, l.last = 0, 0, time.Now()
+}
+
+func (l *rateLimiter) refill() {
+	now := time.Now()
+	elapsed := now.Sub(l.last).Seconds()
+	l.last = now
+	l.bytes = refillTokens(l.bytes, l.limit.BytesPerSec, elapsed)
+	l.entries = refillTokens(l.entries, l.limit.EntriesPerSec, elapsed)
+}
+
+func refillTokens(tokens float64, perSec uint64, elapsed float64) float64 {
+	tokens += float64(perSec) * elapsed
+	if burst := float64(perSec) * rateLimitBurst.Seconds(); tokens > burst {
+		tokens = burst
+	}
+	return tokens
+}
+
+// how long until sending is allowed again, zero if it is now
+func (l *rateLimiter) wait() time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.limit.BytesPerSec == 0 && l.limit.EntriesPerSec == 0 {
+		return 0
+	}
+	l.refill()
+	var wait time.Duration
+	if l.limit.BytesPerSec > 0 && l.bytes < 0 {
+		wait = time.Duration(-l.bytes / float64(l.limit.BytesPerSec) * float64(time.Second))
+	}
+	if l.limit.EntriesPerSec > 0 && l.entries < 0 {
+		if w := time.Duration(-l.entries / float64(l.limit.EntriesPerSec) * float64(time.Second)); w > wait {
+			wait = w
+		}
+	}
+	return wait
+}
+
+// accounts what has been sent, entries is zero for bulk-synced parts
+func (l *rateLimiter) take(bytes, entries int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.limit.BytesPerSec == 0 && l.limit.EntriesPerSec == 0 {
+		return
+	}
+	l.refill()
+	if l.limit.BytesPerSec > 0 {
+		l.bytes -= float64(bytes)
+	}
+	if l.limit.EntriesPerSec > 0 {
+		l.entries -= float64(entries)
+	}
+}
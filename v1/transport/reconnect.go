@@ -0,0 +1,86 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kuking/go-frank/v1/api"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultHeartbeatEvery = 1 * time.Second // idle links send a WireHEARTBEAT (origin) or a WireACK (replica)
+	defaultPeerTimeOut    = 5 * time.Second // nothing received for this long, the peer is considered dead
+	reconnectBackoffMin   = 250 * time.Millisecond
+	reconnectBackoffMax   = 30 * time.Second
+)
+
+var ErrPeerTimedOut = errors.New("peer timed out")
+
+// Keeps sending, redialing with an exponential back-off every time the link fails. It stops once the link is closed,
+// or on failures retrying would not fix: the origin got fenced, the handshake was refused, or the replica never took
+// anything over the first connection (i.e. it is not authorised to).
+func (s *SyncLink) goFuncSendReconnecting() {
+	var established bool
+	for {
+		s.goFuncSend()
+		s.ancillary.Wait() // so it does not get the next connection errors
+		established = established || atomic.LoadUint32(&s.acked) != 0
+		if s.Closed() || !established || !retriable(s.Err()) {
+			atomic.StoreUint32(&s.reconnecting, 0)
+			return
+		}
+		for {
+			backoff, failingSince := s.backoff()
+			for t0 := time.Now(); time.Since(t0) < backoff && !s.Closed(); {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if s.Closed() {
+				atomic.StoreUint32(&s.reconnecting, 0)
+				return
+			}
+			conn, err := s.redial()
+			if err == nil {
+				s.reconnected(conn)
+				break
+			}
+			log.Printf("reconnecting to %v (failing since %v), err: %v\n", s.host, failingSince.Format(time.RFC3339), err)
+			s.incError()
+		}
+	}
+}
+
+func retriable(err error) bool {
+	return !errors.Is(err, api.ErrFenced) && !errors.Is(err, ErrAuthenticationFailed) &&
+		!errors.Is(err, ErrAuthenticationRequired)
+}
+
+// The link went down, but it is being redialed.
+func (s *SyncLink) Reconnecting() bool {
+	return atomic.LoadUint32(&s.reconnecting) != 0
+}
+
+// starts a new connection afresh, the replica says from where to continue (it starts at the last acknowledged one)
+func (s *SyncLink) reconnected(conn net.Conn) {
+	s.errLock.Lock()
+	s.err = nil
+	s.conn = conn
+	s.errLock.Unlock()
+	atomic.AddUint64(&s.stats.reconnects, 1)
+	atomic.StoreUint32(&s.bulk, 0)
+	atomic.StoreUint32(&s.acked, 0)
+	atomic.StoreUint64(&s.window, 0)
+	for len(s.retrans) > 0 {
+		<-s.retrans
+	}
+	for len(s.partReqs) > 0 {
+		<-s.partReqs
+	}
+	s.setState(CONNECTED)
+}
+
+func (s *SyncLink) peerTimedOut(since time.Time) error {
+	return fmt.Errorf("%w: nothing received from %v since %v", ErrPeerTimedOut, s.host, since.Format(time.RFC3339))
+}
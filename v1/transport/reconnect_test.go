@@ -0,0 +1,142 @@
+package transport
+
+import (
+	"errors"
+	"github.com/kuking/go-frank/v1/persistent"
+	"github.com/kuking/go-frank/v1/serialisation"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestReplicator_HeartbeatsKeepIdleLinksUp(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+	replica := givenFastHeartbeats(NewReplicator())
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+	go replica.Serve(listener, prefix)
+
+	stream, _ := persistent.MmapStreamCreate(path.Join(prefix, "origin"), 64*1024, serialisation.ByteArraySerialiser{})
+	stream.Feed([]byte("hello"))
+	origin := givenFastHeartbeats(NewReplicator())
+	if err := origin.ConnectTCP(stream, "repl", listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	assertReplicaCatchesUp(prefix, stream, t)
+	time.Sleep(1 * time.Second) // idle, a few times the time-out
+	if origin.Links[0].State() != PUSHING || origin.Links[0].Err() != nil ||
+		replica.Links[0].State() != PULLING || replica.Links[0].Err() != nil {
+		t.Fatal("the link should be up,", origin.Links[0].Err(), replica.Links[0].Err())
+	}
+	origin.Links[0].Close()
+}
+
+func TestReplicator_DeadPeersTimeOut(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+
+	// a replica which never answers
+	silent, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer silent.Close()
+	go func() {
+		for {
+			if _, err := silent.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	stream, _ := persistent.MmapStreamCreate(path.Join(prefix, "origin"), 64*1024, serialisation.ByteArraySerialiser{})
+	conn, _ := net.Dial("tcp", silent.Addr().String())
+	origin := givenFastHeartbeats(NewReplicator()).NewSyncLinkSend(conn, "silent", stream, "repl")
+	go origin.goFuncSend()
+	assertWait("origin to time out", func() bool { return errors.Is(origin.Err(), ErrPeerTimedOut) }, 5*time.Second, t)
+
+	// an origin which never says hello
+	replica := givenFastHeartbeats(NewReplicator())
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+	go replica.Serve(listener, prefix)
+	conn, _ = net.Dial("tcp", listener.Addr().String())
+	defer conn.Close()
+	assertWait("replica to time out", func() bool {
+		return replica.linkCount() == 1 && errors.Is(replica.Links[0].Err(), ErrPeerTimedOut)
+	}, 5*time.Second, t)
+}
+
+func TestReplicator_ReconnectsAndResumes(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+	replica := NewReplicator()
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+	go replica.Serve(listener, prefix)
+
+	stream, _ := persistent.MmapStreamCreate(path.Join(prefix, "origin"), 64*1024, serialisation.ByteArraySerialiser{})
+	for i := 0; i < 1_000; i++ {
+		stream.Feed([]byte("before"))
+	}
+	origin := NewReplicator()
+	if err := origin.ConnectTCP(stream, "repl", listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	sl := origin.Links[0]
+	defer sl.Close()
+	assertReplicaCatchesUp(prefix, stream, t)
+
+	for i := 0; i < 2; i++ {
+		// the connection drops, twice: once reconnected the back-off starts over
+		_ = replica.Links[replica.linkCount()-1].conn.Close()
+		assertWait("origin to notice", func() bool { return sl.State() == DISCONNECTED }, 5*time.Second, t)
+		if !sl.Reconnecting() {
+			t.Fatal("it should be reconnecting")
+		}
+		for j := 0; j < 1_000; j++ {
+			stream.Feed([]byte("while disconnected"))
+		}
+		assertWait("origin to reconnect", func() bool { return sl.State() == PUSHING && sl.Err() == nil }, 5*time.Second, t)
+		assertReplicaCatchesUp(prefix, stream, t)
+	}
+	origin.houseKeeping()
+	if origin.linkCount() != 1 || replica.linkCount() != 3 {
+		t.Fatal("it should be the same link, reconnected", origin.linkCount(), replica.linkCount())
+	}
+	if sent := sl.Stats().Elements; sent > 3_000+1_000 {
+		t.Fatal("it should resume from the acknowledged position, not from scratch; sent:", sent)
+	}
+	replicaStream, _ := persistent.MmapStreamOpen(path.Join(prefix, hexId(stream)), serialisation.ByteArraySerialiser{})
+	defer replicaStream.CloseFile()
+	if err := sameStreamContents(stream, replicaStream); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncLink_BackoffDoubles(t *testing.T) {
+	sl := NewReplicator().NewSyncLinkRecv(nil, "host", "")
+	expected := []time.Duration{250 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond, time.Second}
+	for i, exp := range expected {
+		if backoff, _ := sl.backoff(); backoff != exp {
+			t.Fatal(i, backoff, "expected", exp)
+		}
+		sl.incError()
+	}
+	for i := 0; i < 20; i++ {
+		sl.incError()
+	}
+	if backoff, failingSince := sl.backoff(); backoff != reconnectBackoffMax || time.Since(failingSince) > time.Second {
+		t.Fatal(backoff, failingSince)
+	}
+	sl.resetError()
+	if backoff, _ := sl.backoff(); backoff != reconnectBackoffMin {
+		t.Fatal(backoff)
+	}
+}
+
+func givenFastHeartbeats(r *Replicator) *Replicator {
+	r.HeartbeatEvery = 50 * time.Millisecond
+	r.PeerTimeOut = 300 * time.Millisecond
+	return r
+}
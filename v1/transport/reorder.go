@@ -0,0 +1,52 @@
+package transport
+
+import (
+	"github.com/kuking/go-frank/v1/persistent"
+	"time"
+)
+
+const (
+	reorderMax = 1_024                 // out-of-order elements the replica keeps while asking for the missing ones
+	nack1Every = 20 * time.Millisecond // replica asks again for a missing element, if it did not arrive yet
+)
+
+// Out-of-order elements kept by the replica while the missing ones are retransmitted, keyed by absolute position.
+type reorderBuffer map[uint64][]byte
+
+// keeps a copy of elem, false if the buffer is full (even after dropping the elements already fed)
+func (rb reorderBuffer) add(absPos uint64, elem []byte, writePos uint64) bool {
+	if len(rb) >= reorderMax {
+		for pos := range rb {
+			if pos < writePos {
+				delete(rb, pos)
+			}
+		}
+		if len(rb) >= reorderMax {
+			return false
+		}
+	}
+	if _, ok := rb[absPos]; !ok {
+		rb[absPos] = append([]byte(nil), elem...)
+	}
+	return true
+}
+
+// feeds the elements following the stream write position, if they were received already
+func (rb reorderBuffer) drain(stream *persistent.MmapStream, stats *linkCounters) {
+	for {
+		writePos := stream.WritePos()
+		elem, ok := rb[writePos]
+		if !ok {
+			return
+		}
+		delete(rb, writePos)
+		stream.Feed(elem)
+		stats.element(len(elem))
+	}
+}
+
+func (rb reorderBuffer) clear() {
+	for pos := range rb {
+		delete(rb, pos)
+	}
+}
@@ -1,11 +1,15 @@
 package transport
 
 import (
+	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/kuking/go-frank/v1/persistent"
+	"io"
 	"log"
-	"math"
 	"net"
+	"os"
 	"sync"
 	"time"
 )
@@ -14,15 +18,61 @@ type Replicator struct {
 	mutex sync.Mutex
 	Links []*SyncLink
 	Close bool
+	// Optional hook deciding which peers can push streams into this replicator: replicate into an existing stream
+	// (create=false) or create a new one (create=true). When nil, every peer is allowed.
+	Authorise func(peer PeerIdentity, uniqId uint64, create bool) bool
+	// Optional, when set the TCP links (ConnectTCP, ConnectTCPMux, ListenTCP and the tcp and mux links of a Topology)
+	// go over TLS with it, as with ConnectTLS and ListenTLS
+	TLS *tls.Config
+	// Optional pre-shared key, when set both ends of every link have to prove they know it (HMAC-SHA256 challenge)
+	SharedSecret []byte
+	// Optional flate level (i.e. flate.BestSpeed) of the links this replicator originates, zero for no compression.
+	// Datagram links are never compressed, and a replica can refuse it.
+	Compression int
+	// Optional, the replicas of this replicator refuse the compression offered by their origins
+	RefuseCompression bool
+	// Optional, bytes the replicas of this replicator accept beyond the ones they have written (advertised to the
+	// origins with WireWINDOW), so a slow replica slows its origin down. Zero for no window.
+	Window uint64
+	// Idle links send a heartbeat this often, and a link is dropped when nothing arrives from its peer for PeerTimeOut.
+	// Zero disables them, NewReplicator sets defaults.
+	HeartbeatEvery time.Duration
+	PeerTimeOut    time.Duration
+	// Optional, how often the links this replicator originates send the positions of the stream named subscribers, so
+	// the consumers can move to a replica (i.e. after a failover) and continue where they left off. Zero for never.
+	SubscribersEvery time.Duration
+	// Optional network the links are dialed and listened on, the OS one when nil (see SimNetwork)
+	Transport Transport
+	// How often the topology given to Apply is re-applied, re-establishing the links which are down
+	ReconcileEvery time.Duration
+	// Optional, Shutdown first waits until the replicas acknowledged everything written (up to then) on the streams
+	// this replicator originates
+	DrainOnShutdown bool
+	limiter         rateLimiter
+	shutdown        bool
+	listeners       []io.Closer
+	topologyLock    sync.Mutex
+	topology        Topology
+	managed         map[LinkSpec]*SyncLink
+	streams         map[string]*managedStream
+	muxes           map[string]*mux
 }
 
 func NewReplicator() *Replicator {
 	return &Replicator{
-		Links: make([]*SyncLink, 0),
-		Close: false,
+		Links:          make([]*SyncLink, 0),
+		Close:          false,
+		HeartbeatEvery: defaultHeartbeatEvery,
+		PeerTimeOut:    defaultPeerTimeOut,
+		ReconcileEvery: defaultReconcileEvery,
 	}
 }
 
+// Limits the rate all the (origin) links of this replicator send at, together.
+func (r *Replicator) SetRateLimit(limit RateLimit) {
+	r.limiter.set(limit)
+}
+
 func (r *Replicator) addSyncLink(link *SyncLink) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
@@ -32,72 +82,197 @@ func (r *Replicator) addSyncLink(link *SyncLink) {
 func (r *Replicator) houseKeeping() {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
-	for i, link := range r.Links {
-		if link.State == DISCONNECTED {
-			r.Links[len(r.Links)-1], r.Links[i] = r.Links[i], r.Links[len(r.Links)-1]
-			r.Links = r.Links[:len(r.Links)-1]
+	links := r.Links[:0]
+	for _, link := range r.Links {
+		if link.State() != DISCONNECTED || link.Reconnecting() {
+			links = append(links, link)
 		}
 	}
+	for i := len(links); i < len(r.Links); i++ {
+		r.Links[i] = nil
+	}
+	r.Links = links
 }
 
+// Logs the throughput and lag of every link each second (see Stats), until there are no links left (exitOnZero) or
+// one of them caught up (exitOn100Transfer).
 func (r *Replicator) WaitAll(exitOnZero bool, exitOn100Transfer bool) {
-	prevReadPos := map[uint64]uint64{}
-	prevWritePos := map[uint64]uint64{}
-
+	prevBytes := map[string]uint64{}
 	for {
 		r.houseKeeping()
 		time.Sleep(1 * time.Second)
-		for i, l := range r.Links {
-			uniqId := l.Stream.GetUniqId()
-			readPos := l.Stream.ReadSubRPos(l.subId)
-			writePos := l.Stream.WritePos()
-			if prevReadPos[uniqId] != 0 || prevWritePos[uniqId] != 0 {
-				readPct := float64(readPos) * 100.0 / float64(writePos)
-				readMiB := float64((readPos - prevReadPos[uniqId]) / 1024.0 / 1024.0)
-				writeMiB := float64((writePos - prevWritePos[uniqId]) / 1024.0 / 1024.0)
-				fmt.Printf("[%v: R: %v (%2.2fMiB/s) %2.2f%% W: %v (%2.2fMiB/s)]\n", i, readPos, readMiB, readPct, writePos, writeMiB)
-				if exitOn100Transfer && math.Abs(readPct-100.0) < 0.0001 {
+		stats := r.Stats()
+		for i, l := range stats {
+			key := fmt.Sprint(l.Origin, l.Host, l.Name, l.Stream)
+			if prev, ok := prevBytes[key]; ok {
+				log.Printf("[%v: %v %2.2fMiB/s, lag: %v bytes]\n", i, l.Host, float64(l.Bytes-prev)/1024/1024, l.Lag)
+				if exitOn100Transfer && l.Lag == 0 {
 					return
 				}
 			}
-			prevReadPos[uniqId] = readPos
-			prevWritePos[uniqId] = writePos
-		}
-		if exitOnZero {
-			r.mutex.Lock()
-			l := len(r.Links)
-			r.mutex.Unlock()
-			if l == 0 {
-				return
-			}
+			prevBytes[key] = l.Bytes
+		}
+		if exitOnZero && len(stats) == 0 {
+			return
 		}
 	}
 }
 
+// Replicates the stream into the replica listening at connectTo. When the link fails it is redialed, with an
+// exponential back-off, and it continues from the last position the replica acknowledged.
 func (r *Replicator) ConnectTCP(stream *persistent.MmapStream, replicatorName string, connectTo string) error {
-	conn, err := net.Dial("tcp", connectTo)
+	if r.TLS != nil {
+		return r.ConnectTLS(stream, replicatorName, connectTo, r.TLS)
+	}
+	_, err := r.connect(stream, replicatorName, connectTo, false, func() (net.Conn, error) {
+		return r.transport().Dial("tcp", connectTo)
+	})
+	return err
+}
+
+// As ConnectTCP but over TLS, the config should carry the client certificate when the replica requires one.
+func (r *Replicator) ConnectTLS(stream *persistent.MmapStream, replicatorName string, connectTo string, config *tls.Config) error {
+	_, err := r.connect(stream, replicatorName, connectTo, false, func() (net.Conn, error) {
+		return dialTLS(r.transport(), connectTo, config)
+	})
+	return err
+}
+
+// As ConnectTCP but over a unix domain socket, for replicas in the same host.
+func (r *Replicator) ConnectUnix(stream *persistent.MmapStream, replicatorName string, socketPath string) error {
+	_, err := r.connect(stream, replicatorName, socketPath, false, func() (net.Conn, error) {
+		return r.transport().Dial("unix", socketPath)
+	})
+	return err
+}
+
+// As ConnectTCP, but all the streams replicated with it to the same replica share a single connection; each one has
+// its own link (a channel of the connection) and they take turns to send. When the connection fails every link redials
+// it, the first one re-establishes it for all.
+func (r *Replicator) ConnectTCPMux(stream *persistent.MmapStream, replicatorName string, connectTo string) error {
+	if r.TLS != nil {
+		return r.ConnectTLSMux(stream, replicatorName, connectTo, r.TLS)
+	}
+	_, err := r.connect(stream, replicatorName, connectTo, false, r.muxDialer("tcp", connectTo, func() (net.Conn, error) {
+		return r.transport().Dial("tcp", connectTo)
+	}))
+	return err
+}
+
+// As ConnectTCPMux but over TLS.
+func (r *Replicator) ConnectTLSMux(stream *persistent.MmapStream, replicatorName string, connectTo string, config *tls.Config) error {
+	_, err := r.connect(stream, replicatorName, connectTo, false, r.muxDialer("tls", connectTo, func() (net.Conn, error) {
+		return dialTLS(r.transport(), connectTo, config)
+	}))
+	return err
+}
+
+// dials a channel of the connection to connectTo, dialing the connection when there is none (or it failed). There is a
+// connection per network ("tcp", "tls") and address; it is dialed without holding the replicator lock.
+func (r *Replicator) muxDialer(network string, connectTo string, dial func() (net.Conn, error)) func() (net.Conn, error) {
+	key := network + "://" + connectTo
+	return func() (net.Conn, error) {
+		r.mutex.Lock()
+		m := r.muxes[key]
+		r.mutex.Unlock()
+		if m != nil {
+			if mc, err := m.open(); err == nil {
+				return mc, nil
+			}
+		}
+		conn, err := dial()
+		if err != nil {
+			return nil, err
+		}
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		if r.shutdown {
+			_ = conn.Close()
+			return nil, ErrReplicatorShutdown
+		}
+		if m := r.muxes[key]; m != nil {
+			if mc, err := m.open(); err == nil {
+				_ = conn.Close() // another link re-established it meanwhile
+				return mc, nil
+			}
+		}
+		if r.muxes == nil {
+			r.muxes = map[string]*mux{}
+		}
+		m = newMux(conn, nil, nil)
+		r.muxes[key] = m
+		return m.open()
+	}
+}
+
+func (r *Replicator) connect(stream *persistent.MmapStream, replicatorName string, connectTo string, datagram bool,
+	dial func() (net.Conn, error)) (*SyncLink, error) {
+	if r.isShutdown() {
+		return nil, ErrReplicatorShutdown
+	}
+	conn, err := dial()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	sl := r.NewSyncLinkSend(conn, connectTo, stream, replicatorName)
-	go sl.goFuncSend()
-	return nil
+	sl.datagram = datagram
+	sl.redial = dial
+	sl.reconnecting = 1
+	go sl.goFuncSendReconnecting()
+	return sl, nil
 }
 
 func (r *Replicator) ListenTCP(bind string, basePath string) error {
-	serverAddr, err := net.ResolveTCPAddr("tcp", bind)
+	if r.TLS != nil {
+		return r.ListenTLS(bind, basePath, r.TLS)
+	}
+	listener, err := r.transport().Listen("tcp", bind)
+	if err != nil {
+		return err
+	}
+	return r.Serve(listener, basePath)
+}
+
+// As ListenTCP but on a unix domain socket. A stale socket file (nobody listening on it) is removed first.
+func (r *Replicator) ListenUnix(socketPath string, basePath string) error {
+	if info, err := os.Stat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := r.transport().Dial("unix", socketPath); err == nil {
+			_ = conn.Close() // in use, listening fails below
+		} else {
+			_ = os.Remove(socketPath)
+		}
+	}
+	listener, err := r.transport().Listen("unix", socketPath)
 	if err != nil {
 		return err
 	}
-	listener, err := net.ListenTCP("tcp", serverAddr)
+	return r.Serve(listener, basePath)
+}
+
+// As ListenTCP but over TLS. For mutual authentication set config.ClientAuth to tls.RequireAndVerifyClientCert and
+// config.ClientCAs; the verified peer identity is then given to the Authorise hook.
+func (r *Replicator) ListenTLS(bind string, basePath string, config *tls.Config) error {
+	listener, err := r.transport().Listen("tcp", bind)
 	if err != nil {
 		return err
 	}
+	return r.Serve(tls.NewListener(listener, config), basePath)
+}
+
+// Accepts replication links on the listener, replicas are created in basePath. It returns when the listener is closed.
+func (r *Replicator) Serve(listener net.Listener, basePath string) error {
+	if !r.trackListener(listener) {
+		_ = listener.Close()
+		return ErrReplicatorShutdown
+	}
 	for {
 		conn, err := listener.Accept()
-		if err == nil {
-			sl := r.NewSyncLinkRecv(conn, conn.RemoteAddr().String(), basePath)
-			go sl.goFuncRecv()
+		if err == nil && r.isShutdown() {
+			_ = conn.Close()
+		} else if err == nil {
+			go r.serveConn(conn, basePath)
+		} else if errors.Is(err, net.ErrClosed) {
+			return nil
 		} else {
 			log.Printf("error accepting connection, err: %v\n", err)
 		}
@@ -106,3 +281,130 @@ func (r *Replicator) ListenTCP(bind string, basePath string) error {
 		}
 	}
 }
+
+// A connection carries one link, or many when it starts with a WireMUX frame (see mux.go).
+func (r *Replicator) serveConn(conn net.Conn, basePath string) {
+	host := conn.RemoteAddr().String()
+	if _, ok := conn.(*net.UnixConn); ok {
+		host = "unix:" + conn.LocalAddr().String() // the peer is not named
+	}
+	since := time.Now()
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// a peer which never completes the handshake is dropped in time
+		_ = tlsConn.SetDeadline(since.Add(handshakeTimeout))
+		err := tlsConn.Handshake()
+		_ = tlsConn.SetDeadline(time.Time{})
+		if err != nil {
+			r.NewSyncLinkRecv(conn, host, basePath).handleError(err)
+			return
+		}
+	}
+	if r.PeerTimeOut > 0 {
+		_ = conn.SetReadDeadline(since.Add(r.PeerTimeOut))
+	}
+	reader := bufio.NewReaderSize(conn, muxBufferSize)
+	first, err := reader.Peek(2)
+	if r.isShutdown() {
+		_ = conn.Close()
+		return
+	}
+	if err != nil { // it fails as the link it would have been
+		sl := r.NewSyncLinkRecv(conn, host, basePath)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			err = sl.peerTimedOut(since)
+		}
+		sl.handleError(err)
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	if first[1] == WireMUX {
+		newMux(conn, reader, func(mc *muxConn) {
+			if r.isShutdown() {
+				_ = mc.Close()
+				return
+			}
+			sl := r.NewSyncLinkRecv(mc, host, basePath)
+			go sl.goFuncRecv()
+		})
+		return
+	}
+	r.NewSyncLinkRecv(&peekedConn{Conn: conn, r: reader}, host, basePath).goFuncRecv()
+}
+
+// As ConnectTCP but over UDP: lower latency, lost or reordered datagrams are recovered with WireNACK1 retransmissions
+// and the amount of data in flight is bounded by a window of unacknowledged bytes. Elements have to fit in a datagram.
+func (r *Replicator) ConnectUDP(stream *persistent.MmapStream, replicatorName string, connectTo string) error {
+	_, err := r.connect(stream, replicatorName, connectTo, true, func() (net.Conn, error) {
+		return r.transport().Dial("udp", connectTo)
+	})
+	return err
+}
+
+func (r *Replicator) ListenUDP(bind string, basePath string) error {
+	pconn, err := r.transport().ListenPacket("udp", bind)
+	if err != nil {
+		return err
+	}
+	return r.ServeUDP(pconn, basePath)
+}
+
+// Accepts replication links over a packet connection, datagrams are demultiplexed by source address into one link per
+// peer. It returns when the packet connection is closed.
+func (r *Replicator) ServeUDP(pconn net.PacketConn, basePath string) error {
+	if !r.trackListener(pconn) {
+		_ = pconn.Close()
+		return ErrReplicatorShutdown
+	}
+	if udpConn, ok := pconn.(*net.UDPConn); ok {
+		_ = udpConn.SetReadBuffer(datagramSocketBuffer) // best effort, capped by the OS (net.core.rmem_max in linux)
+	}
+	peers := map[string]*demuxConn{}
+	defer func() {
+		for _, dc := range peers {
+			_ = dc.Close()
+		}
+	}()
+	buffer := make([]byte, 65536)
+	lastEviction := time.Now()
+	for {
+		n, addr, err := pconn.ReadFrom(buffer)
+		if err == nil {
+			now := time.Now()
+			if now.Sub(lastEviction) > datagramPeerIdle {
+				evictIdlePeers(peers, now)
+				lastEviction = now
+			}
+			dc := peers[addr.String()]
+			if dc == nil || dc.isClosed() {
+				dc = newDemuxConn(pconn, addr)
+				peers[addr.String()] = dc
+				sl := r.NewSyncLinkRecv(dc, addr.String(), basePath)
+				sl.datagram = true
+				go sl.goFuncRecv()
+			}
+			dc.lastSeen = now
+			dc.deliver(append([]byte(nil), buffer[:n]...))
+		} else if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else {
+			log.Printf("error reading datagram, err: %v\n", err)
+		}
+		if r.Close {
+			return pconn.Close()
+		}
+	}
+}
+
+// forgets the peers whose links ended, and drops the ones gone quiet (a datagram link does not notice a peer going away)
+func evictIdlePeers(peers map[string]*demuxConn, now time.Time) {
+	for addr, dc := range peers {
+		if dc.isClosed() || now.Sub(dc.lastSeen) > datagramPeerIdle {
+			_ = dc.Close()
+			delete(peers, addr)
+		}
+	}
+}
+
+func (r *Replicator) authorised(peer PeerIdentity, uniqId uint64, create bool) bool {
+	return r.Authorise == nil || r.Authorise(peer, uniqId, create)
+}
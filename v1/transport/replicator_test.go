@@ -0,0 +1,533 @@
+package transport
+
+import (
+	"compress/flate"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"github.com/kuking/go-frank/v1/api"
+	"github.com/kuking/go-frank/v1/persistent"
+	"github.com/kuking/go-frank/v1/serialisation"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReplicator_TLSMutualAuthentication(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+	serverCfg, clientCfg := givenMutualTLSConfigs("replica", "origin-1", t)
+
+	var authorisedPeer PeerIdentity
+	var authorisedCreate bool
+	r := NewReplicator()
+	r.Authorise = func(peer PeerIdentity, uniqId uint64, create bool) bool {
+		authorisedPeer, authorisedCreate = peer, create
+		return peer.CommonName == "origin-1"
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go r.Serve(listener, prefix)
+
+	stream, _ := persistent.MmapStreamCreate(path.Join(prefix, "origin"), 64*1024, serialisation.ByteArraySerialiser{})
+	for i := 0; i < 1_000; i++ {
+		stream.Feed([]byte("hello"))
+	}
+	if err = NewReplicator().ConnectTLS(stream, "repl", listener.Addr().String(), clientCfg); err != nil {
+		t.Fatal(err)
+	}
+
+	assertWait("replica to catch up", func() bool {
+		replica, err := persistent.MmapStreamOpen(path.Join(prefix, hexId(stream)), serialisation.ByteArraySerialiser{})
+		if err != nil {
+			return false
+		}
+		defer replica.CloseFile()
+		return replica.WritePos() == stream.WritePos()
+	}, 5*time.Second, t)
+	if authorisedPeer.CommonName != "origin-1" || authorisedPeer.Certificate == nil || !authorisedCreate {
+		t.Fatal("the hook should have been given the verified identity", authorisedPeer)
+	}
+}
+
+func TestReplicator_TLSUnauthorisedPeerCanNotCreateStreams(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+	serverCfg, clientCfg := givenMutualTLSConfigs("replica", "intruder", t)
+
+	r := NewReplicator()
+	r.Authorise = func(peer PeerIdentity, uniqId uint64, create bool) bool {
+		return peer.CommonName == "origin-1"
+	}
+	listener, _ := tls.Listen("tcp", "127.0.0.1:0", serverCfg)
+	defer listener.Close()
+	go r.Serve(listener, prefix)
+
+	stream, _ := persistent.MmapStreamCreate(path.Join(prefix, "origin"), 64*1024, serialisation.ByteArraySerialiser{})
+	stream.Feed([]byte("hello"))
+	sender := NewReplicator()
+	if err := sender.ConnectTLS(stream, "repl", listener.Addr().String(), clientCfg); err != nil {
+		t.Fatal(err)
+	}
+	assertWait("link to be dropped", func() bool {
+		sender.houseKeeping()
+		sender.mutex.Lock()
+		defer sender.mutex.Unlock()
+		return len(sender.Links) == 0
+	}, 5*time.Second, t)
+	if _, err := os.Stat(path.Join(prefix, hexId(stream)+".frank")); !os.IsNotExist(err) {
+		t.Fatal("the replica should not have been created")
+	}
+}
+
+func TestReplicator_TLSOptionOnTheTCPLinks(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+	serverCfg, clientCfg := givenMutualTLSConfigs("replica", "origin-1", t)
+	network := NewSimNetwork(1)
+
+	var authorisedPeer PeerIdentity
+	replica := NewReplicator()
+	replica.Transport = network.Host("b")
+	replica.TLS = serverCfg
+	replica.Authorise = func(peer PeerIdentity, uniqId uint64, create bool) bool {
+		authorisedPeer = peer
+		return true
+	}
+	defer replica.Shutdown(context.Background())
+	go replica.ListenTCP("b:7000", prefix)
+
+	stream, _ := persistent.MmapStreamCreate(path.Join(prefix, "origin"), 64*1024, serialisation.ByteArraySerialiser{})
+	defer stream.CloseFile()
+	for i := 0; i < 1_000; i++ {
+		stream.Feed([]byte("hello"))
+	}
+	origin := NewReplicator()
+	origin.Transport = network.Host("a")
+	origin.TLS = clientCfg
+	defer origin.Shutdown(context.Background())
+	assertWait("origin to connect", func() bool {
+		return origin.ConnectTCP(stream, "repl", "b:7000") == nil
+	}, 5*time.Second, t)
+	assertReplicaCatchesUp(prefix, stream, t)
+	if authorisedPeer.CommonName != "origin-1" {
+		t.Fatal("the link should have gone over TLS, with the client certificate", authorisedPeer)
+	}
+}
+
+func TestReplicator_SharedSecretHandshake(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+
+	replica := NewReplicator()
+	replica.SharedSecret = []byte("s3cr3t")
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+	go replica.Serve(listener, prefix)
+
+	stream, _ := persistent.MmapStreamCreate(path.Join(prefix, "origin"), 64*1024, serialisation.ByteArraySerialiser{})
+	for i := 0; i < 1_000; i++ {
+		stream.Feed([]byte("hello"))
+	}
+	origin := NewReplicator()
+	origin.SharedSecret = []byte("s3cr3t")
+	if err := origin.ConnectTCP(stream, "repl", listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	assertWait("replica to catch up", func() bool {
+		return replica.linkCount() == 1 && replica.Links[0].State() == PULLING &&
+			replica.Links[0].Stream.WritePos() == stream.WritePos()
+	}, 5*time.Second, t)
+	if origin.Links[0].State() != PUSHING || origin.Links[0].Err() != nil {
+		t.Fatal(origin.Links[0].Err())
+	}
+}
+
+func TestReplicator_SharedSecretMismatchDisconnects(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+
+	replica := NewReplicator()
+	replica.SharedSecret = []byte("s3cr3t")
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+	go replica.Serve(listener, prefix)
+
+	stream, _ := persistent.MmapStreamCreate(path.Join(prefix, "origin"), 64*1024, serialisation.ByteArraySerialiser{})
+	stream.Feed([]byte("hello"))
+	for _, secret := range []string{"wrong", ""} {
+		origin := NewReplicator()
+		origin.SharedSecret = []byte(secret)
+		if err := origin.ConnectTCP(stream, "repl", listener.Addr().String()); err != nil {
+			t.Fatal(err)
+		}
+		sl := origin.Links[0]
+		assertWait("origin to disconnect", func() bool { return sl.State() == DISCONNECTED }, 5*time.Second, t)
+		if secret != "" && !errors.Is(sl.Err(), ErrAuthenticationFailed) {
+			t.Fatal("unexpected error:", sl.Err())
+		}
+	}
+	assertWait("replica to disconnect", func() bool {
+		return replica.linkCount() == 2 &&
+			replica.Links[0].State() == DISCONNECTED && replica.Links[1].State() == DISCONNECTED
+	}, 5*time.Second, t)
+	if !errors.Is(replica.Links[0].Err(), ErrAuthenticationFailed) || replica.Links[1].Err() != ErrAuthenticationRequired {
+		t.Fatal("unexpected errors:", replica.Links[0].Err(), replica.Links[1].Err())
+	}
+	if _, err := os.Stat(path.Join(prefix, hexId(stream)+".frank")); !os.IsNotExist(err) {
+		t.Fatal("the replica should not have been created")
+	}
+}
+
+func TestReplicator_FeedAndWaitForQuorum(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+
+	stream, _ := persistent.MmapStreamCreate(path.Join(prefix, "origin"), 64*1024, serialisation.ByteArraySerialiser{})
+	origin := NewReplicator()
+	for i := 0; i < 2; i++ {
+		replicaPath := path.Join(prefix, fmt.Sprint("replica-", i))
+		_ = os.Mkdir(replicaPath, 0755)
+		listener, _ := net.Listen("tcp", "127.0.0.1:0")
+		defer listener.Close()
+		go NewReplicator().Serve(listener, replicaPath)
+		if err := origin.ConnectTCP(stream, fmt.Sprint("repl-", i), listener.Addr().String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := stream.FeedAndWait([]byte("first"), 2, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		t0 := time.Now()
+		if err := stream.FeedAndWait([]byte(fmt.Sprint("elem-", i)), 2, 5*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if time.Since(t0) > 200*time.Millisecond {
+			t.Fatal("replicas should acknowledge promptly, it took:", time.Since(t0))
+		}
+	}
+	if err := stream.FeedAndWait([]byte("three?"), 3, 100*time.Millisecond); err != api.ErrQuorumTimeOut {
+		t.Fatal("there are only two replicas, err:", err)
+	}
+}
+
+func TestReplicator_PromotedReplicaFencesTheOldOrigin(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+	listenerB, pathB := givenReplicaServing(prefix, "b")
+	defer listenerB.Close()
+	listenerC, pathC := givenReplicaServing(prefix, "c")
+	defer listenerC.Close()
+	addrB, addrC := listenerB.Addr().String(), listenerC.Addr().String()
+
+	origin, _ := persistent.MmapStreamCreate(path.Join(prefix, "origin"), 64*1024, serialisation.ByteArraySerialiser{})
+	toB, toC := givenSyncLinkSend(origin, "b", addrB), givenSyncLinkSend(origin, "c", addrC)
+	for i := 0; i < 100; i++ {
+		origin.Feed([]byte(fmt.Sprint(i)))
+	}
+	assertReplicaCatchesUp(pathB, origin, t)
+
+	// b loses the origin first, c gets a few more before losing it too
+	toB.Close()
+	assertWait("link to b to disconnect", func() bool { return toB.State() == DISCONNECTED }, 5*time.Second, t)
+	for i := 100; i < 110; i++ {
+		origin.Feed([]byte(fmt.Sprint(i)))
+	}
+	assertReplicaCatchesUp(pathC, origin, t)
+	toC.Close()
+
+	b, _ := persistent.MmapStreamOpen(path.Join(pathB, hexId(origin)), serialisation.ByteArraySerialiser{})
+	defer b.CloseFile()
+	c, _ := persistent.MmapStreamOpen(path.Join(pathC, hexId(origin)), serialisation.ByteArraySerialiser{})
+	defer c.CloseFile()
+	if epoch, err := b.Promote(); epoch != 1 || err != nil {
+		t.Fatal(epoch, err)
+	}
+	toCFromB := givenSyncLinkSend(b, "c", addrC)
+	defer func() {
+		// before b gets closed
+		toCFromB.Close()
+		assertWait("link from b to disconnect", func() bool { return toCFromB.State() == DISCONNECTED }, 5*time.Second, t)
+	}()
+	for i := 0; i < 100; i++ {
+		if err := b.FeedAndWait([]byte(fmt.Sprint("b-", i)), 1, 5*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.GetEpoch() != 1 || c.WritePos() != b.WritePos() {
+		t.Fatal("c should follow b")
+	}
+	if err := sameStreamContents(b, c); err != nil {
+		t.Fatal("what c got after the promotion should have been discarded,", err)
+	}
+
+	// the old origin comes back
+	fenced := givenSyncLinkSend(origin, "c", addrC)
+	assertWait("old origin to be fenced", func() bool { return errors.Is(fenced.Err(), api.ErrFenced) }, 5*time.Second, t)
+	if !origin.IsFenced() || origin.FeedAndWait([]byte("split-brain"), 0, 0) != api.ErrFenced {
+		t.Fatal("the old origin should not take writes")
+	}
+	if err := sameStreamContents(b, c); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplicator_CompressedLink(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+
+	replica := NewReplicator()
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+	go replica.Serve(listener, prefix)
+
+	stream, _ := persistent.MmapStreamCreate(path.Join(prefix, "origin"), 1024*1024, serialisation.ByteArraySerialiser{})
+	var total uint64
+	feed := func(from, to int) {
+		for i := from; i < to; i++ {
+			elem := []byte(fmt.Sprintf("element %08d, quite compressible, quite compressible, quite compressible", i))
+			stream.Feed(elem)
+			total += uint64(len(elem))
+		}
+	}
+	feed(0, 5_000)
+	origin := NewReplicator()
+	origin.Compression = flate.BestSpeed
+	if err := origin.ConnectTCP(stream, "repl", listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	feed(5_000, 10_000)
+	assertReplicaCatchesUp(prefix, stream, t)
+	replicaStream, _ := persistent.MmapStreamOpen(path.Join(prefix, hexId(stream)), serialisation.ByteArraySerialiser{})
+	defer replicaStream.CloseFile()
+	if err := sameStreamContents(stream, replicaStream); err != nil {
+		t.Fatal(err)
+	}
+
+	sent, received := origin.Links[0].Stats(), replica.Links[0].Stats()
+	if sent.Batches == 0 || received.Batches == 0 || sent.CompressionRatio() < 2 {
+		t.Fatal("elements should be sent in compressed batches", sent, received)
+	}
+	if received.Elements != 10_000 || received.Bytes != total || received.Throughput() <= 0 {
+		t.Fatal("unexpected replica stats", received)
+	}
+}
+
+func TestReplicator_ReplicaRefusesCompression(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+
+	replica := NewReplicator()
+	replica.RefuseCompression = true
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+	go replica.Serve(listener, prefix)
+
+	stream, _ := persistent.MmapStreamCreate(path.Join(prefix, "origin"), 1024*1024, serialisation.ByteArraySerialiser{})
+	for i := 0; i < 5_000; i++ {
+		stream.Feed([]byte(fmt.Sprintf("element %08d, quite compressible, quite compressible", i)))
+	}
+	origin := NewReplicator()
+	origin.Compression = flate.BestSpeed
+	if err := origin.ConnectTCP(stream, "repl", listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	assertReplicaCatchesUp(prefix, stream, t)
+	replicaStream, _ := persistent.MmapStreamOpen(path.Join(prefix, hexId(stream)), serialisation.ByteArraySerialiser{})
+	defer replicaStream.CloseFile()
+	if err := sameStreamContents(stream, replicaStream); err != nil {
+		t.Fatal(err)
+	}
+	if sent, received := origin.Links[0].Stats(), replica.Links[0].Stats(); sent.Batches != 0 || received.Batches != 0 {
+		t.Fatal("the elements should be sent as they are", sent, received)
+	}
+}
+
+func TestReplicator_RateLimits(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+	go NewReplicator().Serve(listener, prefix)
+
+	// 1_000 elements of 100 bytes, at 200KB/s per link or 2_000 entries/s per replicator, takes about half a second
+	for _, perLink := range []bool{true, false} {
+		stream, _ := persistent.MmapStreamCreate(path.Join(prefix, fmt.Sprint("origin-", perLink)), 1024*1024, serialisation.ByteArraySerialiser{})
+		for i := 0; i < 1_000; i++ {
+			stream.Feed(make([]byte, 100))
+		}
+		origin := NewReplicator()
+		if !perLink {
+			origin.SetRateLimit(RateLimit{EntriesPerSec: 2_000})
+		}
+		conn, _ := net.Dial("tcp", listener.Addr().String())
+		sl := origin.NewSyncLinkSend(conn, "replica", stream, "repl")
+		if perLink {
+			sl.SetRateLimit(RateLimit{BytesPerSec: 200_000})
+		}
+		t0 := time.Now()
+		go sl.goFuncSend()
+		assertReplicaCatchesUp(prefix, stream, t)
+		if elapsed := time.Since(t0); elapsed < 350*time.Millisecond || elapsed > 2*time.Second {
+			t.Fatal("it should have been throttled to about half a second, it took:", elapsed)
+		}
+		sl.Close()
+	}
+}
+
+func TestReplicator_ReplicaWindow(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+	replica := NewReplicator()
+	replica.Window = 4 * 1024
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+	go replica.Serve(listener, prefix)
+
+	stream, _ := persistent.MmapStreamCreate(path.Join(prefix, "origin"), 1024*1024, serialisation.ByteArraySerialiser{})
+	stream.Feed([]byte("first"))
+	sl := givenSyncLinkSend(stream, "repl", listener.Addr().String())
+	defer sl.Close()
+	assertWait("the replica window", func() bool { return atomic.LoadUint64(&sl.window) == replica.Window }, 5*time.Second, t)
+
+	go func() {
+		for i := 0; i < 10_000; i++ {
+			stream.Feed(make([]byte, 200))
+		}
+	}()
+	var inFlight uint64
+	assertWait("replica to catch up", func() bool {
+		sent := stream.ReadSubRPos(sl.subId)
+		if hwm := stream.GetRepHWM(sl.repId); sent > hwm && sent-hwm > inFlight {
+			inFlight = sent - hwm
+		}
+		return stream.WritePos() == stream.GetRepHWM(sl.repId) && stream.WritePos() > 10_000*200
+	}, 10*time.Second, t)
+	if inFlight == 0 || inFlight > replica.Window+1024 {
+		t.Fatal("there should not be more than the window in flight, there was:", inFlight)
+	}
+}
+
+func TestReplicator_WaitAllReturnsOnceCaughtUp(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+	listener, _ := givenReplicaServing(prefix, "replica")
+	defer listener.Close()
+	stream, _ := persistent.MmapStreamCreate(path.Join(prefix, "origin"), 64*1024, serialisation.ByteArraySerialiser{})
+	defer stream.CloseFile()
+	for i := 0; i < 1_000; i++ {
+		stream.Feed([]byte("element"))
+	}
+	origin := NewReplicator()
+	defer origin.Shutdown(context.Background())
+	if err := origin.ConnectTCP(stream, "repl", listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		origin.WaitAll(false, true)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the replica should have caught up")
+	}
+	if stats := origin.Stats(); len(stats) != 1 || stats[0].Lag != 0 {
+		t.Fatal(stats)
+	}
+}
+
+func givenReplicaServing(prefix, name string) (listener net.Listener, basePath string) {
+	basePath = path.Join(prefix, name)
+	_ = os.Mkdir(basePath, 0755)
+	listener, _ = net.Listen("tcp", "127.0.0.1:0")
+	go NewReplicator().Serve(listener, basePath)
+	return
+}
+
+func givenSyncLinkSend(stream *persistent.MmapStream, repName, addr string) *SyncLink {
+	conn, _ := net.Dial("tcp", addr)
+	sl := NewReplicator().NewSyncLinkSend(conn, addr, stream, repName)
+	go sl.goFuncSend()
+	return sl
+}
+
+func (r *Replicator) linkCount() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.Links)
+}
+
+func hexId(stream *persistent.MmapStream) string {
+	return fmt.Sprintf("%x", stream.GetUniqId())
+}
+
+// a throw-away CA signing one server and one client certificate
+func givenMutualTLSConfigs(serverName, clientName string, t *testing.T) (serverCfg, clientCfg *tls.Config) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDer)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	issue := func(serial int64, name string, usage x509.ExtKeyUsage) tls.Certificate {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			DNSNames:     []string{name},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+
+	serverCfg = &tls.Config{
+		Certificates: []tls.Certificate{issue(2, serverName, x509.ExtKeyUsageServerAuth)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	clientCfg = &tls.Config{
+		Certificates: []tls.Certificate{issue(3, clientName, x509.ExtKeyUsageClientAuth)},
+		RootCAs:      pool,
+		ServerName:   serverName,
+	}
+	return
+}
@@ -0,0 +1,104 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const closeGrace = 1 * time.Second
+
+var ErrReplicatorShutdown = errors.New("replicator shut down")
+
+// registers a listener (or packet connection) so Shutdown closes it, false if it is shut down already
+func (r *Replicator) trackListener(listener io.Closer) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.shutdown {
+		return false
+	}
+	r.listeners = append(r.listeners, listener)
+	return true
+}
+
+func (r *Replicator) isShutdown() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.shutdown
+}
+
+// Stops accepting connections and closes all the links, waiting for their goroutines to finish. With DrainOnShutdown,
+// it first waits until the replicas acknowledged everything written (up to now) on the streams this replicator
+// originates. It returns the errors which disconnected links, or the context error if it expired draining or closing.
+func (r *Replicator) Shutdown(ctx context.Context) error {
+	r.mutex.Lock()
+	r.shutdown = true
+	listeners := r.listeners
+	r.listeners = nil
+	links := append([]*SyncLink(nil), r.Links...)
+	drain := r.DrainOnShutdown
+	r.mutex.Unlock()
+
+	var errs []error
+	for _, listener := range listeners {
+		if err := listener.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if drain {
+		if err := drainLinks(ctx, links); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, link := range links {
+		link.Close()
+		if conn := link.getConn(); conn != nil {
+			_ = conn.Close() // unblocks its goroutines
+		}
+	}
+	closedAt := time.Now()
+	for _, link := range links {
+		// closing is prompt, it gets a moment even when the context expired while draining
+		for (link.State() != DISCONNECTED || link.Reconnecting()) && (ctx.Err() == nil || time.Since(closedAt) < closeGrace) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if link.State() != DISCONNECTED || link.Reconnecting() {
+			errs = append(errs, fmt.Errorf("closing link to %v: %w", link.host, ctx.Err()))
+			continue
+		}
+		if err := link.Err(); err != nil {
+			errs = append(errs, fmt.Errorf("link to %v: %w", link.host, err))
+		}
+	}
+	r.houseKeeping()
+	r.closeManagedStreams()
+	return errors.Join(errs...)
+}
+
+// waits until every origin link has its replica acknowledging the stream write position, as it is when called
+func drainLinks(ctx context.Context, links []*SyncLink) error {
+	targets := map[*SyncLink]uint64{}
+	for _, link := range links {
+		if link.origin {
+			targets[link] = link.Stream.WritePos()
+		}
+	}
+	for len(targets) > 0 {
+		for link, target := range targets {
+			if link.Stream.GetRepHWM(link.repId) >= target || link.State() == DISCONNECTED && !link.Reconnecting() {
+				delete(targets, link) // drained, or it never will
+			}
+		}
+		if len(targets) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("draining %v links: %w", len(targets), ctx.Err())
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+	return nil
+}
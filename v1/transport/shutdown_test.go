@@ -0,0 +1,118 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"github.com/kuking/go-frank/v1/persistent"
+	"github.com/kuking/go-frank/v1/serialisation"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestReplicator_ShutdownStopsIdleListeners(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+	r := NewReplicator()
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	pconn, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	served := make(chan error, 2)
+	go func() { served <- r.Serve(listener, prefix) }()
+	go func() { served <- r.ServeUDP(pconn, prefix) }()
+	time.Sleep(50 * time.Millisecond)
+
+	if err := r.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-served:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("it should stop serving")
+		}
+	}
+	if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Fatal("it should not be listening anymore")
+	}
+	if r.Serve(listener, prefix) != ErrReplicatorShutdown {
+		t.Fatal("it should not serve once shut down")
+	}
+}
+
+func TestReplicator_ShutdownDrainsLinks(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+	replica := NewReplicator()
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	go replica.Serve(listener, prefix)
+
+	stream, _ := persistent.MmapStreamCreate(path.Join(prefix, "origin"), 1024*1024, serialisation.ByteArraySerialiser{})
+	origin := NewReplicator()
+	origin.SetRateLimit(RateLimit{EntriesPerSec: 5_000}) // so there is something left to drain
+	if err := origin.ConnectTCP(stream, "repl", listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1_000; i++ {
+		stream.Feed([]byte("drain me"))
+	}
+	sl := origin.Links[0]
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	origin.DrainOnShutdown = true
+	if err := origin.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if stream.GetRepHWM(sl.repId) != stream.WritePos() {
+		t.Fatal("the replica should have acknowledged everything")
+	}
+	if sl.State() != DISCONNECTED || sl.Reconnecting() || origin.linkCount() != 0 {
+		t.Fatal("the links should be closed")
+	}
+	if origin.ConnectTCP(stream, "repl", listener.Addr().String()) != ErrReplicatorShutdown {
+		t.Fatal("it should not connect once shut down")
+	}
+	assertWait("replica to notice", func() bool { return replica.Links[0].State() == DISCONNECTED }, 5*time.Second, t)
+	if err := replica.Shutdown(ctx); !errors.Is(err, io.EOF) {
+		t.Fatal("the origin hung up first, err:", err)
+	}
+	if replica.linkCount() != 0 {
+		t.Fatal("the replica links should be closed")
+	}
+}
+
+func TestReplicator_ShutdownDrainTimesOut(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+	// a replica which never acknowledges
+	silent, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer silent.Close()
+	go func() {
+		for {
+			if _, err := silent.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	stream, _ := persistent.MmapStreamCreate(path.Join(prefix, "origin"), 64*1024, serialisation.ByteArraySerialiser{})
+	stream.Feed([]byte("never acknowledged"))
+	origin := NewReplicator()
+	if err := origin.ConnectTCP(stream, "repl", silent.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	origin.DrainOnShutdown = true
+	if err := origin.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("it should have given up draining, err:", err)
+	}
+	if origin.linkCount() != 0 {
+		t.Fatal("the links should be closed anyway")
+	}
+}
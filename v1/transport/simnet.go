@@ -0,0 +1,702 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A SimNetwork is an in-memory Transport for tests. Its faults are drawn from a seeded generator, so a test sees the
+// same losses, duplicates and reorderings every run (as far as goroutines scheduling goes), without real sockets.
+// Datagrams ("udp") can be lost, duplicated, reordered and delayed. Stream connections ("tcp", "unix") are reliable
+// as TCP is: they are delayed, hold what is written while partitioned, and are reset when a host "crashes".
+// Hosts are named after the addresses: "b:7000" is on host "b". Connections dialed from the network itself come from
+// host "sim", Host gives the network as seen from another one.
+
+const (
+	simStreamBuffer   = 1024 * 1024           // unread bytes of a stream connection before writes block
+	simDatagramQueue  = 4096                  // unread datagrams of an endpoint before new ones are lost
+	simReorderHold    = 10 * time.Millisecond // a reordered datagram is overtaken by the next one, or delivered after this
+	simPoll           = time.Millisecond
+	simBacklog        = 64
+	simEphemeralPorts = 40000
+)
+
+var (
+	errSimRefused     = errors.New("sim: connection refused")
+	errSimUnreachable = errors.New("sim: host unreachable")
+	errSimReset       = errors.New("sim: connection reset")
+)
+
+type SimFaults struct {
+	Drop      float64 // probability of losing a datagram
+	Duplicate float64 // of delivering a datagram twice
+	Reorder   float64 // of the next datagram overtaking it
+	// every datagram, or write to a stream connection, arrives after a delay in between
+	MinDelay time.Duration
+	MaxDelay time.Duration
+}
+
+type SimNetwork struct {
+	lock       sync.Mutex
+	rnd        *rand.Rand
+	faults     SimFaults
+	partitions map[[2]string]bool
+	listeners  map[string]*simListener
+	endpoints  map[string]*simEndpoint
+	conns      map[*simConn]bool
+	lastPort   int
+}
+
+func NewSimNetwork(seed int64) *SimNetwork {
+	return &SimNetwork{
+		rnd:        rand.New(rand.NewSource(seed)),
+		partitions: map[[2]string]bool{},
+		listeners:  map[string]*simListener{},
+		endpoints:  map[string]*simEndpoint{},
+		conns:      map[*simConn]bool{},
+	}
+}
+
+func (n *SimNetwork) SetFaults(faults SimFaults) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.faults = faults
+}
+
+// Nothing goes through between the hosts until they are healed: datagrams are lost, stream connections hold what is
+// written to them (and their peers eventually time out), new connections are unreachable.
+func (n *SimNetwork) Partition(a, b string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.partitions[simPair(a, b)] = true
+}
+
+func (n *SimNetwork) Heal(a, b string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.partitions, simPair(a, b))
+}
+
+// Resets the stream connections of the host, as if it crashed: both ends fail reading and writing them.
+func (n *SimNetwork) Reset(host string) {
+	n.lock.Lock()
+	var reset []*simConn
+	for c := range n.conns {
+		if simHostOf(c.local.address) == host || simHostOf(c.remote.address) == host {
+			reset = append(reset, c)
+		}
+	}
+	n.lock.Unlock()
+	for _, c := range reset {
+		c.in.setReset()
+		c.out.setReset()
+	}
+}
+
+// The network as seen from the host, the connections it dials come from it.
+func (n *SimNetwork) Host(name string) Transport {
+	return &simHost{net: n, name: name}
+}
+
+func (n *SimNetwork) Dial(network, address string) (net.Conn, error) {
+	return n.dial("sim", network, address)
+}
+
+func (n *SimNetwork) Listen(network, address string) (net.Listener, error) {
+	if !simStream(network) {
+		return nil, errors.New(fmt.Sprintf("sim: unsupported network: %v", network))
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	address = n.bindLocked(address)
+	if n.listeners[address] != nil {
+		return nil, errors.New(fmt.Sprintf("sim: listen %v: address in use", address))
+	}
+	l := &simListener{
+		net:    n,
+		addr:   simAddr{network: network, address: address},
+		accept: make(chan *simConn, simBacklog),
+		closed: make(chan struct{}),
+	}
+	n.listeners[address] = l
+	return l, nil
+}
+
+func (n *SimNetwork) ListenPacket(network, address string) (net.PacketConn, error) {
+	if !simDatagram(network) {
+		return nil, errors.New(fmt.Sprintf("sim: unsupported network: %v", network))
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	address = n.bindLocked(address)
+	if n.endpoints[address] != nil {
+		return nil, errors.New(fmt.Sprintf("sim: listen %v: address in use", address))
+	}
+	return n.newEndpointLocked(simAddr{network: network, address: address}), nil
+}
+
+func (n *SimNetwork) dial(from, network, address string) (net.Conn, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	local := simAddr{network: network, address: n.bindLocked(from + ":0")}
+	remote := simAddr{network: network, address: address}
+	if simDatagram(network) {
+		return &simDatagramConn{simEndpoint: n.newEndpointLocked(local), remote: remote}, nil
+	}
+	if !simStream(network) {
+		return nil, errors.New(fmt.Sprintf("sim: unsupported network: %v", network))
+	}
+	l := n.listeners[address]
+	if l == nil {
+		return nil, errSimRefused
+	}
+	if n.partitions[simPair(from, simHostOf(address))] {
+		return nil, errSimUnreachable
+	}
+	toServer, toClient := newSimQueue(n, from, simHostOf(address)), newSimQueue(n, simHostOf(address), from)
+	client := newSimConn(n, local, remote, toClient, toServer)
+	server := newSimConn(n, remote, local, toServer, toClient)
+	select {
+	case l.accept <- server:
+		n.conns[client], n.conns[server] = true, true
+		return client, nil
+	default:
+		return nil, errSimRefused // backlog full
+	}
+}
+
+// the address, with a port assigned when it is zero
+func (n *SimNetwork) bindLocked(address string) string {
+	if host, port, err := net.SplitHostPort(address); err == nil && port == "0" {
+		n.lastPort++
+		return net.JoinHostPort(host, fmt.Sprint(simEphemeralPorts+n.lastPort))
+	}
+	return address
+}
+
+func (n *SimNetwork) newEndpointLocked(addr simAddr) *simEndpoint {
+	e := &simEndpoint{net: n, addr: addr, in: newSimQueue(n, "", ""), closed: make(chan struct{})}
+	e.deadline.Store(time.Time{})
+	n.endpoints[addr.address] = e
+	return e
+}
+
+func (n *SimNetwork) partitioned(a, b string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.partitions[simPair(a, b)]
+}
+
+func (n *SimNetwork) delayLocked() time.Duration {
+	delay := n.faults.MinDelay
+	if spread := n.faults.MaxDelay - n.faults.MinDelay; spread > 0 {
+		delay += time.Duration(n.rnd.Int63n(int64(spread) + 1))
+	}
+	return delay
+}
+
+func (n *SimNetwork) delay() time.Duration {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.delayLocked()
+}
+
+func (n *SimNetwork) send(from simAddr, to string, datagram []byte) {
+	n.lock.Lock()
+	// every datagram draws the same, so the faults only depend on the seed and the order they are sent in
+	drop := n.rnd.Float64() < n.faults.Drop
+	duplicate := n.rnd.Float64() < n.faults.Duplicate
+	reorder := n.rnd.Float64() < n.faults.Reorder
+	delay := n.delayLocked()
+	dst := n.endpoints[to]
+	partitioned := n.partitions[simPair(simHostOf(from.address), simHostOf(to))]
+	n.lock.Unlock()
+	if dst == nil || drop || partitioned {
+		return
+	}
+	packet := simPacket{data: append([]byte(nil), datagram...), from: from, at: time.Now().Add(delay)}
+	dst.in.enqueueDatagram(simPacket{data: packet.data, from: from, at: packet.at, held: reorder})
+	if duplicate {
+		dst.in.enqueueDatagram(packet)
+	}
+}
+
+func (n *SimNetwork) forget(c *simConn) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.conns, c)
+}
+
+func (n *SimNetwork) forgetEndpoint(e *simEndpoint) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.endpoints[e.addr.address] == e {
+		delete(n.endpoints, e.addr.address)
+	}
+}
+
+type simHost struct {
+	net  *SimNetwork
+	name string
+}
+
+func (h *simHost) Dial(network, address string) (net.Conn, error) {
+	return h.net.dial(h.name, network, address)
+}
+
+func (h *simHost) Listen(network, address string) (net.Listener, error) {
+	return h.net.Listen(network, address)
+}
+
+func (h *simHost) ListenPacket(network, address string) (net.PacketConn, error) {
+	return h.net.ListenPacket(network, address)
+}
+
+func simStream(network string) bool {
+	return strings.HasPrefix(network, "tcp") || network == "unix"
+}
+
+func simDatagram(network string) bool {
+	return strings.HasPrefix(network, "udp")
+}
+
+func simHostOf(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+func simPair(a, b string) [2]string {
+	if a > b {
+		return [2]string{b, a}
+	}
+	return [2]string{a, b}
+}
+
+type simAddr struct {
+	network string
+	address string
+}
+
+func (a simAddr) Network() string {
+	return a.network
+}
+
+func (a simAddr) String() string {
+	return a.address
+}
+
+type simPacket struct {
+	data []byte
+	from net.Addr
+	at   time.Time // not delivered before
+	held bool      // reordered, waiting for the next one to overtake it
+}
+
+// what is in flight towards a connection, or a datagram endpoint, in delivery order
+type simQueue struct {
+	net        *SimNetwork
+	from, to   string // hosts of a stream connection, held while partitioned
+	lock       sync.Mutex
+	packets    []simPacket
+	buffered   int
+	closed     bool // by the writer, the reader gets io.EOF once it read everything
+	readerGone bool
+	reset      bool
+	signal     chan struct{}
+}
+
+func newSimQueue(n *SimNetwork, from, to string) *simQueue {
+	return &simQueue{net: n, from: from, to: to, signal: make(chan struct{}, 1)}
+}
+
+func (q *simQueue) notify() {
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+// it returns how long to wait for something to read (forever when negative) when there is nothing yet
+func (q *simQueue) readStream(p []byte) (int, time.Duration, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.reset {
+		return 0, 0, errSimReset
+	}
+	if len(q.packets) == 0 {
+		if !q.closed {
+			return 0, -1, nil
+		}
+		if q.net.partitioned(q.from, q.to) { // the close does not get through either
+			return 0, simPoll, nil
+		}
+		return 0, 0, io.EOF
+	}
+	head := &q.packets[0]
+	if wait := time.Until(head.at); wait > 0 {
+		return 0, wait, nil
+	}
+	if q.net.partitioned(q.from, q.to) {
+		return 0, simPoll, nil
+	}
+	n := copy(p, head.data)
+	head.data = head.data[n:]
+	if len(head.data) == 0 {
+		q.packets = q.packets[1:]
+	}
+	q.buffered -= n
+	q.notify()
+	return n, 0, nil
+}
+
+// false when it is full, the writer has to wait for the reader
+func (q *simQueue) writeStream(p []byte, delay time.Duration) (bool, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.reset {
+		return false, errSimReset
+	}
+	if q.closed {
+		return false, io.ErrClosedPipe
+	}
+	if q.readerGone {
+		if q.net.partitioned(q.from, q.to) {
+			return true, nil // lost, the writer does not know yet
+		}
+		return false, io.ErrClosedPipe
+	}
+	if q.buffered >= simStreamBuffer {
+		return false, nil
+	}
+	at := time.Now().Add(delay)
+	if last := len(q.packets) - 1; last >= 0 && q.packets[last].at.After(at) {
+		at = q.packets[last].at // a stream is never reordered
+	}
+	q.packets = append(q.packets, simPacket{data: append([]byte(nil), p...), at: at})
+	q.buffered += len(p)
+	q.notify()
+	return true, nil
+}
+
+func (q *simQueue) readDatagram(p []byte) (int, net.Addr, time.Duration) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.packets) == 0 {
+		return 0, nil, -1
+	}
+	head := q.packets[0]
+	due := head.at
+	if head.held {
+		due = due.Add(simReorderHold)
+	}
+	if wait := time.Until(due); wait > 0 {
+		return 0, nil, wait
+	}
+	q.packets = q.packets[1:]
+	return copy(p, head.data), head.from, 0
+}
+
+func (q *simQueue) enqueueDatagram(packet simPacket) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.packets) >= simDatagramQueue {
+		return
+	}
+	i := len(q.packets)
+	if !packet.held {
+		for i > 0 && q.packets[i-1].held { // it overtakes them
+			i--
+			q.packets[i].held = false
+		}
+	}
+	q.packets = append(q.packets, simPacket{})
+	copy(q.packets[i+1:], q.packets[i:])
+	q.packets[i] = packet
+	q.notify()
+}
+
+func (q *simQueue) setClosed() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed = true
+	q.notify()
+}
+
+func (q *simQueue) setReaderGone() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.readerGone = true
+	q.packets, q.buffered = nil, 0
+	q.notify()
+}
+
+func (q *simQueue) setReset() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.reset = true
+	q.notify()
+}
+
+// waits for a signal, for wait (forever when negative) or until the deadline; the caller checks again afterwards
+func simAwait(signal <-chan struct{}, closed <-chan struct{}, deadline time.Time, wait time.Duration) error {
+	if !deadline.IsZero() {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		if wait < 0 || left < wait {
+			wait = left
+		}
+	}
+	var timeOut <-chan time.Time
+	if wait >= 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeOut = timer.C
+	}
+	select {
+	case <-signal:
+	case <-closed:
+	case <-timeOut:
+	}
+	return nil
+}
+
+type simConn struct {
+	net      *SimNetwork
+	local    simAddr
+	remote   simAddr
+	in       *simQueue
+	out      *simQueue
+	closed   chan struct{}
+	once     sync.Once
+	deadline atomic.Value // time.Time, of reads
+}
+
+func newSimConn(n *SimNetwork, local, remote simAddr, in, out *simQueue) *simConn {
+	c := &simConn{net: n, local: local, remote: remote, in: in, out: out, closed: make(chan struct{})}
+	c.deadline.Store(time.Time{})
+	return c
+}
+
+func (c *simConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *simConn) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		if c.isClosed() {
+			return 0, net.ErrClosed
+		}
+		n, wait, err := c.in.readStream(p)
+		if n > 0 || err != nil {
+			return n, err
+		}
+		if err = simAwait(c.in.signal, c.closed, c.deadline.Load().(time.Time), wait); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *simConn) Write(p []byte) (int, error) {
+	for {
+		if c.isClosed() {
+			return 0, net.ErrClosed
+		}
+		written, err := c.out.writeStream(p, c.net.delay())
+		if err != nil {
+			return 0, err
+		}
+		if written {
+			return len(p), nil
+		}
+		_ = simAwait(c.out.signal, c.closed, time.Time{}, simPoll)
+	}
+}
+
+func (c *simConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.out.setClosed()
+		c.in.setReaderGone()
+		c.net.forget(c)
+	})
+	return nil
+}
+
+func (c *simConn) CloseWrite() error {
+	c.out.setClosed()
+	return nil
+}
+
+func (c *simConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *simConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *simConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *simConn) SetReadDeadline(t time.Time) error {
+	c.deadline.Store(t)
+	c.in.notify()
+	return nil
+}
+
+func (c *simConn) SetWriteDeadline(_ time.Time) error {
+	return nil
+}
+
+type simListener struct {
+	net    *SimNetwork
+	addr   simAddr
+	accept chan *simConn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (l *simListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *simListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.net.lock.Lock()
+		if l.net.listeners[l.addr.address] == l {
+			delete(l.net.listeners, l.addr.address)
+		}
+		l.net.lock.Unlock()
+		for {
+			select {
+			case c := <-l.accept:
+				_ = c.Close()
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+func (l *simListener) Addr() net.Addr {
+	return l.addr
+}
+
+// a datagram endpoint, a net.PacketConn
+type simEndpoint struct {
+	net      *SimNetwork
+	addr     simAddr
+	in       *simQueue
+	closed   chan struct{}
+	once     sync.Once
+	deadline atomic.Value // time.Time, of reads
+}
+
+func (e *simEndpoint) isClosed() bool {
+	select {
+	case <-e.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (e *simEndpoint) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		if e.isClosed() {
+			return 0, nil, net.ErrClosed
+		}
+		n, from, wait := e.in.readDatagram(p)
+		if from != nil {
+			return n, from, nil
+		}
+		if err := simAwait(e.in.signal, e.closed, e.deadline.Load().(time.Time), wait); err != nil {
+			return 0, nil, err
+		}
+	}
+}
+
+func (e *simEndpoint) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if e.isClosed() {
+		return 0, net.ErrClosed
+	}
+	e.net.send(e.addr, addr.String(), p)
+	return len(p), nil
+}
+
+func (e *simEndpoint) Close() error {
+	e.once.Do(func() {
+		close(e.closed)
+		e.net.forgetEndpoint(e)
+	})
+	return nil
+}
+
+func (e *simEndpoint) LocalAddr() net.Addr {
+	return e.addr
+}
+
+func (e *simEndpoint) SetDeadline(t time.Time) error {
+	return e.SetReadDeadline(t)
+}
+
+func (e *simEndpoint) SetReadDeadline(t time.Time) error {
+	e.deadline.Store(t)
+	e.in.notify()
+	return nil
+}
+
+func (e *simEndpoint) SetWriteDeadline(_ time.Time) error {
+	return nil
+}
+
+// a dialed datagram endpoint, it only talks to the address it dialed
+type simDatagramConn struct {
+	*simEndpoint
+	remote simAddr
+}
+
+func (c *simDatagramConn) Read(p []byte) (int, error) {
+	for {
+		n, from, err := c.ReadFrom(p)
+		if err != nil || from.String() == c.remote.address {
+			return n, err
+		}
+	}
+}
+
+func (c *simDatagramConn) Write(p []byte) (int, error) {
+	return c.WriteTo(p, c.remote)
+}
+
+func (c *simDatagramConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,204 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kuking/go-frank/v1/persistent"
+	"github.com/kuking/go-frank/v1/serialisation"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSimNetwork_DatagramFaultsAreDeterministic(t *testing.T) {
+	faults := SimFaults{Drop: 0.1, Duplicate: 0.1, Reorder: 0.1}
+	first, again, other := simReceived(42, faults, t), simReceived(42, faults, t), simReceived(43, faults, t)
+	if fmt.Sprint(first) != fmt.Sprint(again) {
+		t.Fatal("the same seed should give the same faults\n", first, "\n", again)
+	}
+	if fmt.Sprint(first) == fmt.Sprint(other) {
+		t.Fatal("another seed should give other faults")
+	}
+	lost, duplicated, reordered := 1_000, 0, 0
+	seen := map[int]bool{}
+	for i, seq := range first {
+		if !seen[seq] {
+			lost--
+		} else {
+			duplicated++
+		}
+		seen[seq] = true
+		if i > 0 && seq < first[i-1] {
+			reordered++
+		}
+	}
+	if lost < 50 || duplicated < 50 || reordered < 50 {
+		t.Fatal("expected ~100 of each, lost:", lost, "duplicated:", duplicated, "reordered:", reordered)
+	}
+}
+
+// the sequence numbers received, out of 1000 sent
+func simReceived(seed int64, faults SimFaults, t *testing.T) (received []int) {
+	network := NewSimNetwork(seed)
+	network.SetFaults(faults)
+	pconn, err := network.ListenPacket("udp", "b:7000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pconn.Close()
+	conn, _ := network.Host("a").Dial("udp", "b:7000")
+	defer conn.Close()
+	for i := 0; i < 1_000; i++ {
+		_, _ = conn.Write([]byte(fmt.Sprint(i)))
+	}
+	buffer := make([]byte, 100)
+	for {
+		_ = pconn.SetReadDeadline(time.Now().Add(2 * simReorderHold))
+		n, from, err := pconn.ReadFrom(buffer)
+		if err != nil {
+			return received
+		}
+		if from.String() != conn.LocalAddr().String() {
+			t.Fatal("unexpected sender", from)
+		}
+		var seq int
+		_, _ = fmt.Sscan(string(buffer[:n]), &seq)
+		received = append(received, seq)
+	}
+}
+
+func TestSimNetwork_StreamPartitionsAndResets(t *testing.T) {
+	network := NewSimNetwork(1)
+	listener, _ := network.Listen("tcp", "b:7000")
+	defer listener.Close()
+	if _, err := network.Dial("tcp", "b:7001"); !errors.Is(err, errSimRefused) {
+		t.Fatal("nobody listens there", err)
+	}
+	client, _ := network.Host("a").Dial("tcp", "b:7000")
+	server, _ := listener.Accept()
+
+	network.Partition("a", "b")
+	if _, err := network.Host("a").Dial("tcp", "b:7000"); !errors.Is(err, errSimUnreachable) {
+		t.Fatal("b is unreachable from a", err)
+	}
+	if _, err := client.Write([]byte("held")); err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, 10)
+	_ = server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := server.Read(buffer); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("it should be held while partitioned", err)
+	}
+	network.Heal("a", "b")
+	_ = server.SetReadDeadline(time.Time{})
+	if n, err := server.Read(buffer); err != nil || string(buffer[:n]) != "held" {
+		t.Fatal("it should arrive once healed", err)
+	}
+
+	network.Reset("a")
+	if _, err := server.Read(buffer); !errors.Is(err, errSimReset) {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte("lost")); !errors.Is(err, errSimReset) {
+		t.Fatal(err)
+	}
+	_ = client.Close()
+	_ = server.Close()
+}
+
+func TestReplicator_SimLossyDatagrams(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+	network := NewSimNetwork(7)
+	network.SetFaults(SimFaults{Drop: 0.05, Duplicate: 0.05, Reorder: 0.05, MaxDelay: time.Millisecond})
+	replica := NewReplicator()
+	replica.Transport = network.Host("b")
+	defer replica.Shutdown(context.Background())
+	pconn, _ := replica.Transport.ListenPacket("udp", "b:7000")
+	go replica.ServeUDP(pconn, prefix)
+
+	stream, _ := persistent.MmapStreamCreate(path.Join(prefix, "origin"), 1024*1024, serialisation.ByteArraySerialiser{})
+	defer stream.CloseFile()
+	for i := 0; i < 5_000; i++ {
+		stream.Feed([]byte(fmt.Sprint(i)))
+	}
+	origin := NewReplicator()
+	origin.Transport = network.Host("a")
+	defer origin.Shutdown(context.Background())
+	if err := origin.ConnectUDP(stream, "repl", "b:7000"); err != nil {
+		t.Fatal(err)
+	}
+	assertReplicaCatchesUp(prefix, stream, t)
+	replicaStream, _ := persistent.MmapStreamOpen(path.Join(prefix, hexId(stream)), serialisation.ByteArraySerialiser{})
+	defer replicaStream.CloseFile()
+	if err := sameStreamContents(stream, replicaStream); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// counts the dials which found the host unreachable
+type unreachableCounter struct {
+	Transport
+	unreachable int32
+}
+
+func (u *unreachableCounter) Dial(network, address string) (net.Conn, error) {
+	conn, err := u.Transport.Dial(network, address)
+	if errors.Is(err, errSimUnreachable) {
+		atomic.AddInt32(&u.unreachable, 1)
+	}
+	return conn, err
+}
+
+func TestReplicator_SimPartitionTimesOutAndReconnects(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+	network := NewSimNetwork(7)
+	network.SetFaults(SimFaults{MaxDelay: time.Millisecond})
+	replica := givenFastHeartbeats(NewReplicator())
+	replica.Transport = network.Host("b")
+	defer replica.Shutdown(context.Background())
+	listener, _ := replica.Transport.Listen("tcp", "b:7000")
+	go replica.Serve(listener, prefix)
+
+	stream, _ := persistent.MmapStreamCreate(path.Join(prefix, "origin"), 64*1024, serialisation.ByteArraySerialiser{})
+	defer stream.CloseFile()
+	for i := 0; i < 1_000; i++ {
+		stream.Feed([]byte("before"))
+	}
+	origin := givenFastHeartbeats(NewReplicator())
+	dials := &unreachableCounter{Transport: network.Host("a")}
+	origin.Transport = dials
+	defer origin.Shutdown(context.Background())
+	if err := origin.ConnectTCP(stream, "repl", "b:7000"); err != nil {
+		t.Fatal(err)
+	}
+	sl := origin.Links[0]
+	assertReplicaCatchesUp(prefix, stream, t)
+
+	network.Partition("a", "b")
+	for i := 0; i < 1_000; i++ {
+		stream.Feed([]byte("while partitioned"))
+	}
+	assertWait("origin to time out", func() bool {
+		return sl.State() == DISCONNECTED && errors.Is(sl.Err(), ErrPeerTimedOut)
+	}, 5*time.Second, t)
+	assertWait("a redial to fail", func() bool { return atomic.LoadInt32(&dials.unreachable) > 0 }, 5*time.Second, t)
+	if !sl.Reconnecting() || sl.Stats().Reconnects != 0 {
+		t.Fatal("it should not reconnect while partitioned")
+	}
+
+	network.Heal("a", "b")
+	assertWait("origin to reconnect", func() bool { return sl.State() == PUSHING && sl.Err() == nil }, 5*time.Second, t)
+	assertReplicaCatchesUp(prefix, stream, t)
+	replicaStream, _ := persistent.MmapStreamOpen(path.Join(prefix, hexId(stream)), serialisation.ByteArraySerialiser{})
+	defer replicaStream.CloseFile()
+	if err := sameStreamContents(stream, replicaStream); err != nil {
+		t.Fatal(err)
+	}
+}
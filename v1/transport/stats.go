@@ -0,0 +1,163 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Link statistics, since the link was created. Elements and Bytes (their payload) are the ones sent by the origin, or
+// written by the replica; compressed batches are counted before (BatchBytes) and after (BatchWireBytes) compression.
+// BytesSent and BytesReceived are everything that went through the connection(s), both ways. Lag is what was written
+// to the origin stream and the replica did not acknowledge, replicas know it as of the last WireSTATUS.
+type LinkStats struct {
+	Host           string    `json:"host"`
+	Name           string    `json:"name,omitempty"` // replicator name, on the origin
+	Stream         string    `json:"stream"`         // lineage id, as the replicas are named
+	Origin         bool      `json:"origin"`
+	State          SyncState `json:"state"`
+	Since          time.Time `json:"since"`
+	Elements       uint64    `json:"elements"`
+	Bytes          uint64    `json:"bytes"`
+	Batches        uint64    `json:"batches"`
+	BatchBytes     uint64    `json:"batch_bytes"`
+	BatchWireBytes uint64    `json:"batch_wire_bytes"`
+	BytesSent      uint64    `json:"bytes_sent"`
+	BytesReceived  uint64    `json:"bytes_received"`
+	Lag            uint64    `json:"lag"`
+	LastAck        time.Time `json:"last_ack"` // zero if none
+	Errors         uint64    `json:"errors"`
+	Reconnects     uint64    `json:"reconnects"`
+	Err            string    `json:"error,omitempty"` // the one which disconnected the link
+}
+
+// Uncompressed to compressed size of the batches, 1 when there are none.
+func (l LinkStats) CompressionRatio() float64 {
+	if l.BatchWireBytes == 0 {
+		return 1
+	}
+	return float64(l.BatchBytes) / float64(l.BatchWireBytes)
+}
+
+// Elements payload bytes per second.
+func (l LinkStats) Throughput() float64 {
+	return float64(l.Bytes) / time.Since(l.Since).Seconds()
+}
+
+func (s SyncState) String() string {
+	switch s {
+	case DISCONNECTED:
+		return "DISCONNECTED"
+	case CONNECTED:
+		return "CONNECTED"
+	case PULLING:
+		return "PULLING"
+	case PUSHING:
+		return "PUSHING"
+	case AUTHENTICATING:
+		return "AUTHENTICATING"
+	}
+	return fmt.Sprintf("SyncState(%d)", int32(s))
+}
+
+func (s SyncState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+type linkCounters struct {
+	elements       uint64
+	bytes          uint64
+	batches        uint64
+	batchBytes     uint64
+	batchWireBytes uint64
+	sent           uint64
+	received       uint64
+	lastAck        int64  // unix nanos
+	originWritePos uint64 // as of the last WireSTATUS, on replicas
+	errors         uint64
+	reconnects     uint64
+}
+
+func (c *linkCounters) element(n int) {
+	atomic.AddUint64(&c.elements, 1)
+	atomic.AddUint64(&c.bytes, uint64(n))
+}
+
+func (c *linkCounters) batch(raw, wire int) {
+	atomic.AddUint64(&c.batches, 1)
+	atomic.AddUint64(&c.batchBytes, uint64(raw))
+	atomic.AddUint64(&c.batchWireBytes, uint64(wire))
+}
+
+func (c *linkCounters) ack() {
+	atomic.StoreInt64(&c.lastAck, time.Now().UnixNano())
+}
+
+func (s *SyncLink) Stats() LinkStats {
+	stats := LinkStats{
+		Host:           s.host,
+		Name:           s.repName,
+		Origin:         s.origin,
+		State:          s.State(),
+		Since:          s.created,
+		Elements:       atomic.LoadUint64(&s.stats.elements),
+		Bytes:          atomic.LoadUint64(&s.stats.bytes),
+		Batches:        atomic.LoadUint64(&s.stats.batches),
+		BatchBytes:     atomic.LoadUint64(&s.stats.batchBytes),
+		BatchWireBytes: atomic.LoadUint64(&s.stats.batchWireBytes),
+		BytesSent:      atomic.LoadUint64(&s.stats.sent),
+		BytesReceived:  atomic.LoadUint64(&s.stats.received),
+		Errors:         atomic.LoadUint64(&s.stats.errors),
+		Reconnects:     atomic.LoadUint64(&s.stats.reconnects),
+	}
+	if lastAck := atomic.LoadInt64(&s.stats.lastAck); lastAck != 0 {
+		stats.LastAck = time.Unix(0, lastAck)
+	}
+	if err := s.Err(); err != nil {
+		stats.Err = err.Error()
+	}
+	if stream := s.Stream; stream != nil { // replicas open theirs on WireHELLO
+		stats.Stream = fmt.Sprintf("%x", stream.GetReplicaOf())
+		writePos, ackPos := stream.WritePos(), uint64(0)
+		if s.origin {
+			ackPos = stream.GetRepHWM(s.repId)
+		} else {
+			writePos, ackPos = atomic.LoadUint64(&s.stats.originWritePos), writePos
+		}
+		if writePos > ackPos {
+			stats.Lag = writePos - ackPos
+		}
+	}
+	return stats
+}
+
+// The statistics of all its links.
+func (r *Replicator) Stats() []LinkStats {
+	r.mutex.Lock()
+	links := append([]*SyncLink(nil), r.Links...)
+	r.mutex.Unlock()
+	stats := make([]LinkStats, len(links))
+	for i, link := range links {
+		stats[i] = link.Stats()
+	}
+	return stats
+}
+
+// counts the bytes going through the connection
+type countingConn struct {
+	net.Conn
+	stats *linkCounters
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddUint64(&c.stats.received, uint64(n))
+	return n, err
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddUint64(&c.stats.sent, uint64(n))
+	return n, err
+}
@@ -0,0 +1,84 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/kuking/go-frank/v1/persistent"
+	"github.com/kuking/go-frank/v1/serialisation"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplicator_Stats(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+	replica := NewReplicator()
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	go replica.Serve(listener, prefix)
+	defer replica.Shutdown(context.Background())
+
+	stream, _ := persistent.MmapStreamCreate(path.Join(prefix, "origin"), 1024*1024, serialisation.ByteArraySerialiser{})
+	defer stream.CloseFile()
+	origin := NewReplicator()
+	defer origin.Shutdown(context.Background())
+	if err := origin.ConnectTCP(stream, "repl", listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		stream.Feed([]byte("0123456789"))
+	}
+	assertReplicaCatchesUp(prefix, stream, t)
+	assertWait("the last ACK", func() bool { return origin.Stats()[0].Lag == 0 }, 5*time.Second, t)
+
+	sent, received := origin.Stats()[0], replica.Stats()[0]
+	if !sent.Origin || sent.State != PUSHING || sent.Name != "repl" || sent.Stream != hexId(stream) ||
+		sent.Elements != 100 || sent.Bytes != 1_000 || sent.BytesSent <= sent.Bytes || sent.BytesReceived == 0 ||
+		sent.LastAck.IsZero() || sent.Errors != 0 || sent.Reconnects != 0 || sent.Err != "" {
+		t.Fatal("unexpected origin stats", sent)
+	}
+	if received.Origin || received.State != PULLING || received.Stream != hexId(stream) || received.Elements != 100 ||
+		received.BytesReceived < sent.Bytes || received.Lag != 0 || received.LastAck.IsZero() {
+		t.Fatal("unexpected replica stats", received)
+	}
+
+	server := httptest.NewServer(origin.StatsHandler())
+	defer server.Close()
+	res, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats []map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&stats)
+	_ = res.Body.Close()
+	if err != nil || len(stats) != 1 || stats[0]["state"] != "PUSHING" || stats[0]["elements"] != 100.0 {
+		t.Fatal("unexpected json stats", stats, err)
+	}
+
+	res, err = http.Get(server.URL + "?format=prometheus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	_ = res.Body.Close()
+	labels := fmt.Sprintf(`host="%v",name="repl",stream="%v",role="origin"`, listener.Addr(), hexId(stream))
+	for _, line := range []string{
+		"# TYPE frank_link_elements_total counter",
+		"frank_link_elements_total{" + labels + "} 100",
+		"frank_link_element_bytes_total{" + labels + "} 1000",
+		"frank_link_lag_bytes{" + labels + "} 0",
+		"frank_link_up{" + labels + "} 1",
+		"frank_link_state{" + labels + `,state="PUSHING"} 1`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Fatal("missing:", line, "in:\n", string(body))
+		}
+	}
+}
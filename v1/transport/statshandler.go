@@ -0,0 +1,96 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type linkMetric struct {
+	name  string
+	kind  string
+	help  string
+	value func(l LinkStats) float64
+}
+
+var linkMetrics = []linkMetric{
+	{"frank_link_up", "gauge", "1 when the link is connected, 0 when it is down (or redialing)",
+		func(l LinkStats) float64 { return boolMetric(l.State != DISCONNECTED) }},
+	{"frank_link_elements_total", "counter", "Elements sent by the origin, or written by the replica",
+		func(l LinkStats) float64 { return float64(l.Elements) }},
+	{"frank_link_element_bytes_total", "counter", "Payload bytes of the elements",
+		func(l LinkStats) float64 { return float64(l.Bytes) }},
+	{"frank_link_sent_bytes_total", "counter", "Bytes sent through the connection",
+		func(l LinkStats) float64 { return float64(l.BytesSent) }},
+	{"frank_link_received_bytes_total", "counter", "Bytes received through the connection",
+		func(l LinkStats) float64 { return float64(l.BytesReceived) }},
+	{"frank_link_lag_bytes", "gauge", "Bytes written to the origin stream not acknowledged by the replica",
+		func(l LinkStats) float64 { return float64(l.Lag) }},
+	{"frank_link_last_ack_timestamp_seconds", "gauge", "When the replica acknowledged last, 0 if it never did",
+		func(l LinkStats) float64 {
+			if l.LastAck.IsZero() {
+				return 0
+			}
+			return float64(l.LastAck.UnixNano()) / 1e9
+		}},
+	{"frank_link_errors_total", "counter", "Link failures, including failed redials",
+		func(l LinkStats) float64 { return float64(l.Errors) }},
+	{"frank_link_reconnects_total", "counter", "Times the link was redialed",
+		func(l LinkStats) float64 { return float64(l.Reconnects) }},
+	{"frank_link_compression_ratio", "gauge", "Uncompressed to compressed size of the element batches",
+		func(l LinkStats) float64 { return l.CompressionRatio() }},
+}
+
+// Serves the statistics of the replicator links as JSON, or in the Prometheus text format when asked for it: with
+// ?format=prometheus, or accepting text/plain (as Prometheus does).
+func (r *Replicator) StatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		stats := r.Stats()
+		format := req.URL.Query().Get("format")
+		if format == "prometheus" || format == "" && strings.Contains(req.Header.Get("Accept"), "text/plain") {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+			writePrometheus(w, stats)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(stats)
+	})
+}
+
+func writePrometheus(w io.Writer, stats []LinkStats) {
+	labels := make([]string, len(stats))
+	for i, l := range stats {
+		role := "replica"
+		if l.Origin {
+			role = "origin"
+		}
+		labels[i] = fmt.Sprintf(`host="%v",name="%v",stream="%v",role="%v"`,
+			labelValue(l.Host), labelValue(l.Name), l.Stream, role)
+	}
+	for _, metric := range linkMetrics {
+		_, _ = fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", metric.name, metric.help, metric.name, metric.kind)
+		for i, l := range stats {
+			_, _ = fmt.Fprintf(w, "%v{%v} %v\n", metric.name, labels[i], strconv.FormatFloat(metric.value(l), 'g', -1, 64))
+		}
+	}
+	_, _ = fmt.Fprintf(w, "# HELP frank_link_state The link state, 1 for the current one\n# TYPE frank_link_state gauge\n")
+	for i, l := range stats {
+		_, _ = fmt.Fprintf(w, "frank_link_state{%v,state=\"%v\"} 1\n", labels[i], l.State)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelValue(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
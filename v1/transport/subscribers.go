@@ -0,0 +1,40 @@
+package transport
+
+import (
+	"encoding/binary"
+	"github.com/kuking/go-frank/v1/misc"
+	"github.com/kuking/go-frank/v1/serialisation"
+)
+
+// origin side, the stream status followed by the positions of its named subscribers (see Replicator.SubscribersEvery)
+func (s *SyncLink) sendSubscribers(conn BufferedConn) error {
+	status := WireStatusMsg{
+		Version:    WireVersion,
+		Message:    WireSTATUS,
+		FirstPart:  s.Stream.GetFirstPart(),
+		PartsCount: s.Stream.GetPartsCount(),
+		WritePos:   s.Stream.WritePos(),
+		Closed:     misc.AsUint32Bool(s.Stream.IsClosed()),
+	}
+	if err := binary.Write(conn, binary.LittleEndian, &status); err != nil {
+		return err
+	}
+	for name, readPos := range s.Stream.SubscriberPositions() {
+		msg := WireSubStatusMsg{Version: WireVersion, Message: WireSUBSTATUS, ReadPos: readPos}
+		serialisation.ToNTString(msg.Name[:], name)
+		if err := binary.Write(conn, binary.LittleEndian, &msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replica side, a subscriber never gets ahead of what the replica has (it would skip what is still to arrive); one
+// that does not fit in the replica is skipped, rather than taking over the replicators slots
+func (s *SyncLink) setSubscriber(msg *WireSubStatusMsg) {
+	readPos := msg.ReadPos
+	if writePos := s.Stream.WritePos(); readPos > writePos {
+		readPos = writePos
+	}
+	_ = s.Stream.SetSubscriberPosition(serialisation.FromNTString(msg.Name[:]), readPos)
+}
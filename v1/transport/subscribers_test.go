@@ -0,0 +1,68 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"github.com/kuking/go-frank/v1/api"
+	"github.com/kuking/go-frank/v1/base"
+	"github.com/kuking/go-frank/v1/persistent"
+	"github.com/kuking/go-frank/v1/serialisation"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestReplicator_ReplicatesSubscriberPositions(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+	listener, replicaPath := givenReplicaServing(prefix, "replica")
+	defer listener.Close()
+
+	stream, _ := persistent.MmapStreamCreate(path.Join(prefix, "origin"), 1024*1024, serialisation.ByteArraySerialiser{})
+	defer stream.CloseFile()
+	for i := 0; i < 100; i++ {
+		stream.Feed([]byte(fmt.Sprint("element ", i)))
+	}
+	billing, audit := stream.SubscriberIdForName("billing"), stream.SubscriberIdForName("audit")
+	consume := func(stream *persistent.MmapStream, subId, n int) (last string) {
+		for i := 0; i < n; i++ {
+			elem, _, _ := stream.PullBySubId(subId, api.WaitingUpto10ms, base.NewBusyWait())
+			last = string(elem.([]byte))
+		}
+		return
+	}
+	consume(stream, billing, 30)
+	consume(stream, audit, 100)
+
+	origin := NewReplicator()
+	origin.SubscribersEvery = 20 * time.Millisecond
+	defer origin.Shutdown(context.Background())
+	if err := origin.ConnectTCP(stream, "dr", listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	assertReplicaCatchesUp(replicaPath, stream, t)
+	assertSubscribersReplicated := func() {
+		assertWait("subscriber positions to be replicated", func() bool {
+			replica, err := persistent.MmapStreamOpen(path.Join(replicaPath, hexId(stream)), serialisation.ByteArraySerialiser{})
+			if err != nil {
+				return false
+			}
+			defer replica.CloseFile()
+			positions := replica.SubscriberPositions()
+			return len(positions) == 2 && positions["billing"] == stream.ReadSubRPos(billing) &&
+				positions["audit"] == stream.ReadSubRPos(audit)
+		}, 5*time.Second, t)
+	}
+	assertSubscribersReplicated()
+	consume(stream, billing, 10)
+	assertSubscribersReplicated()
+
+	// billing moves to the replica, and continues where it left off
+	replica, _ := persistent.MmapStreamOpen(path.Join(replicaPath, hexId(stream)), serialisation.ByteArraySerialiser{})
+	defer replica.CloseFile()
+	if next := consume(replica, replica.SubscriberIdForName("billing"), 1); next != "element 40" {
+		t.Fatal("billing should continue at element 40, got:", next)
+	}
+}
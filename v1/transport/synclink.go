@@ -1,6 +1,8 @@
 package transport
 
 import (
+	"bytes"
+	"crypto/hmac"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -9,11 +11,14 @@ import (
 	"github.com/kuking/go-frank/v1/misc"
 	"github.com/kuking/go-frank/v1/persistent"
 	"github.com/kuking/go-frank/v1/serialisation"
+	"hash/crc32"
 	"io"
 	"log"
 	"net"
+	"os"
 	"path"
 	"runtime"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -21,10 +26,11 @@ import (
 type SyncState int32
 
 const (
-	DISCONNECTED SyncState = iota
-	CONNECTED    SyncState = iota
-	PULLING      SyncState = iota
-	PUSHING      SyncState = iota
+	DISCONNECTED   SyncState = iota
+	CONNECTED      SyncState = iota
+	PULLING        SyncState = iota
+	PUSHING        SyncState = iota
+	AUTHENTICATING SyncState = iota
 )
 
 type SyncLink struct {
@@ -33,13 +39,33 @@ type SyncLink struct {
 	errCount int
 	conn     net.Conn
 	host     string
-	State    SyncState
+	state    SyncState // see State
 	basePath string
 	Stream   *persistent.MmapStream
 	repName  string
 	repId    int
 	subId    int
 	close    uint32
+	wLock    sync.Mutex // serialises writes of the goroutines sharing the connection
+	errLock  sync.Mutex
+	err      error       // first error, the one that disconnected the link
+	datagram bool        // packet transport (UDP): messages can be lost, duplicated or reordered, see datagram.go
+	acked    uint32      // the replica acknowledged at least once, datagram HELLOs are retransmitted until then
+	retrans  chan uint64 // positions the replica asked for with WireNACK1, sent by goFuncSend
+	bulk     uint32      // the replica is bulk-syncing parts, no entries are streamed until it WireNACKNs
+	partReqs chan WirePartReqMsg
+	ackNow   chan struct{} // the replica wrote all it received, goFuncRecvAncillary ACKs it without waiting
+	epoch    uint64        // of the origin, a replica link is fenced once the replica follows a newer one
+	compress uint32        // both ends agreed on flate-compressed batches (WireCDATA) in the HELLOs, see compression.go
+	stats    linkCounters
+	created  time.Time
+	limiter  rateLimiter
+	window   uint64 // bytes the replica accepts beyond the ones it acknowledged (WireWINDOW), zero if it did not say
+	// outbound links redial when they fail, see reconnect.go
+	redial       func() (net.Conn, error)
+	reconnecting uint32
+	ancillary    sync.WaitGroup
+	origin       bool // created by NewSyncLinkSend
 }
 
 func (r *Replicator) NewSyncLinkSend(conn net.Conn, host string, stream *persistent.MmapStream, repName string) *SyncLink {
@@ -50,13 +76,18 @@ func (r *Replicator) NewSyncLinkSend(conn net.Conn, host string, stream *persist
 		errCount: 0,
 		conn:     conn,
 		host:     host,
-		State:    CONNECTED,
+		state:    CONNECTED,
 		basePath: "",
 		Stream:   stream,
 		repName:  repName,
 		repId:    repId,
 		subId:    subId,
 		close:    0,
+		retrans:  make(chan uint64, 256),
+		partReqs: make(chan WirePartReqMsg, 16),
+		ackNow:   make(chan struct{}, 1),
+		created:  time.Now(),
+		origin:   true,
 	}
 	r.addSyncLink(sl)
 	return sl
@@ -69,126 +100,458 @@ func (r *Replicator) NewSyncLinkRecv(conn net.Conn, host string, basePath string
 		errCount: 0,
 		conn:     conn,
 		host:     host,
-		State:    CONNECTED,
+		state:    CONNECTED,
 		basePath: basePath,
 		Stream:   nil,
 		repName:  "",
 		repId:    0,
 		subId:    0,
 		close:    0,
+		retrans:  make(chan uint64, 256),
+		partReqs: make(chan WirePartReqMsg, 16),
+		ackNow:   make(chan struct{}, 1),
+		created:  time.Now(),
 	}
 	r.addSyncLink(sl)
 	return sl
 }
 
+// Limits the rate this (origin) link sends at, on top of its Replicator one.
+func (s *SyncLink) SetRateLimit(limit RateLimit) {
+	s.limiter.set(limit)
+}
+
+// how long the link has to wait before sending more, because of its rate limit or its replicator one
+func (s *SyncLink) throttled() time.Duration {
+	wait := s.limiter.wait()
+	if w := s.repl.limiter.wait(); w > wait {
+		wait = w
+	}
+	return wait
+}
+
+func (s *SyncLink) throttle(bytes, entries int) {
+	s.limiter.take(bytes, entries)
+	s.repl.limiter.take(bytes, entries)
+}
+
 func (s *SyncLink) Close() {
 	atomic.StoreUint32(&s.close, 1)
 }
 
+// The link state, read from other goroutines (i.e. Shutdown, the topology housekeeping and the stats).
+func (s *SyncLink) State() SyncState {
+	return SyncState(atomic.LoadInt32((*int32)(&s.state)))
+}
+
+func (s *SyncLink) setState(state SyncState) {
+	atomic.StoreInt32((*int32)(&s.state), int32(state))
+}
+
 func (s *SyncLink) Closed() bool {
 	return atomic.LoadUint32(&s.close) > 0
 }
 
+// Error which caused the link to disconnect, nil if it is still connected or it was closed.
+func (s *SyncLink) Err() error {
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+	return s.err
+}
+
+func (s *SyncLink) getConn() net.Conn {
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+	return s.conn
+}
+
+// consecutive failures (connections, or dialing), since errT0
 func (s *SyncLink) incError() {
-	if s.errT0.IsZero() {
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+	if s.errCount == 0 {
 		s.errT0 = time.Now()
-		s.errCount = 1
-	} else {
-		s.errT0 = time.Time{}
-		s.errCount = 0
 	}
+	s.errCount++
+	atomic.AddUint64(&s.stats.errors, 1)
 }
 
 func (s *SyncLink) resetError() {
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
 	s.errT0 = time.Time{}
 	s.errCount = 0
 }
 
+// how long to wait before redialing, doubling with every consecutive failure
+func (s *SyncLink) backoff() (backoff time.Duration, failingSince time.Time) {
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+	backoff = reconnectBackoffMin
+	for i := 1; i < s.errCount && backoff < reconnectBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > reconnectBackoffMax {
+		backoff = reconnectBackoffMax
+	}
+	return backoff, s.errT0
+}
+
 func (s *SyncLink) handleError(err error) bool {
 	if err == nil {
 		return false
 	}
-	if s.State != DISCONNECTED { // so it does not logs extra errors I suppose ... ?
+	// errors after closing it are a consequence of it, i.e. reading from a closed connection
+	closed := s.Closed()
+	if s.State() != DISCONNECTED && !closed { // so it does not logs extra errors I suppose ... ?
 		log.Println(err)
 	}
+	s.errLock.Lock()
+	if s.err == nil && !closed {
+		s.err = err
+	}
+	s.errLock.Unlock()
 	s.incError()
 	_ = s.conn.Close()
-	s.State = DISCONNECTED
+	s.setState(DISCONNECTED)
 	return true
 }
 
+func (s *SyncLink) newBufferedConn() BufferedConn {
+	conn := countingConn{Conn: s.conn, stats: &s.stats}
+	if s.datagram {
+		return NewDatagramConn(conn, defaultDatagramMTU)
+	}
+	return NewBufferedConnSize(conn, 8192)
+}
+
 func (s *SyncLink) goFuncSend() {
-	conn := NewBufferedConnSize(s.conn, 8192)
-	var n int
+	conn := s.newBufferedConn()
 	var err error
 	var loop int
 	var wireHelloMsg WireHelloMsg
+	var wireResponseMsg *WireResponseMsg
 	var wireStatusMsg WireStatusMsg
 	var wireDataMsgNA WireDataMsgNA
 	wireDataMsgNA.SetVersion(WireVersion)
 	wireDataMsgNA.SetMessage(WireDATA)
+	var scratch []byte
+
+	// bulk-sync, the part being sent
+	var partReq WirePartReqMsg
+	var partSending bool
+	var wirePartMsg WirePartMsg
+	partChunk := make([]byte, partChunkSize)
+	if s.datagram {
+		partChunk = partChunk[0 : defaultDatagramMTU-binary.Size(&wirePartMsg)]
+	}
+
+	// datagram mode
+	var lastHello, lastHWMT time.Time
+	var lastHWM uint64
+
+	// heartbeats, when nothing else was sent during the last one
+	var lastBeat, lastSubscribers time.Time
+	var busy bool
+	wireHeartbeatMsg := WireHeartbeatMsg{Version: WireVersion, Message: WireHEARTBEAT}
+
+	// woken up by the producers (low latency for FeedAndWait), but not longer than the pull time-out
+	waitDuty := base.NewNotifyWait(s.Stream.Notifier(), 1_000, int64(api.WaitingUpto10ms))
 
-	waitDuty := base.NewDefaultFastSpinThenWait()
+	// compression, WireDATA messages are batched and sent compressed before flushing the connection
+	var deflater *deflater
+	flush := func() error {
+		if deflater != nil {
+			if err := deflater.flush(conn, &s.stats); err != nil {
+				return err
+			}
+		}
+		return conn.Flush()
+	}
 
-	go s.goFuncSendAncillary(conn)
+	sendData := func(absPos uint64, elem []byte) error {
+		wireDataMsgNA.SetAbsPos(absPos)
+		wireDataMsgNA.SetLength(uint16(len(elem)))
+		s.stats.element(len(elem))
+		s.throttle(len(wireDataMsgNA)+len(elem), 1)
+		if atomic.LoadUint32(&s.compress) == compressOn {
+			deflater.add(&wireDataMsgNA, elem)
+			if deflater.full() {
+				return deflater.flush(conn, &s.stats)
+			}
+			return nil
+		}
+		if s.datagram {
+			// one Write per message, so it does not get split between datagrams
+			scratch = append(append(scratch[:0], wireDataMsgNA[:]...), elem...)
+			elem = scratch
+		} else if err := wireDataMsgNA.Write(conn); err != nil {
+			return err
+		}
+		n, err := conn.Write(elem)
+		if err == nil && n != len(elem) {
+			err = errors.New("short write")
+		}
+		return err
+	}
+	sendPartChunk := func() error {
+		chunk := partChunk
+		if partReq.Length > 0 && partReq.Length < uint64(len(chunk)) {
+			chunk = chunk[0:partReq.Length]
+		}
+		n, err := s.Stream.ReadPartAt(partReq.PartNo, partReq.Offset, chunk)
+		if err != nil {
+			return err
+		}
+		if deflater != nil {
+			if err = deflater.flush(conn, &s.stats); err != nil {
+				return err
+			}
+		}
+		wirePartMsg = WirePartMsg{
+			Version: WireVersion,
+			Message: WirePART,
+			PartNo:  partReq.PartNo,
+			Offset:  partReq.Offset,
+			Crc:     crc32.Checksum(partChunk[0:n], crc32c),
+			Length:  uint16(n),
+		}
+		s.throttle(binary.Size(&wirePartMsg)+n, 0)
+		partReq.Offset += uint64(n)
+		if partReq.Length > 0 {
+			partReq.Length -= uint64(n)
+			partSending = partReq.Length > 0
+		} else {
+			partSending = partReq.Offset < s.Stream.GetPartSize()
+		}
+		partSending = partSending && n > 0
+		if s.datagram {
+			// one Write per message, so it does not get split between datagrams
+			buf := bytes.NewBuffer(scratch[:0])
+			_ = binary.Write(buf, binary.LittleEndian, &wirePartMsg)
+			buf.Write(partChunk[0:n])
+			scratch = buf.Bytes()
+			_, err = conn.Write(scratch)
+			return err
+		}
+		if err = binary.Write(conn, binary.LittleEndian, &wirePartMsg); err != nil {
+			return err
+		}
+		_, err = conn.Write(partChunk[0:n])
+		return err
+	}
+	sendHelloStatus := func() error {
+		if err := binary.Write(conn, binary.LittleEndian, &wireHelloMsg); err != nil {
+			return err
+		}
+		if wireResponseMsg != nil {
+			if err := binary.Write(conn, binary.LittleEndian, wireResponseMsg); err != nil {
+				return err
+			}
+		}
+		wireStatusMsg = WireStatusMsg{
+			Version:    WireVersion,
+			Message:    WireSTATUS,
+			FirstPart:  s.Stream.GetFirstPart(),
+			PartsCount: s.Stream.GetPartsCount(),
+			WritePos:   s.Stream.WritePos(),
+			Closed:     misc.AsUint32Bool(s.Stream.IsClosed()),
+		}
+		if err := binary.Write(conn, binary.LittleEndian, &wireStatusMsg); err != nil {
+			return err
+		}
+		return conn.Flush()
+	}
 
 	for {
-		if s.Closed() {
+		if s.Closed() || s.State() == DISCONNECTED { // closed, or the ancillary hit an error (i.e. the origin got fenced)
 			_ = conn.Close()
-			s.State = DISCONNECTED
+			s.setState(DISCONNECTED)
 			return
 		}
-		if s.State == CONNECTED {
+		if s.State() == CONNECTED {
+			if s.Stream.IsFenced() {
+				s.handleError(api.ErrFenced)
+				return
+			}
 			wireHelloMsg = WireHelloMsg{
 				Version:      WireVersion,
 				Message:      WireHELLO,
-				StreamUniqId: s.Stream.GetUniqId(),
+				StreamUniqId: s.Stream.GetReplicaOf(),
 				PartSize:     s.Stream.GetPartSize(),
 				FirstPart:    s.Stream.GetFirstPart(),
+				Epoch:        s.Stream.GetEpoch(),
+				EpochStart:   s.Stream.GetEpochStart(),
 			}
-			if s.handleError(binary.Write(conn, binary.LittleEndian, &wireHelloMsg)) {
-				return
+			atomic.StoreUint32(&s.compress, compressOff)
+			if s.repl.Compression != 0 && !s.datagram {
+				wireHelloMsg.Flags |= WireFlagCompress
+				atomic.StoreUint32(&s.compress, compressOffered)
+				if deflater == nil {
+					if deflater, err = newDeflater(s.repl.Compression); s.handleError(err) {
+						return
+					}
+				}
 			}
-
-			wireStatusMsg = WireStatusMsg{
-				Version:    WireVersion,
-				Message:    WireSTATUS,
-				FirstPart:  s.Stream.GetFirstPart(),
-				PartsCount: s.Stream.GetPartsCount(),
-				Closed:     misc.AsUint32Bool(s.Stream.IsClosed()),
+			if len(s.repl.SharedSecret) > 0 {
+				wireHelloMsg.Flags |= WireFlagAuth
+				if wireHelloMsg.Nonce, err = newNonce(); s.handleError(err) {
+					return
+				}
 			}
-			if s.handleError(binary.Write(conn, binary.LittleEndian, &wireStatusMsg)) {
-				return
+			if wireHelloMsg.Flags&WireFlagAuth != 0 {
+				if s.handleError(binary.Write(conn, binary.LittleEndian, &wireHelloMsg)) {
+					return
+				}
+				if wireResponseMsg = s.authenticateReplica(conn, &wireHelloMsg); wireResponseMsg == nil {
+					return
+				}
 			}
-			if s.handleError(conn.Flush()) {
+			// from here on, the ancillary is the only one reading
+			s.ancillary.Add(1)
+			go s.goFuncSendAncillary(conn)
+
+			if wireResponseMsg != nil {
+				if s.handleError(binary.Write(conn, binary.LittleEndian, wireResponseMsg)) {
+					return
+				}
+				wireStatusMsg = WireStatusMsg{
+					Version:    WireVersion,
+					Message:    WireSTATUS,
+					FirstPart:  s.Stream.GetFirstPart(),
+					PartsCount: s.Stream.GetPartsCount(),
+					WritePos:   s.Stream.WritePos(),
+					Closed:     misc.AsUint32Bool(s.Stream.IsClosed()),
+				}
+				if s.handleError(binary.Write(conn, binary.LittleEndian, &wireStatusMsg)) {
+					return
+				}
+				if s.handleError(conn.Flush()) {
+					return
+				}
+			} else if s.handleError(sendHelloStatus()) {
 				return
 			}
+			lastHello = time.Now()
+			lastBeat = lastHello
 
 			s.Stream.SetSubRPos(s.subId, s.Stream.GetRepHWM(s.repId))
+			lastHWM, lastHWMT = s.Stream.GetRepHWM(s.repId), time.Now()
 
-			s.State = PUSHING
+			s.setState(PUSHING)
 		}
-		if s.State == PUSHING {
-			elem, absPos, closed := s.Stream.PullBySubId(s.subId, api.WaitingUpto10ms, waitDuty)
-			if !closed {
-				wireDataMsgNA.SetAbsPos(absPos)
-				wireDataMsgNA.SetLength(uint16(len(elem.([]byte))))
-				if s.handleError(wireDataMsgNA.Write(conn)) {
+		if s.State() == PUSHING && s.datagram {
+			var doIt bool
+			if atomic.LoadUint32(&s.acked) == 0 {
+				// HELLO (or STATUS) might have been lost
+				if lastHello, doIt = onceEvery(lastHello, datagramHelloEvery); doIt && s.handleError(sendHelloStatus()) {
 					return
 				}
-				n, err = conn.Write(elem.([]byte))
-				if n != len(elem.([]byte)) {
-					err = errors.New("short write")
+			}
+		}
+		if s.State() == PUSHING {
+			for retrans := true; retrans; {
+				select {
+				case absPos := <-s.retrans:
+					// over datagrams the element was likely lost with the ones next to it, resends a datagram worth of them
+					sent := s.Stream.ReadSubRPos(s.subId)
+					for size := 0; (size == 0 || s.datagram && size < defaultDatagramMTU) && absPos < sent; {
+						elem, nextAbsPos, ok := s.Stream.PeekBySubId(s.subId, absPos)
+						if !ok {
+							break
+						}
+						if s.handleError(sendData(absPos, elem.([]byte))) {
+							return
+						}
+						size += len(wireDataMsgNA) + len(elem.([]byte))
+						absPos = nextAbsPos
+					}
+					loop = 1 // flushes promptly
+				default:
+					retrans = false
 				}
-				if s.handleError(err) {
+			}
+		}
+		// retransmissions are sent anyway, but they count towards the rate limits
+		throttled := s.State() == PUSHING && s.throttled() > 0
+		if s.State() == PUSHING {
+			if !partSending {
+				select {
+				case partReq = <-s.partReqs:
+					partSending = true
+				default:
+				}
+			}
+			if partSending && !throttled {
+				if s.handleError(sendPartChunk()) {
+					return
+				}
+				busy = true
+				loop = 1
+			}
+		}
+		// nothing is streamed while the replica bulk-syncs, or when it is behind the first part (it should bulk-sync), nor
+		// until it answered the compression offered
+		holdOn := atomic.LoadUint32(&s.bulk) != 0 || atomic.LoadUint32(&s.compress) == compressOffered ||
+			s.Stream.ReadSubRPos(s.subId) < s.Stream.GetFirstPart()*s.Stream.GetPartSize()
+		window := atomic.LoadUint64(&s.window)
+		if s.datagram && (window == 0 || window > defaultDatagramWindow) {
+			window = defaultDatagramWindow
+		}
+		windowFull := false
+		if s.State() == PUSHING && window > 0 && !holdOn {
+			sent := s.Stream.ReadSubRPos(s.subId)
+			hwm := s.Stream.GetRepHWM(s.repId)
+			if s.datagram {
+				if hwm != lastHWM {
+					lastHWM, lastHWMT = hwm, time.Now()
+				}
+				if sent > hwm && time.Since(lastHWMT) > datagramAckTimeOut {
+					// the tail (or an ACK) got lost, goes back to the last acknowledged position
+					s.Stream.SetSubRPos(s.subId, hwm)
+					lastHWMT = time.Now()
+				}
+			}
+			windowFull = sent > hwm && sent-hwm >= window
+		}
+		if s.State() == PUSHING && !windowFull && !holdOn && !throttled {
+			elem, absPos, result := s.Stream.PullBySubId(s.subId, api.WaitingUpto10ms, waitDuty)
+			if result == api.PullOk {
+				if s.handleError(sendData(absPos, elem.([]byte))) {
 					return
 				}
+				busy = true
 				loop = 0
 			}
+		} else if (windowFull || holdOn) && !partSending || throttled {
+			time.Sleep(time.Millisecond)
+		}
+		if s.State() == PUSHING && s.repl.HeartbeatEvery > 0 {
+			var doIt bool
+			if lastBeat, doIt = onceEvery(lastBeat, s.repl.HeartbeatEvery); doIt && !busy {
+				if s.handleError(binary.Write(conn, binary.LittleEndian, &wireHeartbeatMsg)) {
+					return
+				}
+				loop = 1
+			}
+			busy = busy && !doIt
+		}
+		if s.State() == PUSHING && s.repl.SubscribersEvery > 0 {
+			var doIt bool
+			if lastSubscribers, doIt = onceEvery(lastSubscribers, s.repl.SubscribersEvery); doIt {
+				// after the elements batched so far, so the replica likely has what the subscribers read
+				if deflater != nil && s.handleError(deflater.flush(conn, &s.stats)) {
+					return
+				}
+				if s.handleError(s.sendSubscribers(conn)) {
+					return
+				}
+				loop = 1
+			}
 		}
 		if loop > 0 {
 			runtime.Gosched()
-			if s.handleError(conn.Flush()) {
+			if s.handleError(flush()) {
 				return
 			}
 		}
@@ -196,56 +559,322 @@ func (s *SyncLink) goFuncSend() {
 	}
 }
 
+// origin side of the challenge-response, both ends prove they know the shared secret before any stream data flows.
+// It returns the response to be sent, nil if the handshake failed.
+func (s *SyncLink) authenticateReplica(conn BufferedConn, hello *WireHelloMsg) *WireResponseMsg {
+	s.setState(AUTHENTICATING)
+	if s.handleError(conn.Flush()) {
+		return nil
+	}
+	var wireChallengeMsg WireChallengeMsg
+	for retries := 0; ; retries++ {
+		if s.datagram {
+			_ = s.conn.SetReadDeadline(time.Now().Add(datagramHelloEvery))
+		}
+		_, err := conn.Peek(2) // a datagram is only read once peeked
+		if err == nil {
+			err = binary.Read(conn, binary.LittleEndian, &wireChallengeMsg)
+		}
+		if s.datagram && errors.Is(err, os.ErrDeadlineExceeded) && retries < 40 {
+			// the HELLO or the CHALLENGE got lost
+			if s.handleError(binary.Write(conn, binary.LittleEndian, hello)) || s.handleError(conn.Flush()) {
+				return nil
+			}
+			continue
+		}
+		if s.datagram {
+			_ = s.conn.SetReadDeadline(time.Time{})
+		}
+		if err != nil {
+			s.handleError(fmt.Errorf("%w: replica hung up during the handshake (%v)", ErrAuthenticationFailed, err))
+			return nil
+		}
+		break
+	}
+	if wireChallengeMsg.Version != WireVersion || wireChallengeMsg.Message != WireCHALLENGE {
+		s.handleError(errors.New("invalid WireCHALLENGE message"))
+		return nil
+	}
+	expected := handshakeMac(s.repl.SharedSecret, handshakeRoleReplica, hello.Nonce, wireChallengeMsg.Nonce, hello.StreamUniqId)
+	if !hmac.Equal(expected[:], wireChallengeMsg.Mac[:]) {
+		s.handleError(ErrAuthenticationFailed)
+		return nil
+	}
+	s.setState(CONNECTED)
+	return &WireResponseMsg{
+		Version: WireVersion,
+		Message: WireRESPONSE,
+		Mac:     handshakeMac(s.repl.SharedSecret, handshakeRoleOrigin, hello.Nonce, wireChallengeMsg.Nonce, hello.StreamUniqId),
+	}
+}
+
 // handles ACKs readings
 func (s *SyncLink) goFuncSendAncillary(conn BufferedConn) {
+	defer s.ancillary.Done()
 	var wireAcksMsg WireAcksMsg
+	var wireChallengeMsg WireChallengeMsg
+	var wirePartReqMsg WirePartReqMsg
+	var wireFencedMsg WireFencedMsg
+	var wireWindowMsg WireWindowMsg
+	var wireHelloMsg WireHelloMsg
 	for {
 		if s.Closed() {
 			return
 		}
+		timeout := s.repl.PeerTimeOut
+		if timeout > 0 && conn.Buffered() < 2 {
+			// the replica ACKs at least once per heartbeat
+			_ = s.conn.SetReadDeadline(time.Now().Add(timeout))
+		}
 		// it will be mostly blocked here
+		bytes, err := conn.Peek(2)
+		if timeout > 0 && errors.Is(err, os.ErrDeadlineExceeded) {
+			err = s.peerTimedOut(time.Now().Add(-timeout))
+		}
+		if s.handleError(err) {
+			return
+		}
+		if s.datagram && bytes[1] == WireCHALLENGE {
+			// a retransmitted HELLO can still produce a late CHALLENGE, already answered
+			if s.handleError(binary.Read(conn, binary.LittleEndian, &wireChallengeMsg)) {
+				return
+			}
+			continue
+		}
+		if bytes[1] == WirePARTREQ {
+			if s.handleError(binary.Read(conn, binary.LittleEndian, &wirePartReqMsg)) {
+				return
+			}
+			if wirePartReqMsg.Version != WireVersion {
+				s.handleError(errors.New(fmt.Sprintf("received a message of unknown wire version: %v", wirePartReqMsg.Version)))
+				return
+			}
+			atomic.StoreUint32(&s.bulk, 1)
+			select {
+			case s.partReqs <- wirePartReqMsg:
+			default: // too many pending, it will be asked again
+			}
+			continue
+		}
+		if bytes[1] == WireWINDOW {
+			if s.handleError(binary.Read(conn, binary.LittleEndian, &wireWindowMsg)) {
+				return
+			}
+			atomic.StoreUint64(&s.window, wireWindowMsg.Window)
+			continue
+		}
+		if bytes[1] == WireHELLO {
+			// the replica answer to the compression offered
+			if s.handleError(binary.Read(conn, binary.LittleEndian, &wireHelloMsg)) {
+				return
+			}
+			if wireHelloMsg.Flags&WireFlagCompress != 0 && atomic.LoadUint32(&s.compress) == compressOffered {
+				atomic.StoreUint32(&s.compress, compressOn)
+			} else {
+				atomic.StoreUint32(&s.compress, compressOff)
+			}
+			continue
+		}
+		if bytes[1] == WireFENCED {
+			if s.handleError(binary.Read(conn, binary.LittleEndian, &wireFencedMsg)) {
+				return
+			}
+			// a replica got promoted, this stream is no longer the origin
+			s.Stream.Fence()
+			s.handleError(fmt.Errorf("%w: replica %v follows epoch %v, this origin is at %v", api.ErrFenced, s.host,
+				wireFencedMsg.Epoch, s.Stream.GetEpoch()))
+			return
+		}
 		if s.handleError(binary.Read(conn, binary.LittleEndian, &wireAcksMsg)) {
 			return
 		}
 		if wireAcksMsg.Version != WireVersion {
 			s.handleError(errors.New(fmt.Sprintf("received a message of unknown wire version: %v", wireAcksMsg.Version)))
 		}
-		if wireAcksMsg.Message != WireNACKN && wireAcksMsg.Message != WireACK {
+		if wireAcksMsg.Message != WireNACKN && wireAcksMsg.Message != WireACK && wireAcksMsg.Message != WireNACK1 {
 			s.handleError(errors.New(fmt.Sprintf("received an unrecognised message type: %v", wireAcksMsg.Message)))
 		}
 		if wireAcksMsg.Message == WireNACKN {
+			// the replica has everything before, i.e. after a bulk-sync
+			s.Stream.SetRepHWM(s.repId, wireAcksMsg.AbsPos)
 			s.Stream.SetSubRPos(s.subId, wireAcksMsg.AbsPos)
+			atomic.StoreUint32(&s.bulk, 0)
+		}
+		if wireAcksMsg.Message == WireNACK1 {
+			select {
+			case s.retrans <- wireAcksMsg.AbsPos:
+			default: // too many pending, it will be asked again
+			}
 		}
 		if wireAcksMsg.Message == WireACK {
+			s.stats.ack()
+		}
+		if wireAcksMsg.Message == WireACK && wireAcksMsg.AbsPos > s.Stream.GetRepHWM(s.repId) {
+			// only forward, an ACK sent before a bulk-sync could arrive after its WireNACKN
 			s.Stream.SetRepHWM(s.repId, wireAcksMsg.AbsPos)
 		}
+		if wireAcksMsg.Message == WireACK && atomic.SwapUint32(&s.acked, 1) == 0 {
+			s.resetError() // the link works, a (re)connection succeeded
+		}
 	}
 }
 
 func (s *SyncLink) goFuncRecv() {
-	conn := NewBufferedConnSize(s.conn, 8192)
+	conn := s.newBufferedConn()
 	var bytes []byte
+	var message byte
 	var n int
 	var err error
 	var wireHelloMsg WireHelloMsg
+	var wireResponseMsg WireResponseMsg
 	var wireStatusMsg WireStatusMsg
 	var wireDataMsgNA WireDataMsgNA
-	var wireAcksMsg WireAcksMsg
+	var replicaNonce [16]byte
+	var wireChallengeMsg WireChallengeMsg
+
+	// gaps
+	var lastNack1 time.Time
+	var lastNack1Pos, lastAckPos uint64
+	var idleDeadline bool
+	lastRecv := time.Now()
+	reorder := reorderBuffer{}
+
+	// bulk-sync
+	var bulk bulkSync
+	var statusSeen bool
+	var wirePartMsg WirePartMsg
+
+	// datagram mode
+	var dupHelloMsg WireHelloMsg
+
+	// compression
+	var inflater inflater
+
+	// an idle origin sends heartbeats
+	var wireHeartbeatMsg WireHeartbeatMsg
+
+	// the origin named subscribers positions
+	var wireSubStatusMsg WireSubStatusMsg
 
 	var lastNack time.Time
 	var nackFrequency = 1 * time.Second
 	var buffer []byte = make([]byte, 65535) // max size
 
+	// an element from a WireDATA, or a WireCDATA batch; true if the link failed
+	receiveData := func(absPos uint64, elem []byte) bool {
+		writePos := s.Stream.WritePos()
+		if absPos == writePos {
+			bulk.resuming = false
+			s.Stream.Feed(elem)
+			s.stats.element(len(elem))
+			if !s.datagram && conn.Buffered() == 0 {
+				// prompt ACK, there might be producers waiting for a quorum
+				select {
+				case s.ackNow <- struct{}{}:
+				default:
+				}
+			}
+			if len(reorder) > 0 {
+				reorder.drain(s.Stream, &s.stats)
+				if len(reorder) > 0 {
+					// still a gap ahead
+					lastNack1Pos, lastNack1 = s.Stream.WritePos(), time.Now()
+					if s.handleError(s.sendAcks(conn, WireNACK1, lastNack1Pos)) {
+						return true
+					}
+				}
+			}
+			if s.datagram && s.Stream.WritePos()-lastAckPos >= datagramAckEvery {
+				lastAckPos = s.Stream.WritePos()
+				if s.handleError(s.sendAcks(conn, WireACK, lastAckPos)) {
+					return true
+				}
+			}
+		} else if absPos < writePos {
+			// duplicated, or retransmitted after it arrived anyway
+		} else if reorder.add(absPos, elem, writePos) {
+			// gap, asks only for the first missing element; the rest is asked for as the gap closes
+			if writePos != lastNack1Pos || time.Since(lastNack1) > nack1Every {
+				lastNack1Pos, lastNack1 = writePos, time.Now()
+				if s.handleError(s.sendAcks(conn, WireNACK1, writePos)) {
+					return true
+				}
+			}
+		} else {
+			// too far behind to keep the elements around, restarts from the write position
+			var doIt bool
+			if lastNack, doIt = onceEvery(lastNack, nackFrequency); doIt {
+				reorder.clear()
+				if s.handleError(s.sendAcks(conn, WireNACKN, s.Stream.WritePos())) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
 	go s.goFuncRecvAncillary(conn)
 
 	for {
 		if s.Closed() {
 			_ = conn.Close()
-			s.State = DISCONNECTED
+			s.setState(DISCONNECTED)
 			return
 		}
+		reading := conn.Buffered() < 2
+		if s.State() == PULLING && (s.datagram || len(reorder) > 0) {
+			// wakes up when idle, for re-asking the missing element or acknowledging the tail
+			_ = s.conn.SetReadDeadline(time.Now().Add(datagramIdleEvery))
+			idleDeadline = true
+		} else if reading && s.repl.PeerTimeOut > 0 {
+			// the origin sends at least a heartbeat every now and then
+			_ = s.conn.SetReadDeadline(lastRecv.Add(s.repl.PeerTimeOut))
+			idleDeadline = false
+		} else if idleDeadline {
+			_ = s.conn.SetReadDeadline(time.Time{})
+			idleDeadline = false
+		}
 		// it will be mostly blocked here
 		bytes, err = conn.Peek(2)
+		if err == nil && reading {
+			lastRecv = time.Now()
+		}
+		if s.repl.PeerTimeOut > 0 && errors.Is(err, os.ErrDeadlineExceeded) && time.Since(lastRecv) > s.repl.PeerTimeOut {
+			s.handleError(s.peerTimedOut(lastRecv))
+			return
+		}
+		if idleDeadline && errors.Is(err, os.ErrDeadlineExceeded) {
+			writePos := s.Stream.WritePos()
+			if bulk.active && time.Since(bulk.lastReq) > partReqEvery {
+				// stalled, asks for everything still missing in the part
+				for ofs, length := range bulk.missing() {
+					if err = s.sendPartReq(conn, bulk.partNo, ofs, length); err != nil {
+						break
+					}
+				}
+				bulk.lastReq = time.Now()
+			} else if bulk.resuming && time.Since(bulk.lastReq) > partReqEvery {
+				err = s.continueBulkSync(conn, &bulk)
+			} else if bulk.active || bulk.resuming {
+				err = nil
+			} else if len(reorder) > 0 {
+				lastNack1Pos, lastNack1 = writePos, time.Now()
+				err = s.sendAcks(conn, WireNACK1, writePos)
+			} else if s.datagram && writePos != lastAckPos {
+				lastAckPos = writePos
+				err = s.sendAcks(conn, WireACK, writePos)
+			} else {
+				err = nil
+			}
+			if s.handleError(err) {
+				return
+			}
+			continue
+		}
+		if err != nil && s.State() == AUTHENTICATING {
+			s.handleError(fmt.Errorf("%w: origin hung up during the handshake (%v)", ErrAuthenticationFailed, err))
+			return
+		}
 		if s.handleError(err) {
 			return
 		}
@@ -253,8 +882,28 @@ func (s *SyncLink) goFuncRecv() {
 			s.handleError(errors.New(fmt.Sprintf("invalid wire version: %v", bytes[0])))
 			return
 		}
-		if bytes[1] == WireHELLO {
-			if s.State != CONNECTED {
+		message = bytes[1]
+		if s.State() == PULLING && (s.Stream.GetEpoch() != s.epoch || !s.Stream.IsReplica()) {
+			// the replica follows a newer origin (another link brought it) or it has been promoted itself
+			s.fenceOrigin(conn)
+			return
+		}
+		if message == WireHELLO && s.State() != CONNECTED && s.datagram {
+			// retransmitted HELLO, the CHALLENGE might have been lost
+			if s.handleError(binary.Read(conn, binary.LittleEndian, &dupHelloMsg)) {
+				return
+			}
+			if dupHelloMsg.StreamUniqId != wireHelloMsg.StreamUniqId || dupHelloMsg.Nonce != wireHelloMsg.Nonce {
+				s.handleError(errors.New("unexpected WireHELLO message"))
+				return
+			}
+			if s.State() == AUTHENTICATING && s.handleError(s.sendMsg(conn, &wireChallengeMsg)) {
+				return
+			}
+			continue
+		}
+		if message == WireHELLO {
+			if s.State() != CONNECTED {
 				s.handleError(errors.New("unexpected WireHELLO message"))
 				return
 			}
@@ -265,35 +914,119 @@ func (s *SyncLink) goFuncRecv() {
 				s.handleError(errors.New("invalid WireHELLO message"))
 				return
 			}
-			baseName := path.Join(s.basePath, fmt.Sprintf("%x", wireHelloMsg.StreamUniqId))
-			s.Stream, err = persistent.MmapStreamOpen(baseName, serialisation.ByteArraySerialiser{})
-			if err != nil {
-				s.Stream, err = persistent.MmapStreamCreate(baseName, wireHelloMsg.PartSize, serialisation.ByteArraySerialiser{})
-				if s.handleError(err) {
+			authRequested := wireHelloMsg.Flags&WireFlagAuth != 0
+			if authRequested != (len(s.repl.SharedSecret) > 0) {
+				s.handleError(ErrAuthenticationRequired)
+				return
+			}
+			if authRequested {
+				if replicaNonce, err = newNonce(); s.handleError(err) {
 					return
 				}
-				s.Stream.SetReplicaOf(wireHelloMsg.StreamUniqId) // only on creation
+				wireChallengeMsg = WireChallengeMsg{
+					Version: WireVersion,
+					Message: WireCHALLENGE,
+					Nonce:   replicaNonce,
+					Mac:     handshakeMac(s.repl.SharedSecret, handshakeRoleReplica, wireHelloMsg.Nonce, replicaNonce, wireHelloMsg.StreamUniqId),
+				}
+				s.setState(AUTHENTICATING)
+				if s.handleError(s.sendMsg(conn, &wireChallengeMsg)) {
+					return
+				}
+			} else if !s.openReplica(conn, &wireHelloMsg) {
+				return
+			}
+		}
+		if message == WireRESPONSE && s.State() == PULLING && s.datagram {
+			// retransmitted with the HELLO, already authenticated
+			if s.handleError(binary.Read(conn, binary.LittleEndian, &wireResponseMsg)) {
+				return
+			}
+			continue
+		}
+		if message == WireRESPONSE {
+			if s.State() != AUTHENTICATING {
+				s.handleError(errors.New("unexpected WireRESPONSE message"))
+				return
+			}
+			if s.handleError(binary.Read(conn, binary.LittleEndian, &wireResponseMsg)) {
+				return
+			}
+			expected := handshakeMac(s.repl.SharedSecret, handshakeRoleOrigin, wireHelloMsg.Nonce, replicaNonce, wireHelloMsg.StreamUniqId)
+			if !hmac.Equal(expected[:], wireResponseMsg.Mac[:]) {
+				s.handleError(ErrAuthenticationFailed)
+				return
 			}
-			if s.Stream.GetReplicaOf() != wireHelloMsg.StreamUniqId {
-				s.handleError(errors.New("local ReplicaOf UniqId is not what expected. inconsistency"))
+			if !s.openReplica(conn, &wireHelloMsg) {
 				return
 			}
-			s.State = PULLING
 		}
-		if bytes[1] == WireSTATUS {
-			if s.State != PULLING {
+		if message == WireSTATUS {
+			if s.State() != PULLING && !s.datagram {
 				s.handleError(errors.New("unexpected WireSTATUS message"))
 				return
 			}
 			if s.handleError(binary.Read(conn, binary.LittleEndian, &wireStatusMsg)) {
 				return
 			}
+			atomic.StoreUint64(&s.stats.originWritePos, wireStatusMsg.WritePos)
+			if s.State() != PULLING {
+				continue // datagram arriving ahead of the handshake, it will be retransmitted
+			}
+			if !statusSeen {
+				statusSeen = true
+				window := uint64(0)
+				if s.datagram {
+					window = partWindow
+				}
+				if bulk.start(s.Stream, &wireStatusMsg, window) {
+					reorder.clear()
+					if s.handleError(s.continueBulkSync(conn, &bulk)) {
+						return
+					}
+				}
+			}
 			if misc.Uint32Bool(wireStatusMsg.Closed) {
 				s.Stream.Close()
 			}
 		}
-		if bytes[1] == WireDATA {
-			if s.State != PULLING {
+		if message == WirePART {
+			if s.State() != PULLING && !s.datagram {
+				s.handleError(errors.New("unexpected WirePART message"))
+				return
+			}
+			if s.handleError(binary.Read(conn, binary.LittleEndian, &wirePartMsg)) {
+				return
+			}
+			if n, err = io.ReadFull(conn, buffer[0:wirePartMsg.Length]); n != int(wirePartMsg.Length) || err != nil {
+				s.handleError(err)
+				return
+			}
+			if s.State() != PULLING || !bulk.active {
+				continue // late, a retransmission
+			}
+			partNo := bulk.partNo
+			gapOfs, gapLen, err := bulk.write(s.Stream, &wirePartMsg, buffer[0:wirePartMsg.Length])
+			if s.handleError(err) {
+				return
+			}
+			if bulk.partNo != partNo {
+				err = s.continueBulkSync(conn, &bulk)
+			} else {
+				if gapLen > 0 {
+					// lost (or reordered), asks again for the range just skipped
+					err = s.sendPartReq(conn, bulk.partNo, gapOfs, gapLen)
+				}
+				if ofs, length, ok := bulk.next(s.Stream.GetPartSize()); ok && err == nil {
+					err = s.sendPartReq(conn, bulk.partNo, ofs, length)
+				}
+			}
+			if s.handleError(err) {
+				return
+			}
+		}
+		if message == WireDATA {
+			if s.State() != PULLING && !s.datagram {
 				s.handleError(errors.New("unexpected WireDATA message"))
 				return
 			}
@@ -308,55 +1041,205 @@ func (s *SyncLink) goFuncRecv() {
 				s.handleError(err)
 				return
 			}
-			if s.Stream.WritePos() != wireDataMsgNA.AbsPos() {
-				var doIt bool
-				if lastNack, doIt = onceEvery(lastNack, nackFrequency); doIt {
-					wireAcksMsg = WireAcksMsg{
-						Version: WireVersion,
-						Message: WireNACKN,
-						AbsPos:  s.Stream.WritePos(),
-					}
-					if s.handleError(binary.Write(conn, binary.LittleEndian, &wireAcksMsg)) {
-						return
-					}
-					if s.handleError(conn.Flush()) {
-						return
-					}
+			if s.State() != PULLING || bulk.active {
+				continue // datagram arriving ahead of the handshake or the bulk-sync, it will be retransmitted
+			}
+			if receiveData(wireDataMsgNA.AbsPos(), buffer[0:wireDataMsgNA.Length()]) {
+				return
+			}
+		}
+		if message == WireCDATA {
+			if s.State() != PULLING || atomic.LoadUint32(&s.compress) != compressOn {
+				s.handleError(errors.New("unexpected WireCDATA message"))
+				return
+			}
+			frames, err := inflater.read(conn, &s.stats)
+			if s.handleError(err) {
+				return
+			}
+			if bulk.active {
+				continue
+			}
+			for len(frames) > 0 {
+				absPos, elem, rest, err := nextFrame(frames)
+				if s.handleError(err) {
+					return
 				}
-			} else {
-				s.Stream.Feed(buffer[0:wireDataMsgNA.Length()])
+				if receiveData(absPos, elem) {
+					return
+				}
+				frames = rest
+			}
+		}
+		if message == WireHEARTBEAT {
+			if s.handleError(binary.Read(conn, binary.LittleEndian, &wireHeartbeatMsg)) {
+				return
+			}
+		}
+		if message == WireSUBSTATUS {
+			if s.State() != PULLING && !s.datagram {
+				s.handleError(errors.New("unexpected WireSUBSTATUS message"))
+				return
+			}
+			if s.handleError(binary.Read(conn, binary.LittleEndian, &wireSubStatusMsg)) {
+				return
+			}
+			if s.State() == PULLING {
+				s.setSubscriber(&wireSubStatusMsg)
 			}
 		}
+	}
+}
 
+// opens (or creates) the local replica once the origin is authenticated, if there is a handshake at all
+func (s *SyncLink) openReplica(conn BufferedConn, wireHelloMsg *WireHelloMsg) bool {
+	var err error
+	peer := peerIdentityOf(s.conn, s.host)
+	baseName := path.Join(s.basePath, fmt.Sprintf("%x", wireHelloMsg.StreamUniqId))
+	s.Stream, err = persistent.MmapStreamOpen(baseName, serialisation.ByteArraySerialiser{})
+	if err == nil && !s.repl.authorised(peer, wireHelloMsg.StreamUniqId, false) {
+		_ = s.Stream.CloseFile()
+		s.Stream = nil
+		s.handleError(errors.New(fmt.Sprintf("peer %v (%v) is not authorised to replicate stream %x", peer.Addr, peer.CommonName, wireHelloMsg.StreamUniqId)))
+		return false
+	}
+	if err != nil {
+		if !s.repl.authorised(peer, wireHelloMsg.StreamUniqId, true) {
+			s.handleError(errors.New(fmt.Sprintf("peer %v (%v) is not authorised to create stream %x", peer.Addr, peer.CommonName, wireHelloMsg.StreamUniqId)))
+			return false
+		}
+		s.Stream, err = persistent.MmapStreamCreate(baseName, wireHelloMsg.PartSize, serialisation.ByteArraySerialiser{})
+		if s.handleError(err) {
+			return false
+		}
+		s.Stream.SetReplicaOf(wireHelloMsg.StreamUniqId) // only on creation
 	}
+	if s.Stream.GetReplicaOf() != wireHelloMsg.StreamUniqId {
+		s.handleError(errors.New("local ReplicaOf UniqId is not what expected. inconsistency"))
+		return false
+	}
+	epoch := s.Stream.GetEpoch()
+	if wireHelloMsg.Epoch < epoch || wireHelloMsg.Epoch == epoch && !s.Stream.IsReplica() {
+		s.fenceOrigin(conn)
+		return false
+	}
+	if !s.Stream.IsReplica() {
+		s.handleError(errors.New(fmt.Sprintf("stream %x is an origin at epoch %v, it can not follow epoch %v", wireHelloMsg.StreamUniqId, epoch, wireHelloMsg.Epoch)))
+		return false
+	}
+	if wireHelloMsg.Epoch > epoch {
+		// a promoted origin, what this replica got from the previous one after the promotion is not in its history
+		if s.Stream.WritePos() > wireHelloMsg.EpochStart && s.handleError(s.Stream.Truncate(wireHelloMsg.EpochStart)) {
+			return false
+		}
+		s.Stream.SetEpoch(wireHelloMsg.Epoch, wireHelloMsg.EpochStart)
+	}
+	s.epoch = wireHelloMsg.Epoch
+	if wireHelloMsg.Flags&WireFlagCompress != 0 {
+		// the origin holds on streaming until it reads the answer
+		answer := WireHelloMsg{Version: WireVersion, Message: WireHELLO, StreamUniqId: wireHelloMsg.StreamUniqId}
+		if !s.repl.RefuseCompression && !s.datagram {
+			answer.Flags = WireFlagCompress
+			atomic.StoreUint32(&s.compress, compressOn)
+		}
+		if s.handleError(s.sendMsg(conn, &answer)) {
+			return false
+		}
+	}
+	s.setState(PULLING)
+	return true
+}
+
+// tells the origin it is fenced, a newer origin (or this replica itself) has been promoted
+func (s *SyncLink) fenceOrigin(conn BufferedConn) {
+	_ = s.sendMsg(conn, &WireFencedMsg{
+		Version: WireVersion,
+		Message: WireFENCED,
+		Epoch:   s.Stream.GetEpoch(),
+	})
+	s.handleError(errors.New(fmt.Sprintf("origin %v is fenced, the replica follows epoch %v", s.host, s.Stream.GetEpoch())))
 }
 
 func (s *SyncLink) goFuncRecvAncillary(conn BufferedConn) {
-	var wireAcksMsg WireAcksMsg
-	var lastAck time.Time
+	var lastAck, lastWindow time.Time
+	var lastAckPos uint64
 	var ackFrequency = 1 * time.Second
+	if s.repl.HeartbeatEvery > 0 && s.repl.HeartbeatEvery < ackFrequency {
+		ackFrequency = s.repl.HeartbeatEvery // ACKs are the replica heartbeats
+	}
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
 	for {
-		if s.Closed() {
+		if s.Closed() || s.State() == DISCONNECTED {
 			return
 		}
-		if s.State == PULLING {
-			var doIt bool
-			if lastAck, doIt = onceEvery(lastAck, ackFrequency); doIt {
-				wireAcksMsg = WireAcksMsg{
-					Version: WireVersion,
-					Message: WireACK,
-					AbsPos:  s.Stream.WritePos(),
-				}
-				if s.handleError(binary.Write(conn, binary.LittleEndian, &wireAcksMsg)) {
-					return
-				}
-				if s.handleError(conn.Flush()) {
+		if s.State() == PULLING && s.repl.Window > 0 &&
+			(lastWindow.IsZero() || s.datagram && time.Since(lastWindow) > ackFrequency) {
+			// over datagrams it could get lost, it is repeated
+			lastWindow = time.Now()
+			if s.handleError(s.sendMsg(conn, &WireWindowMsg{Version: WireVersion, Message: WireWINDOW, Window: s.repl.Window})) {
+				return
+			}
+		}
+		if s.State() == PULLING {
+			writePos := s.Stream.WritePos()
+			if writePos != lastAckPos || time.Since(lastAck) > ackFrequency {
+				lastAck, lastAckPos = time.Now(), writePos
+				if s.handleError(s.sendAcks(conn, WireACK, writePos)) {
 					return
 				}
 			}
 		}
-		time.Sleep(250 * time.Millisecond)
+		select {
+		case <-s.ackNow:
+		case <-ticker.C:
+		}
+	}
+}
+
+// asks for the next part, or once they are all received continues streaming entries from the end of them
+func (s *SyncLink) continueBulkSync(conn BufferedConn, bulk *bulkSync) error {
+	bulk.lastReq = time.Now()
+	if bulk.done() {
+		if bulk.active {
+			bulk.finish(s.Stream)
+		}
+		bulk.resuming = s.datagram // it could get lost, it is repeated until entries arrive
+		return s.sendAcks(conn, WireNACKN, s.Stream.WritePos())
+	}
+	ofs, length, _ := bulk.next(s.Stream.GetPartSize())
+	return s.sendPartReq(conn, bulk.partNo, ofs, length)
+}
+
+func (s *SyncLink) sendPartReq(conn BufferedConn, partNo, offset, length uint64) error {
+	return s.sendMsg(conn, &WirePartReqMsg{
+		Version: WireVersion,
+		Message: WirePARTREQ,
+		PartNo:  partNo,
+		Offset:  offset,
+		Length:  length,
+	})
+}
+
+// sends (and flushes) an ACK / NACK message; both receiving goroutines write on the same connection so it is serialised
+func (s *SyncLink) sendAcks(conn BufferedConn, message byte, absPos uint64) error {
+	if message == WireACK {
+		s.stats.ack()
+	}
+	return s.sendMsg(conn, &WireAcksMsg{
+		Version: WireVersion,
+		Message: message,
+		AbsPos:  absPos,
+	})
+}
+
+func (s *SyncLink) sendMsg(conn BufferedConn, msg interface{}) error {
+	s.wLock.Lock()
+	defer s.wLock.Unlock()
+	if err := binary.Write(conn, binary.LittleEndian, msg); err != nil {
+		return err
 	}
+	return conn.Flush()
 }
 
 func onceEvery(lastT time.Time, wait time.Duration) (newT time.Time, doIt bool) {
@@ -3,6 +3,7 @@ package transport
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/kuking/go-frank/v1/api"
 	"github.com/kuking/go-frank/v1/base"
@@ -25,7 +26,7 @@ func TestSyncLink_GoFuncSend_Close(t *testing.T) {
 
 	sl.Close()
 
-	assertWait("is disconnected", func() bool { return sl.State == DISCONNECTED }, 100*time.Millisecond, t)
+	assertWait("is disconnected", func() bool { return sl.State() == DISCONNECTED }, 100*time.Millisecond, t)
 	assertClosedConnection(ctx)
 }
 
@@ -36,7 +37,7 @@ func TestSyncLink_GoFuncSend_DetectsClosedConnection(t *testing.T) {
 	_ = ctx.recvPipe.Close()
 	go sl.goFuncSend()
 
-	assertWait("is disconnected", func() bool { return sl.State == DISCONNECTED }, 100*time.Millisecond, t)
+	assertWait("is disconnected", func() bool { return sl.State() == DISCONNECTED }, 100*time.Millisecond, t)
 	assertClosedConnection(ctx)
 }
 
@@ -128,6 +129,46 @@ func TestSyncLink_GoFuncSend_ProcessesNACKs(t *testing.T) {
 	closeAndVerify(sl, ctx)
 }
 
+func TestSyncLink_GoFuncSend_ProcessesNACK1(t *testing.T) {
+	ctx := setup(t)
+	defer teardown(ctx)
+	sl := ctx.repl.NewSyncLinkSend(ctx.sendPipe, "host:1234", ctx.sendStream, "repl-1")
+	go sl.goFuncSend()
+
+	initialSendHandShakeDone(ctx)
+
+	feedStream(ctx.sendStream, 100)
+	var retransAbsPos uint64
+	for i := 0; i < 100; i++ {
+		wireDataMsg := verifyReceivesDataMessage(i, ctx)
+		if i == 50 {
+			retransAbsPos = wireDataMsg.AbsPos
+		}
+	}
+
+	wireAcksMsg := WireAcksMsg{
+		Version: WireVersion,
+		Message: WireNACK1,
+		AbsPos:  retransAbsPos,
+	}
+	if err := binary.Write(ctx.recvPipe, binary.LittleEndian, &wireAcksMsg); err != nil {
+		t.Fatal(err)
+	}
+	// only the 50th is sent again, the subscriber is not rewound
+	if verifyReceivesDataMessage(50, ctx).AbsPos != retransAbsPos {
+		t.Fatal("retransmitted element is not at the requested position")
+	}
+	_ = ctx.recvPipe.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := ctx.recvPipe.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("nothing else should have been sent, err:", err)
+	}
+	if sl.Stream.ReadSubRPos(sl.subId) != ctx.sendStream.WritePos() {
+		t.Fatal("subscriber should not be rewound")
+	}
+
+	closeAndVerify(sl, ctx)
+}
+
 func TestSyncLink_GoFuncSend_ProcessesACKs(t *testing.T) {
 	ctx := setup(t)
 	defer teardown(ctx)
@@ -172,7 +213,7 @@ func TestSyncLink_GoFuncRecv_Close(t *testing.T) {
 
 	sl.Close()
 
-	assertWait("is disconnected", func() bool { return sl.State == DISCONNECTED }, 100*time.Millisecond, t)
+	assertWait("is disconnected", func() bool { return sl.State() == DISCONNECTED }, 100*time.Millisecond, t)
 	assertClosedConnection(ctx)
 }
 
@@ -183,7 +224,7 @@ func TestSyncLink_GoFuncRecv_DetectsClosedConnection(t *testing.T) {
 	_ = ctx.recvPipe.Close()
 	go sl.goFuncRecv()
 
-	assertWait("is disconnected", func() bool { return sl.State == DISCONNECTED }, 100*time.Millisecond, t)
+	assertWait("is disconnected", func() bool { return sl.State() == DISCONNECTED }, 100*time.Millisecond, t)
 	assertClosedConnection(ctx)
 }
 
@@ -193,7 +234,7 @@ func TestSyncLink_GoFuncRecv_ReceivesHelloAndStatus(t *testing.T) {
 	sl := ctx.repl.NewSyncLinkRecv(ctx.recvPipe, "host:1234", ctx.prefix)
 	go sl.goFuncRecv()
 
-	assertWait("is connected", func() bool { return sl.State == CONNECTED }, 100*time.Millisecond, t)
+	assertWait("is connected", func() bool { return sl.State() == CONNECTED }, 100*time.Millisecond, t)
 
 	wireHelloMsg := WireHelloMsg{
 		Version:      WireVersion,
@@ -205,7 +246,7 @@ func TestSyncLink_GoFuncRecv_ReceivesHelloAndStatus(t *testing.T) {
 	if err := binary.Write(ctx.sendPipe, binary.LittleEndian, &wireHelloMsg); err != nil {
 		t.Fatal(err)
 	}
-	assertWait("is pulling", func() bool { return sl.State == PULLING }, 500*time.Millisecond, t)
+	assertWait("is pulling", func() bool { return sl.State() == PULLING }, 500*time.Millisecond, t)
 
 	if ctx.sendStream.GetUniqId() == sl.Stream.GetUniqId() {
 		t.Fatal("source and replica should have differnet uniqIds")
@@ -247,56 +288,85 @@ func TestSyncLink_GoFuncRecv_ReceivesData(t *testing.T) {
 	waitDuty := base.NewDefaultFastSpinThenWait()
 	lastAbsPos := uint64(0)
 	for {
-		elem, absPos, closed := ctx.sendStream.PullBySubId(subId, api.UntilNoMoreData, waitDuty)
-		if closed {
+		elem, absPos, result := ctx.sendStream.PullBySubId(subId, api.UntilNoMoreData, waitDuty)
+		if result != api.PullOk {
 			break
 		}
 		givenDataIsSent(elem, absPos, ctx)
 		lastAbsPos = absPos
 	}
 
-	assertEqualStreams(ctx.sendStream, sl.Stream, ctx)
 	assertWait("write > lastAbsPos", func() bool { return lastAbsPos < sl.Stream.WritePos() }, 500*time.Millisecond, t)
+	assertEqualStreams(ctx.sendStream, sl.Stream, ctx)
 
 	forceCloseAndVerify(sl, ctx)
 }
 
-func TestSyncLink_GoFuncRecv_NACKN(t *testing.T) {
+func TestSyncLink_GoFuncRecv_NACK1(t *testing.T) {
 	ctx := setup(t)
 	defer teardown(ctx)
 	sl := ctx.repl.NewSyncLinkRecv(ctx.recvPipe, "host:1234", ctx.prefix)
 	go sl.goFuncRecv()
 
 	initialRecvHandShakeDone(ctx)
-
 	assertAckRecv("initial ACK", 0, WireACK, ctx)
+	acks := givenAcksAreCollected(ctx)
 
-	feedStream(ctx.sendStream, 100)
+	feedStream(ctx.sendStream, 10)
 	subId := ctx.sendStream.SubscriberIdForName("sub1")
 	waitDuty := base.NewDefaultFastSpinThenWait()
-	var expAckPos uint64
+	var skippedElems []interface{}
+	var skippedAbsPos []uint64
 	for i := 0; i < 10; i++ {
 		elem, absPos, _ := ctx.sendStream.PullBySubId(subId, api.UntilNoMoreData, waitDuty)
-		if i > 2 && i < 5 { // lets skip message 3,4 -- so it will ask to retry from 2
-			if i == 3 {
-				expAckPos = absPos
-			}
+		if i == 3 || i == 4 { // lets skip messages 3,4 -- the ones after are kept, and 3,4 asked for one by one
+			skippedElems = append(skippedElems, elem)
+			skippedAbsPos = append(skippedAbsPos, absPos)
 			continue
 		}
 		givenDataIsSent(elem, absPos, ctx)
-		if i == 5 {
-			// just after 5th, it will ask for 2nd pos again
-			//... and given it is the first NACK, it will come straight away
-			assertAckRecv("expected NACK", expAckPos, WireNACKN, ctx)
+	}
+
+	assertAckCollected("expected NACK1 for 3", skippedAbsPos[0], WireNACK1, acks, ctx)
+	givenDataIsSent(skippedElems[0], skippedAbsPos[0], ctx)
+	assertAckCollected("expected NACK1 for 4", skippedAbsPos[1], WireNACK1, acks, ctx)
+	givenDataIsSent(skippedElems[1], skippedAbsPos[1], ctx)
+
+	assertAckCollected("last ACK", ctx.sendStream.WritePos(), WireACK, acks, ctx)
+	assertEqualStreams(ctx.sendStream, sl.Stream, ctx)
+
+	forceCloseAndVerify(sl, ctx)
+}
+
+func TestSyncLink_GoFuncRecv_NACKN(t *testing.T) {
+	ctx := setup(t)
+	defer teardown(ctx)
+	sl := ctx.repl.NewSyncLinkRecv(ctx.recvPipe, "host:1234", ctx.prefix)
+	go sl.goFuncRecv()
+
+	initialRecvHandShakeDone(ctx)
+	assertAckRecv("initial ACK", 0, WireACK, ctx)
+	acks := givenAcksAreCollected(ctx)
+
+	feedStream(ctx.sendStream, reorderMax+10)
+	subId := ctx.sendStream.SubscriberIdForName("sub1")
+	waitDuty := base.NewDefaultFastSpinThenWait()
+	var expAckPos uint64
+	for i := 0; i < reorderMax+10; i++ {
+		elem, absPos, _ := ctx.sendStream.PullBySubId(subId, api.UntilNoMoreData, waitDuty)
+		if i == 3 { // lets skip message 3, too many out-of-order elements after it will make it ask to restart from 3
+			expAckPos = absPos
+			continue
 		}
+		givenDataIsSent(elem, absPos, ctx)
 	}
 
-	assertAckRecv("last ACK", expAckPos, WireACK, ctx)
+	assertAckCollected("expected NACKN", expAckPos, WireNACKN, acks, ctx)
 
 	forceCloseAndVerify(sl, ctx)
 }
 
-func assertAckRecv(explanation string, expAbsPos uint64, ackType byte, ctx *context) {
+func assertAckRecv(explanation string, expAbsPos uint64, ackType byte, ctx *linkContext) {
 	var wireAcksMsg WireAcksMsg
 	if err := binary.Read(ctx.sendPipe, binary.LittleEndian, &wireAcksMsg); err != nil {
 		ctx.t.Fatal("Unexpected read error while", explanation)
@@ -313,7 +383,41 @@ func assertAckRecv(explanation string, expAbsPos uint64, ackType byte, ctx *cont
 	}
 }
 
-func givenDataIsSent(elem interface{}, absPos uint64, ctx *context) {
+// reads the replica acknowledgements in the background, so the replica never blocks writing them
+func givenAcksAreCollected(ctx *linkContext) chan WireAcksMsg {
+	acks := make(chan WireAcksMsg, 1024)
+	go func() {
+		defer close(acks)
+		var wireAcksMsg WireAcksMsg
+		for binary.Read(ctx.sendPipe, binary.LittleEndian, &wireAcksMsg) == nil {
+			acks <- wireAcksMsg
+		}
+	}()
+	return acks
+}
+
+// waits for the expected acknowledgement, skipping any other (i.e. repeated NACK1s or periodic ACKs)
+func assertAckCollected(explanation string, expAbsPos uint64, ackType byte, acks chan WireAcksMsg, ctx *linkContext) {
+	timeOut := time.After(2 * time.Second)
+	for {
+		select {
+		case wireAcksMsg, ok := <-acks:
+			if !ok {
+				ctx.t.Fatal("Unexpected read error while", explanation)
+			}
+			if wireAcksMsg.Version != WireVersion {
+				ctx.t.Fatal("Unexpected message, wire version", wireAcksMsg.Version, "while", explanation)
+			}
+			if wireAcksMsg.Message == ackType && wireAcksMsg.AbsPos == expAbsPos {
+				return
+			}
+		case <-timeOut:
+			ctx.t.Fatal("timed out while", explanation)
+		}
+	}
+}
+
+func givenDataIsSent(elem interface{}, absPos uint64, ctx *linkContext) {
 	elemB := elem.([]byte)
 	wireDataMsg := WireDataMsg{
 		Version: WireVersion,
@@ -342,7 +446,7 @@ func feedStream(stream *persistent.MmapStream, qty int) {
 	}
 }
 
-func verifyReceivesDataMessage(n int, ctx *context) *WireDataMsg {
+func verifyReceivesDataMessage(n int, ctx *linkContext) *WireDataMsg {
 	var wireDataMsg WireDataMsg
 	buf := make([]byte, 10)
 	if err := binary.Read(ctx.recvPipe, binary.LittleEndian, &wireDataMsg); err != nil {
@@ -362,7 +466,7 @@ func verifyReceivesDataMessage(n int, ctx *context) *WireDataMsg {
 	return &wireDataMsg
 }
 
-func initialSendHandShakeDone(ctx *context) {
+func initialSendHandShakeDone(ctx *linkContext) {
 	var wireHelloMsg WireHelloMsg
 	if err := binary.Read(ctx.recvPipe, binary.LittleEndian, &wireHelloMsg); err != nil {
 		ctx.t.Fatal(err)
@@ -373,7 +477,7 @@ func initialSendHandShakeDone(ctx *context) {
 	}
 }
 
-func initialRecvHandShakeDone(ctx *context) {
+func initialRecvHandShakeDone(ctx *linkContext) {
 	wireHelloMsg := WireHelloMsg{
 		Version:      WireVersion,
 		Message:      WireHELLO,
@@ -396,18 +500,18 @@ func initialRecvHandShakeDone(ctx *context) {
 	}
 }
 
-func assertEqualStreams(left *persistent.MmapStream, right *persistent.MmapStream, ctx *context) {
+func assertEqualStreams(left *persistent.MmapStream, right *persistent.MmapStream, ctx *linkContext) {
 	leftWaitDuty := base.NewDefaultFastSpinThenWait()
 	rightWaitDuty := base.NewDefaultFastSpinThenWait()
 	leftSubId := left.SubscriberIdForName("left-subscriber")
 	rightSubId := right.SubscriberIdForName("right-subscriber")
 	for {
-		leftElem, leftAbsPos, leftClosed := left.PullBySubId(leftSubId, api.UntilNoMoreData, leftWaitDuty)
-		rightElem, rightAbsPos, rightClosed := right.PullBySubId(rightSubId, api.UntilNoMoreData, rightWaitDuty)
-		if leftClosed && rightClosed {
+		leftElem, leftAbsPos, leftResult := left.PullBySubId(leftSubId, api.UntilNoMoreData, leftWaitDuty)
+		rightElem, rightAbsPos, rightResult := right.PullBySubId(rightSubId, api.UntilNoMoreData, rightWaitDuty)
+		if leftResult != api.PullOk && rightResult != api.PullOk {
 			return // happy
 		}
-		if leftClosed || rightClosed {
+		if leftResult != api.PullOk || rightResult != api.PullOk {
 			ctx.t.Fatal("streams have different quantity of elements")
 		}
 		if leftAbsPos != rightAbsPos {
@@ -420,20 +524,20 @@ func assertEqualStreams(left *persistent.MmapStream, right *persistent.MmapStrea
 }
 
 // needed as Buffer Peek blocks
-func forceCloseAndVerify(sl *SyncLink, ctx *context) {
+func forceCloseAndVerify(sl *SyncLink, ctx *linkContext) {
 	_ = sl.conn.Close()
 	closeAndVerify(sl, ctx)
 }
 
-func closeAndVerify(sl *SyncLink, ctx *context) {
+func closeAndVerify(sl *SyncLink, ctx *linkContext) {
 	sl.Close()
-	assertWait("is disconnected", func() bool { return sl.State == DISCONNECTED }, 500*time.Millisecond, ctx.t)
+	assertWait("is disconnected", func() bool { return sl.State() == DISCONNECTED }, 500*time.Millisecond, ctx.t)
 	assertClosedConnection(ctx)
 }
 
 // -------------------------------------------------------------------------------------------------------------------
 
-type context struct {
+type linkContext struct {
 	t          *testing.T
 	repl       *Replicator
 	prefix     string
@@ -445,7 +549,7 @@ type context struct {
 	recvPipe   net.Conn
 }
 
-func setup(t *testing.T) *context {
+func setup(t *testing.T) *linkContext {
 	prefix, err := ioutil.TempDir("", "MMAP-")
 	if err != nil {
 		panic(err)
@@ -457,7 +561,7 @@ func setup(t *testing.T) *context {
 	sendPipe, recvPipe := net.Pipe()
 	_ = sendPipe.SetDeadline(time.Now().Add(5 * time.Second)) // no test should take longer than 5 seconds
 	_ = recvPipe.SetDeadline(time.Now().Add(5 * time.Second))
-	return &context{
+	return &linkContext{
 		t:          t,
 		repl:       NewReplicator(),
 		prefix:     prefix,
@@ -470,7 +574,7 @@ func setup(t *testing.T) *context {
 	}
 }
 
-func teardown(ctx *context) {
+func teardown(ctx *linkContext) {
 	err := os.RemoveAll(ctx.prefix)
 	if err != nil {
 		fmt.Println(err)
@@ -479,7 +583,7 @@ func teardown(ctx *context) {
 	_ = ctx.recvPipe.Close()
 }
 
-func assertClosedConnection(ctx *context) {
+func assertClosedConnection(ctx *linkContext) {
 	assertIsClosed(ctx.sendPipe, ctx.t)
 	assertIsClosed(ctx.recvPipe, ctx.t)
 }
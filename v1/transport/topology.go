@@ -0,0 +1,216 @@
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kuking/go-frank/v1/persistent"
+	"github.com/kuking/go-frank/v1/serialisation"
+	"io/ioutil"
+	"log"
+	"net"
+	"time"
+)
+
+const defaultReconcileEvery = 5 * time.Second
+
+// Declarative replication: the links a replicator originates. A stream can be replicated to many targets, and listing
+// a replica stream chains the replication (the replica replicates to a third node).
+type Topology struct {
+	Links []LinkSpec `json:"links"`
+}
+
+type LinkSpec struct {
+	Stream    string `json:"stream"`              // base file name of the stream, as given to MmapStreamOpen
+	Name      string `json:"name"`                // replicator name, the stream keeps each replica position by name
+	Target    string `json:"target"`              // host:port of the replica, or its socket path (unix)
+	Transport string `json:"transport,omitempty"` // "tcp" (default), "udp", "unix" or "mux" (a tcp connection per target)
+}
+
+func (l LinkSpec) String() string {
+	return fmt.Sprintf("%v -[%v]-> %v", l.Stream, l.Name, l.Target)
+}
+
+func ParseTopology(data []byte) (topology Topology, err error) {
+	if err = json.Unmarshal(data, &topology); err != nil {
+		return
+	}
+	return topology, topology.Validate()
+}
+
+func LoadTopology(fileName string) (Topology, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return Topology{}, err
+	}
+	return ParseTopology(data)
+}
+
+func (t Topology) Validate() error {
+	seen := map[[2]string]bool{} // stream and name, two links would move the same replica position
+	for _, spec := range t.Links {
+		if spec.Stream == "" || spec.Name == "" || spec.Target == "" {
+			return errors.New(fmt.Sprintf("incomplete link: %v", spec))
+		}
+		if spec.Transport != "" && spec.Transport != "tcp" && spec.Transport != "udp" && spec.Transport != "unix" &&
+			spec.Transport != "mux" {
+			return errors.New(fmt.Sprintf("unknown transport %v in link: %v", spec.Transport, spec))
+		}
+		key := [2]string{spec.Stream, spec.Name}
+		if seen[key] {
+			return errors.New(fmt.Sprintf("duplicated stream and name in link: %v", spec))
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+type managedStream struct {
+	stream *persistent.MmapStream
+	links  int
+}
+
+// Establishes the links in the topology which are not up (or gave up, i.e. the replica refused them) and closes the
+// ones not in it anymore, at runtime. The topology is re-applied every ReconcileEvery, so the links which could not be
+// established (i.e. the stream or the replica are not there yet) are retried; their errors are returned.
+func (r *Replicator) Apply(topology Topology) error {
+	if err := topology.Validate(); err != nil {
+		return err
+	}
+	r.topologyLock.Lock()
+	defer r.topologyLock.Unlock()
+	if r.isShutdown() {
+		return ErrReplicatorShutdown
+	}
+	if r.managed == nil {
+		r.managed = map[LinkSpec]*SyncLink{}
+		r.streams = map[string]*managedStream{}
+		go r.goFuncReconcile()
+	}
+	r.topology = topology
+
+	wanted := map[LinkSpec]bool{}
+	for _, spec := range topology.Links {
+		wanted[spec] = true
+	}
+	for spec, link := range r.managed {
+		if !wanted[spec] {
+			r.unmanage(spec, link)
+		}
+	}
+	var errs []error
+	for _, spec := range topology.Links {
+		if link, ok := r.managed[spec]; ok && (link.State() != DISCONNECTED || link.Reconnecting()) {
+			continue
+		} else if ok {
+			r.unmanage(spec, link)
+		}
+		if err := r.manage(spec); err != nil {
+			errs = append(errs, fmt.Errorf("link %v: %w", spec, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// The link established for spec by Apply, nil if there is none.
+func (r *Replicator) LinkFor(spec LinkSpec) *SyncLink {
+	r.topologyLock.Lock()
+	defer r.topologyLock.Unlock()
+	return r.managed[spec]
+}
+
+func (r *Replicator) manage(spec LinkSpec) error {
+	ms, ok := r.streams[spec.Stream]
+	if !ok {
+		stream, err := persistent.MmapStreamOpen(spec.Stream, serialisation.ByteArraySerialiser{})
+		if err != nil {
+			return err
+		}
+		ms = &managedStream{stream: stream}
+		r.streams[spec.Stream] = ms
+	}
+	network := "tcp"
+	if spec.Transport == "udp" || spec.Transport == "unix" {
+		network = spec.Transport
+	}
+	dial := func() (net.Conn, error) {
+		return r.transport().Dial(network, spec.Target)
+	}
+	if network == "tcp" && r.TLS != nil {
+		network = "tls"
+		dial = func() (net.Conn, error) {
+			return dialTLS(r.transport(), spec.Target, r.TLS)
+		}
+	}
+	if spec.Transport == "mux" {
+		dial = r.muxDialer(network, spec.Target, dial)
+	}
+	link, err := r.connect(ms.stream, spec.Name, spec.Target, network == "udp", dial)
+	if err != nil {
+		r.releaseStream(spec.Stream)
+		return err
+	}
+	ms.links++
+	r.managed[spec] = link
+	return nil
+}
+
+func (r *Replicator) unmanage(spec LinkSpec, link *SyncLink) {
+	delete(r.managed, spec)
+	link.Close()
+	if !link.awaitStopped(closeGrace) {
+		log.Printf("link %v did not stop, its stream is left open\n", spec)
+		return
+	}
+	r.streams[spec.Stream].links--
+	r.releaseStream(spec.Stream)
+}
+
+// closes the stream once no link uses it
+func (r *Replicator) releaseStream(name string) {
+	if ms := r.streams[name]; ms != nil && ms.links == 0 {
+		_ = ms.stream.CloseFile()
+		delete(r.streams, name)
+	}
+}
+
+func (r *Replicator) goFuncReconcile() {
+	for {
+		time.Sleep(r.ReconcileEvery)
+		r.topologyLock.Lock()
+		topology := r.topology
+		r.topologyLock.Unlock()
+		if r.isShutdown() {
+			return
+		}
+		if err := r.Apply(topology); err != nil && !errors.Is(err, ErrReplicatorShutdown) {
+			log.Printf("reconciling the replication topology, err: %v\n", err)
+		}
+	}
+}
+
+// closes the streams opened by Apply, once shut down
+func (r *Replicator) closeManagedStreams() {
+	r.topologyLock.Lock()
+	defer r.topologyLock.Unlock()
+	for spec, link := range r.managed {
+		if link.State() == DISCONNECTED && !link.Reconnecting() {
+			delete(r.managed, spec)
+			r.streams[spec.Stream].links--
+		}
+	}
+	for name := range r.streams {
+		r.releaseStream(name)
+	}
+}
+
+// waits for its goroutines to finish after closing it, false if they did not in time
+func (s *SyncLink) awaitStopped(timeOut time.Duration) bool {
+	for t0 := time.Now(); s.State() != DISCONNECTED || s.Reconnecting(); {
+		if time.Since(t0) > timeOut {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return true
+}
@@ -0,0 +1,134 @@
+package transport
+
+import (
+	"context"
+	"github.com/kuking/go-frank/v1/persistent"
+	"github.com/kuking/go-frank/v1/serialisation"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestTopology_Parse(t *testing.T) {
+	topology, err := ParseTopology([]byte(`{"links": [
+		{"stream": "/data/orders", "name": "dr", "target": "10.0.0.2:1234"},
+		{"stream": "/data/orders", "name": "metrics", "target": "10.0.0.3:1234", "transport": "udp"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(topology.Links) != 2 || topology.Links[1].Transport != "udp" || topology.Links[0].Target != "10.0.0.2:1234" {
+		t.Fatal(topology)
+	}
+	for _, invalid := range []string{
+		`{"links": [{"stream": "/data/orders", "name": "dr"}]}`,
+		`{"links": [{"stream": "/data/orders", "name": "dr", "target": "a:1", "transport": "carrier-pigeon"}]}`,
+		`{"links": [{"stream": "/data/orders", "name": "dr", "target": "a:1"}, {"stream": "/data/orders", "name": "dr", "target": "a:1"}]}`,
+		`{"links": [{"stream": "/data/orders", "name": "dr", "target": "a:1"}, {"stream": "/data/orders", "name": "dr", "target": "b:1"}]}`,
+		`{"links": `,
+	} {
+		if _, err := ParseTopology([]byte(invalid)); err == nil {
+			t.Fatal("it should be invalid:", invalid)
+		}
+	}
+}
+
+func TestReplicator_ApplyFansOutChainsAndRemoves(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+	listenerB, pathB := givenReplicaServing(prefix, "b")
+	defer listenerB.Close()
+	listenerC, pathC := givenReplicaServing(prefix, "c")
+	defer listenerC.Close()
+	listenerD, pathD := givenReplicaServing(prefix, "d")
+	defer listenerD.Close()
+	addrB, addrC, addrD := listenerB.Addr().String(), listenerC.Addr().String(), listenerD.Addr().String()
+
+	orders, _ := persistent.MmapStreamCreate(path.Join(prefix, "orders"), 64*1024, serialisation.ByteArraySerialiser{})
+	trades, _ := persistent.MmapStreamCreate(path.Join(prefix, "trades"), 64*1024, serialisation.ByteArraySerialiser{})
+	feed := func(n int) {
+		for i := 0; i < n; i++ {
+			orders.Feed([]byte("order"))
+			trades.Feed([]byte("trade"))
+		}
+	}
+	feed(100)
+
+	// orders to b and c, trades to b too: many streams into one listener
+	a := NewReplicator()
+	defer a.Shutdown(context.Background())
+	toB := LinkSpec{Stream: path.Join(prefix, "orders"), Name: "b", Target: addrB}
+	toC := LinkSpec{Stream: path.Join(prefix, "orders"), Name: "c", Target: addrC}
+	tradesToB := LinkSpec{Stream: path.Join(prefix, "trades"), Name: "b", Target: addrB}
+	if err := a.Apply(Topology{Links: []LinkSpec{toB, toC, tradesToB}}); err != nil {
+		t.Fatal(err)
+	}
+	assertReplicaCatchesUp(pathB, orders, t)
+	assertReplicaCatchesUp(pathB, trades, t)
+	assertReplicaCatchesUp(pathC, orders, t)
+
+	// b replicates its replica of orders to d
+	b := NewReplicator()
+	defer b.Shutdown(context.Background())
+	if err := b.Apply(Topology{Links: []LinkSpec{{Stream: path.Join(pathB, hexId(orders)), Name: "d", Target: addrD}}}); err != nil {
+		t.Fatal(err)
+	}
+	assertReplicaCatchesUp(pathD, orders, t)
+
+	// c is removed, at runtime
+	linkToC := a.LinkFor(toC)
+	if err := a.Apply(Topology{Links: []LinkSpec{toB, tradesToB}}); err != nil {
+		t.Fatal(err)
+	}
+	if linkToC.State() != DISCONNECTED || a.LinkFor(toC) != nil || a.LinkFor(toB) == nil {
+		t.Fatal("the link to c should be closed, and only that one")
+	}
+	atC := orders.WritePos()
+	feed(100)
+	assertReplicaCatchesUp(pathB, trades, t)
+	assertReplicaCatchesUp(pathD, orders, t)
+	c, _ := persistent.MmapStreamOpen(path.Join(pathC, hexId(orders)), serialisation.ByteArraySerialiser{})
+	defer c.CloseFile()
+	if c.WritePos() != atC {
+		t.Fatal("c should not get anything else")
+	}
+	d, _ := persistent.MmapStreamOpen(path.Join(pathD, hexId(orders)), serialisation.ByteArraySerialiser{})
+	defer d.CloseFile()
+	if err := sameStreamContents(orders, d); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplicator_ApplyReconcilesLinksDown(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+	// a free port, nobody listens on it yet
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := listener.Addr().String()
+	_ = listener.Close()
+
+	stream, _ := persistent.MmapStreamCreate(path.Join(prefix, "origin"), 64*1024, serialisation.ByteArraySerialiser{})
+	stream.Feed([]byte("hello"))
+	origin := NewReplicator()
+	origin.ReconcileEvery = 50 * time.Millisecond
+	defer origin.Shutdown(context.Background())
+	spec := LinkSpec{Stream: path.Join(prefix, "origin"), Name: "late", Target: addr}
+	if err := origin.Apply(Topology{Links: []LinkSpec{spec}}); err == nil {
+		t.Fatal("the replica is not there yet")
+	}
+
+	replicaPath := path.Join(prefix, "replica")
+	_ = os.Mkdir(replicaPath, 0755)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go NewReplicator().Serve(listener, replicaPath)
+	assertReplicaCatchesUp(replicaPath, stream, t)
+	if link := origin.LinkFor(spec); link == nil || link.State() != PUSHING {
+		t.Fatal("it should have been established by the reconciliation")
+	}
+}
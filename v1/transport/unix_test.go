@@ -0,0 +1,49 @@
+package transport
+
+import (
+	"context"
+	"github.com/kuking/go-frank/v1/persistent"
+	"github.com/kuking/go-frank/v1/serialisation"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplicator_UnixSocket(t *testing.T) {
+	prefix, _ := ioutil.TempDir("", "MMAP-")
+	defer os.RemoveAll(prefix)
+	socketPath := path.Join(prefix, "replica.sock")
+	// a previous replica died, leaving its socket file behind
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	replica := NewReplicator()
+	defer replica.Shutdown(context.Background())
+	go replica.ListenUnix(socketPath, prefix)
+
+	stream, _ := persistent.MmapStreamCreate(path.Join(prefix, "origin"), 64*1024, serialisation.ByteArraySerialiser{})
+	defer stream.CloseFile()
+	for i := 0; i < 1_000; i++ {
+		stream.Feed([]byte("local"))
+	}
+	origin := NewReplicator()
+	defer origin.Shutdown(context.Background())
+	assertWait("replica to listen", func() bool {
+		return origin.ConnectUnix(stream, "local", socketPath) == nil
+	}, 5*time.Second, t)
+	assertReplicaCatchesUp(prefix, stream, t)
+	if host := replica.Stats()[0].Host; !strings.HasPrefix(host, "unix:") {
+		t.Fatal("unexpected replica link host:", host)
+	}
+	if err := replica.ListenUnix(socketPath, prefix); err == nil {
+		t.Fatal("the socket is in use")
+	}
+}
@@ -1,33 +1,94 @@
 package transport
 
 const (
-	WireVersion byte = 1
-	WireHELLO   byte = 1
-	WireSTATUS  byte = 2
-	WireACK     byte = 3
-	WireNACK1   byte = 4
-	WireNACKN   byte = 5
-	WireDATA    byte = 6
+	WireVersion   byte = 11
+	WireHELLO     byte = 1
+	WireSTATUS    byte = 2
+	WireACK       byte = 3
+	WireNACK1     byte = 4
+	WireNACKN     byte = 5
+	WireDATA      byte = 6
+	WireCHALLENGE byte = 7
+	WireRESPONSE  byte = 8
+	WirePARTREQ   byte = 9
+	WirePART      byte = 10
+	WireFENCED    byte = 11
+	WireCDATA     byte = 12
+	WireWINDOW    byte = 13
+	WireHEARTBEAT byte = 14
+	WireMUX       byte = 15
+	WireSUBSTATUS byte = 16
+	WireMUXCREDIT byte = 17
+)
+
+// WireHelloMsg.Flags
+const (
+	WireFlagAuth     uint32 = 1 // origin has a shared secret and expects a challenge
+	WireFlagCompress uint32 = 2 // origin offers flate-compressed batches (WireCDATA), only over TCP; replica accepts it
 )
 
 // One wire communication (UDP/TCP) is established per replication link, all structs are sent in little endian
+// A TCP connection can also carry many links, one per stream: it is then a sequence of WireMUX frames, each one with a
+// chunk of the wire communication of one of the links (see mux.go). A channel sends up to a window of bytes beyond what
+// the link at the other end read, which grants them back with WireMUXCREDIT.
+// Over UDP, messages are packed into datagrams without ever splitting one, so a lost datagram loses whole messages.
+// On a gap the replica keeps the out-of-order elements and asks for the missing ones with WireNACK1 (see reorder.go),
+// WireNACKN (rewinding the origin) is only used when too many elements are out-of-order.
+// A replica far behind (or behind the origin' first part) bulk-syncs whole sealed parts first, see bulksync.go.
+// Both ends consider the other dead when nothing arrives for a while (Replicator.PeerTimeOut), outbound links redial.
+// WireHELLO carries the origin epoch (bumped when a replica is promoted to origin): a replica refuses an origin with an
+// older epoch with WireFENCED, with a newer one it truncates what it has beyond the promotion point and follows it.
 
 // Replication flow
 // ORIGIN      ->        REPLICA
 // send     WireHELLO    recv     - Sender, the one who initiates de connection sends hello
+// recv   WireCHALLENGE  send     - Only with WireFlagAuth: replica proves it knows the secret and sends its nonce
+// send   WireRESPONSE   recv     - Only with WireFlagAuth: origin proves it knows the secret, replica starts pulling
+// recv    WireFENCED    send     - Only when the origin epoch is older than the replica one: the origin is fenced
+// recv     WireHELLO    send     - Only with WireFlagCompress: replica accepts (flag set) or refuses the compression
 // send     WireSTATUS   recv     - Persistent stream status
+// recv    WirePARTREQ   send     - Only when far behind: replica asks for a sealed part, or the missing range of it
+// send     WirePART     recv     - Only when far behind: a chunk of the part, once all are received it WireNACKNs
 // recv     WireNACKN    send     - Replica indicates from where to start to receive
-// recv     WireNACK1    send     - Replica might indicate to retransmit only one element
+// recv     WireNACK1    send     - Replica asks to retransmit one missing element (over UDP, and the ones lost with it)
 // send     WireDATA     recv     - Replica receives one payload
+// send     WireCDATA    recv     - Once the compression is accepted, instead of WireDATA: a batch of them, compressed
 // recv     WireACK      send     - Replica informs Origin his confirmed high-water-mark
+// recv     WireWINDOW   send     - Optional: bytes the replica accepts beyond its ACKs, the origin holds on once reached
+// send   WireHEARTBEAT  recv     - Origin sent nothing else for a while; an idle replica keeps sending WireACKs instead
 // send     WireSTATUS   recv     - Persistent stream status update i.e. closed, parts quantity, etc.
+// send   WireSUBSTATUS  recv     - Optional: after a periodic WireSTATUS, the read position of a named subscriber
 
 type WireHelloMsg struct {
-	Version      byte // = WireVersion
-	Message      byte // = WireHELLO
-	StreamUniqId uint64
+	Version      byte   // = WireVersion
+	Message      byte   // = WireHELLO
+	StreamUniqId uint64 // of the lineage, the (first) origin UniqId
 	PartSize     uint64
 	FirstPart    uint64
+	Flags        uint32
+	Nonce        [16]byte
+	Epoch        uint64
+	EpochStart   uint64 // write position when the epoch started
+}
+
+// Handshake MACs are HMAC-SHA256(secret, role | origin nonce | replica nonce | stream uniqId), see handshakeMac
+type WireChallengeMsg struct {
+	Version byte // = WireVersion
+	Message byte // = WireCHALLENGE
+	Nonce   [16]byte
+	Mac     [32]byte
+}
+
+type WireFencedMsg struct {
+	Version byte // = WireVersion
+	Message byte // = WireFENCED
+	Epoch   uint64
+}
+
+type WireResponseMsg struct {
+	Version byte // = WireVersion
+	Message byte // = WireRESPONSE
+	Mac     [32]byte
 }
 
 type WireStatusMsg struct {
@@ -35,9 +96,17 @@ type WireStatusMsg struct {
 	Message    byte // = WireSTATUS
 	FirstPart  uint64
 	PartsCount uint64
+	WritePos   uint64
 	Closed     uint32
 }
 
+type WireSubStatusMsg struct {
+	Version byte // = WireVersion
+	Message byte // = WireSUBSTATUS
+	Name    [64]byte
+	ReadPos uint64
+}
+
 type WireAcksMsg struct {
 	Version byte // = WireVersion
 	Message byte // = WireACK / WireNACK1 / WireNACKN
@@ -51,3 +120,55 @@ type WireDataMsg struct {
 	Length  uint16 // = Length -- from here on, it can be read directly into mmap
 	// Data    []byte
 }
+
+type WireCDataMsg struct {
+	Version   byte   // = WireVersion
+	Message   byte   // = WireCDATA
+	RawLength uint32 // of the WireDATA messages (header and payload) once decompressed
+	Length    uint32
+	// Data    []byte (flate)
+}
+
+type WireHeartbeatMsg struct {
+	Version byte // = WireVersion
+	Message byte // = WireHEARTBEAT
+}
+
+type WireWindowMsg struct {
+	Version byte // = WireVersion
+	Message byte // = WireWINDOW
+	Window  uint64
+}
+
+type WireMuxMsg struct {
+	Version byte // = WireVersion
+	Message byte // = WireMUX
+	Channel uint32
+	Length  uint16 // zero meaning the channel is closed
+	// Data    []byte
+}
+
+type WireMuxCreditMsg struct {
+	Version byte // = WireVersion
+	Message byte // = WireMUXCREDIT
+	Channel uint32
+	Credit  uint32 // bytes of the channel read by its link, the other end can send them again
+}
+
+type WirePartReqMsg struct {
+	Version byte // = WireVersion
+	Message byte // = WirePARTREQ
+	PartNo  uint64
+	Offset  uint64
+	Length  uint64 // zero meaning up to the end of the part
+}
+
+type WirePartMsg struct {
+	Version byte // = WireVersion
+	Message byte // = WirePART
+	PartNo  uint64
+	Offset  uint64 // within the part body
+	Crc     uint32 // CRC32-C of the chunk
+	Length  uint16
+	// Data    []byte
+}
@@ -5,6 +5,7 @@ type Provider[T any] interface {
 	Close()
 	IsClosed() bool
 	Pull() (elem T, found bool)
+	PullEx() (elem T, result PullResult)
 	Prev() (moved bool)
 	Reset() (position uint64)
 	ReadPos() uint64
@@ -12,3 +13,13 @@ type Provider[T any] interface {
 	WithWaitTimeOut(waitTimeOut WaitTimeOut)
 	WithWaitDuty(waitDuty WaitDuty)
 }
+
+// PullResult is the outcome of a pull, it tells apart a quiet provider (the wait time-out expired but it is still open)
+// from a finished one (closed and fully consumed).
+type PullResult int8
+
+const (
+	PullOk       PullResult = iota // an element was read
+	PullTimedOut                   // no element arrived within the wait time-out, the provider is still open
+	PullClosed                     // the provider is closed and there are no more elements to read
+)
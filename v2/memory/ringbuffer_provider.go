@@ -54,6 +54,11 @@ func (r *ringBufferProvider[T]) Feed(elem T) {
 }
 
 func (r *ringBufferProvider[T]) Pull() (read T, found bool) {
+	read, result := r.PullEx()
+	return read, result == api.PullOk
+}
+
+func (r *ringBufferProvider[T]) PullEx() (read T, result api.PullResult) {
 	var totalNsWait int64
 	r.waitDuty.Reset()
 	for i := 0; ; i++ {
@@ -64,18 +69,18 @@ func (r *ringBufferProvider[T]) Pull() (read T, found bool) {
 			ringReadNextVal := ringRead + 1
 			val := r.ringBuffer[ringRead%r.cap]
 			if atomic.CompareAndSwapUint64(&r.ringRead, ringRead, ringReadNextVal) {
-				return val, true
+				return val, api.PullOk
 			}
 		}
 		otherThreadWriting := ringWrite != ringWAlloc
 		if ringRead == ringWAlloc && !otherThreadWriting && r.IsClosed() {
-			return r.zero, false
+			return r.zero, api.PullClosed
 		}
 		totalNsWait += r.waitDuty.Loop()
 		if r.waitTimeOut == api.UntilClosed {
 			// just continue
 		} else if !otherThreadWriting && totalNsWait > int64(r.waitTimeOut) {
-			return r.zero, false
+			return r.zero, api.PullTimedOut
 		}
 	}
 }